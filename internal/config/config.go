@@ -2,20 +2,230 @@ package config
 
 import (
 	"log"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// FeatureFlags - включаемые и отключаемые без изменения кода возможности
+type FeatureFlags struct {
+    Thumbnails bool // построение миниатюр изображений
+    CopyTo     bool // выгрузка файлов по внешним подписанным ссылкам
+}
+
+// Active возвращает состояние флагов по их именам в окружении
+func (f FeatureFlags) Active() map[string]bool {
+    return map[string]bool{
+        "FEATURE_THUMBNAILS": f.Thumbnails,
+        "FEATURE_COPY_TO":    f.CopyTo,
+    }
+}
+
 type Config struct {
     MinioEndpoint  string
     MinioAccessKey string
     MinioSecretKey string
     MinioSSL       bool
+    MinioBucket    string
     MongoURI       string
     MongoDatabase  string
     ServerPort     string
+
+    // Write concern MongoDB ("majority" или число; пусто - по умолчанию сервера)
+    // и время ожидания подтверждения записи
+    MongoWriteConcern string
+    MongoWriteTimeout time.Duration
+
+    // Схема идентификаторов файлов: uuid или ulid
+    IDScheme string
+    // Число hex-символов хеша ID, добавляемых префиксом к ключу объекта
+    // для равномерного распределения в Minio (0 - без префикса)
+    HashPrefix int
+    // Максимальная длина ключа объекта в байтах (лимит S3 - 1024)
+    MaxObjectKeyLength int
+    // Префикс всех ключей объектов (например, "staging/"), чтобы несколько
+    // окружений могли использовать один бакет. Пусто - без префикса
+    KeyPrefix string
+
+    // Создавать отсутствующие бакеты при запуске. По умолчанию включено, кроме
+    // GIN_MODE=release: в продакшене опечатка в имени бакета или чужие учетные
+    // данные должны останавливать запуск, а не создавать новый пустой бакет
+    CreateBucketIfMissing bool
+
+    // Отдельный бакет для миниатюр; пусто - миниатюры хранятся рядом с оригиналами
+    MinioThumbBucket       string
+    MinioThumbBucketPublic bool
+
+    // Максимальный размер загружаемого файла (для пакетной загрузки - всего запроса)
+    MaxUploadSize int64
+    // Число файлов в одном запросе пакетной загрузки
+    MaxBatchFiles int
+    // Часть multipart-формы, которая держится в памяти; остальное
+    // сбрасывается во временные файлы
+    MultipartMemThreshold int64
+    // Допустимое расхождение заявленного и фактического размера тела, байт
+    SizeMismatchTolerance int64
+    // Суммарный размер текстовых полей multipart-формы (без файла), байт
+    MaxFormFieldsSize int64
+
+    // Защита от медленных клиентов (slowloris)
+    ReadHeaderTimeout time.Duration
+    ReadTimeout       time.Duration // 0 - без ограничения общей длительности
+    UploadIdleTimeout time.Duration
+    UploadMinRate     int64 // байт в секунду, 0 - без ограничения
+    UploadRateGrace   time.Duration
+
+    // Время, за которое при остановке должны завершиться начатые запросы
+    ShutdownTimeout time.Duration
+
+    // Формат журнала доступа: json или text
+    AccessLogFormat string
+
+    // Время кеширования браузером результата preflight-запроса CORS
+    CORSMaxAge time.Duration
+    // Заголовки ответа, доступные скрипту на странице другого источника
+    CORSExposeHeaders []string
+
+    // Очистка незавершенных multipart-загрузок (интервал 0 - отключена)
+    IncompleteUploadCleanupInterval time.Duration
+    IncompleteUploadMaxAge          time.Duration
+
+    // Таймаут обработки запроса по умолчанию и таймауты отдельных маршрутов
+    // ("post /api/v1/upload=10m"); 0 - без ограничения
+    RequestTimeout time.Duration
+    RouteTimeouts  map[string]string
+
+    // Интервал фоновой проверки доступности Minio и MongoDB
+    HealthCheckInterval time.Duration
+    // Время ожидания ответа одной зависимости; зависшая зависимость
+    // не задерживает пробу дольше этого времени
+    HealthCheckTimeout time.Duration
+    // Максимальный возраст результата, который /readyz отдает без повторной проверки
+    ReadinessCacheTTL time.Duration
+    // Расхождение часов с Minio, при котором при запуске выводится предупреждение
+    ClockSkewThreshold time.Duration
+
+    ThumbnailWorkers   int
+    ThumbnailQueueSize int
+    ThumbnailMaxSize   int
+    // Перестраивать миниатюру при замене содержимого файла
+    ThumbnailOnReplace bool
+
+    MaxDescriptionLength int
+    MaxTags              int
+    MaxTagLength         int
+
+    // Время жизни блокировки файла на время замены/удаления
+    FileLockTTL time.Duration
+
+    // Сохранять замененный файл под новым ключом, чтобы CDN не отдавал
+    // устаревшее содержимое по старому URL
+    ReplaceNewKey bool
+
+    // Не загружать повторно содержимое, уже сохраненное под другим файлом:
+    // новые метаданные ссылаются на существующий объект
+    DedupEnabled bool
+
+    // Политика для загрузок с уже занятым именем: reject - 409, suffix -
+    // добавить к имени " (1)", " (2)" и т.д. Пусто - имена не проверяются
+    UniqueNames string
+
+    // Срок действия POST-политики для прямой загрузки из браузера
+    PostPolicyTTL time.Duration
+
+    // Директивы кеширования для объектов, отдаваемых по подписанным ссылкам
+    PresignCacheControl string
+    PresignSetExpires   bool
+
+    // Число подписанных ссылок, кешируемых в памяти для повторной выдачи (0 - без кеша)
+    PresignCacheSize int
+
+    // Лимит на генерацию подписанных ссылок для одного API ключа
+    PresignRateLimit int // запросов в минуту
+    PresignRateBurst int
+
+    // Число одновременных скачиваний через сервис для одного API ключа
+    // (0 - без ограничения); не зависит от лимитов загрузки
+    MaxConcurrentDownloads int
+    // Размер буфера копирования при отдаче файлов через сервис, байт
+    DownloadBufferSize int
+
+    // Типы содержимого, которые хранятся в Minio сжатыми gzip
+    CompressContentTypes []string
+
+    // Контрольная сумма, с которой объекты загружаются в хранилище:
+    // md5, sha256, crc32c или пусто (не передается)
+    ChecksumAlgorithm string
+
+    // Число повторных загрузок, если хранилище сообщило о несовпадении
+    // контрольной суммы (содержимое повреждено при передаче)
+    UploadChecksumRetries int
+
+    // Число частей больших объектов, параллельно загружаемых в Minio (0 и 1 - по одной)
+    UploadPartConcurrency int
+
+    // Общий лимит трафика в Minio и из него, МБ/с (0 - без ограничения).
+    // Сглаживает нагрузку на общий Minio при всплесках загрузок и скачиваний
+    UploadBandwidthMBps   int
+    DownloadBandwidthMBps int
+
+    // Расширения и определенные сниффингом типы содержимого, разрешенные
+    // к загрузке
+    AllowedExtensions []string
+    AllowedMIMETypes  []string
+
+    // Тип содержимого по расширению для файлов, которые сниффинг распознает
+    // только как application/octet-stream (например, .mov и .mkv).
+    // Применяется лишь к octet-stream: распознанный сниффингом тип важнее
+    ContentTypeFallbacks map[string]string
+    // Правильный тип содержимого по расширению для старых записей с заведомо
+    // неверным content_type: подставляется при скачивании вместо сохраненного
+    ContentTypeCorrections map[string]string
+
+    // Размер начала файла, по которому определяется тип содержимого
+    SniffBytes int
+    // Определять тип содержимого при скачивании старых записей без
+    // content_type и сохранять его в метаданные
+    SniffMissingContentType bool
+
+    // Хосты, на которые разрешена выгрузка файлов по внешним подписанным
+    // ссылкам. Пустой список запрещает выгрузку
+    CopyToAllowedHosts []string
+
+    // Кодировки сжатия JSON-ответов в порядке предпочтения (br, gzip);
+    // пустой список отключает сжатие
+    ResponseEncodings []string
+
+    // Отклонять JSON-тела запросов с неизвестными полями
+    StrictJSON bool
+
+    // Добавлять к списку файлов заголовок Link со ссылками на соседние
+    // страницы (RFC 8288)
+    ListLinkHeaders bool
+
+    // API-ключи клиентов: ключ -> имя клиента (API_KEYS и устаревший API_KEY)
+    APIKeys map[string]string
+
+    // Ключ для административных эндпоинтов; пустой ключ их отключает
+    AdminAPIKey string
+
+    // Период записи среза использования хранилища
+    UsageSnapshotInterval time.Duration
+
+    // Через сколько после последнего скачивания объект помечается тегом
+    // ColdTierTag для перевода в холодный класс хранения; 0 - отключено
+    ColdTierAfter time.Duration
+    // Период поиска холодных объектов
+    ColdTierInterval time.Duration
+    // Тег холодного объекта в виде key=value
+    ColdTierTag string
+
+    Features FeatureFlags
 }
 
 func LoadConfig() *Config {
@@ -28,10 +238,267 @@ func LoadConfig() *Config {
         MinioAccessKey: getEnv("MINIO_ACCESS_KEY", "minioadmin"),
         MinioSecretKey: getEnv("MINIO_SECRET_KEY", "minioadmin"),
         MinioSSL:       getEnvAsBool("MINIO_SSL", false),
+        MinioBucket:    getEnv("MINIO_BUCKET", "user-uploads"),
         MongoURI:       getEnv("MONGO_URI", "mongodb://localhost:27017"),
         MongoDatabase:  getEnv("MONGO_DATABASE", "file_storage"),
         ServerPort:     getEnv("SERVER_PORT", ":8080"),
+        IDScheme:       getEnv("ID_SCHEME", "uuid"),
+        HashPrefix:     getEnvAsInt("HASH_PREFIX", 0),
+
+        MaxObjectKeyLength: getEnvAsInt("MAX_OBJECT_KEY_LENGTH", 1024),
+        KeyPrefix:          getEnv("KEY_PREFIX", ""),
+
+        MongoWriteConcern: getEnv("MONGO_WRITE_CONCERN", ""),
+        MongoWriteTimeout: getEnvAsDuration("MONGO_WRITE_TIMEOUT", 5*time.Second),
+
+        CreateBucketIfMissing: getEnvAsBool("CREATE_BUCKET_IF_MISSING", os.Getenv("GIN_MODE") != "release"),
+
+        MinioThumbBucket:       getEnv("MINIO_THUMB_BUCKET", ""),
+        MinioThumbBucketPublic: getEnvAsBool("MINIO_THUMB_BUCKET_PUBLIC", true),
+
+        MaxUploadSize:         getEnvAsInt64("MAX_UPLOAD_SIZE", 1024<<20),
+        MaxBatchFiles:         getEnvAsInt("MAX_BATCH_FILES", 20),
+        MultipartMemThreshold: getEnvAsInt64("MULTIPART_MEM_THRESHOLD", 8<<20),
+        SizeMismatchTolerance: getEnvAsInt64("SIZE_MISMATCH_TOLERANCE", 0),
+        MaxFormFieldsSize:     getEnvAsInt64("MAX_FORM_FIELDS_SIZE", 64<<10),
+
+        ReadHeaderTimeout: getEnvAsDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+        ReadTimeout:       getEnvAsDuration("READ_TIMEOUT", 0),
+        UploadIdleTimeout: getEnvAsDuration("UPLOAD_IDLE_TIMEOUT", 30*time.Second),
+        UploadMinRate:     getEnvAsInt64("UPLOAD_MIN_RATE", 1024),
+        UploadRateGrace:   getEnvAsDuration("UPLOAD_RATE_GRACE", 10*time.Second),
+
+        ShutdownTimeout: getEnvAsDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+        AccessLogFormat: getEnv("ACCESS_LOG_FORMAT", "json"),
+        CORSMaxAge:      getEnvAsDuration("CORS_MAX_AGE", 600*time.Second),
+        CORSExposeHeaders: getEnvAsList("CORS_EXPOSE_HEADERS", []string{
+            "Content-Length", "Content-Range", "ETag", "X-Request-ID", "X-Checksum-SHA256", "Retry-After", "Link",
+        }),
+
+        IncompleteUploadCleanupInterval: getEnvAsDuration("INCOMPLETE_UPLOAD_CLEANUP_INTERVAL", time.Hour),
+        IncompleteUploadMaxAge:          getEnvAsDuration("INCOMPLETE_UPLOAD_MAX_AGE", 24*time.Hour),
+
+        RequestTimeout: getEnvAsDuration("REQUEST_TIMEOUT", 30*time.Second),
+        RouteTimeouts: getEnvAsMap("ROUTE_TIMEOUTS", map[string]string{
+            "post /api/v1/upload":            "10m",
+            "post /api/v1/upload/batch":      "10m",
+            "put /api/v1/files/:id":          "10m",
+            "put /api/v1/files/:id/content":  "10m",
+            "get /api/v1/files/:id/content":  "0",
+            "get /api/v1/files/:id/events":   "0",
+            "post /api/v1/files/:id/copy-to": "10m",
+        }),
+
+        HealthCheckInterval: getEnvAsDuration("HEALTH_CHECK_INTERVAL", 10*time.Second),
+        HealthCheckTimeout:  getEnvAsDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second),
+        ReadinessCacheTTL:   getEnvAsDuration("READINESS_CACHE_TTL", 2*time.Second),
+        ClockSkewThreshold:  getEnvAsDuration("CLOCK_SKEW_THRESHOLD", time.Minute),
+
+        ThumbnailWorkers:   getEnvAsInt("THUMBNAIL_WORKERS", 2),
+        ThumbnailQueueSize: getEnvAsInt("THUMBNAIL_QUEUE_SIZE", 100),
+        ThumbnailMaxSize:   getEnvAsInt("THUMBNAIL_MAX_SIZE", 256),
+        ThumbnailOnReplace: getEnvAsBool("THUMBNAIL_ON_REPLACE", true),
+
+        MaxDescriptionLength: getEnvAsInt("MAX_DESCRIPTION_LENGTH", 1000),
+        MaxTags:              getEnvAsInt("MAX_TAGS", 20),
+        MaxTagLength:         getEnvAsInt("MAX_TAG_LEN", 50),
+
+        FileLockTTL: getEnvAsDuration("FILE_LOCK_TTL", 5*time.Minute),
+
+        ReplaceNewKey: getEnvAsBool("REPLACE_NEW_KEY", false),
+
+        DedupEnabled: getEnvAsBool("DEDUP_ENABLED", false),
+
+        UniqueNames: strings.ToLower(getEnv("UNIQUE_NAMES", "")),
+
+        PostPolicyTTL: getEnvAsDuration("POST_POLICY_TTL", 15*time.Minute),
+
+        PresignCacheControl: getEnv("PRESIGN_CACHE_CONTROL", ""),
+        PresignSetExpires:   getEnvAsBool("PRESIGN_SET_EXPIRES", false),
+        PresignCacheSize:    getEnvAsInt("PRESIGN_CACHE_SIZE", 10000),
+
+        PresignRateLimit: getEnvAsInt("PRESIGN_RATE_LIMIT", 60),
+        PresignRateBurst: getEnvAsInt("PRESIGN_RATE_BURST", 10),
+
+        MaxConcurrentDownloads: getEnvAsInt("MAX_CONCURRENT_DOWNLOADS", 0),
+        DownloadBufferSize:     getEnvAsInt("DOWNLOAD_BUFFER_SIZE", 1<<20),
+
+        CompressContentTypes: getEnvAsList("COMPRESS_CONTENT_TYPES", nil),
+
+        ChecksumAlgorithm: strings.ToLower(getEnv("CHECKSUM_ALGORITHM", "")),
+
+        UploadChecksumRetries: getEnvAsInt("UPLOAD_CHECKSUM_RETRIES", 1),
+
+        UploadPartConcurrency: getEnvAsInt("UPLOAD_PART_CONCURRENCY", 4),
+
+        UploadBandwidthMBps:   getEnvAsInt("UPLOAD_BANDWIDTH_MBPS", 0),
+        DownloadBandwidthMBps: getEnvAsInt("DOWNLOAD_BANDWIDTH_MBPS", 0),
+
+        AllowedExtensions: getEnvAsList("ALLOWED_EXTENSIONS", []string{
+            ".jpg", ".jpeg", ".png", ".mp4", ".mov", ".avi", ".mkv",
+        }),
+        AllowedMIMETypes: getEnvAsList("ALLOWED_MIME_TYPES", []string{
+            "image/jpeg", "image/png", "video/mp4", "video/quicktime", "video/x-msvideo", "video/x-matroska",
+        }),
+
+        ContentTypeFallbacks: getEnvAsMap("CONTENT_TYPE_FALLBACKS", map[string]string{
+            ".mov": "video/quicktime",
+            ".mkv": "video/x-matroska",
+        }),
+        ContentTypeCorrections: getEnvAsMap("CONTENT_TYPE_CORRECTIONS", map[string]string{}),
+
+        SniffBytes:              getEnvAsInt("SNIFF_BYTES", 512),
+        SniffMissingContentType: getEnvAsBool("SNIFF_MISSING_CONTENT_TYPE", true),
+
+        CopyToAllowedHosts: getEnvAsList("COPY_TO_ALLOWED_HOSTS", nil),
+
+        ResponseEncodings: getEnvAsList("RESPONSE_ENCODINGS", []string{"br", "gzip"}),
+
+        StrictJSON: getEnvAsBool("STRICT_JSON", true),
+
+        ListLinkHeaders: getEnvAsBool("LIST_LINK_HEADERS", true),
+
+        APIKeys:     getAPIKeys(),
+        AdminAPIKey: getEnv("ADMIN_API_KEY", ""),
+
+        UsageSnapshotInterval: getEnvAsDuration("USAGE_SNAPSHOT_INTERVAL", 24*time.Hour),
+
+        ColdTierAfter:    getEnvAsDuration("COLD_TIER_AFTER", 0),
+        ColdTierInterval: getEnvAsDuration("COLD_TIER_INTERVAL", time.Hour),
+        ColdTierTag:      getEnv("COLD_TIER_TAG", "tier=cold"),
+
+        Features: FeatureFlags{
+            Thumbnails: getEnvAsBool("FEATURE_THUMBNAILS", true),
+            CopyTo:     getEnvAsBool("FEATURE_COPY_TO", true),
+        },
+    }
+}
+
+// Redacted возвращает действующую конфигурацию в виде, безопасном для логов:
+// секреты замаскированы, пароль в MONGO_URI скрыт
+func (c *Config) Redacted() map[string]string {
+    return map[string]string{
+        "MINIO_ENDPOINT":                     c.MinioEndpoint,
+        "MINIO_ACCESS_KEY":                   redact(c.MinioAccessKey),
+        "MINIO_SECRET_KEY":                   redact(c.MinioSecretKey),
+        "MINIO_SSL":                          strconv.FormatBool(c.MinioSSL),
+        "MINIO_BUCKET":                       c.MinioBucket,
+        "MINIO_THUMB_BUCKET":                 c.MinioThumbBucket,
+        "MINIO_THUMB_BUCKET_PUBLIC":          strconv.FormatBool(c.MinioThumbBucketPublic),
+        "CREATE_BUCKET_IF_MISSING":           strconv.FormatBool(c.CreateBucketIfMissing),
+        "MONGO_URI":                          redactURI(c.MongoURI),
+        "MONGO_DATABASE":                     c.MongoDatabase,
+        "MONGO_WRITE_CONCERN":                c.MongoWriteConcern,
+        "MONGO_WRITE_TIMEOUT":                c.MongoWriteTimeout.String(),
+        "SERVER_PORT":                        c.ServerPort,
+        "ID_SCHEME":                          c.IDScheme,
+        "MAX_OBJECT_KEY_LENGTH":              strconv.Itoa(c.MaxObjectKeyLength),
+        "HASH_PREFIX":                        strconv.Itoa(c.HashPrefix),
+        "KEY_PREFIX":                         c.KeyPrefix,
+        "MAX_UPLOAD_SIZE":                    strconv.FormatInt(c.MaxUploadSize, 10),
+        "MAX_BATCH_FILES":                    strconv.Itoa(c.MaxBatchFiles),
+        "MULTIPART_MEM_THRESHOLD":            strconv.FormatInt(c.MultipartMemThreshold, 10),
+        "MAX_FORM_FIELDS_SIZE":               strconv.FormatInt(c.MaxFormFieldsSize, 10),
+        "SIZE_MISMATCH_TOLERANCE":            strconv.FormatInt(c.SizeMismatchTolerance, 10),
+        "READ_HEADER_TIMEOUT":                c.ReadHeaderTimeout.String(),
+        "READ_TIMEOUT":                       c.ReadTimeout.String(),
+        "UPLOAD_IDLE_TIMEOUT":                c.UploadIdleTimeout.String(),
+        "UPLOAD_MIN_RATE":                    strconv.FormatInt(c.UploadMinRate, 10),
+        "UPLOAD_RATE_GRACE":                  c.UploadRateGrace.String(),
+        "SHUTDOWN_TIMEOUT":                   c.ShutdownTimeout.String(),
+        "ACCESS_LOG_FORMAT":                  c.AccessLogFormat,
+        "CORS_MAX_AGE":                       c.CORSMaxAge.String(),
+        "CORS_EXPOSE_HEADERS":                strings.Join(c.CORSExposeHeaders, ","),
+        "INCOMPLETE_UPLOAD_CLEANUP_INTERVAL": c.IncompleteUploadCleanupInterval.String(),
+        "INCOMPLETE_UPLOAD_MAX_AGE":          c.IncompleteUploadMaxAge.String(),
+        "READINESS_CACHE_TTL":                c.ReadinessCacheTTL.String(),
+        "REQUEST_TIMEOUT":                    c.RequestTimeout.String(),
+        "ROUTE_TIMEOUTS":                     joinMap(c.RouteTimeouts),
+        "HEALTH_CHECK_INTERVAL":              c.HealthCheckInterval.String(),
+        "HEALTH_CHECK_TIMEOUT":               c.HealthCheckTimeout.String(),
+        "CLOCK_SKEW_THRESHOLD":               c.ClockSkewThreshold.String(),
+        "THUMBNAIL_WORKERS":                  strconv.Itoa(c.ThumbnailWorkers),
+        "THUMBNAIL_QUEUE_SIZE":               strconv.Itoa(c.ThumbnailQueueSize),
+        "THUMBNAIL_MAX_SIZE":                 strconv.Itoa(c.ThumbnailMaxSize),
+        "THUMBNAIL_ON_REPLACE":               strconv.FormatBool(c.ThumbnailOnReplace),
+        "MAX_DESCRIPTION_LENGTH":             strconv.Itoa(c.MaxDescriptionLength),
+        "MAX_TAGS":                           strconv.Itoa(c.MaxTags),
+        "MAX_TAG_LEN":                        strconv.Itoa(c.MaxTagLength),
+        "REPLACE_NEW_KEY":                    strconv.FormatBool(c.ReplaceNewKey),
+        "DEDUP_ENABLED":                      strconv.FormatBool(c.DedupEnabled),
+        "UNIQUE_NAMES":                       c.UniqueNames,
+        "FILE_LOCK_TTL":                      c.FileLockTTL.String(),
+        "POST_POLICY_TTL":                    c.PostPolicyTTL.String(),
+        "PRESIGN_CACHE_CONTROL":              c.PresignCacheControl,
+        "PRESIGN_SET_EXPIRES":                strconv.FormatBool(c.PresignSetExpires),
+        "PRESIGN_CACHE_SIZE":                 strconv.Itoa(c.PresignCacheSize),
+        "PRESIGN_RATE_LIMIT":                 strconv.Itoa(c.PresignRateLimit),
+        "PRESIGN_RATE_BURST":                 strconv.Itoa(c.PresignRateBurst),
+        "MAX_CONCURRENT_DOWNLOADS":           strconv.Itoa(c.MaxConcurrentDownloads),
+        "DOWNLOAD_BUFFER_SIZE":               strconv.Itoa(c.DownloadBufferSize),
+        "COMPRESS_CONTENT_TYPES":             strings.Join(c.CompressContentTypes, ","),
+        "COPY_TO_ALLOWED_HOSTS":              strings.Join(c.CopyToAllowedHosts, ","),
+        "FEATURE_THUMBNAILS":                 strconv.FormatBool(c.Features.Thumbnails),
+        "FEATURE_COPY_TO":                    strconv.FormatBool(c.Features.CopyTo),
+        "RESPONSE_ENCODINGS":                 strings.Join(c.ResponseEncodings, ","),
+        "STRICT_JSON":                        strconv.FormatBool(c.StrictJSON),
+        "LIST_LINK_HEADERS":                  strconv.FormatBool(c.ListLinkHeaders),
+        "API_KEYS":                           redactAPIKeys(c.APIKeys),
+        "ADMIN_API_KEY":                      redact(c.AdminAPIKey),
+        "USAGE_SNAPSHOT_INTERVAL":            c.UsageSnapshotInterval.String(),
+        "COLD_TIER_AFTER":                    c.ColdTierAfter.String(),
+        "COLD_TIER_INTERVAL":                 c.ColdTierInterval.String(),
+        "COLD_TIER_TAG":                      c.ColdTierTag,
+        "ALLOWED_EXTENSIONS":                 strings.Join(c.AllowedExtensions, ","),
+        "ALLOWED_MIME_TYPES":                 strings.Join(c.AllowedMIMETypes, ","),
+        "CONTENT_TYPE_FALLBACKS":             joinMap(c.ContentTypeFallbacks),
+        "CONTENT_TYPE_CORRECTIONS":           joinMap(c.ContentTypeCorrections),
+        "CHECKSUM_ALGORITHM":                 c.ChecksumAlgorithm,
+        "UPLOAD_CHECKSUM_RETRIES":            strconv.Itoa(c.UploadChecksumRetries),
+        "UPLOAD_PART_CONCURRENCY":            strconv.Itoa(c.UploadPartConcurrency),
+        "UPLOAD_BANDWIDTH_MBPS":              strconv.Itoa(c.UploadBandwidthMBps),
+        "DOWNLOAD_BANDWIDTH_MBPS":            strconv.Itoa(c.DownloadBandwidthMBps),
+        "SNIFF_BYTES":                        strconv.Itoa(c.SniffBytes),
+        "SNIFF_MISSING_CONTENT_TYPE":         strconv.FormatBool(c.SniffMissingContentType),
+    }
+}
+
+// joinMap собирает map обратно в строку "key=value,..." с сортировкой ключей
+func joinMap(m map[string]string) string {
+    pairs := make([]string, 0, len(m))
+    for k, v := range m {
+        pairs = append(pairs, k+"="+v)
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, ",")
+}
+
+// redactAPIKeys скрывает ключи, оставляя имена клиентов
+func redactAPIKeys(keys map[string]string) string {
+    clients := make([]string, 0, len(keys))
+    for key, client := range keys {
+        clients = append(clients, client+"="+redact(key))
+    }
+    sort.Strings(clients)
+    return strings.Join(clients, ",")
+}
+
+// redact заменяет непустой секрет маской фиксированной длины
+func redact(secret string) string {
+    if secret == "" {
+        return ""
     }
+    return strings.Repeat("*", 8)
+}
+
+// redactURI скрывает пароль в URI подключения
+func redactURI(rawURI string) string {
+    u, err := url.Parse(rawURI)
+    if err != nil {
+        return redact(rawURI)
+    }
+    return u.Redacted()
 }
 
 func getEnv(key, defaultValue string) string {
@@ -50,4 +517,92 @@ func getEnvAsBool(key string, defaultValue bool) bool {
         return boolValue
     }
     return defaultValue
+}
+
+func getEnvAsInt(key string, defaultValue int) int {
+    if value, exists := os.LookupEnv(key); exists {
+        intValue, err := strconv.Atoi(value)
+        if err != nil {
+            return defaultValue
+        }
+        return intValue
+    }
+    return defaultValue
+}
+
+func getEnvAsList(key string, defaultValue []string) []string {
+    if value, exists := os.LookupEnv(key); exists {
+        var items []string
+        for _, item := range strings.Split(value, ",") {
+            if item = strings.TrimSpace(item); item != "" {
+                items = append(items, item)
+            }
+        }
+        return items
+    }
+    return defaultValue
+}
+
+// getEnvAsMap разбирает список вида "key=value,key=value"
+func getEnvAsMap(key string, defaultValue map[string]string) map[string]string {
+    if value, exists := os.LookupEnv(key); exists {
+        items := make(map[string]string)
+        for _, pair := range strings.Split(value, ",") {
+            k, v, ok := strings.Cut(pair, "=")
+            if k, v = strings.TrimSpace(k), strings.TrimSpace(v); ok && k != "" && v != "" {
+                items[strings.ToLower(k)] = v
+            }
+        }
+        return items
+    }
+    return defaultValue
+}
+
+// defaultAPIClient - имя клиента для ключей, заданных без имени
+const defaultAPIClient = "default"
+
+// getAPIKeys разбирает API_KEYS вида "key:client,key" (ключ без имени
+// принадлежит клиенту default) и добавляет одиночный API_KEY прежних версий
+func getAPIKeys() map[string]string {
+    keys := make(map[string]string)
+    for _, item := range getEnvAsList("API_KEYS", nil) {
+        key, client, _ := strings.Cut(item, ":")
+        key, client = strings.TrimSpace(key), strings.TrimSpace(client)
+        if key == "" {
+            continue
+        }
+        if client == "" {
+            client = defaultAPIClient
+        }
+        keys[key] = client
+    }
+
+    if key := getEnv("API_KEY", ""); key != "" {
+        if _, exists := keys[key]; !exists {
+            keys[key] = defaultAPIClient
+        }
+    }
+    return keys
+}
+
+func getEnvAsInt64(key string, defaultValue int64) int64 {
+    if value, exists := os.LookupEnv(key); exists {
+        intValue, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            return defaultValue
+        }
+        return intValue
+    }
+    return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+    if value, exists := os.LookupEnv(key); exists {
+        duration, err := time.ParseDuration(value)
+        if err != nil {
+            return defaultValue
+        }
+        return duration
+    }
+    return defaultValue
 }
\ No newline at end of file
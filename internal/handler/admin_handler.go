@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"kuber-code-s3/internal/middleware"
+	"kuber-code-s3/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// usageDefaultRange is the period returned when "from" is omitted
+const usageDefaultRange = 30 * 24 * time.Hour
+
+// GetUsage godoc
+// @Summary Storage usage over time
+// @Description Return daily storage usage snapshots (total bytes and file count)
+// @Description for the given date range. Defaults to the last 30 days
+// @Tags admin
+// @Produce json
+// @Param from query string false "First day, YYYY-MM-DD"
+// @Param to query string false "Last day, YYYY-MM-DD"
+// @Security AdminKeyAuth
+// @Success 200 {array} models.UsageSnapshot
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/admin/usage [get]
+func (h *FileHandler) GetUsage(c *gin.Context) {
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid 'to' date, expected YYYY-MM-DD"})
+			return
+		}
+		to = parsed
+	}
+
+	from := to.Add(-usageDefaultRange)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid 'from' date, expected YYYY-MM-DD"})
+			return
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "'from' must not be after 'to'"})
+		return
+	}
+
+	snapshots, err := h.service.GetUsage(c.Request.Context(), from, to)
+	if err != nil {
+		log.Printf("Usage query error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshots)
+}
+
+// DeleteObject godoc
+// @Summary Delete an object by its key
+// @Description Remove the raw Minio object with the given key together with any
+// @Description metadata that references it. Meant for cleaning up orphaned objects
+// @Description or metadata. Every deletion is written to the audit log
+// @Tags admin
+// @Produce json
+// @Param name query string true "Object key in the bucket"
+// @Security AdminKeyAuth
+// @Success 200 {object} service.ObjectDeleteResult
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 423 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/admin/objects [delete]
+func (h *FileHandler) DeleteObject(c *gin.Context) {
+	name := c.Query("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Query parameter 'name' is required"})
+		return
+	}
+
+	result, err := h.service.DeleteObjectByName(c.Request.Context(), name)
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "Object not found"})
+			return
+		}
+		if err == service.ErrFileLocked {
+			c.JSON(http.StatusLocked, ErrorResponse{Error: "File is locked by another operation"})
+			return
+		}
+		log.Printf("Object deletion error for %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete object"})
+		return
+	}
+
+	log.Printf("AUDIT action=delete_object object=%q file_id=%q object_deleted=%t metadata_deleted=%t client=%s request_id=%s",
+		result.ObjectName, result.FileID, result.ObjectDeleted, result.MetadataDeleted,
+		c.GetString(middleware.ClientLabelKey), c.GetString(middleware.RequestIDKey))
+
+	c.JSON(http.StatusOK, result)
+}
+
+// GetFileDiff godoc
+// @Summary Compare file metadata with the stored object
+// @Description Compare the stored metadata of a file (size, content type, content
+// @Description encoding, checksum) with Minio's view of the object and list the
+// @Description discrepancies. Size is only compared for objects stored uncompressed,
+// @Description the checksum only when both the metadata and the object have one
+// @Tags admin
+// @Produce json
+// @Param id path string true "File ID"
+// @Security AdminKeyAuth
+// @Success 200 {object} service.FileDiff
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/admin/files/{id}/diff [get]
+func (h *FileHandler) GetFileDiff(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	diff, err := h.service.DiffFile(c.Request.Context(), fileID)
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		log.Printf("File diff error for %s: %v", fileID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to compare file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// BackfillChecksums godoc
+// @Summary Backfill missing content checksums
+// @Description Compute the SHA-256 of the content of files created before checksums
+// @Description were stored, reading each object from Minio, and save it on the metadata.
+// @Description Files are processed in ID order; pass the returned last_id as "after"
+// @Description to continue an incremental run. Files whose object is missing are skipped
+// @Tags admin
+// @Produce json
+// @Param limit query int false "Maximum number of files to process (default all)"
+// @Param after query string false "Only process files with a greater ID"
+// @Security AdminKeyAuth
+// @Success 200 {object} service.ChecksumBackfillResult
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/admin/backfill-checksums [post]
+func (h *FileHandler) BackfillChecksums(c *gin.Context) {
+	limit, ok := queryInt(c, "limit", 0)
+	if !ok {
+		return
+	}
+
+	result, err := h.service.BackfillChecksums(c.Request.Context(), c.Query("after"), limit)
+	if err != nil {
+		log.Printf("Checksum backfill error after %d files (last %q): %v", result.Processed, result.LastID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to backfill checksums"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,436 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"kuber-code-s3/internal/config"
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+	"kuber-code-s3/internal/repository/repotest"
+	"kuber-code-s3/internal/service"
+)
+
+func TestBackfillChecksums(t *testing.T) {
+	mt := mongoMock(t)
+
+	plain := []byte("plain content")
+	compressed := bytes.Repeat([]byte("compressible content\n"), 50)
+	sum := func(data []byte) string {
+		digest := sha256.Sum256(data)
+		return hex.EncodeToString(digest[:])
+	}
+
+	// Records created before checksums were stored, in ID order
+	seeded := func() []models.FileMetadata {
+		files := make([]models.FileMetadata, 3)
+		for i, id := range []string{"file-a", "file-b", "file-c"} {
+			files[i] = testFile()
+			files[i].ID = id
+			files[i].ObjectName = id + ".txt"
+		}
+		files[1].ContentEncoding = "gzip"
+		return files
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		listed      int // seeded records returned by the find
+		wantStatus  int
+		wantLimit   int64
+		wantUpdates map[string]string
+		wantResult  service.ChecksumBackfillResult
+	}{
+		{
+			name:        "all records",
+			listed:      3,
+			wantStatus:  http.StatusOK,
+			wantLimit:   100,
+			wantUpdates: map[string]string{"file-a": sum(plain), "file-b": sum(compressed)},
+			wantResult:  service.ChecksumBackfillResult{Processed: 3, Updated: 2, MissingObjects: 1, LastID: "file-c", Done: true},
+		},
+		{
+			name:        "incremental run",
+			query:       "?limit=2",
+			listed:      2,
+			wantStatus:  http.StatusOK,
+			wantLimit:   2,
+			wantUpdates: map[string]string{"file-a": sum(plain), "file-b": sum(compressed)},
+			wantResult:  service.ChecksumBackfillResult{Processed: 2, Updated: 2, LastID: "file-b"},
+		},
+		{
+			name:       "invalid limit",
+			query:      "?limit=-1",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.POST("/admin/backfill-checksums", ts.handler.BackfillChecksums)
+
+			files := seeded()
+			ts.s3.Put(testBucket, files[0].ObjectName, repotest.Object{Data: plain})
+			var gz bytes.Buffer
+			w := gzip.NewWriter(&gz)
+			w.Write(compressed)
+			w.Close()
+			ts.s3.Put(testBucket, files[1].ObjectName, repotest.Object{Data: gz.Bytes(), ContentEncoding: "gzip"})
+			// The object of file-c is missing
+
+			if tt.wantStatus == http.StatusOK {
+				mt.AddMockResponses(metadataReply(mt, files[:tt.listed]...))
+				for range tt.wantUpdates {
+					mt.AddMockResponses(updateReply(1))
+				}
+			}
+
+			resp := ts.do(http.MethodPost, "/admin/backfill-checksums"+tt.query, nil, nil)
+			if resp.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", resp.Code, tt.wantStatus, resp.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if writes := mongoWrites(mt); len(writes) != 0 {
+					mt.Errorf("rejected request wrote %v", writes)
+				}
+				return
+			}
+
+			var result service.ChecksumBackfillResult
+			decodeJSON(mt, resp, &result)
+			if result != tt.wantResult {
+				mt.Errorf("result %+v, want %+v", result, tt.wantResult)
+			}
+
+			find := waitForCommands(mt, "find", 1)[0]
+			if limit, _ := find.Lookup("limit").AsInt64OK(); limit != tt.wantLimit {
+				mt.Errorf("find limit %d, want %d", limit, tt.wantLimit)
+			}
+
+			updates := make(map[string]string)
+			for _, command := range waitForCommands(mt, "update", len(tt.wantUpdates)) {
+				update := command.Lookup("updates").Array().Index(0).Value().Document()
+				id := update.Lookup("q", "_id").StringValue()
+				var set struct {
+					SHA256 string `bson:"sha256"`
+				}
+				if err := bson.Unmarshal(update.Lookup("u", "$set").Document(), &set); err != nil {
+					mt.Fatal(err)
+				}
+				updates[id] = set.SHA256
+			}
+			if len(updates) != len(tt.wantUpdates) {
+				mt.Errorf("updated %v, want %v", updates, tt.wantUpdates)
+			}
+			for id, want := range tt.wantUpdates {
+				if updates[id] != want {
+					mt.Errorf("sha256 of %s = %q, want %q", id, updates[id], want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	mt := mongoMock(t)
+	today := time.Now().UTC().Format("2006-01-02")
+	monthAgo := time.Now().UTC().Add(-usageDefaultRange).Format("2006-01-02")
+
+	seeded := []models.UsageSnapshot{
+		{ID: "2026-01-02", TotalBytes: 1000, FileCount: 10},
+		{ID: "2026-01-03", TotalBytes: 1500, FileCount: 12},
+		{ID: "2026-01-04", TotalBytes: 1200, FileCount: 11},
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantFrom   string
+		wantTo     string
+	}{
+		{"range", "?from=2026-01-02&to=2026-01-04", http.StatusOK, "2026-01-02", "2026-01-04"},
+		{"single day", "?from=2026-01-03&to=2026-01-03", http.StatusOK, "2026-01-03", "2026-01-03"},
+		{"default range", "", http.StatusOK, monthAgo, today},
+		{"to only", "?to=2026-01-31", http.StatusOK, "2026-01-01", "2026-01-31"},
+		{"invalid from", "?from=02.01.2026", http.StatusBadRequest, "", ""},
+		{"invalid to", "?to=2026-13-01", http.StatusBadRequest, "", ""},
+		{"from after to", "?from=2026-01-04&to=2026-01-02", http.StatusBadRequest, "", ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/admin/usage", ts.handler.GetUsage)
+
+			docs := make([]bson.D, 0, len(seeded))
+			for _, snapshot := range seeded {
+				docs = append(docs, toDocument(mt, snapshot))
+			}
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "file_storage.usage_snapshots", mtest.FirstBatch, docs...))
+
+			w := ts.do(http.MethodGet, "/admin/usage"+tt.query, nil, nil)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if events := mt.GetAllStartedEvents(); len(events) != 0 {
+					mt.Errorf("rejected request sent %s", events[0].CommandName)
+				}
+				return
+			}
+
+			find := waitForCommands(mt, "find", 1)[0]
+			if collection := find.Lookup("find").StringValue(); collection != "usage_snapshots" {
+				mt.Errorf("queried %q, want usage_snapshots", collection)
+			}
+			filter := find.Lookup("filter", "_id")
+			from, to := filter.Document().Lookup("$gte").StringValue(), filter.Document().Lookup("$lte").StringValue()
+			if from != tt.wantFrom || to != tt.wantTo {
+				mt.Errorf("queried days %s..%s, want %s..%s", from, to, tt.wantFrom, tt.wantTo)
+			}
+
+			var snapshots []models.UsageSnapshot
+			decodeJSON(mt, w, &snapshots)
+			if len(snapshots) != len(seeded) {
+				mt.Fatalf("got %d snapshots, want %d", len(snapshots), len(seeded))
+			}
+			for i, snapshot := range snapshots {
+				if snapshot.ID != seeded[i].ID || snapshot.TotalBytes != seeded[i].TotalBytes || snapshot.FileCount != seeded[i].FileCount {
+					mt.Errorf("snapshot %d = %+v, want %+v", i, snapshot, seeded[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteObject(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name         string
+		query        string // name of the file's object when empty
+		storeObject  bool
+		hasMetadata  bool
+		wantStatus   int
+		wantResult   service.ObjectDeleteResult
+		wantS3Delete bool
+	}{
+		{
+			name:         "orphaned object",
+			storeObject:  true,
+			wantStatus:   http.StatusOK,
+			wantResult:   service.ObjectDeleteResult{ObjectDeleted: true},
+			wantS3Delete: true,
+		},
+		{
+			name:         "object with metadata",
+			storeObject:  true,
+			hasMetadata:  true,
+			wantStatus:   http.StatusOK,
+			wantResult:   service.ObjectDeleteResult{ObjectDeleted: true, MetadataDeleted: true},
+			wantS3Delete: true,
+		},
+		{
+			name:        "orphaned metadata",
+			hasMetadata: true,
+			wantStatus:  http.StatusOK,
+			wantResult:  service.ObjectDeleteResult{MetadataDeleted: true},
+		},
+		{name: "nothing stored", wantStatus: http.StatusNotFound},
+		{name: "key of another environment", query: "?name=staging/orphan.png", storeObject: true, wantStatus: http.StatusNotFound},
+		{name: "missing name", query: "?name=", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.KeyPrefix = "prod"
+			})
+			ts.router.DELETE("/admin/objects", ts.handler.DeleteObject)
+
+			file := testFile()
+			file.ObjectName = "prod/" + file.ObjectName
+			query := tt.query
+			if query == "" {
+				query = "?name=" + url.QueryEscape(file.ObjectName)
+			}
+			if tt.storeObject {
+				ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("content")})
+				ts.s3.Put(testBucket, "staging/orphan.png", repotest.Object{Data: []byte("content")})
+			}
+			if tt.hasMetadata {
+				mt.AddMockResponses(metadataReply(mt, file), updateReply(1), deleteReply(1), updateReply(1))
+			} else {
+				mt.AddMockResponses(metadataReply(mt))
+			}
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			w := ts.do(http.MethodDelete, "/admin/objects"+query, nil, nil)
+			log.SetOutput(os.Stderr)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			deletes := ts.s3.Requests(http.MethodDelete)
+			if tt.wantS3Delete != (len(deletes) == 1) {
+				mt.Errorf("S3 deletes %v, want object deleted = %t", deletes, tt.wantS3Delete)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if len(deletes) != 0 || slices.Contains(mongoWrites(mt), "delete") {
+					mt.Error("rejected request deleted data")
+				}
+				return
+			}
+
+			want := tt.wantResult
+			want.ObjectName = file.ObjectName
+			if tt.hasMetadata {
+				want.FileID = file.ID
+			}
+			var result service.ObjectDeleteResult
+			decodeJSON(mt, w, &result)
+			if result != want {
+				mt.Errorf("result %+v, want %+v", result, want)
+			}
+			if _, ok := ts.s3.Get(testBucket, file.ObjectName); ok {
+				mt.Error("object is still stored")
+			}
+			if deleted := slices.Contains(mongoWrites(mt), "delete"); deleted != tt.hasMetadata {
+				mt.Errorf("metadata deleted = %t, want %t", deleted, tt.hasMetadata)
+			}
+			if !strings.Contains(logs.String(), "AUDIT action=delete_object object="+strconv.Quote(file.ObjectName)) {
+				mt.Errorf("deletion is missing from the audit log: %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestGetFileDiff(t *testing.T) {
+	mt := mongoMock(t)
+	content := []byte("stored content")
+	sha := sha256.Sum256(content)
+	contentSHA256 := base64.StdEncoding.EncodeToString(sha[:])
+	contentMD5 := md5.Sum(content)
+
+	tests := []struct {
+		name       string
+		configure  func(file *models.FileMetadata)
+		object     *repotest.Object
+		wantExists bool
+		want       []service.FieldDiff
+	}{
+		{
+			name:       "in sync",
+			configure:  func(file *models.FileMetadata) {},
+			object:     &repotest.Object{Data: content, ContentType: "text/plain"},
+			wantExists: true,
+			want:       []service.FieldDiff{},
+		},
+		{
+			name:       "size differs",
+			configure:  func(file *models.FileMetadata) { file.FileSize = 2048 },
+			object:     &repotest.Object{Data: content, ContentType: "text/plain"},
+			wantExists: true,
+			want:       []service.FieldDiff{{Field: "file_size", Metadata: "2048", Object: strconv.Itoa(len(content))}},
+		},
+		{
+			name:       "compressed size is not compared",
+			configure:  func(file *models.FileMetadata) { file.FileSize, file.ContentEncoding = 2048, "gzip" },
+			object:     &repotest.Object{Data: content, ContentType: "text/plain", ContentEncoding: "gzip"},
+			wantExists: true,
+			want:       []service.FieldDiff{},
+		},
+		{
+			name:       "content type and encoding differ",
+			configure:  func(file *models.FileMetadata) { file.ContentEncoding = "gzip" },
+			object:     &repotest.Object{Data: content, ContentType: "application/octet-stream"},
+			wantExists: true,
+			want: []service.FieldDiff{
+				{Field: "content_type", Metadata: "text/plain", Object: "application/octet-stream"},
+				{Field: "content_encoding", Metadata: "gzip", Object: ""},
+			},
+		},
+		{
+			name: "sha256 checksum differs",
+			configure: func(file *models.FileMetadata) {
+				file.Checksum, file.ChecksumAlgorithm = "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", repository.ChecksumSHA256
+			},
+			object:     &repotest.Object{Data: content, ContentType: "text/plain"},
+			wantExists: true,
+			want:       []service.FieldDiff{{Field: "checksum", Metadata: "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", Object: contentSHA256}},
+		},
+		{
+			name: "sha256 checksum matches",
+			configure: func(file *models.FileMetadata) {
+				file.Checksum, file.ChecksumAlgorithm = contentSHA256, repository.ChecksumSHA256
+			},
+			object:     &repotest.Object{Data: content, ContentType: "text/plain"},
+			wantExists: true,
+			want:       []service.FieldDiff{},
+		},
+		{
+			name: "md5 checksum differs",
+			configure: func(file *models.FileMetadata) {
+				file.Checksum, file.ChecksumAlgorithm = "9a0364b9e99bb480dd25e1f0284c8555", repository.ChecksumMD5
+			},
+			object:     &repotest.Object{Data: content, ContentType: "text/plain"},
+			wantExists: true,
+			want:       []service.FieldDiff{{Field: "checksum", Metadata: "9a0364b9e99bb480dd25e1f0284c8555", Object: hex.EncodeToString(contentMD5[:])}},
+		},
+		{
+			name:      "object missing",
+			configure: func(file *models.FileMetadata) {},
+			want:      []service.FieldDiff{},
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/admin/files/:id/diff", ts.handler.GetFileDiff)
+
+			file := testFile()
+			file.ObjectName = file.ID + ".txt"
+			file.FileSize, file.ContentType = int64(len(content)), "text/plain"
+			tt.configure(&file)
+			if tt.object != nil {
+				ts.s3.Put(testBucket, file.ObjectName, *tt.object)
+			}
+			mt.AddMockResponses(metadataReply(mt, file))
+
+			w := ts.do(http.MethodGet, "/admin/files/"+file.ID+"/diff", nil, nil)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			var diff service.FileDiff
+			decodeJSON(mt, w, &diff)
+			if diff.FileID != file.ID || diff.ObjectName != file.ObjectName || diff.ObjectExists != tt.wantExists {
+				mt.Errorf("diff of %s (%s), exists %t, want %s (%s), exists %t",
+					diff.FileID, diff.ObjectName, diff.ObjectExists, file.ID, file.ObjectName, tt.wantExists)
+			}
+			if !slices.Equal(diff.Discrepancies, tt.want) {
+				mt.Errorf("discrepancies %+v, want %+v", diff.Discrepancies, tt.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,39 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"kuber-code-s3/internal/config"
+	"kuber-code-s3/internal/middleware"
+	"kuber-code-s3/internal/models"
 	"kuber-code-s3/internal/service"
+	"kuber-code-s3/pkg/utils"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
+	"github.com/go-playground/validator/v10"
 )
 
 // @title File Storage Service API
@@ -31,44 +53,243 @@ import (
 // @in header
 // @name Authorization
 
+// Default lifetime of URLs from the presign endpoint, in seconds
+const defaultPresignExpires = 3600
+
+// Page size bounds for the file list
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// Time window bounds for the recent files list
+const (
+	defaultRecentWindow = time.Hour
+	maxRecentWindow     = 30 * 24 * time.Hour
+)
+
+// errFormFieldsTooLarge is returned when the text fields of a multipart form
+// exceed the configured total size
+var errFormFieldsTooLarge = errors.New("form fields are too large")
+
+// errRangeNotSatisfiable is returned for a malformed or unsatisfiable Range header
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
 type FileHandler struct {
 	service *service.FileService
+	config  *config.Config
+
+	// Normalized extensions and sniffed content types accepted for upload
+	// (ALLOWED_EXTENSIONS, ALLOWED_MIME_TYPES)
+	allowedExtensions   map[string]bool
+	allowedContentTypes map[string]bool
+
+	// Reusable DOWNLOAD_BUFFER_SIZE buffers for streaming file content
+	copyBuffers sync.Pool
 }
 
 type SuccessResponse struct {
-	URL string `json:"url"`
+	URL string `json:"url" xml:"url"`
+}
+
+// UploadResponse is returned for a new upload. Deduplicated is set when the
+// content was already stored and the file reuses the existing object
+type UploadResponse struct {
+	URL          string `json:"url" xml:"url"`
+	Deduplicated bool   `json:"deduplicated" xml:"deduplicated"`
+}
+
+// BatchUploadItem is the result for one file of a batch upload. Error and Code
+// are set when that file failed; the remaining files are still processed
+type BatchUploadItem struct {
+	Filename     string `json:"filename" xml:"filename"`
+	ID           string `json:"id,omitempty" xml:"id,omitempty"`
+	URL          string `json:"url,omitempty" xml:"url,omitempty"`
+	Deduplicated bool   `json:"deduplicated,omitempty" xml:"deduplicated,omitempty"`
+	Error        string `json:"error,omitempty" xml:"error,omitempty"`
+	Code         string `json:"code,omitempty" xml:"code,omitempty"`
 }
 
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error string `json:"error" xml:"error"`
+	Code  string `json:"code,omitempty" xml:"code,omitempty"`
+}
+
+// ExpandedMetadataResponse is the stored metadata document plus computed fields
+type ExpandedMetadataResponse struct {
+	XMLName xml.Name `json:"-" xml:"FileMetadata"`
+	*models.FileMetadata
+	PresignedURL string `json:"presigned_url,omitempty" xml:"presigned_url,omitempty"`
+	ObjectExists bool   `json:"object_exists" xml:"object_exists"`
+	HumanSize    string `json:"human_size" xml:"human_size"`
+}
+
+// UploadPolicyRequest describes the file a browser is about to upload directly
+type UploadPolicyRequest struct {
+	Filename    string `json:"filename" binding:"required"`
+	ContentType string `json:"content_type" binding:"required"`
+}
+
+// UpdateFileRequest is the body of a partial metadata update
+type UpdateFileRequest struct {
+	Description     *string    `json:"description"`
+	Tags            *[]string  `json:"tags"`
+	AccessibleUntil *time.Time `json:"accessible_until"`
+}
+
+// GalleryRequest lists the files of a gallery in display order
+type GalleryRequest struct {
+	IDs []string `json:"ids" binding:"required,min=1,max=100"`
+}
+
+// BulkDeleteRequest lists the files to delete in one request
+type BulkDeleteRequest struct {
+	IDs []string `json:"ids" binding:"required,min=1,max=100"`
+}
+
+// CopyToRequest is the body of an export to an external presigned PUT URL
+type CopyToRequest struct {
+	PresignedPutURL string `json:"presigned_put_url" binding:"required"`
+}
+
+// PresignResponse is a time-limited download URL
+type PresignResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RecentFilesResponse lists files uploaded since the start of the window.
+// In XML the files are wrapped in <items> with one <file> element each
+type RecentFilesResponse struct {
+	XMLName xml.Name              `json:"-" xml:"RecentFiles"`
+	Items   []models.FileMetadata `json:"items" xml:"items>file"`
+	Since   time.Time             `json:"since" xml:"since"`
+}
+
+// FileListResponse is one page of the file list. In XML the files are
+// wrapped in <items> with one <file> element each
+type FileListResponse struct {
+	XMLName xml.Name              `json:"-" xml:"FileList"`
+	Items   []models.FileMetadata `json:"items" xml:"items>file"`
+	Total   int64                 `json:"total" xml:"total"`
+	Limit   int                   `json:"limit" xml:"limit"`
+	Offset  int                   `json:"offset" xml:"offset"`
+}
+
+// AuthCheckResponse describes the API key used for the request
+type AuthCheckResponse struct {
+	Client string   `json:"client"`
+	Scopes []string `json:"scopes"`
+}
+
+// ThumbnailEvent is the payload of a "status" server-sent event
+type ThumbnailEvent struct {
+	FileID          string `json:"file_id"`
+	ThumbnailStatus string `json:"thumbnail_status"`
 }
 
+// sseKeepAlive is the interval of comment lines that keep idle event streams open
+const sseKeepAlive = 15 * time.Second
+
 // NewFileHandler creates a new file handler
-func NewFileHandler(service *service.FileService) *FileHandler {
-	return &FileHandler{service: service}
+func NewFileHandler(service *service.FileService, cfg *config.Config) *FileHandler {
+	h := &FileHandler{
+		service:             service,
+		config:              cfg,
+		allowedExtensions:   make(map[string]bool),
+		allowedContentTypes: make(map[string]bool),
+	}
+	for _, ext := range cfg.AllowedExtensions {
+		if normalized := utils.NormalizeExtension("file." + strings.TrimPrefix(ext, ".")); normalized != "" {
+			h.allowedExtensions[normalized] = true
+		}
+	}
+	for _, contentType := range cfg.AllowedMIMETypes {
+		h.allowedContentTypes[strings.ToLower(contentType)] = true
+	}
+
+	bufferSize := max(cfg.DownloadBufferSize, minDownloadBufferSize)
+	h.copyBuffers.New = func() any {
+		buf := make([]byte, bufferSize)
+		return &buf
+	}
+	return h
+}
+
+// AuthCheck godoc
+// @Summary Check an API key
+// @Description Validate the API key without performing any action and return its
+// @Description label and scopes. Invalid keys get 401 from the auth middleware
+// @Tags auth
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} AuthCheckResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /api/v1/auth/check [get]
+func (h *FileHandler) AuthCheck(c *gin.Context) {
+	scopes := c.GetStringSlice(middleware.ClientScopesKey)
+	if scopes == nil {
+		scopes = []string{}
+	}
+	c.JSON(http.StatusOK, AuthCheckResponse{
+		Client: c.GetString(middleware.ClientLabelKey),
+		Scopes: scopes,
+	})
 }
 
 // UploadFile godoc
 // @Summary Upload a file
 // @Description Upload file to storage
+// @Description With DEDUP_ENABLED, content already stored under another file is not uploaded
+// @Description again: the new file references the existing object and deduplicated is true.
+// @Description UNIQUE_NAMES=reject answers 409 for a name already in use; suffix renames the file
 // @Tags files
 // @Accept multipart/form-data
 // @Produce json
 // @Param file formData file true "File to upload"
+// @Param description formData string false "File description (alt text)"
+// @Param tags formData string false "Comma-separated tags"
+// @Param accessible_until formData string false "RFC 3339 time after which the file is no longer readable"
+// @Param X-Content-SHA256 header string false "Expected hex SHA-256 of the file; the upload fails with 400 on mismatch"
 // @Security ApiKeyAuth
-// @Success 200 {object} SuccessResponse
+// @Success 200 {object} UploadResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
+// @Failure 507 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
 // @Router /api/v1/upload [post]
 func (h *FileHandler) UploadFile(c *gin.Context) {
-	// Validate file size
-	const maxUploadSize = 1024 << 20 // 1024 MB = 1 GB
-	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize)
-
-	file, err := c.FormFile("file")
+	file, err := h.formFile(c)
 	if err != nil {
-		log.Printf("File upload error: %v", err)
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "File upload error"})
+		formFileError(c, err)
+		return
+	}
+
+	description := c.PostForm("description")
+	if !h.validDescription(description) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Description is too long"})
+		return
+	}
+
+	tags, ok := h.normalizeTags(c, splitTags(c.PostFormArray("tags")))
+	if !ok {
+		return
+	}
+
+	var accessibleUntil *time.Time
+	if value := c.PostForm("accessible_until"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid accessible_until, expected RFC 3339 time"})
+			return
+		}
+		accessibleUntil = &parsed
+	}
+
+	expectedSHA256 := strings.TrimSpace(c.GetHeader("X-Content-SHA256"))
+	if expectedSHA256 != "" && !validSHA256(expectedSHA256) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid X-Content-SHA256, expected 64 hex characters"})
 		return
 	}
 
@@ -76,91 +297,350 @@ func (h *FileHandler) UploadFile(c *gin.Context) {
 	log.Printf("Upload attempt: Filename=%s, Size=%d, MIME=%s",
 		file.Filename, file.Size, file.Header.Get("Content-Type"))
 
-	// Validate file extension
-	ext := strings.ToLower(filepath.Ext(file.Filename))
-	allowedExtensions := map[string]bool{
-		".jpg":  true,
-		".jpeg": true,
-		".png":  true,
-		".mp4":  true,
-		".mov":  true,
-		".avi":  true,
-		".mkv":  true,
-	}
-	if !allowedExtensions[ext] {
-		log.Printf("Unsupported file extension: %s", ext)
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unsupported file extension"})
+	// Validate extension and real content type
+	contentType, ok := h.checkUploadFile(c, file)
+	if !ok {
+		return
+	}
+
+	// Upload file
+	uploaded, err := h.service.UploadFile(c.Request.Context(), file, service.UploadOptions{
+		Description: description,
+		Tags:        tags,
+		ContentType: contentType,
+
+		AccessibleUntil: accessibleUntil,
+		ExpectedSHA256:  expectedSHA256,
+	})
+	if err != nil {
+		if err == service.ErrChecksumMismatch {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "File content does not match X-Content-SHA256",
+				Code:  "CHECKSUM_MISMATCH",
+			})
+			return
+		}
+		if err == service.ErrUnavailable {
+			metadataUnavailable(c)
+			return
+		}
+		if err == service.ErrKeyTooLong {
+			keyTooLong(c)
+			return
+		}
+		if err == service.ErrNameTaken {
+			nameTaken(c)
+			return
+		}
+		if err == service.ErrCorruption {
+			contentCorrupted(c)
+			return
+		}
+		log.Printf("File upload service error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to process file"})
 		return
 	}
 
-	// Detect real content type
-	contentType, err := detectContentType(file)
+	log.Printf("File uploaded successfully: %s (deduplicated=%t)", uploaded.URL, uploaded.Deduplicated)
+	c.JSON(http.StatusOK, UploadResponse{URL: uploaded.URL, Deduplicated: uploaded.Deduplicated})
+}
+
+// UploadBatch godoc
+// @Summary Upload several files
+// @Description Upload every file sent in the "files" form field, each validated and stored
+// @Description like a single upload. A failed file does not abort the batch: its result carries
+// @Description error and code instead of id and url. Answers 207 if any file failed.
+// @Description MAX_UPLOAD_SIZE caps the whole request, MAX_BATCH_FILES the number of files
+// @Tags files
+// @Accept multipart/form-data
+// @Produce json
+// @Param files formData file true "Files to upload (repeat the field for each file)"
+// @Security ApiKeyAuth
+// @Success 200 {array} BatchUploadItem
+// @Success 207 {array} BatchUploadItem
+// @Failure 400 {object} ErrorResponse
+// @Failure 507 {object} ErrorResponse
+// @Router /api/v1/upload/batch [post]
+func (h *FileHandler) UploadBatch(c *gin.Context) {
+	if err := h.parseUploadForm(c); err != nil {
+		formFileError(c, err)
+		return
+	}
+	form, err := c.MultipartForm()
 	if err != nil {
-		log.Printf("Content type detection error: %v", err)
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file content"})
+		formFileError(c, err)
 		return
 	}
 
-	// Validate content type
-	allowedTypes := map[string]bool{
-		"image/jpeg":      true,
-		"image/png":       true,
-		"video/mp4":       true,
-		"video/quicktime": true,
-		"video/x-msvideo": true,
-		"video/x-matroska": true,
+	files := form.File["files"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Form field 'files' is required"})
+		return
 	}
-	if !allowedTypes[contentType] {
-		log.Printf("Unsupported content type: %s", contentType)
+	if len(files) > h.config.MaxBatchFiles {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("At most %d files can be uploaded in one batch", h.config.MaxBatchFiles),
+			Code:  "TOO_MANY_FILES",
+		})
+		return
+	}
+
+	status := http.StatusOK
+	items := make([]BatchUploadItem, 0, len(files))
+	for _, file := range files {
+		item := h.uploadBatchFile(c, file)
+		if item.Error != "" {
+			status = http.StatusMultiStatus
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(status, items)
+}
+
+// uploadBatchFile validates and uploads one file of a batch, reporting
+// a failure in the returned item instead of the response
+func (h *FileHandler) uploadBatchFile(c *gin.Context, file *multipart.FileHeader) BatchUploadItem {
+	item := BatchUploadItem{Filename: file.Filename}
+
+	contentType, reject := h.uploadFileType(file)
+	if reject != nil {
+		item.Error, item.Code = reject.Error, reject.Code
+		return item
+	}
+
+	uploaded, err := h.service.UploadFile(c.Request.Context(), file, service.UploadOptions{ContentType: contentType})
+	if err != nil {
+		switch err {
+		case service.ErrUnavailable:
+			item.Error, item.Code = "Metadata storage is temporarily unavailable, retry later", "METADATA_UNAVAILABLE"
+		case service.ErrKeyTooLong:
+			item.Error, item.Code = "Object key is too long", "KEY_TOO_LONG"
+		case service.ErrNameTaken:
+			item.Error, item.Code = "A file with this name already exists", "NAME_TAKEN"
+		case service.ErrCorruption:
+			item.Error, item.Code = "Stored content is corrupted, upload again", "CORRUPTION"
+		default:
+			log.Printf("Batch upload service error for %s: %v", file.Filename, err)
+			item.Error = "Failed to process file"
+		}
+		return item
+	}
+
+	log.Printf("File uploaded successfully: %s (deduplicated=%t)", uploaded.URL, uploaded.Deduplicated)
+	item.ID, item.URL, item.Deduplicated = uploaded.ID, uploaded.URL, uploaded.Deduplicated
+	return item
+}
+
+// CreateUploadPolicy godoc
+// @Summary Create a presigned POST policy
+// @Description Return a presigned POST policy for uploading directly from a browser
+// @Description form to Minio. The policy pins the key prefix and content type and caps the size
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param request body UploadPolicyRequest true "File to upload"
+// @Security ApiKeyAuth
+// @Success 200 {object} service.UploadPolicy
+// @Failure 400 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/upload/post-policy [post]
+func (h *FileHandler) CreateUploadPolicy(c *gin.Context) {
+	var req UploadPolicyRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	if !h.validExtension(req.Filename) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unsupported file extension"})
+		return
+	}
+	if !h.allowedContentTypes[req.ContentType] {
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unsupported file type"})
 		return
 	}
 
-	// Upload file
-	url, err := h.service.UploadFile(c.Request.Context(), file)
+	policy, err := h.service.CreateUploadPolicy(c.Request.Context(), req.Filename, req.ContentType)
 	if err != nil {
-		log.Printf("File upload service error: %v", err)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to process file"})
+		if err == service.ErrKeyTooLong {
+			keyTooLong(c)
+			return
+		}
+		log.Printf("Post policy error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create upload policy"})
 		return
 	}
 
-	log.Printf("File uploaded successfully: %s", url)
-	c.JSON(http.StatusOK, SuccessResponse{URL: url})
+	c.JSON(http.StatusOK, policy)
+}
+
+// CopyTo godoc
+// @Summary Copy a file to an external presigned URL
+// @Description Stream the stored file to an external presigned PUT URL, e.g. a bucket
+// @Description of another service. Only hosts from COPY_TO_ALLOWED_HOSTS are accepted
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param id path string true "File ID"
+// @Param request body CopyToRequest true "Destination"
+// @Security ApiKeyAuth
+// @Success 200 {object} service.CopyResult
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 502 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/files/{id}/copy-to [post]
+func (h *FileHandler) CopyTo(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req CopyToRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	result, err := h.service.CopyTo(c.Request.Context(), fileID, req.PresignedPutURL)
+	if err != nil {
+		switch {
+		case err == service.ErrDestinationNotAllowed:
+			c.JSON(http.StatusForbidden, ErrorResponse{
+				Error: "Destination host is not allowed",
+				Code:  "DESTINATION_NOT_ALLOWED",
+			})
+		case err == service.ErrFileNotFound:
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+		case err == service.ErrAccessExpired:
+			accessExpired(c)
+		case errors.Is(err, service.ErrDestinationFailed):
+			log.Printf("File copy error: %v", err)
+			c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Destination rejected the upload"})
+		default:
+			log.Printf("File copy error: %v", err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to copy file"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
 }
 
 // DeleteFile godoc
 // @Summary Delete a file
-// @Description Delete file from storage
+// @Description Delete file from storage. With dryRun=true nothing is removed and
+// @Description the object that would be deleted is reported instead
 // @Tags files
 // @Produce json
 // @Param id path string true "File ID"
+// @Param dryRun query bool false "Report what would be deleted without deleting"
+// @Param older_than query string false "Delete only if uploaded before this date (YYYY-MM-DD or RFC 3339), otherwise 412"
 // @Security ApiKeyAuth
 // @Success 200 {object} SuccessResponse
+// @Failure 400 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
+// @Failure 412 {object} ErrorResponse
+// @Failure 423 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/files/{id} [delete]
 func (h *FileHandler) DeleteFile(c *gin.Context) {
-	fileID := c.Param("id")
-
-	if _, err := uuid.Parse(fileID); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file ID format"})
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
 		return
 	}
 
-	err := h.service.DeleteFile(c.Request.Context(), fileID)
+	dryRun := c.Query("dryRun") == "true"
+
+	var olderThan *time.Time
+	if value := c.Query("older_than"); value != "" {
+		parsed, ok := parseDateOrTime(value)
+		if !ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid older_than, expected YYYY-MM-DD or RFC 3339 time"})
+			return
+		}
+		olderThan = &parsed
+	}
+
+	result, err := h.service.DeleteFile(c.Request.Context(), fileID, service.DeleteOptions{
+		DryRun:    dryRun,
+		OlderThan: olderThan,
+	})
 	if err != nil {
 		if err == service.ErrFileNotFound {
 			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
 			return
 		}
+		if err == service.ErrFileTooNew {
+			c.JSON(http.StatusPreconditionFailed, ErrorResponse{
+				Error: "File was uploaded on or after older_than and was not deleted",
+				Code:  "FILE_TOO_NEW",
+			})
+			return
+		}
+		if err == service.ErrFileLocked {
+			c.JSON(http.StatusLocked, ErrorResponse{Error: "File is locked by another operation"})
+			return
+		}
 		log.Printf("File deletion error: %v", err)
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete file"})
 		return
 	}
 
+	log.Printf("Delete result: %+v", *result)
+	if dryRun {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
 	c.JSON(http.StatusOK, SuccessResponse{URL: fmt.Sprintf("File %s deleted", fileID)})
 }
 
+// DeleteFiles godoc
+// @Summary Delete several files
+// @Description Delete up to 100 files in one request. Each ID is reported in deleted,
+// @Description notFound or failed; malformed IDs are listed in failed without being looked up.
+// @Description Objects are removed from Minio in a single batch; objects still shared with
+// @Description other files are kept
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param request body BulkDeleteRequest true "File IDs"
+// @Security ApiKeyAuth
+// @Success 200 {object} service.BulkDeleteResult
+// @Failure 400 {object} ErrorResponse
+// @Router /api/v1/files [delete]
+func (h *FileHandler) DeleteFiles(c *gin.Context) {
+	var req BulkDeleteRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	var (
+		valid   []string
+		invalid []service.BulkDeleteFailure
+	)
+	for _, fileID := range req.IDs {
+		fileID = utils.NormalizeFileID(h.config.IDScheme, fileID)
+		if !utils.IsValidFileID(h.config.IDScheme, fileID) {
+			invalid = append(invalid, service.BulkDeleteFailure{ID: fileID, Error: "Invalid file ID format"})
+			continue
+		}
+		valid = append(valid, fileID)
+	}
+
+	result := h.service.DeleteFiles(c.Request.Context(), valid)
+	if len(invalid) > 0 {
+		result.Failed = append(invalid, result.Failed...)
+	}
+
+	log.Printf("Bulk delete: %d deleted, %d not found, %d failed",
+		len(result.Deleted), len(result.NotFound), len(result.Failed))
+	c.JSON(http.StatusOK, result)
+}
+
 // ReplaceFile godoc
 // @Summary Replace a file
 // @Description Replace existing file
@@ -172,106 +652,1560 @@ func (h *FileHandler) DeleteFile(c *gin.Context) {
 // @Security ApiKeyAuth
 // @Success 200 {object} SuccessResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 423 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
+// @Failure 507 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
 // @Router /api/v1/files/{id} [put]
 func (h *FileHandler) ReplaceFile(c *gin.Context) {
-	fileID := c.Param("id")
-
-	if _, err := uuid.Parse(fileID); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file ID format"})
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
 		return
 	}
 
-	file, err := c.FormFile("file")
+	file, err := h.formFile(c)
 	if err != nil {
-		log.Printf("File upload error: %v", err)
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "File upload error"})
+		formFileError(c, err)
 		return
 	}
 
 	// Validate new file
-	contentType, err := detectContentType(file)
+	contentType, ok := h.checkUploadFile(c, file)
+	if !ok {
+		return
+	}
+
+	url, err := h.service.ReplaceFile(c.Request.Context(), fileID, file, contentType)
 	if err != nil {
-		log.Printf("Content type detection error: %v", err)
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file content"})
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrFileLocked {
+			c.JSON(http.StatusLocked, ErrorResponse{Error: "File is locked by another operation"})
+			return
+		}
+		if err == service.ErrUnavailable {
+			metadataUnavailable(c)
+			return
+		}
+		if err == service.ErrKeyTooLong {
+			keyTooLong(c)
+			return
+		}
+		if err == service.ErrNameTaken {
+			nameTaken(c)
+			return
+		}
+		if err == service.ErrCorruption {
+			contentCorrupted(c)
+			return
+		}
+		log.Printf("File replacement error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to replace file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{URL: url})
+}
+
+// ReplaceContent godoc
+// @Summary Replace file content
+// @Description Replace the stored bytes, keeping the ID, original name and
+// @Description other metadata. The content is stored under a new object key and the
+// @Description previous object is kept until the new one is verified.
+// @Description Accepts a raw request body or a multipart form with a "file" field
+// @Tags files
+// @Accept application/octet-stream
+// @Accept multipart/form-data
+// @Produce json
+// @Param id path string true "File ID"
+// @Param file formData file false "New content (multipart form)"
+// @Security ApiKeyAuth
+// @Success 200 {object} models.FileMetadata
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 423 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 507 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /api/v1/files/{id}/content [put]
+func (h *FileHandler) ReplaceContent(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
 		return
 	}
 
-	allowedTypes := map[string]bool{
-		"image/jpeg": true,
-		"image/png":  true,
-		"video/mp4":  true,
+	var (
+		reader      io.Reader
+		size        int64
+		contentType string
+	)
+
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, err := h.formFile(c)
+		if err != nil {
+			formFileError(c, err)
+			return
+		}
+
+		contentType, err = h.detectContentType(file)
+		if err != nil {
+			log.Printf("Content type detection error: %v", err)
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file content"})
+			return
+		}
+		contentType = h.fallbackContentType(file.Filename, contentType)
+
+		src, err := file.Open()
+		if err != nil {
+			log.Printf("File open error: %v", err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to process file"})
+			return
+		}
+		defer src.Close()
+
+		reader, size = src, file.Size
+	} else {
+		if c.Request.ContentLength > h.config.MaxUploadSize {
+			c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: "File is too large"})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.config.MaxUploadSize)
+
+		// Sniff the content type from the head of the stream without consuming it
+		body := bufio.NewReaderSize(c.Request.Body, h.sniffBytes())
+		head, err := body.Peek(h.sniffBytes())
+		if err != nil && err != io.EOF {
+			log.Printf("Request body read error: %v", err)
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file content"})
+			return
+		}
+		if len(head) == 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Empty request body"})
+			return
+		}
+
+		contentType = utils.DetectContentType(head)
+		if contentType == "application/octet-stream" {
+			// A raw body has no filename: the fallback goes by the stored file's extension
+			current, err := h.service.GetFileMetadata(c.Request.Context(), fileID)
+			if err != nil {
+				if err == service.ErrFileNotFound {
+					c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+					return
+				}
+				log.Printf("Metadata retrieval error: %v", err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file metadata"})
+				return
+			}
+			contentType = h.fallbackContentType(downloadFilename(current), contentType)
+		}
+		reader, size = body, rawBodySize(c.Request)
 	}
-	if !allowedTypes[contentType] {
+
+	if !h.allowedContentTypes[contentType] {
 		log.Printf("Unsupported content type: %s", contentType)
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unsupported file type"})
 		return
 	}
 
-	url, err := h.service.ReplaceFile(c.Request.Context(), fileID, file)
+	metadata, err := h.service.ReplaceContent(c.Request.Context(), fileID, reader, size, contentType)
 	if err != nil {
 		if err == service.ErrFileNotFound {
 			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
 			return
 		}
-		log.Printf("File replacement error: %v", err)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to replace file"})
+		if err == service.ErrFileLocked {
+			c.JSON(http.StatusLocked, ErrorResponse{Error: "File is locked by another operation"})
+			return
+		}
+		if err == service.ErrSizeMismatch {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "Received size does not match Content-Length",
+				Code:  "SIZE_MISMATCH",
+			})
+			return
+		}
+		if err == service.ErrUnavailable {
+			metadataUnavailable(c)
+			return
+		}
+		if err == service.ErrCorruption {
+			contentCorrupted(c)
+			return
+		}
+		if err == service.ErrKeyTooLong {
+			keyTooLong(c)
+			return
+		}
+		log.Printf("File content replacement error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to replace file content"})
 		return
 	}
 
-	c.JSON(http.StatusOK, SuccessResponse{URL: url})
+	c.JSON(http.StatusOK, metadata)
 }
 
 // GetFileMetadata godoc
 // @Summary Get file metadata
-// @Description Get file metadata by ID
+// @Description Get file metadata by ID. With expand=true the response also
+// @Description includes a presigned URL, object existence and human-readable size.
+// @Description Send "Accept: application/xml" to get the metadata as XML
 // @Tags files
-// @Produce json
+// @Produce json,xml
 // @Param id path string true "File ID"
+// @Param expand query bool false "Include computed fields"
 // @Security ApiKeyAuth
 // @Success 200 {object} models.FileMetadata
 // @Failure 404 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/files/{id} [get]
 func (h *FileHandler) GetFileMetadata(c *gin.Context) {
-	fileID := c.Param("id")
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
 
-	if _, err := uuid.Parse(fileID); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid file ID format"})
+	if c.Query("expand") == "true" {
+		h.getExpandedMetadata(c, fileID)
 		return
 	}
 
-	metadata, err := h.service.GetFileMetadata(c.Request.Context(), fileID)
+	metadata, err := h.service.GetAccessibleMetadata(c.Request.Context(), fileID)
 	if err != nil {
 		if err == service.ErrFileNotFound {
 			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
 			return
 		}
+		if err == service.ErrAccessExpired {
+			accessExpired(c)
+			return
+		}
 		log.Printf("Metadata retrieval error: %v", err)
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file metadata"})
 		return
 	}
 
-	c.JSON(http.StatusOK, metadata)
+	negotiate(c, http.StatusOK, metadata)
 }
 
-// detectContentType detects the real content type of a file
-func detectContentType(file *multipart.FileHeader) (string, error) {
-	src, err := file.Open()
-	if err != nil {
-		return "", err
+// ListFiles godoc
+// @Summary List files
+// @Description Return a page of file metadata with the total count, newest uploads first
+// @Description unless another sort is requested.
+// @Description Responds with XML when the Accept header prefers application/xml
+// @Tags files
+// @Produce json,xml
+// @Param limit query int false "Page size (default 20, max 100)"
+// @Param offset query int false "Number of files to skip (default 0)"
+// @Param sort query string false "Sort field (default upload_date)" Enums(upload_date, file_size, original_name)
+// @Param order query string false "Sort order (default desc)" Enums(asc, desc)
+// @Security ApiKeyAuth
+// @Success 200 {object} FileListResponse
+// @Header 200 {string} Link "first, prev, next and last page links (RFC 8288)"
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/files [get]
+func (h *FileHandler) ListFiles(c *gin.Context) {
+	limit, ok := queryInt(c, "limit", defaultListLimit)
+	if !ok {
+		return
 	}
-	defer src.Close()
+	offset, ok := queryInt(c, "offset", 0)
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	limit = min(limit, maxListLimit)
+
+	sortField := c.DefaultQuery("sort", "upload_date")
+	if !slices.Contains(service.ListSortFields, sortField) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Invalid sort, expected one of %s", strings.Join(service.ListSortFields, ", ")),
+		})
+		return
+	}
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid order, expected asc or desc"})
+		return
+	}
+
+	files, total, err := h.service.ListFiles(c.Request.Context(), limit, offset, sortField, order == "desc")
+	if err != nil {
+		log.Printf("File list error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list files"})
+		return
+	}
+
+	if h.config.ListLinkHeaders {
+		c.Header("Link", paginationLinks(c.Request.URL, limit, offset, total))
+	}
+	negotiate(c, http.StatusOK, FileListResponse{
+		Items:  files,
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	})
+}
+
+// RecentFiles godoc
+// @Summary List recently uploaded files
+// @Description Return files uploaded within a relative time window, newest first.
+// @Description The window is a Go duration string such as 15m or 24h and is capped at 720h.
+// @Description Responds with XML when the Accept header prefers application/xml
+// @Tags files
+// @Produce json,xml
+// @Param since query string false "Time window (default 1h, max 720h)"
+// @Param limit query int false "Maximum number of files (default 20, max 100)"
+// @Security ApiKeyAuth
+// @Success 200 {object} RecentFilesResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/files/recent [get]
+func (h *FileHandler) RecentFiles(c *gin.Context) {
+	window := defaultRecentWindow
+	if value := c.Query("since"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid since, expected a positive duration such as 1h"})
+			return
+		}
+		window = min(parsed, maxRecentWindow)
+	}
+
+	limit, ok := queryInt(c, "limit", defaultListLimit)
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	limit = min(limit, maxListLimit)
+
+	files, since, err := h.service.RecentFiles(c.Request.Context(), window, limit)
+	if err != nil {
+		log.Printf("Recent files error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list files"})
+		return
+	}
+
+	negotiate(c, http.StatusOK, RecentFilesResponse{
+		Items: files,
+		Since: since,
+	})
+}
+
+// GetGallery godoc
+// @Summary Get a gallery manifest
+// @Description Return metadata, thumbnail URL and a presigned original URL for up to
+// @Description 100 files in one response, in the requested order. IDs that are unknown,
+// @Description malformed or no longer accessible are skipped and listed in missing
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param request body GalleryRequest true "File IDs in display order"
+// @Security ApiKeyAuth
+// @Success 200 {object} service.GalleryManifest
+// @Failure 400 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/gallery [post]
+func (h *FileHandler) GetGallery(c *gin.Context) {
+	var req GalleryRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	manifest, err := h.service.Gallery(c.Request.Context(), req.IDs)
+	if err != nil {
+		log.Printf("Gallery manifest error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to build gallery manifest"})
+		return
+	}
+
+	c.JSON(http.StatusOK, manifest)
+}
+
+// GetFileContent godoc
+// @Summary Download file content
+// @Description Stream the file bytes through the service, for clients that cannot
+// @Description reach Minio directly. Files stored gzip-compressed are sent with
+// @Description Content-Encoding: gzip when the client accepts it and decompressed otherwise.
+// @Description A single "bytes=" Range returns 206 Partial Content. Malformed, out-of-bounds
+// @Description and multiple ranges return 416 with Content-Range: bytes */size; ranges are
+// @Description not supported for compressed files, which are always sent in full
+// @Description Full responses carry the hex SHA-256 of the content in X-Checksum-SHA256
+// @Tags files
+// @Produce octet-stream
+// @Param id path string true "File ID"
+// @Param Range header string false "Byte range, e.g. bytes=0-1023 or bytes=500-"
+// @Security ApiKeyAuth
+// @Success 200 {file} file
+// @Success 206 {file} file
+// @Success 304 "Not modified (If-None-Match matched the ETag)"
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 416 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/files/{id}/content [get]
+func (h *FileHandler) GetFileContent(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	metadata, err := h.service.GetAccessibleMetadata(c.Request.Context(), fileID)
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrAccessExpired {
+			accessExpired(c)
+			return
+		}
+		log.Printf("Metadata retrieval error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file metadata"})
+		return
+	}
+
+	// The content SHA-256 covers the original bytes and is a strong validator
+	// regardless of encoding; the storage checksum covers the stored bytes,
+	// so it is used only for objects kept uncompressed
+	checksum := metadata.ContentSHA256
+	if checksum == "" && metadata.ContentEncoding == "" {
+		checksum = metadata.Checksum
+	}
+	etag := utils.ETag(checksum, metadata.UploadDate, metadata.FileSize)
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	// Byte offsets of a compressed object do not match the original content
+	var start, end int64
+	ranged := false
+	if metadata.ContentEncoding == "" {
+		c.Header("Accept-Ranges", "bytes")
+		if header := c.GetHeader("Range"); header != "" {
+			start, end, ranged, err = byteRange(header, metadata.FileSize)
+			if err != nil {
+				c.Header("Content-Range", fmt.Sprintf("bytes */%d", metadata.FileSize))
+				c.JSON(http.StatusRequestedRangeNotSatisfiable, ErrorResponse{
+					Error: "Requested range is invalid or not satisfiable",
+					Code:  "RANGE_NOT_SATISFIABLE",
+				})
+				return
+			}
+		}
+	} else {
+		c.Header("Accept-Ranges", "none")
+	}
+
+	var object io.ReadCloser
+	if ranged {
+		object, err = h.service.OpenContentRange(c.Request.Context(), metadata, start, end)
+	} else {
+		object, err = h.service.OpenContent(c.Request.Context(), metadata)
+	}
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		log.Printf("File content retrieval error for %s: %v", fileID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file content"})
+		return
+	}
+	defer object.Close()
+
+	if metadata.ContentSHA256 != "" && !ranged {
+		c.Header("X-Checksum-SHA256", metadata.ContentSHA256)
+	}
+
+	status := http.StatusOK
+	body := io.Reader(object)
+	switch {
+	case ranged:
+		status = http.StatusPartialContent
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, metadata.FileSize))
+		c.Header("Content-Length", strconv.FormatInt(end-start+1, 10))
+	case metadata.ContentEncoding != "" && middleware.AcceptsEncoding(c.GetHeader("Accept-Encoding"), metadata.ContentEncoding):
+		c.Header("Content-Encoding", metadata.ContentEncoding)
+	default:
+		if metadata.ContentEncoding == middleware.EncodingGzip {
+			gz, err := gzip.NewReader(object)
+			if err != nil {
+				log.Printf("File content decode error for %s: %v", fileID, err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file content"})
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		c.Header("Content-Length", strconv.FormatInt(metadata.FileSize, 10))
+	}
+
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType, body = h.missingContentType(c, metadata, body, ranged)
+	}
+	contentType = h.correctContentType(metadata, contentType)
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": downloadFilename(metadata),
+	}))
+	c.Status(status)
+
+	if _, err := h.copyContent(c.Writer, body); err != nil {
+		log.Printf("File content streaming error for %s: %v", fileID, err)
+		return
+	}
+	// Seeking through a video issues many range requests; count whole downloads only,
+	// but every read keeps the file out of cold storage
+	h.service.RecordDownload(metadata, !ranged)
+}
+
+// PresignFile godoc
+// @Summary Get a presigned download URL
+// @Description Return a time-limited Minio URL for the file and its expiry time.
+// @Description expires is clamped to Minio's 7-day maximum and to the file's accessible_until
+// @Tags files
+// @Produce json
+// @Param id path string true "File ID"
+// @Param expires query int false "Lifetime in seconds (default 3600, max 604800)"
+// @Security ApiKeyAuth
+// @Success 200 {object} PresignResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/files/{id}/presign [get]
+func (h *FileHandler) PresignFile(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	seconds := int64(defaultPresignExpires)
+	if value := c.Query("expires"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "'expires' must be a positive number of seconds"})
+			return
+		}
+		// Clamp before converting so huge values cannot overflow a Duration
+		seconds = min(parsed, int64(7*24*time.Hour/time.Second))
+	}
+
+	url, expiresAt, err := h.service.PresignFile(c.Request.Context(), fileID, time.Duration(seconds)*time.Second)
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrAccessExpired {
+			accessExpired(c)
+			return
+		}
+		log.Printf("Presign error for %s: %v", fileID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate URL"})
+		return
+	}
+
+	c.JSON(http.StatusOK, PresignResponse{URL: url, ExpiresAt: expiresAt})
+}
+
+// GetThumbnail godoc
+// @Summary Get file thumbnail
+// @Description Return the JPEG thumbnail of an image file. When no thumbnail is
+// @Description available the 404 carries a code: THUMBNAIL_PENDING while it is being
+// @Description generated, THUMBNAIL_FAILED (with the reason) when generation failed,
+// @Description THUMBNAIL_NOT_AVAILABLE otherwise
+// @Tags files
+// @Produce jpeg
+// @Param id path string true "File ID"
+// @Security ApiKeyAuth
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/files/{id}/thumbnail [get]
+func (h *FileHandler) GetThumbnail(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	metadata, err := h.service.GetAccessibleMetadata(c.Request.Context(), fileID)
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrAccessExpired {
+			accessExpired(c)
+			return
+		}
+		log.Printf("Metadata retrieval error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file metadata"})
+		return
+	}
+
+	switch metadata.ThumbnailStatus {
+	case models.ThumbnailPending:
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Thumbnail is being generated", Code: "THUMBNAIL_PENDING"})
+		return
+	case models.ThumbnailFailed:
+		message := "Thumbnail generation failed"
+		if metadata.ThumbnailError != "" {
+			message += ": " + metadata.ThumbnailError
+		}
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: message, Code: "THUMBNAIL_FAILED"})
+		return
+	}
+
+	thumbnail, err := h.service.OpenThumbnail(c.Request.Context(), metadata)
+	if err != nil {
+		log.Printf("Thumbnail retrieval error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get thumbnail"})
+		return
+	}
+	if thumbnail == nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "File has no thumbnail", Code: "THUMBNAIL_NOT_AVAILABLE"})
+		return
+	}
+	defer thumbnail.Close()
+
+	c.Header("Content-Type", "image/jpeg")
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, thumbnail); err != nil {
+		log.Printf("Thumbnail streaming error for %s: %v", fileID, err)
+	}
+}
+
+// RegenerateThumbnail godoc
+// @Summary Regenerate file thumbnail
+// @Description Queue thumbnail generation again, e.g. after it failed. Returns the
+// @Description metadata with thumbnail_status "pending"; follow progress with the events endpoint
+// @Tags files
+// @Produce json
+// @Param id path string true "File ID"
+// @Security ApiKeyAuth
+// @Success 202 {object} models.FileMetadata
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /api/v1/files/{id}/thumbnail/regenerate [post]
+func (h *FileHandler) RegenerateThumbnail(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	metadata, err := h.service.RegenerateThumbnail(c.Request.Context(), fileID)
+	if err != nil {
+		switch err {
+		case service.ErrFileNotFound:
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+		case service.ErrAccessExpired:
+			accessExpired(c)
+		case service.ErrThumbnailUnsupported:
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Thumbnails are not generated for this file", Code: "THUMBNAIL_UNSUPPORTED"})
+		case service.ErrThumbnailQueueFull:
+			c.Header("Retry-After", "5")
+			c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Thumbnail queue is full, retry later", Code: "THUMBNAIL_QUEUE_FULL"})
+		default:
+			log.Printf("Thumbnail regeneration error for %s: %v", fileID, err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to regenerate thumbnail"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, metadata)
+}
+
+// GetFileBundle godoc
+// @Summary Get metadata and thumbnail in one response
+// @Description Return a multipart/mixed response. The first part (name "metadata",
+// @Description application/json) holds the file metadata; the second part (name
+// @Description "thumbnail", image/jpeg) holds the thumbnail bytes and is omitted
+// @Description when no thumbnail is ready. The boundary is given in the Content-Type header
+// @Tags files
+// @Produce multipart/mixed
+// @Param id path string true "File ID"
+// @Security ApiKeyAuth
+// @Success 200 {file} file
+// @Failure 404 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/files/{id}/bundle [get]
+func (h *FileHandler) GetFileBundle(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	metadata, err := h.service.GetAccessibleMetadata(c.Request.Context(), fileID)
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrAccessExpired {
+			accessExpired(c)
+			return
+		}
+		log.Printf("Metadata retrieval error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file metadata"})
+		return
+	}
+
+	thumbnail, err := h.service.OpenThumbnail(c.Request.Context(), metadata)
+	if err != nil {
+		log.Printf("Thumbnail retrieval error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get thumbnail"})
+		return
+	}
+	if thumbnail != nil {
+		defer thumbnail.Close()
+	}
+
+	mw := multipart.NewWriter(c.Writer)
+	c.Header("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	c.Status(http.StatusOK)
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/json"},
+		"Content-Disposition": {`inline; name="metadata"`},
+	})
+	if err == nil {
+		err = json.NewEncoder(part).Encode(metadata)
+	}
+	if err == nil && thumbnail != nil {
+		part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {"image/jpeg"},
+			"Content-Disposition": {fmt.Sprintf(`attachment; name="thumbnail"; filename="%s.jpg"`, fileID)},
+		})
+		if err == nil {
+			_, err = io.Copy(part, thumbnail)
+		}
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		// Headers are already sent; the client sees a truncated body
+		log.Printf("Bundle write error for %s: %v", fileID, err)
+	}
+}
+
+// GetFileEvents godoc
+// @Summary Watch thumbnail status
+// @Description Stream thumbnail status changes as server-sent events. Each "status"
+// @Description event carries a ThumbnailEvent JSON object. The current status is sent
+// @Description first; the stream closes once the status is final (ready, failed or none)
+// @Tags files
+// @Produce text/event-stream
+// @Param id path string true "File ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} ThumbnailEvent
+// @Failure 404 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/files/{id}/events [get]
+func (h *FileHandler) GetFileEvents(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	metadata, updates, unsubscribe, err := h.service.WatchThumbnail(c.Request.Context(), fileID)
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrAccessExpired {
+			accessExpired(c)
+			return
+		}
+		log.Printf("Metadata retrieval error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file metadata"})
+		return
+	}
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(status string) {
+		c.SSEvent("status", ThumbnailEvent{FileID: fileID, ThumbnailStatus: status})
+		c.Writer.Flush()
+	}
+
+	send(metadata.ThumbnailStatus)
+	if metadata.ThumbnailStatus != models.ThumbnailPending {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case status := <-updates:
+			send(status)
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// UpdateFile godoc
+// @Summary Update file metadata
+// @Description Partially update editable metadata fields
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param id path string true "File ID"
+// @Param request body UpdateFileRequest true "Fields to update"
+// @Security ApiKeyAuth
+// @Success 200 {object} models.FileMetadata
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /api/v1/files/{id} [patch]
+func (h *FileHandler) UpdateFile(c *gin.Context) {
+	fileID, ok := h.fileIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateFileRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	if req.Description != nil && !h.validDescription(*req.Description) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Description is too long"})
+		return
+	}
+
+	if req.Tags != nil {
+		tags, ok := h.normalizeTags(c, *req.Tags)
+		if !ok {
+			return
+		}
+		req.Tags = &tags
+	}
+
+	metadata, err := h.service.UpdateFile(c.Request.Context(), fileID, models.MetadataPatch{
+		Description:     req.Description,
+		Tags:            req.Tags,
+		AccessibleUntil: req.AccessibleUntil,
+	})
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrUnavailable {
+			metadataUnavailable(c)
+			return
+		}
+		log.Printf("Metadata update error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update file metadata"})
+		return
+	}
+
+	c.JSON(http.StatusOK, metadata)
+}
+
+// ResolveURL godoc
+// @Summary Resolve a file URL
+// @Description Resolve a previously returned file URL back to its metadata
+// @Tags files
+// @Produce json
+// @Param url query string true "File URL"
+// @Security ApiKeyAuth
+// @Success 200 {object} models.FileMetadata
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/resolve [get]
+func (h *FileHandler) ResolveURL(c *gin.Context) {
+	rawURL := c.Query("url")
+	if rawURL == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing url parameter"})
+		return
+	}
+
+	metadata, err := h.service.ResolveURL(c.Request.Context(), rawURL)
+	if err != nil {
+		if err == service.ErrForeignURL {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "URL does not belong to this storage"})
+			return
+		}
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrAccessExpired {
+			accessExpired(c)
+			return
+		}
+		log.Printf("URL resolution error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to resolve URL"})
+		return
+	}
+
+	c.JSON(http.StatusOK, metadata)
+}
+
+// getExpandedMetadata responds with metadata enriched with computed fields
+func (h *FileHandler) getExpandedMetadata(c *gin.Context, fileID string) {
+	details, err := h.service.GetFileDetails(c.Request.Context(), fileID)
+	if err != nil {
+		if err == service.ErrFileNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+			return
+		}
+		if err == service.ErrAccessExpired {
+			accessExpired(c)
+			return
+		}
+		log.Printf("Metadata retrieval error: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get file metadata"})
+		return
+	}
+
+	negotiate(c, http.StatusOK, ExpandedMetadataResponse{
+		FileMetadata: details.Metadata,
+		PresignedURL: details.PresignedURL,
+		ObjectExists: details.ObjectExists,
+		HumanSize:    utils.FormatSize(details.Metadata.FileSize),
+	})
+}
+
+// formFile parses the multipart body within the configured size limits and
+// returns the uploaded file. Parts beyond the in-memory threshold are spooled
+// to disk instead of RAM
+func (h *FileHandler) formFile(c *gin.Context) (*multipart.FileHeader, error) {
+	if err := h.parseUploadForm(c); err != nil {
+		return nil, err
+	}
+	return c.FormFile("file")
+}
+
+// parseUploadForm parses the multipart upload form with the body capped at
+// MAX_UPLOAD_SIZE and the text fields at MAX_FORM_FIELDS_SIZE
+func (h *FileHandler) parseUploadForm(c *gin.Context) error {
+	_, params, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	body := &closingBoundaryReader{
+		ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, h.config.MaxUploadSize),
+		marker:     []byte("--" + params["boundary"] + "--"),
+	}
+	c.Request.Body = body
+
+	if err := c.Request.ParseMultipartForm(h.config.MultipartMemThreshold); err != nil {
+		return err
+	}
+	// The multipart reader takes a body cut inside part headers for the end
+	// of the form, which would look like a form without the file
+	if !body.seen {
+		return io.ErrUnexpectedEOF
+	}
+
+	// The standard parser keeps text fields in memory bounded only by the
+	// in-memory threshold plus 10 MB; enforce the much tighter configured cap
+	// before any field is used
+	var fieldsSize int64
+	for name, values := range c.Request.MultipartForm.Value {
+		for _, value := range values {
+			fieldsSize += int64(len(name) + len(value))
+		}
+	}
+	if fieldsSize > h.config.MaxFormFieldsSize {
+		return errFormFieldsTooLarge
+	}
+	return nil
+}
+
+// closingBoundaryReader records whether the closing delimiter of a multipart
+// body has been read, including one split across reads
+type closingBoundaryReader struct {
+	io.ReadCloser
+	marker []byte
+	tail   []byte // last len(marker)-1 bytes read
+	seen   bool
+}
+
+func (r *closingBoundaryReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.seen || n == 0 {
+		return n, err
+	}
+
+	keep := len(r.marker) - 1
+	seam := append(r.tail, p[:min(n, keep)]...)
+	r.seen = bytes.Contains(seam, r.marker) || bytes.Contains(p[:n], r.marker)
+	if n >= keep {
+		r.tail = append(r.tail[:0], p[n-keep:n]...)
+	} else {
+		r.tail = append(r.tail[:0], seam[max(0, len(seam)-keep):]...)
+	}
+	return n, err
+}
+
+// bindJSON binds the JSON request body into obj and on failure writes a 400
+// with the offending field in the message. Unknown fields are rejected when
+// STRICT_JSON is enabled (see binding.EnableDecoderDisallowUnknownFields in main)
+func bindJSON(c *gin.Context, obj any) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+
+	message := "Invalid request body"
+	var (
+		validationErrs validator.ValidationErrors
+		typeErr        *json.UnmarshalTypeError
+		syntaxErr      *json.SyntaxError
+	)
+	switch {
+	case errors.As(err, &validationErrs):
+		fieldErr := validationErrs[0]
+		message = fmt.Sprintf("Field %q failed %q validation", jsonFieldName(obj, fieldErr.StructField()), fieldErr.Tag())
+	case errors.As(err, &typeErr):
+		message = fmt.Sprintf("Field %q must be of type %s", typeErr.Field, typeErr.Type)
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		// A truncated body ends the decoder before a syntax error is reported
+		message = "Malformed JSON"
+	case errors.Is(err, io.EOF):
+		message = "Request body is empty"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		message = "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	}
+
+	c.JSON(http.StatusBadRequest, ErrorResponse{Error: message, Code: "INVALID_BODY"})
+	return false
+}
+
+// jsonFieldName returns the JSON name of a struct field of *obj
+func jsonFieldName(obj any, field string) string {
+	t := reflect.TypeOf(obj)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if f, ok := t.FieldByName(field); ok {
+		if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" {
+			return name
+		}
+	}
+	return field
+}
+
+// negotiate writes obj as XML when the client prefers application/xml in its
+// Accept header and as JSON otherwise
+func negotiate(c *gin.Context, status int, obj any) {
+	if prefersXML(c.GetHeader("Accept")) {
+		c.XML(status, obj)
+		return
+	}
+	c.JSON(status, obj)
+}
+
+// prefersXML reports whether the Accept header ranks XML above JSON. Unlike
+// gin's NegotiateFormat it honours q-values; wildcards and ties go to JSON
+func prefersXML(accept string) bool {
+	var xmlQ, jsonQ float64
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(item, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case gin.MIMEXML, gin.MIMEXML2:
+			xmlQ = max(xmlQ, q)
+		case gin.MIMEJSON, "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return xmlQ > jsonQ
+}
+
+// queryInt reads a non-negative integer query parameter, falling back to
+// defaultValue when it is absent. On an invalid value it writes a 400
+func queryInt(c *gin.Context, name string, defaultValue int) (int, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return defaultValue, true
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("'%s' must be a non-negative integer", name)})
+		return 0, false
+	}
+	return n, true
+}
 
-	buf := make([]byte, 512)
-	if _, err = src.Read(buf); err != nil {
+// paginationLinks builds a Link header value (RFC 8288) with the first, prev,
+// next and last pages of a limit/offset listing. Other query parameters of u
+// are kept; prev and next are omitted on the first and last pages
+func paginationLinks(u *url.URL, limit, offset int, total int64) string {
+	link := func(offset int, rel string) string {
+		query := u.Query()
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("offset", strconv.Itoa(offset))
+		target := url.URL{Path: u.Path, RawQuery: query.Encode()}
+		return fmt.Sprintf("<%s>; rel=%q", target.String(), rel)
+	}
+
+	last := 0
+	if total > 0 {
+		last = int((total-1)/int64(limit)) * limit
+	}
+
+	links := []string{link(0, "first")}
+	if offset > 0 {
+		links = append(links, link(max(offset-limit, 0), "prev"))
+	}
+	if int64(offset+limit) < total {
+		links = append(links, link(offset+limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+	return strings.Join(links, ", ")
+}
+
+// maxByteRanges caps the number of ranges read from one Range header;
+// longer range sets are rejected without parsing them
+const maxByteRanges = 8
+
+// byteRange parses a Range header against an object of the given size and
+// returns the inclusive byte span. ok is false when the header is to be
+// ignored and the whole file sent: a unit other than bytes. The range set
+// is checked strictly (digits only, no stray characters); a malformed or
+// unsatisfiable range, more than one range (multipart/byteranges is not
+// supported) or more than maxByteRanges return errRangeNotSatisfiable
+func byteRange(header string, size int64) (start, end int64, ok bool, err error) {
+	unit, set, found := strings.Cut(header, "=")
+	if !found || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return 0, 0, false, nil
+	}
+
+	specs := strings.Split(set, ",")
+	if len(specs) > maxByteRanges {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+
+	ranges := 0
+	for _, spec := range specs {
+		// Empty list elements are allowed around commas
+		spec = strings.Trim(spec, " \t")
+		if spec == "" {
+			continue
+		}
+		ranges++
+		start, end, err = rangeSpec(spec, size)
+		if err != nil {
+			return 0, 0, false, err
+		}
+	}
+	if ranges != 1 {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end, true, nil
+}
+
+// rangeSpec parses one "first-last", "first-" or "-suffix" range
+func rangeSpec(spec string, size int64) (start, end int64, err error) {
+	first, last, found := strings.Cut(spec, "-")
+	if !found || (first == "" && last == "") || !digitsOrEmpty(first) || !digitsOrEmpty(last) {
+		return 0, 0, errRangeNotSatisfiable
+	}
+
+	if first == "" {
+		// Suffix range "bytes=-N": the last N bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n == 0 || size == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		end = min(end, size-1)
+	}
+	return start, end, nil
+}
+
+// digitsOrEmpty reports whether s holds only ASCII digits; strconv alone
+// would also accept a sign
+func digitsOrEmpty(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// minDownloadBufferSize is the smallest copy buffer used for downloads,
+// whatever DOWNLOAD_BUFFER_SIZE says
+const minDownloadBufferSize = 4 << 10
+
+// copyContent streams src to dst through a pooled DOWNLOAD_BUFFER_SIZE buffer
+func (h *FileHandler) copyContent(dst io.Writer, src io.Reader) (int64, error) {
+	buf := h.copyBuffers.Get().(*[]byte)
+	defer h.copyBuffers.Put(buf)
+	return copyBuffered(dst, src, *buf)
+}
+
+// copyBuffered copies through buf. Both sides are wrapped so io.CopyBuffer
+// cannot bypass buf via WriterTo or ReaderFrom and pick its own chunk size
+func copyBuffered(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
+
+// downloadFilename restores the uploaded file name: the original name is
+// stored without its extension, which is kept on the object key
+func downloadFilename(metadata *models.FileMetadata) string {
+	key := metadata.ObjectName
+	if key == "" {
+		key = metadata.URL
+	}
+	return metadata.OriginalName + filepath.Ext(key)
+}
+
+// formFileError writes the response for a failed multipart parse: 507 when
+// the temp disk is full while spooling parts, 400 otherwise. A body that ends
+// before the closing boundary (client disconnect, aborted upload) is reported
+// separately from a well-formed form that lacks the "file" field
+func formFileError(c *gin.Context, err error) {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		log.Printf("Incomplete upload: %v", err)
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Upload body ended unexpectedly, the upload was incomplete",
+			Code:  "INCOMPLETE_UPLOAD",
+		})
+		return
+	}
+	if err == http.ErrMissingFile {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Form field 'file' is required"})
+		return
+	}
+
+	log.Printf("File upload error: %v", err)
+	if utils.IsDiskFull(err) {
+		storageFull(c)
+		return
+	}
+	if err == errFormFieldsTooLarge {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Form fields are too large",
+			Code:  "FORM_FIELDS_TOO_LARGE",
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, ErrorResponse{Error: "File upload error"})
+}
+
+// accessExpired writes a 410 response for files past their AccessibleUntil date
+func accessExpired(c *gin.Context) {
+	c.JSON(http.StatusGone, ErrorResponse{
+		Error: "File access has expired",
+		Code:  "ACCESS_EXPIRED",
+	})
+}
+
+// metadataUnavailable writes a 503 for writes that MongoDB did not acknowledge
+// in time; the upload was rolled back and can be retried
+func metadataUnavailable(c *gin.Context) {
+	c.Header("Retry-After", "5")
+	c.JSON(http.StatusServiceUnavailable, ErrorResponse{
+		Error: "Metadata storage is temporarily unavailable, retry later",
+		Code:  "METADATA_UNAVAILABLE",
+	})
+}
+
+// keyTooLong writes a 400 for files whose computed object key exceeds the limit
+func keyTooLong(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, ErrorResponse{
+		Error: "Object key is too long",
+		Code:  "KEY_TOO_LONG",
+	})
+}
+
+// contentCorrupted writes a 500 for uploads whose stored content kept failing
+// the storage checksum after all retries
+func contentCorrupted(c *gin.Context) {
+	c.JSON(http.StatusInternalServerError, ErrorResponse{
+		Error: "Stored content is corrupted, upload again",
+		Code:  "CORRUPTION",
+	})
+}
+
+// parseDateOrTime parses an RFC 3339 time or a bare YYYY-MM-DD date,
+// the latter taken as midnight UTC
+func parseDateOrTime(value string) (time.Time, bool) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, true
+	}
+	parsed, err := time.Parse("2006-01-02", value)
+	return parsed, err == nil
+}
+
+// validSHA256 reports whether value is a hex-encoded SHA-256 digest
+func validSHA256(value string) bool {
+	if len(value) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// nameTaken writes a 409 response for a file name rejected by UNIQUE_NAMES
+func nameTaken(c *gin.Context) {
+	c.JSON(http.StatusConflict, ErrorResponse{
+		Error: "A file with this name already exists",
+		Code:  "NAME_TAKEN",
+	})
+}
+
+// storageFull writes a 507 response for uploads that ran out of temp disk
+func storageFull(c *gin.Context) {
+	c.JSON(http.StatusInsufficientStorage, ErrorResponse{
+		Error: "Insufficient storage to process upload",
+		Code:  "STORAGE_FULL",
+	})
+}
+
+// fileIDParam returns the :id path parameter, normalized to its stored form
+// (ULIDs are case-insensitive but stored upper case), after checking it
+// against the configured ID scheme. On failure it writes a 400 INVALID_ID response, so
+// every file route rejects malformed IDs with the same body
+func (h *FileHandler) fileIDParam(c *gin.Context) (string, bool) {
+	fileID := utils.NormalizeFileID(h.config.IDScheme, c.Param("id"))
+	if !utils.IsValidFileID(h.config.IDScheme, fileID) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Invalid file ID format",
+			Code:  "INVALID_ID",
+		})
+		return "", false
+	}
+	return fileID, true
+}
+
+// checkUploadFile validates an uploaded file against the extension allowlist
+// and its sniffed content type against the content type allowlist. On failure
+// it writes a 400 response and returns false
+func (h *FileHandler) checkUploadFile(c *gin.Context, file *multipart.FileHeader) (string, bool) {
+	contentType, reject := h.uploadFileType(file)
+	if reject != nil {
+		c.JSON(http.StatusBadRequest, reject)
+		return "", false
+	}
+	return contentType, true
+}
+
+// uploadFileType returns the sniffed content type of an uploaded file, or the
+// 400 body explaining why the file is not accepted
+func (h *FileHandler) uploadFileType(file *multipart.FileHeader) (string, *ErrorResponse) {
+	if !h.validExtension(file.Filename) {
+		return "", &ErrorResponse{Error: "Unsupported file extension"}
+	}
+
+	contentType, err := h.detectContentType(file)
+	if err != nil {
+		log.Printf("Content type detection error: %v", err)
+		return "", &ErrorResponse{Error: "Invalid file content"}
+	}
+	contentType = h.fallbackContentType(file.Filename, contentType)
+
+	if !h.allowedContentTypes[contentType] {
+		log.Printf("Unsupported content type: %s", contentType)
+		return "", &ErrorResponse{Error: "Unsupported file type"}
+	}
+	return contentType, nil
+}
+
+// validExtension normalizes the file name extension and checks it against
+// the allowlist. Normalization strips anything but [a-z0-9], so names like
+// "evil.php%00.jpg" or ".JPG " cannot smuggle odd characters into object keys
+func (h *FileHandler) validExtension(filename string) bool {
+	ext := utils.NormalizeExtension(filename)
+	if !h.allowedExtensions[ext] {
+		log.Printf("Unsupported file extension: %q (normalized %q)", filepath.Ext(filename), ext)
+		return false
+	}
+	return true
+}
+
+// validDescription checks the description against the configured length cap
+func (h *FileHandler) validDescription(description string) bool {
+	return utf8.RuneCountInString(description) <= h.config.MaxDescriptionLength
+}
+
+// normalizeTags normalizes tags and enforces the configured limits, writing
+// a 400 response with an error code when they are exceeded
+func (h *FileHandler) normalizeTags(c *gin.Context, tags []string) ([]string, bool) {
+	normalized, err := service.NormalizeTags(tags, h.config.MaxTags, h.config.MaxTagLength)
+	switch err {
+	case nil:
+		return normalized, true
+	case service.ErrTooManyTags:
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Too many tags (max %d)", h.config.MaxTags),
+			Code:  "TOO_MANY_TAGS",
+		})
+	case service.ErrTagTooLong:
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Tag is too long (max %d characters)", h.config.MaxTagLength),
+			Code:  "TAG_TOO_LONG",
+		})
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid tags"})
+	}
+	return nil, false
+}
+
+// splitTags accepts both repeated "tags" fields and comma-separated values
+func splitTags(values []string) []string {
+	var tags []string
+	for _, value := range values {
+		tags = append(tags, strings.Split(value, ",")...)
+	}
+	return tags
+}
+
+// rawBodySize returns the declared body length when it can be trusted, so the
+// object is sent to Minio as a single sized upload without buffering parts.
+// Chunked or undeclared bodies return -1 and are streamed as unknown length
+func rawBodySize(r *http.Request) int64 {
+	if r.ContentLength <= 0 || len(r.TransferEncoding) > 0 {
+		return -1
+	}
+	return r.ContentLength
+}
+
+// fallbackContentType replaces an inconclusive application/octet-stream sniff
+// result with the configured content type for the file extension. A type the
+// sniffer did recognize always takes precedence over the fallback
+func (h *FileHandler) fallbackContentType(filename, sniffed string) string {
+	if sniffed != "application/octet-stream" {
+		return sniffed
+	}
+	if fallback, ok := h.config.ContentTypeFallbacks[utils.NormalizeExtension(filename)]; ok {
+		log.Printf("Using fallback content type %s for %s", fallback, filename)
+		return fallback
+	}
+	return sniffed
+}
+
+// correctContentType replaces a stored content type that CONTENT_TYPE_CORRECTIONS
+// marks as wrong for the file's extension, so legacy records are served with
+// the right header without rewriting their objects
+func (h *FileHandler) correctContentType(metadata *models.FileMetadata, contentType string) string {
+	corrected, ok := h.config.ContentTypeCorrections[utils.NormalizeExtension(downloadFilename(metadata))]
+	if !ok || corrected == contentType {
+		return contentType
+	}
+	log.Printf("Correcting content type of %s from %s to %s", metadata.ID, contentType, corrected)
+	return corrected
+}
+
+// missingContentType determines the content type of a legacy record stored
+// without one. With SNIFF_MISSING_CONTENT_TYPE the head of the decoded body is
+// sniffed without consuming it and the result is backfilled into the metadata.
+// Ranged and still-encoded bodies cannot be sniffed and fall back to the
+// extension. Returns the content type and the body to stream
+func (h *FileHandler) missingContentType(c *gin.Context, metadata *models.FileMetadata, body io.Reader, ranged bool) (string, io.Reader) {
+	sniffed := "application/octet-stream"
+	canSniff := h.config.SniffMissingContentType && !ranged && c.Writer.Header().Get("Content-Encoding") == ""
+	if canSniff {
+		buffered := bufio.NewReaderSize(body, h.sniffBytes())
+		head, err := buffered.Peek(h.sniffBytes())
+		body = buffered
+		if err != nil && err != io.EOF {
+			log.Printf("Content type sniffing error for %s: %v", metadata.ID, err)
+			canSniff = false
+		} else if len(head) > 0 {
+			sniffed = utils.DetectContentType(head)
+		}
+	}
+
+	contentType := h.fallbackContentType(downloadFilename(metadata), sniffed)
+	if canSniff {
+		h.service.BackfillContentType(metadata.ID, contentType)
+	}
+	return contentType, body
+}
+
+// detectContentType detects the real content type of a file from its first
+// SNIFF_BYTES bytes
+func (h *FileHandler) detectContentType(file *multipart.FileHeader) (string, error) {
+	src, err := file.Open()
+	if err != nil {
 		return "", err
 	}
+	defer src.Close()
 
-	contentType := http.DetectContentType(buf)
-	if _, err = src.Seek(0, 0); err != nil {
+	buf := make([]byte, h.sniffBytes())
+	n, err := io.ReadFull(src, buf)
+	if n == 0 {
+		return "", err
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
 		return "", err
 	}
 
-	return contentType, nil
+	return utils.DetectContentType(buf[:n]), nil
+}
+
+// sniffBytes returns the configured sniff sample size, never less than the
+// 512 bytes http.DetectContentType itself looks at
+func (h *FileHandler) sniffBytes() int {
+	return max(h.config.SniffBytes, 512)
 }
\ No newline at end of file
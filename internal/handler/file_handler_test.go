@@ -0,0 +1,3723 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"kuber-code-s3/internal/config"
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+	"kuber-code-s3/internal/repository/repotest"
+	"kuber-code-s3/internal/service"
+	"kuber-code-s3/pkg/utils"
+)
+
+func TestByteRange(t *testing.T) {
+	const size = 1000
+
+	tests := []struct {
+		name      string
+		header    string
+		size      int64
+		wantStart int64
+		wantEnd   int64
+		wantOK    bool
+		wantErr   bool
+	}{
+		// Valid
+		{name: "closed range", header: "bytes=0-99", size: size, wantStart: 0, wantEnd: 99, wantOK: true},
+		{name: "open range", header: "bytes=900-", size: size, wantStart: 900, wantEnd: 999, wantOK: true},
+		{name: "suffix range", header: "bytes=-100", size: size, wantStart: 900, wantEnd: 999, wantOK: true},
+		{name: "suffix longer than file", header: "bytes=-5000", size: size, wantStart: 0, wantEnd: 999, wantOK: true},
+		{name: "end clamped to size", header: "bytes=500-5000", size: size, wantStart: 500, wantEnd: 999, wantOK: true},
+		{name: "last byte", header: "bytes=999-999", size: size, wantStart: 999, wantEnd: 999, wantOK: true},
+		{name: "unit case and spaces", header: "Bytes= 10-19 ", size: size, wantStart: 10, wantEnd: 19, wantOK: true},
+		{name: "empty list elements", header: "bytes=,0-9,", size: size, wantStart: 0, wantEnd: 9, wantOK: true},
+
+		// Ignored
+		{name: "other unit", header: "items=0-9", size: size},
+		{name: "no unit", header: "0-9", size: size},
+
+		// Out of bounds
+		{name: "start past end", header: "bytes=1000-", size: size, wantErr: true},
+		{name: "start past end closed", header: "bytes=2000-3000", size: size, wantErr: true},
+		{name: "zero suffix", header: "bytes=-0", size: size, wantErr: true},
+		{name: "empty file", header: "bytes=0-", size: 0, wantErr: true},
+		{name: "empty file suffix", header: "bytes=-10", size: 0, wantErr: true},
+
+		// Malformed
+		{name: "reversed", header: "bytes=99-0", size: size, wantErr: true},
+		{name: "no dash", header: "bytes=100", size: size, wantErr: true},
+		{name: "only dash", header: "bytes=-", size: size, wantErr: true},
+		{name: "empty set", header: "bytes=", size: size, wantErr: true},
+		{name: "sign", header: "bytes=+1-5", size: size, wantErr: true},
+		{name: "negative end", header: "bytes=1--5", size: size, wantErr: true},
+		{name: "inner space", header: "bytes=0 -9", size: size, wantErr: true},
+		{name: "trailing garbage", header: "bytes=0-9abc", size: size, wantErr: true},
+		{name: "hex", header: "bytes=0x10-20", size: size, wantErr: true},
+		{name: "overflow", header: "bytes=99999999999999999999-", size: size, wantErr: true},
+
+		// Several ranges
+		{name: "two ranges", header: "bytes=0-9,20-29", size: size, wantErr: true},
+		{name: "too many ranges", header: "bytes=" + strings.Repeat("0-1,", maxByteRanges) + "0-1", size: size, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, ok, err := byteRange(tt.header, tt.size)
+			if tt.wantErr {
+				if err != errRangeNotSatisfiable {
+					t.Fatalf("byteRange(%q) error = %v, want errRangeNotSatisfiable", tt.header, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("byteRange(%q) unexpected error: %v", tt.header, err)
+			}
+			if ok != tt.wantOK || start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("byteRange(%q) = %d-%d ok=%t, want %d-%d ok=%t",
+					tt.header, start, end, ok, tt.wantStart, tt.wantEnd, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGetFileContentRange(t *testing.T) {
+	mt := mongoMock(t)
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	tests := []struct {
+		name             string
+		header           string
+		wantStatus       int
+		wantContentRange string
+		wantBody         []byte
+	}{
+		{"first chunk", "bytes=0-99", http.StatusPartialContent, "bytes 0-99/1000", content[:100]},
+		{"next chunk", "bytes=100-199", http.StatusPartialContent, "bytes 100-199/1000", content[100:200]},
+		{"resume to the end", "bytes=900-", http.StatusPartialContent, "bytes 900-999/1000", content[900:]},
+		{"no range", "", http.StatusOK, "", content},
+		{"out of bounds", "bytes=1000-1099", http.StatusRequestedRangeNotSatisfiable, "bytes */1000", nil},
+		{"malformed", "bytes=abc-", http.StatusRequestedRangeNotSatisfiable, "bytes */1000", nil},
+		{"several ranges", "bytes=0-9,20-29", http.StatusRequestedRangeNotSatisfiable, "bytes */1000", nil},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+			file := testFile()
+			file.FileSize = int64(len(content))
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: content, ContentType: file.ContentType})
+			mt.AddMockResponses(metadataReply(mt, file), updateReply(1))
+
+			header := map[string]string{}
+			if tt.header != "" {
+				header["Range"] = tt.header
+			}
+			w := ts.do(http.MethodGet, "/files/"+file.ID+"/content", nil, header)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.wantContentRange {
+				mt.Errorf("Content-Range = %q, want %q", got, tt.wantContentRange)
+			}
+			if tt.wantBody != nil && !bytes.Equal(w.Body.Bytes(), tt.wantBody) {
+				mt.Errorf("body has %d bytes, want %d matching the range", w.Body.Len(), len(tt.wantBody))
+			}
+			if tt.wantStatus == http.StatusRequestedRangeNotSatisfiable {
+				if gets := ts.s3.Requests(http.MethodGet); len(gets) != 0 {
+					mt.Errorf("object read %d times for an unsatisfiable range", len(gets))
+				}
+				return
+			}
+			waitForCommand(mt, "update")
+		})
+	}
+}
+
+func TestCorrectContentType(t *testing.T) {
+	h := &FileHandler{config: &config.Config{
+		ContentTypeCorrections: map[string]string{".mp4": "video/mp4"},
+	}}
+
+	tests := []struct {
+		name       string
+		objectName string
+		stored     string
+		want       string
+	}{
+		{"known bad record", "files/abc.mp4", "application/octet-stream", "video/mp4"},
+		{"already correct", "files/abc.mp4", "video/mp4", "video/mp4"},
+		{"extension case", "files/abc.MP4", "text/plain", "video/mp4"},
+		{"no correction for extension", "files/abc.jpg", "image/jpeg", "image/jpeg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := &models.FileMetadata{ID: "abc", OriginalName: "clip", ObjectName: tt.objectName}
+			if got := h.correctContentType(metadata, tt.stored); got != tt.want {
+				t.Errorf("correctContentType(%q) = %q, want %q", tt.stored, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFileContentCorrectedType(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name        string
+		objectName  string
+		stored      string
+		corrections map[string]string
+		want        string
+	}{
+		{"known bad record", "clip.mp4", "application/octet-stream", map[string]string{".mp4": "video/mp4"}, "video/mp4"},
+		{"correct record", "clip.mp4", "video/mp4", map[string]string{".mp4": "video/mp4"}, "video/mp4"},
+		{"no correction configured", "clip.mp4", "text/plain", map[string]string{}, "text/plain"},
+		{"correction for another extension", "photo.png", "image/png", map[string]string{".mp4": "video/mp4"}, "image/png"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ContentTypeCorrections = tt.corrections
+			})
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+			file := testFile()
+			file.ObjectName, file.ContentType = tt.objectName, tt.stored
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: make([]byte, file.FileSize), ContentType: tt.stored})
+
+			mt.AddMockResponses(metadataReply(mt, file), updateReply(1))
+			w := ts.do(http.MethodGet, "/files/"+file.ID+"/content", nil, nil)
+			waitForCommand(mt, "update")
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.want {
+				mt.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+			// The stored record is left as is
+			if writes := mongoWrites(mt); slices.Contains(writes, "findAndModify") {
+				mt.Errorf("metadata was rewritten: %v", writes)
+			}
+		})
+	}
+}
+
+func TestCopyBufferedUsesBuffer(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	var dst chunkRecorder
+
+	n, err := copyBuffered(&dst, bytes.NewReader(data), make([]byte, 1024))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copyBuffered = %d, %v; want %d, nil", n, err, len(data))
+	}
+	if !bytes.Equal(dst.Bytes(), data) {
+		t.Fatal("copied bytes differ from the source")
+	}
+	// bytes.Reader implements WriterTo; the copy must still go through the buffer
+	if dst.maxChunk > 1024 {
+		t.Errorf("largest write %d bytes exceeds the 1024-byte buffer", dst.maxChunk)
+	}
+}
+
+// chunkRecorder records the largest single write it received
+type chunkRecorder struct {
+	bytes.Buffer
+	maxChunk int
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	r.maxChunk = max(r.maxChunk, len(p))
+	return r.Buffer.Write(p)
+}
+
+// BenchmarkCopyBuffered compares download throughput for DOWNLOAD_BUFFER_SIZE
+// values on a 64 MB body
+func BenchmarkCopyBuffered(b *testing.B) {
+	const bodySize = 64 << 20
+	data := bytes.Repeat([]byte{0xAB}, bodySize)
+
+	for _, size := range []int{32 << 10, 256 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			buf := make([]byte, size)
+			b.SetBytes(bodySize)
+			for i := 0; i < b.N; i++ {
+				if _, err := copyBuffered(io.Discard, bytes.NewReader(data), buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetFileMetadataExpand(t *testing.T) {
+	mt := mongoMock(t)
+	computed := []string{"presigned_url", "object_exists", "human_size"}
+
+	tests := []struct {
+		name         string
+		query        string
+		wantExpanded bool
+	}{
+		{"lean by default", "", false},
+		{"expanded with the flag", "?expand=true", true},
+		{"other values stay lean", "?expand=1", false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/:id", ts.handler.GetFileMetadata)
+			file := testFile()
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: make([]byte, file.FileSize), ContentType: file.ContentType})
+			mt.AddMockResponses(metadataReply(mt, file))
+
+			w := ts.do(http.MethodGet, "/files/"+file.ID+tt.query, nil, nil)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			var body map[string]any
+			decodeJSON(mt, w, &body)
+
+			if body["id"] != file.ID || body["original_name"] != file.OriginalName {
+				mt.Errorf("stored fields missing from %v", body)
+			}
+			for _, field := range computed {
+				if _, ok := body[field]; ok != tt.wantExpanded {
+					mt.Errorf("field %q present = %t, want %t", field, ok, tt.wantExpanded)
+				}
+			}
+			if tt.wantExpanded && (body["object_exists"] != true || body["human_size"] != "2.0 KB") {
+				mt.Errorf("computed fields = %v", body)
+			}
+		})
+	}
+}
+
+func TestDeleteFileDryRun(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name         string
+		query        string
+		replies      func(mt *mtest.T, file models.FileMetadata) []bson.D
+		wantDryRun   bool
+		wantMutation bool
+	}{
+		{
+			name:  "dry run",
+			query: "?dryRun=true",
+			replies: func(mt *mtest.T, file models.FileMetadata) []bson.D {
+				return []bson.D{metadataReply(mt, file), countReply(0)}
+			},
+			wantDryRun: true,
+		},
+		{
+			name: "real delete",
+			replies: func(mt *mtest.T, file models.FileMetadata) []bson.D {
+				return []bson.D{updateReply(1), metadataReply(mt, file), countReply(0), deleteReply(1), updateReply(0)}
+			},
+			wantMutation: true,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.DELETE("/files/:id", ts.handler.DeleteFile)
+			file := testFile()
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("content")})
+			mt.AddMockResponses(tt.replies(mt, file)...)
+
+			w := ts.do(http.MethodDelete, "/files/"+file.ID+tt.query, nil, nil)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			_, objectKept := ts.s3.Get(testBucket, file.ObjectName)
+			mutated := len(mongoWrites(mt)) > 0 || len(ts.s3.Mutations()) > 0 || !objectKept
+			if mutated != tt.wantMutation {
+				mt.Errorf("mutated = %t (mongo writes %v, S3 mutations %d), want %t",
+					mutated, mongoWrites(mt), len(ts.s3.Mutations()), tt.wantMutation)
+			}
+
+			if !tt.wantDryRun {
+				return
+			}
+			var result service.DeleteResult
+			decodeJSON(mt, w, &result)
+			want := service.DeleteResult{
+				FileID:     file.ID,
+				ObjectName: file.ObjectName,
+				BucketName: testBucket,
+				FileSize:   file.FileSize,
+				DryRun:     true,
+			}
+			if result != want {
+				mt.Errorf("dry-run result = %+v, want %+v", result, want)
+			}
+		})
+	}
+}
+
+func TestDeleteFileOlderThan(t *testing.T) {
+	mt := mongoMock(t)
+	file := testFile() // uploaded an hour ago
+
+	deleted := func(mt *mtest.T, file models.FileMetadata) []bson.D {
+		return []bson.D{updateReply(1), metadataReply(mt, file), countReply(0), deleteReply(1), updateReply(0)}
+	}
+	preserved := func(mt *mtest.T, file models.FileMetadata) []bson.D {
+		return []bson.D{updateReply(1), metadataReply(mt, file), updateReply(0)}
+	}
+
+	tests := []struct {
+		name        string
+		olderThan   string
+		replies     func(mt *mtest.T, file models.FileMetadata) []bson.D
+		wantStatus  int
+		wantCode    string
+		wantDeleted bool
+	}{
+		{"newer file is preserved", "2024-01-01", preserved, http.StatusPreconditionFailed, "FILE_TOO_NEW", false},
+		{"uploaded exactly at the date is preserved", file.UploadDate.Format(time.RFC3339Nano), preserved, http.StatusPreconditionFailed, "FILE_TOO_NEW", false},
+		{"older than a time", file.UploadDate.Add(time.Minute).Format(time.RFC3339), deleted, http.StatusOK, "", true},
+		{"older than a bare date", time.Now().AddDate(0, 0, 2).Format("2006-01-02"), deleted, http.StatusOK, "", true},
+		{"malformed date", "yesterday", nil, http.StatusBadRequest, "", false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.DELETE("/files/:id", ts.handler.DeleteFile)
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("content")})
+			if tt.replies != nil {
+				mt.AddMockResponses(tt.replies(mt, file)...)
+			}
+
+			w := ts.do(http.MethodDelete, "/files/"+file.ID+"?older_than="+url.QueryEscape(tt.olderThan), nil, nil)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantCode != "" {
+				var body ErrorResponse
+				decodeJSON(mt, w, &body)
+				if body.Code != tt.wantCode {
+					mt.Errorf("error code %q, want %q", body.Code, tt.wantCode)
+				}
+			}
+
+			_, objectKept := ts.s3.Get(testBucket, file.ObjectName)
+			metadataDeleted := slices.Contains(mongoWrites(mt), "delete")
+			if objectKept == tt.wantDeleted || metadataDeleted != tt.wantDeleted {
+				mt.Errorf("object kept = %t, metadata deleted = %t, want deleted = %t",
+					objectKept, metadataDeleted, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestUploadCompressedRoundTrip(t *testing.T) {
+	mt := mongoMock(t)
+	content := bytes.Repeat([]byte("a compressible line of plain text\n"), 200)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"client accepting gzip gets the stored stream", "gzip, deflate", "gzip"},
+		{"other clients get decompressed content", "", ""},
+		{"gzip refused explicitly", "gzip;q=0", ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.AllowedExtensions = []string{".txt"}
+				cfg.AllowedMIMETypes = []string{"text/plain; charset=utf-8"}
+				cfg.CompressContentTypes = []string{"text/plain; charset=utf-8"}
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+			body, contentType := multipartFile(mt, "notes.txt", content, nil)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("upload status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			stored := insertedFile(mt)
+			if stored.ContentEncoding != "gzip" || stored.FileSize != int64(len(content)) {
+				mt.Fatalf("stored encoding %q size %d, want gzip and %d", stored.ContentEncoding, stored.FileSize, len(content))
+			}
+			object, ok := ts.s3.Get(testBucket, stored.ObjectName)
+			if !ok {
+				mt.Fatal("object was not stored")
+			}
+			if len(object.Data) >= len(content) || object.ContentEncoding != "gzip" {
+				mt.Errorf("stored object: %d bytes with encoding %q, want fewer than %d gzip bytes",
+					len(object.Data), object.ContentEncoding, len(content))
+			}
+
+			mt.AddMockResponses(metadataReply(mt, stored), updateReply(1))
+			w = ts.do(http.MethodGet, "/files/"+stored.ID+"/content", nil, map[string]string{"Accept-Encoding": tt.acceptEncoding})
+			waitForCommand(mt, "update")
+			if w.Code != http.StatusOK {
+				mt.Fatalf("download status %d, want 200: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				mt.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			downloaded := w.Body.Bytes()
+			if tt.wantEncoding == "gzip" {
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					mt.Fatal(err)
+				}
+				if downloaded, err = io.ReadAll(gz); err != nil {
+					mt.Fatal(err)
+				}
+			}
+			if !bytes.Equal(downloaded, content) {
+				mt.Errorf("round-tripped content differs: got %d bytes, want %d", len(downloaded), len(content))
+			}
+		})
+	}
+}
+
+func TestFileDescription(t *testing.T) {
+	mt := mongoMock(t)
+	const maxLength = 20
+
+	type step struct {
+		method      string
+		path        string // relative to /files/<id>
+		form        map[string]string
+		json        string
+		replies     func(mt *mtest.T, file models.FileMetadata) []bson.D
+		wantStatus  int
+		wantStored  string // description in the written document
+		wantInReply string // description in the response body
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "set on upload, update, retrieve",
+			steps: []step{
+				{
+					method: http.MethodPost, form: map[string]string{"description": "A red square"},
+					replies: func(mt *mtest.T, file models.FileMetadata) []bson.D {
+						return []bson.D{mtest.CreateSuccessResponse()}
+					},
+					wantStatus: http.StatusOK, wantStored: "A red square",
+				},
+				{
+					method: http.MethodPatch, json: `{"description": "A blue square"}`,
+					replies: func(mt *mtest.T, file models.FileMetadata) []bson.D {
+						file.Description = "A blue square"
+						return []bson.D{mtest.CreateSuccessResponse(bson.E{Key: "value", Value: toDocument(mt, file)})}
+					},
+					wantStatus: http.StatusOK, wantStored: "A blue square", wantInReply: "A blue square",
+				},
+				{
+					method: http.MethodGet,
+					replies: func(mt *mtest.T, file models.FileMetadata) []bson.D {
+						file.Description = "A blue square"
+						return []bson.D{metadataReply(mt, file)}
+					},
+					wantStatus: http.StatusOK, wantInReply: "A blue square",
+				},
+			},
+		},
+		{
+			name: "too long on upload",
+			steps: []step{{
+				method: http.MethodPost, form: map[string]string{"description": strings.Repeat("x", maxLength+1)},
+				wantStatus: http.StatusBadRequest,
+			}},
+		},
+		{
+			name: "too long on update",
+			steps: []step{{
+				method: http.MethodPatch, json: `{"description": "` + strings.Repeat("я", maxLength+1) + `"}`,
+				wantStatus: http.StatusBadRequest,
+			}},
+		},
+		{
+			name: "limit counts characters, not bytes",
+			steps: []step{{
+				method: http.MethodPatch, json: `{"description": "` + strings.Repeat("я", maxLength) + `"}`,
+				replies: func(mt *mtest.T, file models.FileMetadata) []bson.D {
+					file.Description = strings.Repeat("я", maxLength)
+					return []bson.D{mtest.CreateSuccessResponse(bson.E{Key: "value", Value: toDocument(mt, file)})}
+				},
+				wantStatus: http.StatusOK, wantStored: strings.Repeat("я", maxLength), wantInReply: strings.Repeat("я", maxLength),
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.MaxDescriptionLength = maxLength
+			})
+			ts.router.POST("/files", ts.handler.UploadFile)
+			ts.router.PATCH("/files/:id", ts.handler.UpdateFile)
+			ts.router.GET("/files/:id", ts.handler.GetFileMetadata)
+			file := testFile()
+
+			for _, st := range tt.steps {
+				mt.ClearEvents()
+				if st.replies != nil {
+					mt.AddMockResponses(st.replies(mt, file)...)
+				}
+
+				var w *httptest.ResponseRecorder
+				switch st.method {
+				case http.MethodPost:
+					body, contentType := multipartFile(mt, "square.png", testPNG(mt), st.form)
+					w = ts.do(st.method, "/files", body, map[string]string{"Content-Type": contentType})
+				case http.MethodPatch:
+					w = ts.do(st.method, "/files/"+file.ID, strings.NewReader(st.json), map[string]string{"Content-Type": "application/json"})
+				default:
+					w = ts.do(st.method, "/files/"+file.ID, nil, nil)
+				}
+				if w.Code != st.wantStatus {
+					mt.Fatalf("%s: status %d, want %d: %s", st.method, w.Code, st.wantStatus, w.Body)
+				}
+
+				if st.wantStored != "" {
+					if got := writtenDescription(mt); got != st.wantStored {
+						mt.Errorf("%s: stored description %q, want %q", st.method, got, st.wantStored)
+					}
+				}
+				if st.wantInReply != "" {
+					var reply models.FileMetadata
+					decodeJSON(mt, w, &reply)
+					if reply.Description != st.wantInReply {
+						mt.Errorf("%s: description in reply %q, want %q", st.method, reply.Description, st.wantInReply)
+					}
+				}
+			}
+		})
+	}
+}
+
+// writtenDescription returns the description of the last insert or
+// findAndModify command
+func writtenDescription(mt *mtest.T) string {
+	description := ""
+	for _, event := range mt.GetAllStartedEvents() {
+		switch event.CommandName {
+		case "insert":
+			description = insertedFile(mt).Description
+		case "findAndModify":
+			value, err := event.Command.LookupErr("update", "$set", "description")
+			if err == nil {
+				description = value.StringValue()
+			}
+		}
+	}
+	return description
+}
+
+func TestLockContention(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		request func(mt *mtest.T) (io.Reader, string)
+	}{
+		{"delete", http.MethodDelete, "", nil},
+		{"replace", http.MethodPut, "", func(mt *mtest.T) (io.Reader, string) {
+			return multipartFile(mt, "photo.png", testPNG(mt), nil)
+		}},
+		{"replace content", http.MethodPut, "/content", func(mt *mtest.T) (io.Reader, string) {
+			return bytes.NewReader(testPNG(mt)), "image/png"
+		}},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.DELETE("/files/:id", ts.handler.DeleteFile)
+			ts.router.PUT("/files/:id", ts.handler.ReplaceFile)
+			ts.router.PUT("/files/:id/content", ts.handler.ReplaceContent)
+			file := testFile()
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("content")})
+
+			// Another operation holds the lock: the conditional update matches
+			// nothing while the document exists
+			mt.AddMockResponses(updateReply(0), metadataReply(mt, file))
+
+			var body io.Reader
+			header := map[string]string{}
+			if tt.request != nil {
+				body, header["Content-Type"] = tt.request(mt)
+			}
+			w := ts.do(tt.method, "/files/"+file.ID+tt.path, body, header)
+			if w.Code != http.StatusLocked {
+				mt.Fatalf("status %d, want 423: %s", w.Code, w.Body)
+			}
+			if writes := mongoWrites(mt); len(writes) != 1 {
+				mt.Errorf("mongo writes %v, want only the lock attempt", writes)
+			}
+			if mutations := ts.s3.Mutations(); len(mutations) != 0 {
+				mt.Errorf("S3 mutations %d, want none", len(mutations))
+			}
+		})
+	}
+}
+
+func TestParseUploadFormSpoolsLargeParts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const threshold = 1 << 20
+
+	tests := []struct {
+		name     string
+		size     int
+		wantDisk bool
+	}{
+		{"small part stays in memory", 64 << 10, false},
+		{"large part is spooled to disk", 16 << 20, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewFileHandler(nil, &config.Config{
+				MaxUploadSize:         64 << 20,
+				MultipartMemThreshold: threshold,
+				MaxFormFieldsSize:     1 << 10,
+			})
+			body, contentType := multipartFile(t, "video.mp4", bytes.Repeat([]byte{0x42}, tt.size), nil)
+			payload, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(payload))
+			c.Request.Header.Set("Content-Type", contentType)
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			if err := h.parseUploadForm(c); err != nil {
+				t.Fatalf("parseUploadForm() error = %v", err)
+			}
+			runtime.ReadMemStats(&after)
+			defer c.Request.MultipartForm.RemoveAll()
+
+			file, err := c.Request.MultipartForm.File["file"][0].Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if _, onDisk := file.(*os.File); onDisk != tt.wantDisk {
+				t.Errorf("part spooled to disk = %t, want %t", onDisk, tt.wantDisk)
+			}
+
+			// Allocations while parsing depend on the threshold, not the part size
+			if allocated := after.TotalAlloc - before.TotalAlloc; tt.wantDisk && allocated > uint64(tt.size/2) {
+				t.Errorf("parsing a %d-byte part allocated %d bytes, want at most %d", tt.size, allocated, tt.size/2)
+			}
+		})
+	}
+}
+
+func TestListFilesLinkHeader(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name     string
+		query    string
+		total    int64
+		disabled bool
+		want     string
+	}{
+		{
+			name:  "middle page",
+			query: "?limit=10&offset=20",
+			total: 45,
+			want: `</files?limit=10&offset=0>; rel="first", ` +
+				`</files?limit=10&offset=10>; rel="prev", ` +
+				`</files?limit=10&offset=30>; rel="next", ` +
+				`</files?limit=10&offset=40>; rel="last"`,
+		},
+		{
+			name:  "first page",
+			query: "?limit=10",
+			total: 45,
+			want: `</files?limit=10&offset=0>; rel="first", ` +
+				`</files?limit=10&offset=10>; rel="next", ` +
+				`</files?limit=10&offset=40>; rel="last"`,
+		},
+		{
+			name:  "last page",
+			query: "?limit=10&offset=40",
+			total: 45,
+			want: `</files?limit=10&offset=0>; rel="first", ` +
+				`</files?limit=10&offset=30>; rel="prev", ` +
+				`</files?limit=10&offset=40>; rel="last"`,
+		},
+		{
+			name:  "empty list",
+			query: "",
+			total: 0,
+			want:  `</files?limit=20&offset=0>; rel="first", </files?limit=20&offset=0>; rel="last"`,
+		},
+		{
+			name:  "other parameters are kept",
+			query: "?limit=10&offset=10&expand=true",
+			total: 25,
+			want: `</files?expand=true&limit=10&offset=0>; rel="first", ` +
+				`</files?expand=true&limit=10&offset=0>; rel="prev", ` +
+				`</files?expand=true&limit=10&offset=20>; rel="next", ` +
+				`</files?expand=true&limit=10&offset=20>; rel="last"`,
+		},
+		{
+			name:     "disabled",
+			query:    "?limit=10&offset=20",
+			total:    45,
+			disabled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ListLinkHeaders = !tt.disabled
+			})
+			ts.router.GET("/files", ts.handler.ListFiles)
+			mt.AddMockResponses(metadataReply(mt, testFile()), countReply(tt.total))
+
+			w := ts.do(http.MethodGet, "/files"+tt.query, nil, nil)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Link"); got != tt.want {
+				mt.Errorf("Link = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadAdversarialExtensions(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name     string
+		filename string
+		wantExt  string // extension of the object key, empty when rejected
+	}{
+		{"upper case", "photo.PNG", ".png"},
+		{"encoded NUL before extension", "evil.php%00.png", ".png"},
+		{"percent inside extension", "photo.p%ng", ".png"},
+		{"trailing space", "photo.png ", ".png"},
+		{"double extension", "photo.png.php", ""},
+		{"encoded NUL after extension", "photo.png%00.php", ""},
+		{"only symbols", "photo.%00", ""},
+		{"no extension", "photo", ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+			body, contentType := multipartFile(mt, tt.filename, testPNG(mt), nil)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+
+			if tt.wantExt == "" {
+				if w.Code != http.StatusBadRequest {
+					mt.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+				}
+				if writes, mutations := mongoWrites(mt), ts.s3.Mutations(); len(writes) > 0 || len(mutations) > 0 {
+					mt.Errorf("rejected upload wrote %v to MongoDB and made %d S3 requests", writes, len(mutations))
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			stored := insertedFile(mt)
+			if want := stored.ID + tt.wantExt; stored.ObjectName != want {
+				mt.Errorf("object key = %q, want %q", stored.ObjectName, want)
+			}
+			if keys := ts.s3.Keys(testBucket); len(keys) != 1 || keys[0] != stored.ObjectName {
+				mt.Errorf("stored keys = %v, want [%s]", keys, stored.ObjectName)
+			}
+		})
+	}
+}
+
+func TestDownloadCount(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name      string
+		downloads []string // Range header of each download, empty for a whole file
+		wantCount int32
+	}{
+		{"one download", []string{""}, 1},
+		{"each download is counted", []string{"", "", ""}, 3},
+		{"range requests are not counted", []string{"bytes=0-99", "", "bytes=100-"}, 1},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+			file := testFile()
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: make([]byte, file.FileSize), ContentType: file.ContentType})
+
+			var count int32
+			for i, rangeHeader := range tt.downloads {
+				mt.AddMockResponses(metadataReply(mt, file), updateReply(1))
+				header := map[string]string{}
+				if rangeHeader != "" {
+					header["Range"] = rangeHeader
+				}
+				w := ts.do(http.MethodGet, "/files/"+file.ID+"/content", nil, header)
+				if w.Code != http.StatusOK && w.Code != http.StatusPartialContent {
+					mt.Fatalf("download %d: status %d: %s", i+1, w.Code, w.Body)
+				}
+
+				// The counter is updated in the background after the response
+				update := waitForCommands(mt, "update", i+1)[i]
+				doc := update.Lookup("updates").Array().Index(0).Value().Document()
+				if id := doc.Lookup("q", "_id").StringValue(); id != file.ID {
+					mt.Errorf("download %d updated %q, want %q", i+1, id, file.ID)
+				}
+				if inc, err := doc.LookupErr("u", "$inc", "download_count"); err == nil {
+					count += inc.Int32()
+				}
+			}
+
+			if count != tt.wantCount {
+				mt.Errorf("download_count incremented by %d, want %d", count, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestReplaceFileMissingOldObject(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name          string
+		oldObjectKept bool
+	}{
+		{"old object present", true},
+		{"old object missing", false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ThumbnailOnReplace = false
+			})
+			ts.router.PUT("/files/:id", ts.handler.ReplaceFile)
+			file := testFile()
+			file.ObjectName = file.ID + ".jpg"
+			if tt.oldObjectKept {
+				ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("old content")})
+			}
+
+			replaced := file
+			replaced.ObjectName = file.ID + ".png"
+			mt.AddMockResponses(
+				updateReply(1),          // lock
+				metadataReply(mt, file), // current metadata
+				countReply(0),           // the old object is not shared
+				findAndModifyReply(mt, replaced),
+				updateReply(1), // unlock
+			)
+
+			body, contentType := multipartFile(mt, "photo.png", testPNG(mt), nil)
+			w := ts.do(http.MethodPut, "/files/"+file.ID, body, map[string]string{"Content-Type": contentType})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			if keys := ts.s3.Keys(testBucket); len(keys) != 1 || keys[0] != replaced.ObjectName {
+				mt.Errorf("stored keys = %v, want only the new object %s", keys, replaced.ObjectName)
+			}
+			if !bytes.Equal(mustGet(mt, ts.s3, replaced.ObjectName).Data, testPNG(mt)) {
+				mt.Error("new object content differs from the upload")
+			}
+			if writes := mongoWrites(mt); len(writes) != 3 || writes[1] != "findAndModify" {
+				mt.Errorf("mongo writes %v, want lock, metadata update and unlock", writes)
+			}
+		})
+	}
+}
+
+// mustGet returns a stored object of the test bucket
+func mustGet(mt *mtest.T, s3 *repotest.S3, key string) repotest.Object {
+	object, ok := s3.Get(testBucket, key)
+	if !ok {
+		mt.Fatalf("object %s is not stored", key)
+	}
+	return object
+}
+
+func TestFileIDParam(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const (
+		uuidID = "3f2b8c1e-9a4d-4e7b-8f6a-2c1d0e9b8a7f"
+		ulidID = "01HZX3Y4K5M6N7P8Q9R0S1T2V3"
+	)
+
+	tests := []struct {
+		name   string
+		scheme string
+		id     string
+		wantID string // empty when the ID is rejected
+	}{
+		{"uuid scheme accepts uuid", utils.IDSchemeUUID, uuidID, uuidID},
+		{"uuid scheme rejects ulid", utils.IDSchemeUUID, ulidID, ""},
+		{"uuid scheme rejects garbage", utils.IDSchemeUUID, "garbage", ""},
+		{"ulid scheme accepts ulid", utils.IDSchemeULID, ulidID, ulidID},
+		{"ulid scheme upper-cases ulid", utils.IDSchemeULID, strings.ToLower(ulidID), ulidID},
+		{"ulid scheme rejects uuid", utils.IDSchemeULID, uuidID, ""},
+		{"ulid scheme rejects garbage", utils.IDSchemeULID, "garbage", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewFileHandler(nil, &config.Config{IDScheme: tt.scheme})
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Params = gin.Params{{Key: "id", Value: tt.id}}
+
+			fileID, ok := h.fileIDParam(c)
+			if ok != (tt.wantID != "") || fileID != tt.wantID {
+				t.Fatalf("fileIDParam(%q) = %q, %t, want %q", tt.id, fileID, ok, tt.wantID)
+			}
+			if ok {
+				return
+			}
+			var body ErrorResponse
+			decodeJSON(t, w, &body)
+			if w.Code != http.StatusBadRequest || body.Code != "INVALID_ID" {
+				t.Errorf("rejection: status %d body %+v, want 400 INVALID_ID", w.Code, body)
+			}
+		})
+	}
+}
+
+func TestInvalidFileIDRoutes(t *testing.T) {
+	mt := mongoMock(t)
+	const badID = "not-a-file-id"
+
+	routes := []struct {
+		method  string
+		path    string
+		handler func(*FileHandler, *gin.Context)
+	}{
+		{http.MethodGet, "/files/:id", (*FileHandler).GetFileMetadata},
+		{http.MethodPut, "/files/:id", (*FileHandler).ReplaceFile},
+		{http.MethodPatch, "/files/:id", (*FileHandler).UpdateFile},
+		{http.MethodDelete, "/files/:id", (*FileHandler).DeleteFile},
+		{http.MethodGet, "/files/:id/content", (*FileHandler).GetFileContent},
+		{http.MethodPut, "/files/:id/content", (*FileHandler).ReplaceContent},
+		{http.MethodPost, "/files/:id/copy-to", (*FileHandler).CopyTo},
+		{http.MethodGet, "/files/:id/presign", (*FileHandler).PresignFile},
+		{http.MethodGet, "/files/:id/bundle", (*FileHandler).GetFileBundle},
+		{http.MethodGet, "/files/:id/thumbnail", (*FileHandler).GetThumbnail},
+		{http.MethodPost, "/files/:id/thumbnail/regenerate", (*FileHandler).RegenerateThumbnail},
+		{http.MethodGet, "/files/:id/events", (*FileHandler).GetFileEvents},
+		{http.MethodGet, "/admin/files/:id/diff", (*FileHandler).GetFileDiff},
+	}
+
+	var wantBody string
+	for _, route := range routes {
+		mt.Run(route.method+" "+route.path, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.Handle(route.method, route.path, func(c *gin.Context) { route.handler(ts.handler, c) })
+			s3Before := len(ts.s3.Requests(""))
+
+			target := strings.Replace(route.path, ":id", badID, 1)
+			w := ts.do(route.method, target, strings.NewReader("{}"), map[string]string{"Content-Type": "application/json"})
+
+			var body ErrorResponse
+			decodeJSON(mt, w, &body)
+			if w.Code != http.StatusBadRequest || body.Code != "INVALID_ID" {
+				mt.Fatalf("status %d body %s, want 400 INVALID_ID", w.Code, w.Body)
+			}
+			// All routes reject a malformed ID with the same body
+			if wantBody == "" {
+				wantBody = w.Body.String()
+			} else if w.Body.String() != wantBody {
+				mt.Errorf("body %s, want %s", w.Body, wantBody)
+			}
+			// The ID is rejected before MongoDB or S3 are touched
+			if events := mt.GetAllStartedEvents(); len(events) != 0 {
+				mt.Errorf("%d MongoDB commands were sent, want none", len(events))
+			}
+			if requests := ts.s3.Requests("")[s3Before:]; len(requests) != 0 {
+				mt.Errorf("%d S3 requests were sent, want none", len(requests))
+			}
+		})
+	}
+}
+
+func TestReplaceContentKeepsMetadata(t *testing.T) {
+	mt := mongoMock(t)
+	kept := []string{"original_name", "description", "tags", "accessible_until"}
+
+	tests := []struct {
+		name    string
+		request func(mt *mtest.T) (io.Reader, string)
+	}{
+		{"raw body", func(mt *mtest.T) (io.Reader, string) {
+			return bytes.NewReader(testPNG(mt)), "application/octet-stream"
+		}},
+		{"multipart form", func(mt *mtest.T) (io.Reader, string) {
+			return multipartFile(mt, "other-name.png", testPNG(mt), nil)
+		}},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ThumbnailOnReplace = false
+			})
+			ts.router.PUT("/files/:id/content", ts.handler.ReplaceContent)
+			file := testFile()
+			file.Description = "Summer trip"
+			file.Tags = []string{"beach", "holiday"}
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("old content")})
+
+			replaced := file
+			replaced.FileSize = int64(len(testPNG(mt)))
+			mt.AddMockResponses(
+				updateReply(1),          // lock
+				metadataReply(mt, file), // current metadata
+				countReply(0),           // the object is not shared
+				findAndModifyReply(mt, replaced),
+				updateReply(1), // unlock
+			)
+
+			body, contentType := tt.request(mt)
+			w := ts.do(http.MethodPut, "/files/"+file.ID+"/content", body, map[string]string{"Content-Type": contentType})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			// Only content fields are written; name, description and tags stay as stored
+			set := findAndModifySet(mt)
+			for _, field := range kept {
+				if _, err := set.LookupErr(field); err == nil {
+					mt.Errorf("content replace overwrote %q: %v", field, set)
+				}
+			}
+			if size, err := set.LookupErr("file_size"); err != nil || size.Int64() != replaced.FileSize {
+				mt.Errorf("file_size in %v, want %d", set, replaced.FileSize)
+			}
+
+			var got models.FileMetadata
+			decodeJSON(mt, w, &got)
+			if got.OriginalName != file.OriginalName || got.Description != file.Description ||
+				strings.Join(got.Tags, ",") != "beach,holiday" {
+				mt.Errorf("response metadata = %+v, want name, description and tags kept", got)
+			}
+			// The content moves to a new key and the previous object is removed
+			newKey := replacedObjectName(mt)
+			if newKey == file.ObjectName {
+				mt.Errorf("content stored under the previous key %s", newKey)
+			}
+			if !bytes.Equal(mustGet(mt, ts.s3, newKey).Data, testPNG(mt)) {
+				mt.Error("stored content differs from the request body")
+			}
+			if _, ok := ts.s3.Get(testBucket, file.ObjectName); ok {
+				mt.Error("previous object was not deleted")
+			}
+		})
+	}
+}
+
+func TestListFilesSort(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name          string
+		query         string
+		wantField     string // empty when the request is rejected
+		wantDirection int32
+	}{
+		{"default", "", "upload_date", -1},
+		{"upload date ascending", "?sort=upload_date&order=asc", "upload_date", 1},
+		{"upload date descending", "?sort=upload_date&order=desc", "upload_date", -1},
+		{"file size ascending", "?sort=file_size&order=asc", "file_size", 1},
+		{"file size descending", "?sort=file_size&order=desc", "file_size", -1},
+		{"original name ascending", "?sort=original_name&order=asc", "original_name", 1},
+		{"original name descending", "?sort=original_name", "original_name", -1},
+		{"order alone", "?order=asc", "upload_date", 1},
+		{"unknown field", "?sort=bucket_name", "", 0},
+		{"injected operator", "?sort=$where", "", 0},
+		{"unknown order", "?sort=file_size&order=up", "", 0},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files", ts.handler.ListFiles)
+			mt.AddMockResponses(metadataReply(mt, testFile()), countReply(1))
+
+			w := ts.do(http.MethodGet, "/files"+tt.query, nil, nil)
+			if tt.wantField == "" {
+				if w.Code != http.StatusBadRequest {
+					mt.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+				}
+				if events := mt.GetAllStartedEvents(); len(events) != 0 {
+					mt.Errorf("rejected request queried MongoDB: %d commands", len(events))
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			find := mt.GetStartedEvent()
+			if find == nil || find.CommandName != "find" {
+				mt.Fatalf("first command = %v, want find", find)
+			}
+			elements, err := find.Command.Lookup("sort").Document().Elements()
+			if err != nil {
+				mt.Fatal(err)
+			}
+			if len(elements) != 2 || elements[0].Key() != tt.wantField || elements[0].Value().Int32() != tt.wantDirection ||
+				elements[1].Key() != "_id" {
+				mt.Errorf("sort = %v, want {%s: %d, _id: 1}", elements, tt.wantField, tt.wantDirection)
+			}
+		})
+	}
+}
+
+func TestGetFileContentETag(t *testing.T) {
+	mt := mongoMock(t)
+	const sha256hex = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantWeak bool
+	}{
+		{"legacy record gets a weak ETag", "", true},
+		{"checksummed record gets a strong ETag", sha256hex, false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+			file := testFile()
+			file.ContentSHA256 = tt.checksum
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: make([]byte, file.FileSize), ContentType: file.ContentType})
+
+			mt.AddMockResponses(metadataReply(mt, file), updateReply(1))
+			w := ts.do(http.MethodGet, "/files/"+file.ID+"/content", nil, nil)
+			waitForCommand(mt, "update")
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			etag := w.Header().Get("ETag")
+			if weak := strings.HasPrefix(etag, `W/"`); weak != tt.wantWeak {
+				mt.Fatalf("ETag %s weak = %t, want %t", etag, weak, tt.wantWeak)
+			}
+			if !tt.wantWeak && etag != `"`+sha256hex+`"` {
+				mt.Errorf("ETag = %s, want the content SHA-256", etag)
+			}
+
+			// The ETag validates a conditional request without reading the object
+			mt.AddMockResponses(metadataReply(mt, file))
+			w = ts.do(http.MethodGet, "/files/"+file.ID+"/content", nil, map[string]string{"If-None-Match": etag})
+			if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				mt.Errorf("conditional request: status %d with %d bytes, want 304 without a body", w.Code, w.Body.Len())
+			}
+			if gets := ts.s3.Requests(http.MethodGet); len(gets) != 1 {
+				mt.Errorf("object read %d times, want once", len(gets))
+			}
+		})
+	}
+}
+
+func TestFileTagLimits(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name       string
+		upload     bool   // send the tags with an upload instead of a PATCH
+		tags       string // JSON array for PATCH, form value for upload
+		wantStatus int
+		wantCode   string
+		wantStored []string
+	}{
+		{"patch at the limits", false, `["abcde", "b", "c"]`, http.StatusOK, "", []string{"abcde", "b", "c"}},
+		{"patch with too many tags", false, `["a", "b", "c", "d"]`, http.StatusBadRequest, "TOO_MANY_TAGS", nil},
+		{"patch with a long tag", false, `["abcdef"]`, http.StatusBadRequest, "TAG_TOO_LONG", nil},
+		{"patch normalizes tags", false, `[" Beach", "beach ", "SUN", ""]`, http.StatusOK, "", []string{"beach", "sun"}},
+		{"upload normalizes tags", true, " Beach,beach , SUN", http.StatusOK, "", []string{"beach", "sun"}},
+		{"upload with too many tags", true, "a,b,c,d", http.StatusBadRequest, "TOO_MANY_TAGS", nil},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.MaxTags = 3
+				cfg.MaxTagLength = 5
+			})
+			ts.router.POST("/files", ts.handler.UploadFile)
+			ts.router.PATCH("/files/:id", ts.handler.UpdateFile)
+			file := testFile()
+			file.Tags = tt.wantStored
+
+			var w *httptest.ResponseRecorder
+			if tt.upload {
+				mt.AddMockResponses(mtest.CreateSuccessResponse())
+				body, contentType := multipartFile(mt, "photo.png", testPNG(mt), map[string]string{"tags": tt.tags})
+				w = ts.do(http.MethodPost, "/files", body, map[string]string{"Content-Type": contentType})
+			} else {
+				mt.AddMockResponses(findAndModifyReply(mt, file))
+				w = ts.do(http.MethodPatch, "/files/"+file.ID, strings.NewReader(`{"tags": `+tt.tags+`}`),
+					map[string]string{"Content-Type": "application/json"})
+			}
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			if tt.wantCode != "" {
+				var body ErrorResponse
+				decodeJSON(mt, w, &body)
+				if body.Code != tt.wantCode {
+					mt.Errorf("error code %q, want %q", body.Code, tt.wantCode)
+				}
+				if writes := mongoWrites(mt); len(writes) != 0 {
+					mt.Errorf("rejected tags were written: %v", writes)
+				}
+				return
+			}
+
+			var stored []string
+			if tt.upload {
+				stored = insertedFile(mt).Tags
+			} else {
+				for _, event := range mt.GetAllStartedEvents() {
+					if event.CommandName != "findAndModify" {
+						continue
+					}
+					values, err := event.Command.Lookup("update", "$set", "tags").Array().Values()
+					if err != nil {
+						mt.Fatal(err)
+					}
+					for _, value := range values {
+						stored = append(stored, value.StringValue())
+					}
+				}
+			}
+			if strings.Join(stored, ",") != strings.Join(tt.wantStored, ",") {
+				mt.Errorf("stored tags %q, want %q", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestResolveURL(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name       string
+		url        func(ts *testServer, file models.FileMetadata) string
+		found      bool
+		wantStatus int
+	}{
+		{
+			name: "known URL",
+			url: func(ts *testServer, file models.FileMetadata) string {
+				return "http://" + ts.s3.Endpoint() + "/" + testBucket + "/" + file.ObjectName
+			},
+			found:      true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "presigned URL",
+			url: func(ts *testServer, file models.FileMetadata) string {
+				return "http://" + ts.s3.Endpoint() + "/" + testBucket + "/" + file.ObjectName + "?X-Amz-Signature=abc"
+			},
+			found:      true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "unknown object",
+			url: func(ts *testServer, file models.FileMetadata) string {
+				return "http://" + ts.s3.Endpoint() + "/" + testBucket + "/missing.png"
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "other host",
+			url: func(ts *testServer, file models.FileMetadata) string {
+				return "http://cdn.example.com/" + testBucket + "/" + file.ObjectName
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "other bucket",
+			url: func(ts *testServer, file models.FileMetadata) string {
+				return "http://" + ts.s3.Endpoint() + "/private/" + file.ObjectName
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/resolve", ts.handler.ResolveURL)
+			file := testFile()
+			if tt.found {
+				mt.AddMockResponses(metadataReply(mt, file))
+			} else {
+				mt.AddMockResponses(metadataReply(mt))
+			}
+
+			target := "/resolve?" + url.Values{"url": {tt.url(ts, file)}}.Encode()
+			w := ts.do(http.MethodGet, target, nil, nil)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			switch tt.wantStatus {
+			case http.StatusOK:
+				var got models.FileMetadata
+				decodeJSON(mt, w, &got)
+				if got.ID != file.ID {
+					mt.Errorf("resolved file %q, want %q", got.ID, file.ID)
+				}
+				find := mt.GetStartedEvent()
+				if key := find.Command.Lookup("filter", "$or", "0", "object_name").StringValue(); key != file.ObjectName {
+					mt.Errorf("looked up object %q, want %q", key, file.ObjectName)
+				}
+			case http.StatusBadRequest:
+				if events := mt.GetAllStartedEvents(); len(events) != 0 {
+					mt.Errorf("foreign URL queried MongoDB: %d commands", len(events))
+				}
+			}
+		})
+	}
+}
+
+func TestHashPrefixedKeysRetrievable(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name       string
+		hashPrefix int
+		wantPrefix bool
+	}{
+		{"without hash prefix", 0, false},
+		{"with hash prefix", 2, true},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.HashPrefix = tt.hashPrefix
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+			content := testPNG(mt)
+
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+			body, contentType := multipartFile(mt, "photo.png", content, nil)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("upload status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			// The key is stored on the metadata, so reads do not recompute it
+			stored := insertedFile(mt)
+			prefix, rest, found := strings.Cut(stored.ObjectName, "/")
+			if found != tt.wantPrefix {
+				mt.Fatalf("object key %q has hash prefix %t, want %t", stored.ObjectName, found, tt.wantPrefix)
+			}
+			if found && (len(prefix) != tt.hashPrefix || rest != stored.ID+".png") {
+				mt.Errorf("object key %q, want <%d hex>/%s.png", stored.ObjectName, tt.hashPrefix, stored.ID)
+			}
+			mustGet(mt, ts.s3, stored.ObjectName)
+
+			mt.AddMockResponses(metadataReply(mt, stored), updateReply(1))
+			w = ts.do(http.MethodGet, "/files/"+stored.ID+"/content", nil, nil)
+			waitForCommand(mt, "update")
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+				mt.Errorf("download status %d with %d bytes, want 200 with the uploaded %d bytes", w.Code, w.Body.Len(), len(content))
+			}
+		})
+	}
+}
+
+func TestRawBodySize(t *testing.T) {
+	tests := []struct {
+		name             string
+		contentLength    int64
+		transferEncoding []string
+		want             int64
+	}{
+		{"declared length", 2048, nil, 2048},
+		{"unknown length", -1, nil, -1},
+		{"empty declaration", 0, nil, -1},
+		{"chunked", -1, []string{"chunked"}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/files/1/content", nil)
+			req.ContentLength, req.TransferEncoding = tt.contentLength, tt.transferEncoding
+			if got := rawBodySize(req); got != tt.want {
+				t.Errorf("rawBodySize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceContentStreamLength(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name          string
+		knownLength   bool
+		wantMultipart bool
+	}{
+		{"known length is sent as one sized upload", true, false},
+		{"unknown length is streamed in parts", false, true},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ThumbnailOnReplace = false
+			})
+			ts.router.PUT("/files/:id/content", ts.handler.ReplaceContent)
+			file := testFile()
+			content := testPNG(mt)
+			replaced := file
+			replaced.FileSize = int64(len(content))
+			mt.AddMockResponses(updateReply(1), metadataReply(mt, file), countReply(0), findAndModifyReply(mt, replaced), updateReply(1))
+
+			req := httptest.NewRequest(http.MethodPut, "/files/"+file.ID+"/content", bytes.NewReader(content))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			if !tt.knownLength {
+				req.ContentLength, req.TransferEncoding = -1, []string{"chunked"}
+			}
+			w := httptest.NewRecorder()
+			ts.router.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			newKey := replacedObjectName(mt)
+			multipart := false
+			for _, r := range ts.s3.Mutations() {
+				if r.Key == newKey && r.Query.Has("uploads") {
+					multipart = true
+				}
+			}
+			if multipart != tt.wantMultipart {
+				mt.Errorf("multipart upload = %t, want %t", multipart, tt.wantMultipart)
+			}
+			if !bytes.Equal(mustGet(mt, ts.s3, newKey).Data, content) {
+				mt.Error("stored content differs from the request body")
+			}
+			if size := findAndModifySet(mt).Lookup("file_size").Int64(); size != int64(len(content)) {
+				mt.Errorf("stored size %d, want %d", size, len(content))
+			}
+		})
+	}
+}
+
+// findAndModifySet returns the $set document of the last findAndModify command
+func findAndModifySet(mt *mtest.T) bson.Raw {
+	var set bson.Raw
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == "findAndModify" {
+			set = event.Command.Lookup("update", "$set").Document()
+		}
+	}
+	if set == nil {
+		mt.Fatal("no findAndModify command was sent")
+	}
+	return set
+}
+
+// replacedObjectName returns the object key the last findAndModify switched the file to
+func replacedObjectName(mt *mtest.T) string {
+	name, ok := findAndModifySet(mt).Lookup("object_name").StringValueOK()
+	if !ok {
+		mt.Fatal("findAndModify did not set object_name")
+	}
+	return name
+}
+
+func TestCreateUploadPolicy(t *testing.T) {
+	mt := mongoMock(t)
+	const maxSize = 5 << 20
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"allowed file", `{"filename": "photo.png", "content_type": "image/png"}`, http.StatusOK},
+		{"disallowed extension", `{"filename": "script.php", "content_type": "image/png"}`, http.StatusBadRequest},
+		{"disallowed content type", `{"filename": "photo.png", "content_type": "text/html"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.MaxUploadSize = maxSize
+			})
+			ts.router.POST("/upload/post-policy", ts.handler.CreateUploadPolicy)
+
+			w := ts.do(http.MethodPost, "/upload/post-policy", strings.NewReader(tt.body), map[string]string{"Content-Type": "application/json"})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var policy service.UploadPolicy
+			decodeJSON(mt, w, &policy)
+			if key := policy.Fields["key"]; key != policy.FileID+".png" {
+				mt.Errorf("form key %q, want %s.png", key, policy.FileID)
+			}
+
+			// The signed policy document carries the constraints Minio enforces
+			raw, err := base64.StdEncoding.DecodeString(policy.Fields["policy"])
+			if err != nil {
+				mt.Fatalf("policy is not base64: %v", err)
+			}
+			var document struct {
+				Conditions []json.RawMessage `json:"conditions"`
+			}
+			if err := json.Unmarshal(raw, &document); err != nil {
+				mt.Fatalf("decode policy %s: %v", raw, err)
+			}
+			conditions := make(map[string]string)
+			for _, condition := range document.Conditions {
+				var values []any
+				decoder := json.NewDecoder(bytes.NewReader(condition))
+				decoder.UseNumber()
+				if decoder.Decode(&values) == nil && len(values) == 3 {
+					conditions[fmt.Sprint(values[0], " ", values[1])] = fmt.Sprint(values[2])
+				}
+			}
+			want := map[string]string{
+				"content-length-range 1": fmt.Sprint(maxSize),
+				"starts-with $key":       policy.FileID,
+				"eq $Content-Type":       "image/png",
+			}
+			for condition, value := range want {
+				if conditions[condition] != value {
+					mt.Errorf("policy condition %q = %q, want %q (policy %s)", condition, conditions[condition], value, raw)
+				}
+			}
+		})
+	}
+}
+
+func TestReplaceContentSizeMismatch(t *testing.T) {
+	mt := mongoMock(t)
+	old := []byte("previous content")
+
+	tests := []struct {
+		name          string
+		declaredExtra int64 // declared Content-Length minus the bytes sent
+		tolerance     int64
+		wantStatus    int
+	}{
+		{"matching length", 0, 0, http.StatusOK},
+		{"shorter than declared", 10, 0, http.StatusBadRequest},
+		{"shorter beyond the tolerance", 10, 4, http.StatusBadRequest},
+		{"shorter within the tolerance", 4, 4, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ThumbnailOnReplace = false
+				cfg.SizeMismatchTolerance = tt.tolerance
+			})
+			ts.router.PUT("/files/:id/content", ts.handler.ReplaceContent)
+			file := testFile()
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: old, ContentType: file.ContentType})
+			content := testPNG(mt)
+			replaced := file
+			replaced.FileSize = int64(len(content))
+			mt.AddMockResponses(updateReply(1), metadataReply(mt, file), countReply(0), findAndModifyReply(mt, replaced), updateReply(1))
+
+			req := httptest.NewRequest(http.MethodPut, "/files/"+file.ID+"/content", bytes.NewReader(content))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.ContentLength = int64(len(content)) + tt.declaredExtra
+			w := httptest.NewRecorder()
+			ts.router.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			if tt.wantStatus == http.StatusOK {
+				if !bytes.Equal(mustGet(mt, ts.s3, replacedObjectName(mt)).Data, content) {
+					mt.Error("stored content differs from the request body")
+				}
+				return
+			}
+
+			var resp ErrorResponse
+			decodeJSON(mt, w, &resp)
+			if resp.Code != "SIZE_MISMATCH" {
+				mt.Errorf("error code %q, want SIZE_MISMATCH", resp.Code)
+			}
+			// A truncated body must not replace the content or its metadata
+			if stored := mustGet(mt, ts.s3, file.ObjectName).Data; !bytes.Equal(stored, old) {
+				mt.Errorf("stored content %q, want the previous content", stored)
+			}
+			if keys := ts.s3.Keys(testBucket); len(keys) != 1 {
+				mt.Errorf("stored objects %v, want only the previous one", keys)
+			}
+			if uploads := ts.s3.Uploads(); len(uploads) != 0 {
+				mt.Errorf("incomplete uploads left: %v", uploads)
+			}
+			if writes := mongoWrites(mt); slices.Contains(writes, "findAndModify") {
+				mt.Errorf("metadata was updated: %v", writes)
+			}
+		})
+	}
+}
+
+func TestReplaceContentCorruptionKeepsPrevious(t *testing.T) {
+	mt := mongoMock(t)
+	old := []byte("previous content")
+
+	mt.Run("corrupted upload", func(mt *mtest.T) {
+		ts := newTestServer(mt, func(cfg *config.Config) {
+			cfg.ThumbnailOnReplace = false
+			cfg.ChecksumAlgorithm = repository.ChecksumSHA256
+		})
+		ts.router.PUT("/files/:id/content", ts.handler.ReplaceContent)
+		file := testFile()
+		ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: old, ContentType: file.ContentType})
+		// The storage saves and confirms other bytes than it received
+		ts.s3.CorruptPuts(1)
+		mt.AddMockResponses(updateReply(1), metadataReply(mt, file), countReply(0), updateReply(1))
+
+		w := ts.do(http.MethodPut, "/files/"+file.ID+"/content", bytes.NewReader(testPNG(mt)), map[string]string{"Content-Type": "application/octet-stream"})
+		if w.Code != http.StatusInternalServerError {
+			mt.Fatalf("status %d, want 500: %s", w.Code, w.Body)
+		}
+		var resp ErrorResponse
+		decodeJSON(mt, w, &resp)
+		if resp.Code != "CORRUPTION" {
+			mt.Errorf("error code %q, want CORRUPTION", resp.Code)
+		}
+
+		// The previous content stays readable and the corrupted copy is removed
+		if stored := mustGet(mt, ts.s3, file.ObjectName).Data; !bytes.Equal(stored, old) {
+			mt.Errorf("stored content %q, want the previous content", stored)
+		}
+		if keys := ts.s3.Keys(testBucket); len(keys) != 1 {
+			mt.Errorf("stored objects %v, want only the previous one", keys)
+		}
+		if writes := mongoWrites(mt); slices.Contains(writes, "findAndModify") {
+			mt.Errorf("metadata was updated: %v", writes)
+		}
+	})
+}
+
+func TestUploadContentTypeFallback(t *testing.T) {
+	mt := mongoMock(t)
+	// Bytes the sniffer cannot identify
+	unknown := bytes.Repeat([]byte{0x00, 0x01, 0x02, 0x03}, 64)
+
+	tests := []struct {
+		name            string
+		filename        string
+		content         []byte
+		fallbacks       map[string]string
+		wantContentType string // empty when rejected
+	}{
+		{"octet-stream sniff on an extension with a fallback", "clip.mov", unknown, map[string]string{".mov": "video/quicktime"}, "video/quicktime"},
+		{"fallback matched after normalization", "clip.MOV", unknown, map[string]string{".mov": "video/quicktime"}, "video/quicktime"},
+		{"octet-stream sniff without a fallback", "clip.mov", unknown, map[string]string{}, ""},
+		{"fallback of another extension", "photo.png", unknown, map[string]string{".mov": "video/quicktime"}, ""},
+		{"recognized sniff takes precedence", "clip.mov", testPNG(mt), map[string]string{".mov": "video/quicktime"}, "image/png"},
+		{"fallback outside the content type allowlist", "clip.mov", unknown, map[string]string{".mov": "text/html"}, ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.AllowedExtensions = []string{".png", ".mov"}
+				cfg.AllowedMIMETypes = []string{"image/png", "video/quicktime"}
+				cfg.ContentTypeFallbacks = tt.fallbacks
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+			body, contentType := multipartFile(mt, tt.filename, tt.content, nil)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+
+			if tt.wantContentType == "" {
+				if w.Code != http.StatusBadRequest {
+					mt.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+				}
+				if writes, mutations := mongoWrites(mt), ts.s3.Mutations(); len(writes) > 0 || len(mutations) > 0 {
+					mt.Errorf("rejected upload wrote %v to MongoDB and made %d S3 requests", writes, len(mutations))
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			stored := insertedFile(mt)
+			if stored.ContentType != tt.wantContentType {
+				mt.Errorf("stored content type %q, want %q", stored.ContentType, tt.wantContentType)
+			}
+			if object := mustGet(mt, ts.s3, stored.ObjectName); object.ContentType != tt.wantContentType {
+				mt.Errorf("object content type %q, want %q", object.ContentType, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestReplaceContentTypeFallback(t *testing.T) {
+	mt := mongoMock(t)
+	// Bytes the sniffer cannot identify
+	unknown := bytes.Repeat([]byte{0x00, 0x01, 0x02, 0x03}, 64)
+
+	tests := []struct {
+		name            string
+		fallbacks       map[string]string
+		wantContentType string // empty when rejected
+	}{
+		{"raw body of a file with a fallback extension", map[string]string{".mov": "video/quicktime"}, "video/quicktime"},
+		{"raw body without a fallback", map[string]string{}, ""},
+		{"fallback of another extension", map[string]string{".mp4": "video/quicktime"}, ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.AllowedExtensions = []string{".png", ".mov"}
+				cfg.AllowedMIMETypes = []string{"image/png", "video/quicktime"}
+				cfg.ContentTypeFallbacks = tt.fallbacks
+				cfg.ThumbnailOnReplace = false
+			})
+			ts.router.PUT("/files/:id/content", ts.handler.ReplaceContent)
+			file := testFile()
+			file.OriginalName, file.ContentType, file.ObjectName = "clip", "video/quicktime", file.ID+".mov"
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("old content")})
+
+			// The raw body carries no filename: the extension comes from the stored file
+			replaced := file
+			replaced.FileSize = int64(len(unknown))
+			mt.AddMockResponses(
+				metadataReply(mt, file), // extension lookup
+				updateReply(1),          // lock
+				metadataReply(mt, file), // current metadata
+				countReply(0),           // the object is not shared
+				findAndModifyReply(mt, replaced),
+				updateReply(1), // unlock
+			)
+
+			w := ts.do(http.MethodPut, "/files/"+file.ID+"/content", bytes.NewReader(unknown), map[string]string{"Content-Type": "application/octet-stream"})
+
+			if tt.wantContentType == "" {
+				if w.Code != http.StatusBadRequest {
+					mt.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+				}
+				if writes, mutations := mongoWrites(mt), ts.s3.Mutations(); len(writes) > 0 || len(mutations) > 0 {
+					mt.Errorf("rejected replace wrote %v to MongoDB and made %d S3 requests", writes, len(mutations))
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			if got := findAndModifySet(mt).Lookup("content_type").StringValue(); got != tt.wantContentType {
+				mt.Errorf("stored content type %q, want %q", got, tt.wantContentType)
+			}
+			if object := mustGet(mt, ts.s3, replacedObjectName(mt)); object.ContentType != tt.wantContentType {
+				mt.Errorf("object content type %q, want %q", object.ContentType, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	mt := mongoMock(t)
+	content := bytes.Repeat([]byte("exported content\n"), 100)
+
+	// sink is a mock presigned PUT destination recording what it receives
+	type sink struct {
+		requests int
+		method   string
+		body     []byte
+		header   http.Header
+	}
+	newSink := func(mt *mtest.T, status int, redirect string) (*sink, *httptest.Server) {
+		s := &sink{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.requests++
+			s.method, s.header = r.Method, r.Header
+			s.body, _ = io.ReadAll(r.Body)
+			if redirect != "" {
+				http.Redirect(w, r, redirect, http.StatusTemporaryRedirect)
+				return
+			}
+			w.WriteHeader(status)
+		}))
+		mt.Cleanup(server.Close)
+		return s, server
+	}
+
+	tests := []struct {
+		name         string
+		compressed   bool
+		allowedHosts []string
+		sinkStatus   int
+		redirect     bool
+		destination  string // overrides the sink URL
+		wantStatus   int
+	}{
+		{"streamed to the destination", false, []string{"127.0.0.1"}, http.StatusOK, false, "", http.StatusOK},
+		{"compressed object is exported decompressed", true, []string{"127.0.0.1"}, http.StatusOK, false, "", http.StatusOK},
+		{"host not allowed", false, []string{"storage.example.com"}, http.StatusOK, false, "", http.StatusForbidden},
+		{"unsupported scheme", false, []string{"127.0.0.1"}, http.StatusOK, false, "file:///etc/passwd", http.StatusForbidden},
+		{"destination rejects the upload", false, []string{"127.0.0.1"}, http.StatusForbidden, false, "", http.StatusBadGateway},
+		{"redirects are not followed", false, []string{"127.0.0.1"}, http.StatusOK, true, "", http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.CopyToAllowedHosts = tt.allowedHosts
+			})
+			ts.router.POST("/files/:id/copy-to", ts.handler.CopyTo)
+
+			file := testFile()
+			file.FileSize = int64(len(content))
+			object := repotest.Object{Data: content, ContentType: file.ContentType}
+			if tt.compressed {
+				var gz bytes.Buffer
+				w := gzip.NewWriter(&gz)
+				w.Write(content)
+				w.Close()
+				file.ContentEncoding = "gzip"
+				object.Data, object.ContentEncoding = gz.Bytes(), "gzip"
+			}
+			ts.s3.Put(testBucket, file.ObjectName, object)
+			mt.AddMockResponses(metadataReply(mt, file))
+
+			internal, internalServer := newSink(mt, http.StatusOK, "")
+			redirect := ""
+			if tt.redirect {
+				redirect = internalServer.URL + "/internal"
+			}
+			destination, server := newSink(mt, tt.sinkStatus, redirect)
+			target := tt.destination
+			if target == "" {
+				target = server.URL + "/bucket/export.png?X-Amz-Signature=abc"
+			}
+
+			body, _ := json.Marshal(CopyToRequest{PresignedPutURL: target})
+			w := ts.do(http.MethodPost, "/files/"+file.ID+"/copy-to", bytes.NewReader(body), map[string]string{"Content-Type": "application/json"})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if internal.requests != 0 {
+				mt.Error("redirect to an internal address was followed")
+			}
+
+			switch tt.wantStatus {
+			case http.StatusForbidden:
+				if destination.requests != 0 {
+					mt.Errorf("disallowed destination received %d requests", destination.requests)
+				}
+				return
+			case http.StatusBadGateway:
+				if destination.requests != 1 {
+					mt.Errorf("destination received %d requests, want 1", destination.requests)
+				}
+				return
+			}
+
+			var result service.CopyResult
+			decodeJSON(mt, w, &result)
+			if result.FileID != file.ID || result.Bytes != int64(len(content)) {
+				mt.Errorf("result %+v, want %d bytes of %s", result, len(content), file.ID)
+			}
+			if destination.method != http.MethodPut || !bytes.Equal(destination.body, content) {
+				mt.Errorf("destination received %s with %d bytes, want PUT with the original content", destination.method, len(destination.body))
+			}
+			if got := destination.header.Get("Content-Type"); got != file.ContentType {
+				mt.Errorf("destination Content-Type %q, want %q", got, file.ContentType)
+			}
+		})
+	}
+}
+
+func TestFormFileError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// The error multipart parsing returns when spooling a part to a full temp disk
+	diskFull := fmt.Errorf("multipart: %w", &fs.PathError{Op: "write", Path: os.TempDir() + "/multipart-1", Err: syscall.ENOSPC})
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"temp disk full", diskFull, http.StatusInsufficientStorage, "STORAGE_FULL"},
+		{"other temp file error", &fs.PathError{Op: "write", Path: "/tmp/multipart-1", Err: syscall.EIO}, http.StatusBadRequest, ""},
+		{"truncated body", io.ErrUnexpectedEOF, http.StatusBadRequest, "INCOMPLETE_UPLOAD"},
+		{"missing file field", http.ErrMissingFile, http.StatusBadRequest, ""},
+		{"form fields too large", errFormFieldsTooLarge, http.StatusBadRequest, "FORM_FIELDS_TOO_LARGE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			formFileError(c, tt.err)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var resp ErrorResponse
+			decodeJSON(t, w, &resp)
+			if resp.Code != tt.wantCode {
+				t.Errorf("error code %q, want %q", resp.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestUploadFormFieldsLimit(t *testing.T) {
+	mt := mongoMock(t)
+	const limit = 256
+
+	manyFields := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		manyFields[fmt.Sprintf("field%02d", i)] = "value"
+	}
+
+	tests := []struct {
+		name       string
+		fields     map[string]string
+		wantStatus int
+	}{
+		{"no fields", nil, http.StatusOK},
+		{"small description", map[string]string{"description": "holiday photo"}, http.StatusOK},
+		{"fields at the limit", map[string]string{"description": strings.Repeat("a", limit-len("description"))}, http.StatusOK},
+		{"oversized description", map[string]string{"description": strings.Repeat("a", limit)}, http.StatusBadRequest},
+		{"many small fields", manyFields, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.MaxFormFieldsSize = limit
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+			body, contentType := multipartFile(mt, "photo.png", testPNG(mt), tt.fields)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+
+			var resp ErrorResponse
+			decodeJSON(mt, w, &resp)
+			if resp.Code != "FORM_FIELDS_TOO_LARGE" {
+				mt.Errorf("error code %q, want FORM_FIELDS_TOO_LARGE", resp.Code)
+			}
+			// The form is rejected before the file is processed
+			if writes, mutations := mongoWrites(mt), ts.s3.Mutations(); len(writes) > 0 || len(mutations) > 0 {
+				mt.Errorf("rejected upload wrote %v to MongoDB and made %d S3 requests", writes, len(mutations))
+			}
+		})
+	}
+}
+
+func TestReplaceFileNewKey(t *testing.T) {
+	mt := mongoMock(t)
+	old := []byte("old content")
+
+	tests := []struct {
+		name          string
+		newKey        bool
+		metadataFails bool
+		wantStatus    int
+	}{
+		{"same key by default", false, false, http.StatusOK},
+		{"new key when enabled", true, false, http.StatusOK},
+		{"old object kept when the metadata update fails", true, true, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ThumbnailOnReplace = false
+				cfg.ReplaceNewKey = tt.newKey
+			})
+			ts.router.PUT("/files/:id", ts.handler.ReplaceFile)
+			file := testFile()
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: old})
+
+			update := findAndModifyReply(mt, file)
+			if tt.metadataFails {
+				update = mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil})
+			}
+			mt.AddMockResponses(updateReply(1), metadataReply(mt, file), countReply(0), update, updateReply(1))
+
+			content := testPNG(mt)
+			body, contentType := multipartFile(mt, "photo.png", content, nil)
+			w := ts.do(http.MethodPut, "/files/"+file.ID, body, map[string]string{"Content-Type": contentType})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			newKey := findAndModifySet(mt).Lookup("object_name").StringValue()
+			if changed := newKey != file.ObjectName; changed != tt.newKey {
+				mt.Errorf("replaced under %q (old %q), want key changed = %t", newKey, file.ObjectName, tt.newKey)
+			}
+			if tt.newKey && (!strings.HasPrefix(newKey, file.ID+"-") || !strings.HasSuffix(newKey, ".png")) {
+				mt.Errorf("new key %q does not keep the file ID and extension", newKey)
+			}
+
+			if tt.metadataFails {
+				// The metadata still points to the old object, which must survive
+				if keys := ts.s3.Keys(testBucket); len(keys) != 1 || keys[0] != file.ObjectName {
+					mt.Errorf("stored keys = %v, want only the old object %s", keys, file.ObjectName)
+				}
+				if !bytes.Equal(mustGet(mt, ts.s3, file.ObjectName).Data, old) {
+					mt.Error("old object was overwritten")
+				}
+				return
+			}
+
+			if keys := ts.s3.Keys(testBucket); len(keys) != 1 || keys[0] != newKey {
+				mt.Errorf("stored keys = %v, want only the new object %s", keys, newKey)
+			}
+			if !bytes.Equal(mustGet(mt, ts.s3, newKey).Data, content) {
+				mt.Error("new object content differs from the upload")
+			}
+			if tt.newKey {
+				// The old object is deleted only after the new one is stored
+				mutations := ts.s3.Mutations()
+				if last := mutations[len(mutations)-1]; last.Method != http.MethodDelete || last.Key != file.ObjectName {
+					mt.Errorf("last S3 request %s %s, want DELETE of the old object", last.Method, last.Key)
+				}
+			}
+		})
+	}
+}
+
+func TestGetFileBundle(t *testing.T) {
+	mt := mongoMock(t)
+	thumbnail := []byte("\xff\xd8\xff thumbnail bytes")
+
+	tests := []struct {
+		name          string
+		status        string
+		storeThumb    bool
+		wantThumbnail bool
+	}{
+		{"ready thumbnail", models.ThumbnailReady, true, true},
+		{"thumbnail pending", models.ThumbnailPending, false, false},
+		{"thumbnail object missing", models.ThumbnailReady, false, false},
+		{"no thumbnail", "", false, false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/:id/bundle", ts.handler.GetFileBundle)
+			file := testFile()
+			file.ThumbnailStatus = tt.status
+			if tt.storeThumb {
+				ts.s3.Put(testBucket, "thumbnails/"+file.ID+".jpg", repotest.Object{Data: thumbnail, ContentType: "image/jpeg"})
+			}
+			mt.AddMockResponses(metadataReply(mt, file))
+
+			w := ts.do(http.MethodGet, "/files/"+file.ID+"/bundle", nil, nil)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+			mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+			if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+				mt.Fatalf("Content-Type %q, want multipart/mixed with a boundary", w.Header().Get("Content-Type"))
+			}
+
+			type part struct {
+				name, contentType string
+				body              []byte
+			}
+			var parts []part
+			reader := multipart.NewReader(w.Body, params["boundary"])
+			for {
+				p, err := reader.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					mt.Fatalf("read part %d: %v", len(parts), err)
+				}
+				body, err := io.ReadAll(p)
+				if err != nil {
+					mt.Fatal(err)
+				}
+				// FormName only reads form-data dispositions
+				_, disposition, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+				parts = append(parts, part{disposition["name"], p.Header.Get("Content-Type"), body})
+			}
+
+			wantParts := 1
+			if tt.wantThumbnail {
+				wantParts = 2
+			}
+			if len(parts) != wantParts {
+				mt.Fatalf("got %d parts, want %d", len(parts), wantParts)
+			}
+
+			if parts[0].name != "metadata" || parts[0].contentType != "application/json" {
+				mt.Errorf("first part %q (%s), want metadata (application/json)", parts[0].name, parts[0].contentType)
+			}
+			var metadata models.FileMetadata
+			if err := json.Unmarshal(parts[0].body, &metadata); err != nil {
+				mt.Fatalf("decode metadata part: %v", err)
+			}
+			if metadata.ID != file.ID || metadata.FileSize != file.FileSize {
+				mt.Errorf("metadata part %+v, want file %s", metadata, file.ID)
+			}
+
+			if tt.wantThumbnail {
+				if parts[1].name != "thumbnail" || parts[1].contentType != "image/jpeg" {
+					mt.Errorf("second part %q (%s), want thumbnail (image/jpeg)", parts[1].name, parts[1].contentType)
+				}
+				if !bytes.Equal(parts[1].body, thumbnail) {
+					mt.Error("thumbnail part differs from the stored thumbnail")
+				}
+			}
+		})
+	}
+}
+
+func TestThumbnailsFeatureFlag(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		wantStatus string
+	}{
+		{"enabled", true, models.ThumbnailPending},
+		{"disabled", false, ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.Features.Thumbnails = tt.enabled
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			mt.AddMockResponses(mtest.CreateSuccessResponse(), updateReply(1))
+
+			body, contentType := multipartFile(mt, "photo.png", testPNG(mt), nil)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			stored := insertedFile(mt)
+			if stored.ThumbnailStatus != tt.wantStatus {
+				mt.Errorf("thumbnail status %q, want %q", stored.ThumbnailStatus, tt.wantStatus)
+			}
+			thumbnailKey := "thumbnails/" + stored.ID + ".jpg"
+
+			if tt.enabled {
+				waitForCommand(mt, "update")
+				if _, ok := ts.s3.Get(testBucket, thumbnailKey); !ok {
+					mt.Error("thumbnail was not generated")
+				}
+				return
+			}
+
+			// Give a background job the chance to run before asserting it did not
+			ts.service.Close()
+			if _, ok := ts.s3.Get(testBucket, thumbnailKey); ok {
+				mt.Error("thumbnail was generated with the feature disabled")
+			}
+			if writes := mongoWrites(mt); len(writes) != 1 {
+				mt.Errorf("mongo writes %v, want only the insert", writes)
+			}
+		})
+	}
+}
+
+func TestThumbnailBucket(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name        string
+		thumbBucket string // MINIO_THUMB_BUCKET, empty keeps thumbnails with the originals
+		legacy      bool   // thumbnail built before the bucket was configured
+		wantBucket  string
+	}{
+		{"separate bucket", testThumbBucket, false, testThumbBucket},
+		{"originals bucket", "", false, testBucket},
+		{"built before the bucket was configured", testThumbBucket, true, testBucket},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			if tt.thumbBucket != "" {
+				ts.service.SetThumbnailRepository(ts.s3.Repository(mt, tt.thumbBucket))
+			}
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			ts.router.GET("/files/:id/thumbnail", ts.handler.GetThumbnail)
+
+			file := testFile()
+			thumbnailKey := "thumbnails/" + file.ID + ".jpg"
+			if tt.legacy {
+				ts.s3.Put(testBucket, thumbnailKey, repotest.Object{Data: []byte("\xff\xd8\xff legacy"), ContentType: "image/jpeg"})
+			} else {
+				mt.AddMockResponses(mtest.CreateSuccessResponse(), updateReply(1))
+				body, contentType := multipartFile(mt, "photo.png", testPNG(mt), nil)
+				w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+				if w.Code != http.StatusOK {
+					mt.Fatalf("upload status %d, want 200: %s", w.Code, w.Body)
+				}
+				file.ID = insertedFile(mt).ID
+				thumbnailKey = "thumbnails/" + file.ID + ".jpg"
+
+				update := waitForCommands(mt, "update", 1)[0].Lookup("updates").Array().Index(0).Value().Document()
+				if bucket := update.Lookup("u", "$set", "thumbnail_bucket").StringValue(); bucket != tt.wantBucket {
+					mt.Errorf("recorded thumbnail bucket %q, want %q", bucket, tt.wantBucket)
+				}
+				file.ThumbnailBucket = tt.wantBucket
+			}
+
+			stored, ok := ts.s3.Get(tt.wantBucket, thumbnailKey)
+			if !ok {
+				mt.Fatalf("thumbnail is not in bucket %q", tt.wantBucket)
+			}
+			if tt.wantBucket != testBucket {
+				if _, ok := ts.s3.Get(testBucket, thumbnailKey); ok {
+					mt.Error("thumbnail was also stored with the originals")
+				}
+			}
+
+			// The thumbnail endpoint reads from the bucket recorded in the metadata
+			file.ThumbnailStatus = models.ThumbnailReady
+			mt.AddMockResponses(metadataReply(mt, file))
+			w := ts.do(http.MethodGet, "/files/"+file.ID+"/thumbnail", nil, nil)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("thumbnail status %d, want 200: %s", w.Code, w.Body)
+			}
+			if !bytes.Equal(w.Body.Bytes(), stored.Data) {
+				mt.Error("served thumbnail differs from the stored one")
+			}
+		})
+	}
+}
+
+func TestBindJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type renameRequest struct {
+		Name string   `json:"name" binding:"required"`
+		Tags []string `json:"tags"`
+	}
+
+	tests := []struct {
+		name        string
+		strict      bool
+		body        string
+		wantStatus  int
+		wantMessage string
+	}{
+		{"valid body", true, `{"name":"photo.png","tags":["beach"]}`, http.StatusOK, ""},
+		{"unknown field", true, `{"name":"photo.png","nmae":"typo"}`, http.StatusBadRequest, `Unknown field "nmae"`},
+		{"unknown field when not strict", false, `{"name":"photo.png","nmae":"typo"}`, http.StatusOK, ""},
+		{"missing required field", true, `{"tags":[]}`, http.StatusBadRequest, `Field "name" failed "required" validation`},
+		{"wrong type", true, `{"name":"photo.png","tags":"beach"}`, http.StatusBadRequest, `Field "tags" must be of type []string`},
+		{"malformed JSON", true, `{"name":`, http.StatusBadRequest, "Malformed JSON"},
+		{"empty body", true, ``, http.StatusBadRequest, "Request body is empty"},
+	}
+
+	strict := binding.EnableDecoderDisallowUnknownFields
+	t.Cleanup(func() { binding.EnableDecoderDisallowUnknownFields = strict })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			binding.EnableDecoderDisallowUnknownFields = tt.strict
+
+			router := gin.New()
+			router.POST("/rename", func(c *gin.Context) {
+				var req renameRequest
+				if !bindJSON(c, &req) {
+					return
+				}
+				c.JSON(http.StatusOK, req)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/rename", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+			var resp ErrorResponse
+			decodeJSON(t, w, &resp)
+			if resp.Error != tt.wantMessage || resp.Code != "INVALID_BODY" {
+				t.Errorf("error %+v, want %q with INVALID_BODY", resp, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestAccessExpiry(t *testing.T) {
+	mt := mongoMock(t)
+	past := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+
+	tests := []struct {
+		name            string
+		path            string
+		accessibleUntil *time.Time
+		wantStatus      int
+	}{
+		{"metadata before the date", "", &future, http.StatusOK},
+		{"metadata past the date", "", &past, http.StatusGone},
+		{"download before the date", "/content", &future, http.StatusOK},
+		{"download past the date", "/content", &past, http.StatusGone},
+		{"download without a date", "/content", nil, http.StatusOK},
+		{"presign before the date", "/presign", &future, http.StatusOK},
+		{"presign past the date", "/presign", &past, http.StatusGone},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/:id", ts.handler.GetFileMetadata)
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+			ts.router.GET("/files/:id/presign", ts.handler.PresignFile)
+			file := testFile()
+			file.AccessibleUntil = tt.accessibleUntil
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: make([]byte, file.FileSize), ContentType: file.ContentType})
+
+			mt.AddMockResponses(metadataReply(mt, file), updateReply(1))
+			w := ts.do(http.MethodGet, "/files/"+file.ID+tt.path, nil, nil)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if tt.path == "/content" {
+					waitForCommand(mt, "update")
+				}
+				return
+			}
+
+			var resp ErrorResponse
+			decodeJSON(mt, w, &resp)
+			if resp.Code != "ACCESS_EXPIRED" {
+				mt.Errorf("code %q, want ACCESS_EXPIRED", resp.Code)
+			}
+			// The file stays stored, only reads are blocked
+			if _, ok := ts.s3.Get(testBucket, file.ObjectName); !ok {
+				mt.Error("object was removed")
+			}
+			if mutations := ts.s3.Mutations(); len(mutations) != 0 {
+				mt.Errorf("S3 mutations %v, want none", mutations)
+			}
+			if reads := ts.s3.Requests(http.MethodGet); len(reads) != 0 {
+				mt.Errorf("object was read %d times", len(reads))
+			}
+			if writes := mongoWrites(mt); len(writes) != 0 {
+				mt.Errorf("mongo writes %v, want none", writes)
+			}
+		})
+	}
+}
+
+func TestXMLNegotiation(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		accept  string
+		wantXML bool
+	}{
+		{"metadata as XML", "/files/%s", "application/xml", true},
+		{"metadata as text/xml", "/files/%s", "text/xml", true},
+		{"metadata as JSON", "/files/%s", "application/json", false},
+		{"metadata without Accept", "/files/%s", "", false},
+		{"JSON preferred", "/files/%s", "application/xml;q=0.5, application/json", false},
+		{"XML preferred", "/files/%s", "application/json;q=0.5, application/xml", true},
+		{"XML over a wildcard", "/files/%s", "application/xml, */*;q=0.1", true},
+		{"wildcard", "/files/%s", "*/*", false},
+		{"list as XML", "/files", "application/xml", true},
+		{"list as JSON", "/files", "", false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files", ts.handler.ListFiles)
+			ts.router.GET("/files/:id", ts.handler.GetFileMetadata)
+			file := testFile()
+			file.Tags = []string{"beach", "sun"}
+			mt.AddMockResponses(metadataReply(mt, file), countReply(1))
+
+			path := tt.path
+			if strings.Contains(path, "%s") {
+				path = fmt.Sprintf(path, file.ID)
+			}
+			header := map[string]string{}
+			if tt.accept != "" {
+				header["Accept"] = tt.accept
+			}
+			w := ts.do(http.MethodGet, path, nil, header)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			contentType := w.Header().Get("Content-Type")
+			if !tt.wantXML {
+				if !strings.HasPrefix(contentType, "application/json") {
+					mt.Fatalf("Content-Type %q, want JSON", contentType)
+				}
+				return
+			}
+			if !strings.HasPrefix(contentType, "application/xml") {
+				mt.Fatalf("Content-Type %q, want XML", contentType)
+			}
+
+			var got models.FileMetadata
+			if tt.path == "/files" {
+				var list FileListResponse
+				if err := xml.Unmarshal(w.Body.Bytes(), &list); err != nil {
+					mt.Fatalf("invalid XML %q: %v", w.Body, err)
+				}
+				if list.XMLName.Local != "FileList" || list.Total != 1 || len(list.Items) != 1 {
+					mt.Fatalf("list %+v, want FileList with the file", list)
+				}
+				got = list.Items[0]
+			} else if err := xml.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				mt.Fatalf("invalid XML %q: %v", w.Body, err)
+			}
+			if got.ID != file.ID || got.OriginalName != file.OriginalName || got.FileSize != file.FileSize ||
+				!got.UploadDate.Equal(file.UploadDate) || !slices.Equal(got.Tags, file.Tags) {
+				mt.Errorf("decoded %+v, want %+v", got, file)
+			}
+		})
+	}
+}
+
+func TestWriteConcernTimeout(t *testing.T) {
+	mt := mongoMock(t)
+	wtimeout := mtest.CreateWriteConcernErrorResponse(mtest.WriteConcernError{
+		Code:    64,
+		Name:    "WriteConcernFailed",
+		Message: "waiting for replication timed out",
+	})
+	duplicate := mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "duplicate key"})
+
+	tests := []struct {
+		name       string
+		replace    bool
+		reply      bson.D
+		wantStatus int
+	}{
+		{"upload not acknowledged", false, wtimeout, http.StatusServiceUnavailable},
+		{"upload rejected", false, duplicate, http.StatusInternalServerError},
+		{"replace not acknowledged", true, wtimeout, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ThumbnailOnReplace = false
+				cfg.ReplaceNewKey = true
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			ts.router.PUT("/files/:id", ts.handler.ReplaceFile)
+
+			file := testFile()
+			target := "/upload"
+			if tt.replace {
+				ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("old content")})
+				mt.AddMockResponses(updateReply(1), metadataReply(mt, file), countReply(0), tt.reply, updateReply(1))
+				target = "/files/" + file.ID
+			} else {
+				mt.AddMockResponses(tt.reply, deleteReply(1))
+			}
+
+			body, contentType := multipartFile(mt, "photo.png", testPNG(mt), nil)
+			method := http.MethodPost
+			if tt.replace {
+				method = http.MethodPut
+			}
+			w := ts.do(method, target, body, map[string]string{"Content-Type": contentType})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			// The uploaded object is rolled back, only the old one of a replace remains
+			var wantKeys []string
+			if tt.replace {
+				wantKeys = []string{file.ObjectName}
+			}
+			if keys := ts.s3.Keys(testBucket); !slices.Equal(keys, wantKeys) {
+				mt.Errorf("stored keys %v, want %v", keys, wantKeys)
+			}
+
+			if tt.wantStatus != http.StatusServiceUnavailable {
+				if slices.Contains(mongoWrites(mt), "delete") {
+					mt.Error("rejected insert was rolled back in MongoDB")
+				}
+				return
+			}
+			var resp ErrorResponse
+			decodeJSON(mt, w, &resp)
+			if resp.Code != "METADATA_UNAVAILABLE" || w.Header().Get("Retry-After") == "" {
+				mt.Errorf("code %q, Retry-After %q, want METADATA_UNAVAILABLE with a retry hint", resp.Code, w.Header().Get("Retry-After"))
+			}
+			// An unacknowledged insert may still have been applied
+			if !tt.replace && !slices.Contains(mongoWrites(mt), "delete") {
+				mt.Error("unacknowledged insert was not rolled back in MongoDB")
+			}
+		})
+	}
+}
+
+func TestGetFileEvents(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name       string
+		status     string // thumbnail status when the stream opens
+		storeImage bool   // the original is available to build the thumbnail from
+		want       []string
+	}{
+		{"job completes", models.ThumbnailPending, true, []string{models.ThumbnailPending, models.ThumbnailReady}},
+		{"job fails", models.ThumbnailPending, false, []string{models.ThumbnailPending, models.ThumbnailFailed}},
+		{"already final", models.ThumbnailReady, false, []string{models.ThumbnailReady}},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/:id/events", ts.handler.GetFileEvents)
+			ts.router.POST("/files/:id/thumbnail/regenerate", ts.handler.RegenerateThumbnail)
+			server := httptest.NewServer(ts.router)
+			defer server.Close()
+
+			file := testFile()
+			if tt.storeImage {
+				ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: testPNG(mt), ContentType: "image/png"})
+			}
+			watched := file
+			watched.ThumbnailStatus = tt.status
+			mt.AddMockResponses(metadataReply(mt, watched))
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Get(server.URL + "/files/" + file.ID + "/events")
+			if err != nil {
+				mt.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+				mt.Fatalf("status %d, Content-Type %q, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+
+			var got []string
+			events := bufio.NewScanner(resp.Body)
+			for events.Scan() {
+				data, ok := strings.CutPrefix(events.Text(), "data:")
+				if !ok {
+					continue
+				}
+				var event ThumbnailEvent
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					mt.Fatalf("event %q: %v", data, err)
+				}
+				if event.FileID != file.ID {
+					mt.Errorf("event for %q, want %q", event.FileID, file.ID)
+				}
+				got = append(got, event.ThumbnailStatus)
+
+				// Run the job once the client is watching
+				if len(got) == 1 && tt.status == models.ThumbnailPending {
+					failed := file
+					failed.ThumbnailStatus = models.ThumbnailFailed
+					mt.AddMockResponses(metadataReply(mt, failed), updateReply(1), updateReply(1))
+					if w := ts.do(http.MethodPost, "/files/"+file.ID+"/thumbnail/regenerate", nil, nil); w.Code != http.StatusAccepted {
+						mt.Fatalf("regenerate status %d: %s", w.Code, w.Body)
+					}
+				}
+			}
+			if err := events.Err(); err != nil {
+				mt.Fatalf("stream was not closed after the final status: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				mt.Errorf("statuses %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestObjectKeyTooLong(t *testing.T) {
+	mt := mongoMock(t)
+
+	// With the default limit of 1024 bytes a key of prefix + "/" + UUID + ".png"
+	// reaches it exactly with a 983-byte prefix
+	tests := []struct {
+		name       string
+		replace    bool
+		content    bool // replace only the content, under a versioned key
+		keyPrefix  string
+		hashPrefix int
+		wantStatus int
+	}{
+		{"at the limit", false, false, strings.Repeat("a", 983), 0, http.StatusOK},
+		{"folder one byte over", false, false, strings.Repeat("a", 984), 0, http.StatusBadRequest},
+		{"hash prefix over the limit", false, false, strings.Repeat("a", 983), 2, http.StatusBadRequest},
+		{"replace over the limit", true, false, strings.Repeat("a", 984), 0, http.StatusBadRequest},
+		{"versioned content key over the limit", false, true, strings.Repeat("a", 983), 0, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.KeyPrefix = tt.keyPrefix
+				cfg.HashPrefix = tt.hashPrefix
+				cfg.Features.Thumbnails = false
+				cfg.ThumbnailOnReplace = false
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			ts.router.PUT("/files/:id", ts.handler.ReplaceFile)
+			ts.router.PUT("/files/:id/content", ts.handler.ReplaceContent)
+
+			method, target := http.MethodPost, "/upload"
+			file := testFile()
+			body, contentType := multipartFile(mt, "photo.png", testPNG(mt), nil)
+			switch {
+			case tt.replace:
+				ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("old content")})
+				mt.AddMockResponses(updateReply(1), metadataReply(mt, file), countReply(0), findAndModifyReply(mt, file), updateReply(1))
+				method, target = http.MethodPut, "/files/"+file.ID
+			case tt.content:
+				// The stored key is exactly at the limit; the versioned key is longer
+				file.ObjectName = tt.keyPrefix + "/" + file.ID + ".png"
+				ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("old content")})
+				mt.AddMockResponses(updateReply(1), metadataReply(mt, file), countReply(0), updateReply(1))
+				method, target = http.MethodPut, "/files/"+file.ID+"/content"
+				body, contentType = bytes.NewReader(testPNG(mt)), "application/octet-stream"
+			default:
+				mt.AddMockResponses(mtest.CreateSuccessResponse())
+			}
+
+			w := ts.do(method, target, body, map[string]string{"Content-Type": contentType})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if key := insertedFile(mt).ObjectName; len(key) != 1024 {
+					mt.Errorf("key of %d bytes, want 1024", len(key))
+				}
+				return
+			}
+
+			var resp ErrorResponse
+			decodeJSON(mt, w, &resp)
+			if resp.Code != "KEY_TOO_LONG" {
+				mt.Errorf("code %q, want KEY_TOO_LONG", resp.Code)
+			}
+			// Rejected before anything is stored or changed
+			if mutations := ts.s3.Mutations(); len(mutations) != 0 {
+				mt.Errorf("S3 mutations %v, want none", mutations)
+			}
+			if writes := mongoWrites(mt); slices.Contains(writes, "insert") || slices.Contains(writes, "findAndModify") {
+				mt.Errorf("metadata was written: %v", writes)
+			}
+		})
+	}
+}
+
+func TestUploadTruncatedBody(t *testing.T) {
+	mt := mongoMock(t)
+
+	body, contentType := multipartFile(t, "photo.png", testPNG(t), map[string]string{"description": "notes"})
+	complete, _ := io.ReadAll(body)
+	closing := bytes.LastIndex(complete, []byte("\r\n--"))
+	noFile, noFileType := func() ([]byte, string) {
+		var buf bytes.Buffer
+		form := multipart.NewWriter(&buf)
+		form.WriteField("description", "notes")
+		form.Close()
+		return buf.Bytes(), form.FormDataContentType()
+	}()
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		wantStatus  int
+		wantCode    string
+	}{
+		{"complete body", complete, contentType, http.StatusOK, ""},
+		{"cut inside the file", complete[:len(complete)/2], contentType, http.StatusBadRequest, "INCOMPLETE_UPLOAD"},
+		{"cut before the closing boundary", complete[:closing], contentType, http.StatusBadRequest, "INCOMPLETE_UPLOAD"},
+		{"empty body", nil, contentType, http.StatusBadRequest, "INCOMPLETE_UPLOAD"},
+		{"no file field", noFile, noFileType, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.Features.Thumbnails = false
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+			w := ts.do(http.MethodPost, "/upload", bytes.NewReader(tt.body), map[string]string{"Content-Type": tt.contentType})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+
+			var resp ErrorResponse
+			decodeJSON(mt, w, &resp)
+			if resp.Code != tt.wantCode {
+				mt.Errorf("code %q (%s), want %q", resp.Code, resp.Error, tt.wantCode)
+			}
+			if mutations := ts.s3.Mutations(); len(mutations) != 0 {
+				mt.Errorf("S3 mutations %v, want none", mutations)
+			}
+			if writes := mongoWrites(mt); len(writes) != 0 {
+				mt.Errorf("mongo writes %v, want none", writes)
+			}
+		})
+	}
+}
+
+func TestClosingBoundaryReader(t *testing.T) {
+	const boundary = "b0undary"
+	form := "--" + boundary + "\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nvalue\r\n--" + boundary + "--\r\n"
+
+	tests := []struct {
+		name     string
+		body     string
+		wrap     func(io.Reader) io.Reader
+		wantSeen bool
+	}{
+		{"whole body", form, nil, true},
+		{"one byte per read", form, iotest.OneByteReader, true},
+		{"half reads", form, iotest.HalfReader, true},
+		{"truncated", form[:len(form)-5], iotest.OneByteReader, false},
+		{"part boundary only", "--" + boundary + "\r\n", nil, false},
+		{"empty form", "--" + boundary + "--\r\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var src io.Reader = strings.NewReader(tt.body)
+			if tt.wrap != nil {
+				src = tt.wrap(src)
+			}
+			r := &closingBoundaryReader{ReadCloser: io.NopCloser(src), marker: []byte("--" + boundary + "--")}
+			data, err := io.ReadAll(r)
+			if err != nil || string(data) != tt.body {
+				t.Fatalf("read %q, %v, want the body unchanged", data, err)
+			}
+			if r.seen != tt.wantSeen {
+				t.Errorf("seen = %t, want %t", r.seen, tt.wantSeen)
+			}
+		})
+	}
+}
+
+func TestUploadSniffBytes(t *testing.T) {
+	mt := mongoMock(t)
+
+	// An mp4 whose ftyp box lists the isom brand after 200 other brands,
+	// 816 bytes into the file
+	mp4 := []byte("\x00\x00\x00\x00ftypXXXX\x00\x00\x02\x00")
+	mp4 = append(mp4, bytes.Repeat([]byte("avc1"), 200)...)
+	mp4 = append(mp4, "isom"...)
+	binary.BigEndian.PutUint32(mp4, uint32(len(mp4)))
+	mp4 = append(mp4, bytes.Repeat([]byte("mdat payload "), 200)...)
+
+	tests := []struct {
+		name       string
+		sniffBytes int
+		wantStatus int
+	}{
+		// Only the compatible brands in the sample are seen, so the file is not
+		// recognised as a video
+		{"default sample", 512, http.StatusBadRequest},
+		{"larger sample", 1024, http.StatusOK},
+		{"below the minimum", 100, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.SniffBytes = tt.sniffBytes
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+			body, contentType := multipartFile(mt, "clip.mp4", mp4, nil)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			stored := insertedFile(mt)
+			if stored.ContentType != "video/mp4" {
+				mt.Errorf("content type %q, want video/mp4", stored.ContentType)
+			}
+			// The sniffed sample is not lost from the stored object
+			object := mustGet(mt, ts.s3, stored.ObjectName)
+			if !bytes.Equal(object.Data, mp4) {
+				mt.Errorf("stored %d bytes, want the %d uploaded", len(object.Data), len(mp4))
+			}
+		})
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name       string
+		keyPrefix  string
+		hashPrefix int
+		wantPrefix string
+	}{
+		{"no prefix", "", 0, ""},
+		{"environment prefix", "staging", 0, "staging/"},
+		{"prefix with slashes", "/staging/", 0, "staging/"},
+		{"before the hash prefix", "staging", 2, "staging/"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.KeyPrefix = tt.keyPrefix
+				cfg.HashPrefix = tt.hashPrefix
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+			// Another environment's object in the shared bucket
+			ts.s3.Put(testBucket, "prod/other.png", repotest.Object{Data: []byte("prod")})
+
+			content := testPNG(mt)
+			mt.AddMockResponses(mtest.CreateSuccessResponse(), updateReply(1))
+			body, contentType := multipartFile(mt, "photo.png", content, nil)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("upload status %d, want 200: %s", w.Code, w.Body)
+			}
+			waitForCommand(mt, "update")
+
+			// The key is prefixed and stored on the metadata
+			file := insertedFile(mt)
+			if !strings.HasPrefix(file.ObjectName, tt.wantPrefix) || strings.HasPrefix(file.ObjectName, tt.wantPrefix+"/") {
+				mt.Errorf("object key %q, want prefix %q", file.ObjectName, tt.wantPrefix)
+			}
+			if tt.hashPrefix > 0 && strings.Count(strings.TrimPrefix(file.ObjectName, tt.wantPrefix), "/") != 1 {
+				mt.Errorf("object key %q has no hash folder after the prefix", file.ObjectName)
+			}
+			var stored []string
+			for _, key := range ts.s3.Keys(testBucket) {
+				if key != "prod/other.png" {
+					stored = append(stored, key)
+				}
+			}
+			wantStored := []string{file.ObjectName, tt.wantPrefix + "thumbnails/" + file.ID + ".jpg"}
+			slices.Sort(stored)
+			slices.Sort(wantStored)
+			if !slices.Equal(stored, wantStored) {
+				mt.Errorf("stored keys %q, want %q", stored, wantStored)
+			}
+
+			// Retrieval reads the prefixed key
+			mt.AddMockResponses(metadataReply(mt, file), updateReply(1))
+			w = ts.do(http.MethodGet, "/files/"+file.ID+"/content", nil, nil)
+			waitForCommands(mt, "update", 2)
+			if w.Code != http.StatusOK {
+				mt.Fatalf("content status %d, want 200: %s", w.Code, w.Body)
+			}
+			if !bytes.Equal(w.Body.Bytes(), content) {
+				mt.Errorf("content of %d bytes differs from the upload", w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestReplaceFileThumbnail(t *testing.T) {
+	mt := mongoMock(t)
+	mp4 := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), make([]byte, 1000)...)
+
+	tests := []struct {
+		name        string
+		onReplace   bool
+		filename    string
+		content     []byte
+		contentType string
+		// thumbnail_status values written after the metadata update, in order
+		wantStatuses []string
+		wantFresh    bool
+	}{
+		{"image regenerated", true, "photo.png", testPNG(t), "image/png", []string{models.ThumbnailPending, models.ThumbnailReady}, true},
+		{"replaced with a video", true, "clip.mp4", mp4, "video/mp4", []string{""}, false},
+		{"regeneration disabled", false, "photo.png", testPNG(t), "image/png", []string{""}, false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ThumbnailOnReplace = tt.onReplace
+			})
+			ts.router.PUT("/files/:id", ts.handler.ReplaceFile)
+
+			file := testFile()
+			file.ThumbnailStatus = models.ThumbnailReady
+			file.ThumbnailURL = "http://minio/files/thumbnails/" + file.ID + ".jpg"
+			thumbnailKey := "thumbnails/" + file.ID + ".jpg"
+			stale := []byte("\xff\xd8\xff stale thumbnail")
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("old content")})
+			ts.s3.Put(testBucket, thumbnailKey, repotest.Object{Data: stale, ContentType: "image/jpeg"})
+
+			replaced := file
+			replaced.ObjectName = file.ID + filepath.Ext(tt.filename)
+			replaced.ContentType = tt.contentType
+			mt.AddMockResponses(
+				updateReply(1),          // lock
+				metadataReply(mt, file), // current metadata
+				countReply(0),           // the old object is not shared
+				findAndModifyReply(mt, replaced),
+				updateReply(1), // thumbnail reset
+				updateReply(1), // unlock or thumbnail ready
+				updateReply(1),
+			)
+
+			body, contentType := multipartFile(mt, tt.filename, tt.content, nil)
+			w := ts.do(http.MethodPut, "/files/"+file.ID, body, map[string]string{"Content-Type": contentType})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			// Lock, unlock and the thumbnail writes
+			var statuses []string
+			for _, command := range waitForCommands(mt, "update", 2+len(tt.wantStatuses)) {
+				update := command.Lookup("updates").Array().Index(0).Value().Document()
+				if status, err := update.LookupErr("u", "$set", "thumbnail_status"); err == nil {
+					statuses = append(statuses, status.StringValue())
+				}
+			}
+			if !slices.Equal(statuses, tt.wantStatuses) {
+				mt.Errorf("thumbnail statuses %q, want %q", statuses, tt.wantStatuses)
+			}
+
+			// The stale thumbnail is always deleted
+			deleted := false
+			for _, req := range ts.s3.Requests(http.MethodDelete) {
+				deleted = deleted || req.Key == thumbnailKey
+			}
+			if !deleted {
+				mt.Error("stale thumbnail was not deleted")
+			}
+			thumbnail, ok := ts.s3.Get(testBucket, thumbnailKey)
+			if ok != tt.wantFresh {
+				mt.Fatalf("thumbnail stored = %t, want %t", ok, tt.wantFresh)
+			}
+			if ok {
+				if bytes.Equal(thumbnail.Data, stale) {
+					mt.Error("thumbnail was not rebuilt from the new content")
+				}
+				if _, err := jpeg.Decode(bytes.NewReader(thumbnail.Data)); err != nil {
+					mt.Errorf("rebuilt thumbnail is not a JPEG: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	mt := mongoMock(t)
+	content := testPNG(t)
+	md5Sum := md5.Sum(content)
+	shaSum := sha256.Sum256(content)
+	crcSum := binary.BigEndian.AppendUint32(nil, crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli)))
+
+	tests := []struct {
+		name      string
+		algorithm string
+		// header carrying the checksum, directly or announced as a trailer
+		wantHeader   string
+		wantChecksum string
+	}{
+		{"md5", repository.ChecksumMD5, "Content-Md5", hex.EncodeToString(md5Sum[:])},
+		{"sha256", repository.ChecksumSHA256, "X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(shaSum[:])},
+		{"crc32c", repository.ChecksumCRC32C, "X-Amz-Checksum-Crc32c", base64.StdEncoding.EncodeToString(crcSum)},
+		{"disabled", "", "", ""},
+	}
+
+	checksumHeaders := []string{"Content-Md5", "X-Amz-Checksum-Sha256", "X-Amz-Checksum-Crc32c"}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.ChecksumAlgorithm = tt.algorithm
+				cfg.Features.Thumbnails = false
+			})
+			ts.router.POST("/upload", ts.handler.UploadFile)
+
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+			body, contentType := multipartFile(mt, "photo.png", content, nil)
+			w := ts.do(http.MethodPost, "/upload", body, map[string]string{"Content-Type": contentType})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			puts := ts.s3.Requests(http.MethodPut)
+			if len(puts) != 1 {
+				mt.Fatalf("%d PUT requests, want 1", len(puts))
+			}
+			for _, name := range checksumHeaders {
+				sent := puts[0].Header.Get(name) != "" || strings.EqualFold(puts[0].Header.Get("X-Amz-Trailer"), name)
+				if want := name == tt.wantHeader; sent != want {
+					mt.Errorf("checksum %s sent = %t, want %t", name, sent, want)
+				}
+			}
+			if tt.algorithm == repository.ChecksumMD5 {
+				if got := puts[0].Header.Get("Content-Md5"); got != base64.StdEncoding.EncodeToString(md5Sum[:]) {
+					mt.Errorf("Content-Md5 = %q, want the MD5 of the upload", got)
+				}
+			}
+
+			// The storage's confirmed checksum is kept on the metadata
+			file := insertedFile(mt)
+			if file.Checksum != tt.wantChecksum || file.ChecksumAlgorithm != tt.algorithm {
+				mt.Errorf("stored checksum %s %q, want %s %q", file.ChecksumAlgorithm, file.Checksum, tt.algorithm, tt.wantChecksum)
+			}
+		})
+	}
+}
+
+func TestGetThumbnailFailed(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name        string
+		status      string
+		failure     string
+		stored      bool
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{"failed with a reason", models.ThumbnailFailed, "image: unknown format", false, http.StatusNotFound, "THUMBNAIL_FAILED", "Thumbnail generation failed: image: unknown format"},
+		{"failed without a reason", models.ThumbnailFailed, "", false, http.StatusNotFound, "THUMBNAIL_FAILED", "Thumbnail generation failed"},
+		{"still pending", models.ThumbnailPending, "", false, http.StatusNotFound, "THUMBNAIL_PENDING", ""},
+		{"ready but the object is gone", models.ThumbnailReady, "", false, http.StatusNotFound, "THUMBNAIL_NOT_AVAILABLE", ""},
+		{"ready", models.ThumbnailReady, "", true, http.StatusOK, "", ""},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/:id/thumbnail", ts.handler.GetThumbnail)
+			file := testFile()
+			file.ThumbnailStatus, file.ThumbnailError = tt.status, tt.failure
+			if tt.stored {
+				ts.s3.Put(testBucket, "thumbnails/"+file.ID+".jpg", repotest.Object{Data: []byte("\xff\xd8\xff thumbnail"), ContentType: "image/jpeg"})
+			}
+			mt.AddMockResponses(metadataReply(mt, file))
+
+			w := ts.do(http.MethodGet, "/files/"+file.ID+"/thumbnail", nil, nil)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if got := w.Header().Get("Content-Type"); got != "image/jpeg" {
+					mt.Errorf("Content-Type = %q, want image/jpeg", got)
+				}
+				return
+			}
+			var resp ErrorResponse
+			decodeJSON(mt, w, &resp)
+			if resp.Code != tt.wantCode {
+				mt.Errorf("code %q, want %q", resp.Code, tt.wantCode)
+			}
+			if tt.wantMessage != "" && resp.Error != tt.wantMessage {
+				mt.Errorf("error %q, want %q", resp.Error, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestRegenerateThumbnail(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name        string
+		status      string
+		contentType string
+		content     []byte
+		wantStatus  int
+		wantCode    string
+		// thumbnail_status values written, in order
+		wantWrites []string
+		wantError  bool // the failure reason is recorded
+	}{
+		{"failed thumbnail retried", models.ThumbnailFailed, "image/png", testPNG(t), http.StatusAccepted, "", []string{models.ThumbnailPending, models.ThumbnailReady}, false},
+		{"retry fails again", models.ThumbnailFailed, "image/png", []byte("not an image"), http.StatusAccepted, "", []string{models.ThumbnailPending, models.ThumbnailFailed}, true},
+		{"already pending", models.ThumbnailPending, "image/png", testPNG(t), http.StatusAccepted, "", nil, false},
+		{"not an image", models.ThumbnailFailed, "video/mp4", []byte("video"), http.StatusBadRequest, "THUMBNAIL_UNSUPPORTED", nil, false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.POST("/files/:id/thumbnail/regenerate", ts.handler.RegenerateThumbnail)
+			file := testFile()
+			file.ContentType, file.ThumbnailStatus, file.ThumbnailError = tt.contentType, tt.status, "previous failure"
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: tt.content, ContentType: tt.contentType})
+			mt.AddMockResponses(metadataReply(mt, file), updateReply(1), updateReply(1))
+
+			w := ts.do(http.MethodPost, "/files/"+file.ID+"/thumbnail/regenerate", nil, nil)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantCode != "" {
+				var resp ErrorResponse
+				decodeJSON(mt, w, &resp)
+				if resp.Code != tt.wantCode {
+					mt.Errorf("code %q, want %q", resp.Code, tt.wantCode)
+				}
+			} else {
+				var resp models.FileMetadata
+				decodeJSON(mt, w, &resp)
+				if resp.ThumbnailStatus != models.ThumbnailPending {
+					mt.Errorf("thumbnail_status %q, want pending", resp.ThumbnailStatus)
+				}
+			}
+
+			if len(tt.wantWrites) == 0 {
+				if writes := mongoWrites(mt); len(writes) != 0 {
+					mt.Errorf("mongo writes %v, want none", writes)
+				}
+				return
+			}
+			var statuses []string
+			var failure string
+			for _, command := range waitForCommands(mt, "update", len(tt.wantWrites)) {
+				set := command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$set").Document()
+				statuses = append(statuses, set.Lookup("thumbnail_status").StringValue())
+				failure = set.Lookup("thumbnail_error").StringValue()
+			}
+			if !slices.Equal(statuses, tt.wantWrites) {
+				mt.Errorf("thumbnail statuses %q, want %q", statuses, tt.wantWrites)
+			}
+			// The previous reason is cleared and a new failure records its own
+			if (failure != "") != tt.wantError {
+				mt.Errorf("recorded failure reason %q, want one = %t", failure, tt.wantError)
+			}
+			if _, ok := ts.s3.Get(testBucket, "thumbnails/"+file.ID+".jpg"); ok == tt.wantError {
+				mt.Errorf("thumbnail stored = %t, want %t", ok, !tt.wantError)
+			}
+		})
+	}
+}
+
+func TestRecentFiles(t *testing.T) {
+	mt := mongoMock(t)
+
+	// Files uploaded at different times before the request
+	ages := []time.Duration{10 * time.Minute, 50 * time.Minute, 3 * time.Hour, 48 * time.Hour, 1000 * time.Hour}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantWindow time.Duration
+		wantLimit  int64
+	}{
+		{"default window", "", http.StatusOK, time.Hour, 20},
+		{"last hour", "?since=1h", http.StatusOK, time.Hour, 20},
+		{"last day", "?since=24h", http.StatusOK, 24 * time.Hour, 20},
+		{"window is capped", "?since=2000h", http.StatusOK, 720 * time.Hour, 20},
+		{"with a limit", "?since=24h&limit=1", http.StatusOK, 24 * time.Hour, 1},
+		{"invalid duration", "?since=yesterday", http.StatusBadRequest, 0, 0},
+		{"plain number", "?since=60", http.StatusBadRequest, 0, 0},
+		{"negative window", "?since=-1h", http.StatusBadRequest, 0, 0},
+		{"zero window", "?since=0s", http.StatusBadRequest, 0, 0},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.GET("/files/recent", ts.handler.RecentFiles)
+
+			// The mocked deployment replies with the files inside the expected window
+			now := time.Now()
+			var seeded, recent []models.FileMetadata
+			for _, age := range ages {
+				file := testFile()
+				file.UploadDate = now.Add(-age).UTC().Truncate(time.Millisecond)
+				seeded = append(seeded, file)
+				if age < tt.wantWindow && int64(len(recent)) < tt.wantLimit {
+					recent = append(recent, file)
+				}
+			}
+			mt.AddMockResponses(metadataReply(mt, recent...))
+
+			w := ts.do(http.MethodGet, "/files/recent"+tt.query, nil, nil)
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if events := mt.GetAllStartedEvents(); len(events) != 0 {
+					mt.Errorf("%d commands sent for an invalid window", len(events))
+				}
+				return
+			}
+
+			// The query selects exactly the files uploaded within the window
+			find := mt.GetStartedEvent()
+			if find == nil || find.CommandName != "find" {
+				mt.Fatalf("command %v, want find", find)
+			}
+			since := find.Command.Lookup("filter", "upload_date", "$gte").Time()
+			if diff := now.Add(-tt.wantWindow).Sub(since).Abs(); diff > time.Second {
+				mt.Errorf("window starts at %v, want %v ago", since, tt.wantWindow)
+			}
+			for i, file := range seeded {
+				if inWindow := !file.UploadDate.Before(since); inWindow != (ages[i] < tt.wantWindow) {
+					mt.Errorf("file uploaded %v ago selected = %t", ages[i], inWindow)
+				}
+			}
+			if limit := find.Command.Lookup("limit").AsInt64(); limit != tt.wantLimit {
+				mt.Errorf("limit %d, want %d", limit, tt.wantLimit)
+			}
+
+			var resp RecentFilesResponse
+			decodeJSON(mt, w, &resp)
+			if len(resp.Items) != len(recent) {
+				mt.Fatalf("%d files returned, want %d", len(resp.Items), len(recent))
+			}
+			for i := range recent {
+				if resp.Items[i].ID != recent[i].ID {
+					mt.Errorf("item %d is %s, want %s", i, resp.Items[i].ID, recent[i].ID)
+				}
+			}
+			// BSON dates have millisecond precision
+			if !resp.Since.Truncate(time.Millisecond).Equal(since) {
+				mt.Errorf("since %v in the response, want the queried %v", resp.Since, since)
+			}
+		})
+	}
+}
+
+func TestUniqueNames(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name       string
+		policy     string
+		replace    bool
+		taken      []string // names of stored files with the same extension
+		wantStatus int
+		wantName   string
+	}{
+		{"check disabled", "", false, []string{"photo"}, http.StatusOK, "photo"},
+		{"reject a free name", service.UniqueNamesReject, false, nil, http.StatusOK, "photo"},
+		{"reject a taken name", service.UniqueNamesReject, false, []string{"photo"}, http.StatusConflict, ""},
+		{"reject a taken name on replace", service.UniqueNamesReject, true, []string{"photo"}, http.StatusConflict, ""},
+		{"replace keeps its own name", service.UniqueNamesReject, true, nil, http.StatusOK, "photo"},
+		{"suffix a free name", service.UniqueNamesSuffix, false, []string{"photo (1)"}, http.StatusOK, "photo"},
+		{"suffix a taken name", service.UniqueNamesSuffix, false, []string{"photo"}, http.StatusOK, "photo (1)"},
+		{"suffix skips used suffixes", service.UniqueNamesSuffix, false, []string{"photo", "photo (1)", "photo (3)"}, http.StatusOK, "photo (2)"},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.Features.Thumbnails = false
+				cfg.ThumbnailOnReplace = false
+			})
+			if err := ts.service.SetUniqueNames(tt.policy); err != nil {
+				mt.Fatal(err)
+			}
+			ts.router.POST("/upload", ts.handler.UploadFile)
+			ts.router.PUT("/files/:id", ts.handler.ReplaceFile)
+
+			var stored []models.FileMetadata
+			for _, name := range tt.taken {
+				file := testFile()
+				file.OriginalName = name
+				stored = append(stored, file)
+			}
+
+			method, target := http.MethodPost, "/upload"
+			file := testFile()
+			file.OriginalName = "old"
+			if tt.replace {
+				ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: []byte("old content")})
+				replaced := file
+				replaced.OriginalName = tt.wantName
+				mt.AddMockResponses(updateReply(1), metadataReply(mt, file), countReply(0), metadataReply(mt, stored...),
+					findAndModifyReply(mt, replaced), updateReply(1))
+				method, target = http.MethodPut, "/files/"+file.ID
+			} else if tt.policy != "" {
+				mt.AddMockResponses(metadataReply(mt, stored...), mtest.CreateSuccessResponse())
+			} else {
+				mt.AddMockResponses(mtest.CreateSuccessResponse())
+			}
+
+			body, contentType := multipartFile(mt, "photo.png", testPNG(mt), nil)
+			w := ts.do(method, target, body, map[string]string{"Content-Type": contentType})
+			if w.Code != tt.wantStatus {
+				mt.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			if tt.policy != "" {
+				// Names are looked up among files with the same extension, other than the replaced one
+				var lookup bson.Raw
+				for _, event := range mt.GetAllStartedEvents() {
+					if event.CommandName == "find" && event.Command.Lookup("filter", "original_name").Type != 0 {
+						lookup = event.Command.Lookup("filter").Document()
+					}
+				}
+				if lookup == nil {
+					mt.Fatal("names were not looked up")
+				}
+				excluded := ""
+				if tt.replace {
+					excluded = file.ID
+				}
+				if id := lookup.Lookup("_id", "$ne").StringValue(); id != excluded {
+					mt.Errorf("lookup excludes %q, want %q", id, excluded)
+				}
+			}
+
+			if tt.wantStatus == http.StatusConflict {
+				var resp ErrorResponse
+				decodeJSON(mt, w, &resp)
+				if resp.Code != "NAME_TAKEN" {
+					mt.Errorf("code %q, want NAME_TAKEN", resp.Code)
+				}
+				// Nothing is stored or changed
+				if mutations := ts.s3.Mutations(); len(mutations) != 0 {
+					mt.Errorf("S3 mutations %v, want none", mutations)
+				}
+				if writes := mongoWrites(mt); slices.Contains(writes, "insert") || slices.Contains(writes, "findAndModify") {
+					mt.Errorf("metadata was written: %v", writes)
+				}
+				return
+			}
+
+			var got string
+			if tt.replace {
+				for _, event := range mt.GetAllStartedEvents() {
+					if event.CommandName == "findAndModify" {
+						got = event.Command.Lookup("update", "$set", "original_name").StringValue()
+					}
+				}
+			} else {
+				got = insertedFile(mt).OriginalName
+			}
+			if got != tt.wantName {
+				mt.Errorf("stored name %q, want %q", got, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestGetGallery(t *testing.T) {
+	mt := mongoMock(t)
+	past := time.Now().Add(-time.Hour)
+
+	// Files a, b and c; the mocked deployment returns them in its own order
+	newFiles := func() map[string]models.FileMetadata {
+		files := make(map[string]models.FileMetadata)
+		for _, name := range []string{"a", "b", "c"} {
+			file := testFile()
+			file.ThumbnailStatus = models.ThumbnailReady
+			file.ThumbnailURL = "http://minio/files/thumbnails/" + file.ID + ".jpg"
+			files[name] = file
+		}
+		return files
+	}
+
+	tests := []struct {
+		name        string
+		ids         []string // names of files, or literal IDs that are not stored
+		stored      []string
+		modify      func(files map[string]models.FileMetadata)
+		wantItems   []string
+		wantMissing []string
+		wantThumbs  []bool
+	}{
+		{"requested order kept", []string{"c", "a", "b"}, []string{"a", "b", "c"}, nil,
+			[]string{"c", "a", "b"}, []string{}, []bool{true, true, true}},
+		{"missing IDs skipped", []string{"b", "unknown-id", "a"}, []string{"a", "b"}, nil,
+			[]string{"b", "a"}, []string{"unknown-id"}, []bool{true, true}},
+		{"expired files listed as missing", []string{"a", "b"}, []string{"b", "a"}, func(files map[string]models.FileMetadata) {
+			file := files["a"]
+			file.AccessibleUntil = &past
+			files["a"] = file
+		}, []string{"b"}, []string{"a"}, []bool{true}},
+		{"thumbnail only when ready", []string{"a", "b"}, []string{"a", "b"}, func(files map[string]models.FileMetadata) {
+			file := files["b"]
+			file.ThumbnailStatus = models.ThumbnailPending
+			files["b"] = file
+		}, []string{"a", "b"}, []string{}, []bool{true, false}},
+		{"nothing found", []string{"x", "y"}, nil, nil, []string{}, []string{"x", "y"}, []bool{}},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.POST("/gallery", ts.handler.GetGallery)
+
+			files := newFiles()
+			if tt.modify != nil {
+				tt.modify(files)
+			}
+			idOf := func(name string) string {
+				if file, ok := files[name]; ok {
+					return file.ID
+				}
+				return name
+			}
+			var stored []models.FileMetadata
+			for _, name := range tt.stored {
+				stored = append(stored, files[name])
+			}
+			mt.AddMockResponses(metadataReply(mt, stored...))
+
+			ids := make([]string, 0, len(tt.ids))
+			for _, name := range tt.ids {
+				ids = append(ids, idOf(name))
+			}
+			body, _ := json.Marshal(GalleryRequest{IDs: ids})
+			w := ts.do(http.MethodPost, "/gallery", bytes.NewReader(body), map[string]string{"Content-Type": "application/json"})
+			if w.Code != http.StatusOK {
+				mt.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			var manifest service.GalleryManifest
+			decodeJSON(mt, w, &manifest)
+			if len(manifest.Items) != len(tt.wantItems) {
+				mt.Fatalf("%d items, want %d: %s", len(manifest.Items), len(tt.wantItems), w.Body)
+			}
+			for i, name := range tt.wantItems {
+				item := manifest.Items[i]
+				if item.Metadata == nil || item.Metadata.ID != idOf(name) {
+					mt.Errorf("item %d is %+v, want file %s", i, item.Metadata, name)
+					continue
+				}
+				if !strings.Contains(item.URL, item.Metadata.ObjectName) || !strings.Contains(item.URL, "X-Amz-Signature=") {
+					mt.Errorf("item %d URL %q is not a presigned URL of the original", i, item.URL)
+				}
+				if hasThumb := item.ThumbnailURL != ""; hasThumb != tt.wantThumbs[i] {
+					mt.Errorf("item %d thumbnail URL %q, want one = %t", i, item.ThumbnailURL, tt.wantThumbs[i])
+				}
+			}
+			wantMissing := make([]string, 0, len(tt.wantMissing))
+			for _, name := range tt.wantMissing {
+				wantMissing = append(wantMissing, idOf(name))
+			}
+			if !slices.Equal(manifest.Missing, wantMissing) {
+				mt.Errorf("missing %q, want %q", manifest.Missing, wantMissing)
+			}
+		})
+	}
+}
+
+func TestGetGalleryInvalidRequest(t *testing.T) {
+	mt := mongoMock(t)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no ids", `{}`},
+		{"empty ids", `{"ids":[]}`},
+		{"too many ids", `{"ids":[` + strings.TrimSuffix(strings.Repeat(`"id",`, 101), ",") + `]}`},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, nil)
+			ts.router.POST("/gallery", ts.handler.GetGallery)
+
+			w := ts.do(http.MethodPost, "/gallery", strings.NewReader(tt.body), map[string]string{"Content-Type": "application/json"})
+			if w.Code != http.StatusBadRequest {
+				mt.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+			}
+			if events := mt.GetAllStartedEvents(); len(events) != 0 {
+				mt.Errorf("%d commands sent for an invalid request", len(events))
+			}
+		})
+	}
+}
+
+func TestGetFileContentMissingType(t *testing.T) {
+	mt := mongoMock(t)
+	png := testPNG(t)
+
+	tests := []struct {
+		name         string
+		objectName   string
+		content      []byte
+		stored       string
+		sniff        bool
+		rangeHeader  string
+		wantType     string
+		wantBackfill bool
+	}{
+		{"sniffed from the content", "photo.png", png, "", true, "", "image/png", true},
+		{"sniffed despite a misleading extension", "photo.mov", png, "", true, "", "image/png", true},
+		{"unknown content falls back to the extension", "clip.mov", []byte("\x00\x01\x02\x03 no signature"), "", true, "", "video/quicktime", true},
+		{"sniffing disabled", "photo.png", png, "", false, "", "application/octet-stream", false},
+		{"ranged request is not sniffed", "clip.mov", png, "", true, "bytes=0-9", "video/quicktime", false},
+		{"stored type kept", "photo.png", png, "image/png", true, "", "image/png", false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			ts := newTestServer(mt, func(cfg *config.Config) {
+				cfg.SniffMissingContentType = tt.sniff
+			})
+			ts.router.GET("/files/:id/content", ts.handler.GetFileContent)
+			file := testFile()
+			file.ObjectName, file.ContentType = file.ID+filepath.Ext(tt.objectName), tt.stored
+			file.FileSize = int64(len(tt.content))
+			ts.s3.Put(testBucket, file.ObjectName, repotest.Object{Data: tt.content})
+			mt.AddMockResponses(metadataReply(mt, file), updateReply(1), updateReply(1))
+
+			header := map[string]string{}
+			if tt.rangeHeader != "" {
+				header["Range"] = tt.rangeHeader
+			}
+			w := ts.do(http.MethodGet, "/files/"+file.ID+"/content", nil, header)
+			if w.Code != http.StatusOK && w.Code != http.StatusPartialContent {
+				mt.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				mt.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			// Sniffing does not consume the streamed bytes
+			if tt.rangeHeader == "" && !bytes.Equal(w.Body.Bytes(), tt.content) {
+				mt.Errorf("body of %d bytes differs from the stored %d", w.Body.Len(), len(tt.content))
+			}
+
+			// The download count update, and the backfill when the type was determined
+			wantUpdates, wantBackfilled := 1, ""
+			if tt.wantBackfill {
+				wantUpdates, wantBackfilled = 2, tt.wantType
+			}
+			var backfilled string
+			for _, command := range waitForCommands(mt, "update", wantUpdates) {
+				update := command.Lookup("updates").Array().Index(0).Value().Document()
+				if value, err := update.LookupErr("u", "$set", "content_type"); err == nil {
+					backfilled = value.StringValue()
+					if _, err := update.LookupErr("q", "content_type", "$in"); err != nil {
+						mt.Error("backfill may overwrite a stored content type")
+					}
+				}
+			}
+			if backfilled != wantBackfilled {
+				mt.Errorf("backfilled content type %q, want %q", backfilled, wantBackfilled)
+			}
+		})
+	}
+}
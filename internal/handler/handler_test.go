@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"kuber-code-s3/internal/config"
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+	"kuber-code-s3/internal/repository/repotest"
+	"kuber-code-s3/internal/service"
+)
+
+const (
+	testBucket = "files"
+	// testThumbBucket is an empty bucket tests can direct thumbnails to
+	testThumbBucket = "thumbs"
+)
+
+// testServer wires a FileHandler to a mocked MongoDB deployment and a fake S3.
+// MongoDB replies are queued with mt.AddMockResponses in command order
+type testServer struct {
+	mt      *mtest.T
+	s3      *repotest.S3
+	config  *config.Config
+	service *service.FileService
+	handler *FileHandler
+	router  *gin.Engine
+}
+
+func newTestServer(mt *mtest.T, configure func(cfg *config.Config)) *testServer {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.LoadConfig()
+	cfg.MinioBucket = testBucket
+	if configure != nil {
+		configure(cfg)
+	}
+
+	s3 := repotest.NewS3(mt, testBucket, testThumbBucket)
+	minioRepo := s3.Repository(mt, testBucket)
+	if err := minioRepo.SetChecksumAlgorithm(cfg.ChecksumAlgorithm); err != nil {
+		mt.Fatal(err)
+	}
+	mongoRepo := repository.NewMongoRepositoryWithClient(mt.Client, cfg.MongoDatabase)
+
+	fileService := service.NewFileService(minioRepo, mongoRepo, cfg)
+	mt.Cleanup(fileService.Close)
+
+	return &testServer{
+		mt:      mt,
+		s3:      s3,
+		config:  cfg,
+		service: fileService,
+		handler: NewFileHandler(fileService, cfg),
+		router:  gin.New(),
+	}
+}
+
+// do sends a request through the test router
+func (ts *testServer) do(method, target string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, req)
+	return w
+}
+
+// mongoMock returns a mocked MongoDB deployment for handler tests
+func mongoMock(t *testing.T) *mtest.T {
+	return mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+}
+
+// metadataReply is a find reply with the given metadata documents
+func metadataReply(mt *mtest.T, files ...models.FileMetadata) bson.D {
+	docs := make([]bson.D, 0, len(files))
+	for _, file := range files {
+		docs = append(docs, toDocument(mt, file))
+	}
+	return mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch, docs...)
+}
+
+// updateReply is an update reply that matched and modified n documents
+func updateReply(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+// deleteReply is a delete reply that removed n documents
+func deleteReply(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n})
+}
+
+// findAndModifyReply is a findAndModify reply returning the given document
+func findAndModifyReply(mt *mtest.T, file models.FileMetadata) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: toDocument(mt, file)})
+}
+
+// countReply is the aggregate reply of CountDocuments
+func countReply(n int64) bson.D {
+	if n == 0 {
+		return mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch)
+	}
+	return mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+}
+
+func toDocument(mt *mtest.T, v any) bson.D {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		mt.Fatal(err)
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		mt.Fatal(err)
+	}
+	return doc
+}
+
+// mongoWrites lists the write commands sent to the mocked deployment
+func mongoWrites(mt *mtest.T) []string {
+	var writes []string
+	for _, event := range mt.GetAllStartedEvents() {
+		switch event.CommandName {
+		case "insert", "update", "delete", "findAndModify":
+			writes = append(writes, event.CommandName)
+		}
+	}
+	return writes
+}
+
+// testFile returns stored metadata of a PNG file with a fresh ID
+func testFile() models.FileMetadata {
+	id := uuid.New().String()
+	return models.FileMetadata{
+		ID:           id,
+		OriginalName: "photo.png",
+		FileSize:     2048,
+		ContentType:  "image/png",
+		BucketName:   testBucket,
+		ObjectName:   id + ".png",
+		UploadDate:   time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond),
+	}
+}
+
+// testPNG returns a small valid PNG image
+func testPNG(t testing.TB) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// multipartFile builds an upload form with one file part and text fields
+func multipartFile(t testing.TB, filename string, content []byte, fields map[string]string) (io.Reader, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, form.FormDataContentType()
+}
+
+// insertedFile returns the metadata document of the first insert command
+func insertedFile(mt *mtest.T) models.FileMetadata {
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName != "insert" {
+			continue
+		}
+		var file models.FileMetadata
+		doc := event.Command.Lookup("documents").Array().Index(0).Value().Document()
+		if err := bson.Unmarshal(doc, &file); err != nil {
+			mt.Fatal(err)
+		}
+		return file
+	}
+	mt.Fatal("no metadata was inserted")
+	return models.FileMetadata{}
+}
+
+// waitForCommand waits until a command with the given name reaches the mocked
+// deployment, for writes the service makes in the background
+func waitForCommand(mt *mtest.T, name string) {
+	waitForCommands(mt, name, 1)
+}
+
+// waitForCommands waits until n commands with the given name reach the mocked
+// deployment and returns them in the order they were sent
+func waitForCommands(mt *mtest.T, name string, n int) []bson.Raw {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var commands []bson.Raw
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == name {
+				commands = append(commands, event.Command)
+			}
+		}
+		if len(commands) >= n {
+			return commands
+		}
+		if time.Now().After(deadline) {
+			mt.Fatalf("%d %q commands were sent, want %d", len(commands), name, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func decodeJSON(t testing.TB, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,159 @@
+package health
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Check проверяет доступность одной зависимости
+type Check func(ctx context.Context) error
+
+// Status - результат последней проверки зависимостей
+type Status struct {
+	Healthy   bool              `json:"healthy"`
+	Checks    map[string]string `json:"checks"`
+	CheckedAt time.Time         `json:"checked_at"`
+	// Справочные сведения, не влияющие на готовность (например, расхождение часов)
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Monitor периодически опрашивает зависимости в фоне и хранит результат
+// в памяти, чтобы частые readiness-пробы не нагружали Minio и MongoDB
+type Monitor struct {
+	checks   map[string]Check
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.RWMutex
+	status  Status
+	details map[string]string
+
+	// Не дает параллельным пробам опрашивать зависимости одновременно
+	refreshMu sync.Mutex
+}
+
+// NewMonitor создает монитор. До первой проверки состояние считается нездоровым
+func NewMonitor(interval, timeout time.Duration, checks map[string]Check) *Monitor {
+	return &Monitor{
+		checks:   checks,
+		interval: interval,
+		timeout:  timeout,
+		status:   Status{Checks: map[string]string{}},
+	}
+}
+
+// Start выполняет первую проверку и запускает периодический опрос до отмены ctx
+func (m *Monitor) Start(ctx context.Context) {
+	m.Refresh(ctx)
+
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.Refresh(ctx)
+			}
+		}
+	}()
+}
+
+// Refresh опрашивает все зависимости параллельно и обновляет сохраненное
+// состояние. Каждая проверка ограничена timeout, поэтому опрос занимает
+// не больше одного timeout, даже если зависимость не отвечает
+func (m *Monitor) Refresh(ctx context.Context) {
+	status := Status{
+		Healthy:   true,
+		Checks:    make(map[string]string, len(m.checks)),
+		CheckedAt: time.Now(),
+	}
+
+	var (
+		wg        sync.WaitGroup
+		resultsMu sync.Mutex
+	)
+	for name, check := range m.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, m.timeout)
+			err := check(checkCtx)
+			cancel()
+
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			if err != nil {
+				status.Healthy = false
+				status.Checks[name] = err.Error()
+				return
+			}
+			status.Checks[name] = "ok"
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	previous := m.status
+	m.status = status
+	m.mu.Unlock()
+
+	if previous.Healthy != status.Healthy {
+		log.Printf("Dependency health changed: healthy=%t checks=%v", status.Healthy, status.Checks)
+	}
+}
+
+// Current возвращает состояние не старше maxAge: устаревший результат
+// обновляется опросом зависимостей, причем одновременные пробы ждут одного
+// опроса. Так всплеск проб не нагружает Minio и MongoDB, а реальное изменение
+// состояния видно не позже чем через maxAge. При maxAge <= 0 возвращается
+// результат фонового опроса
+func (m *Monitor) Current(maxAge time.Duration) Status {
+	if maxAge <= 0 {
+		return m.Status()
+	}
+
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+
+	// Пока ждали блокировку, опрос мог выполнить другой запрос
+	if time.Since(m.Status().CheckedAt) > maxAge {
+		m.Refresh(context.Background())
+	}
+	return m.Status()
+}
+
+// Status возвращает результат последней проверки
+func (m *Monitor) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	checks := make(map[string]string, len(m.status.Checks))
+	for name, result := range m.status.Checks {
+		checks[name] = result
+	}
+	status := Status{Healthy: m.status.Healthy, Checks: checks, CheckedAt: m.status.CheckedAt}
+	if len(m.details) > 0 {
+		status.Details = make(map[string]string, len(m.details))
+		for name, value := range m.details {
+			status.Details[name] = value
+		}
+	}
+	return status
+}
+
+// SetDetail сохраняет справочное значение, которое отдается вместе с состоянием
+func (m *Monitor) SetDetail(name, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.details == nil {
+		m.details = make(map[string]string)
+	}
+	m.details[name] = value
+}
@@ -0,0 +1,161 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMonitorStateFlips(t *testing.T) {
+	errDown := errors.New("connection refused")
+
+	tests := []struct {
+		name        string
+		failing     string // зависимость, которая становится недоступной
+		wantHealthy bool
+		wantChecks  map[string]string
+	}{
+		{"minio goes down", "minio", false, map[string]string{"minio": errDown.Error(), "mongodb": "ok"}},
+		{"mongodb goes down", "mongodb", false, map[string]string{"minio": "ok", "mongodb": errDown.Error()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var down atomic.Bool
+			check := func(name string) Check {
+				return func(ctx context.Context) error {
+					if name == tt.failing && down.Load() {
+						return errDown
+					}
+					return nil
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			monitor := NewMonitor(10*time.Millisecond, time.Second, map[string]Check{
+				"minio":   check("minio"),
+				"mongodb": check("mongodb"),
+			})
+			monitor.Start(ctx)
+
+			if status := monitor.Status(); !status.Healthy {
+				t.Fatalf("initial status = %+v, want healthy", status)
+			}
+
+			// Фоновый опрос замечает отказ без обращений к /readyz
+			down.Store(true)
+			status := waitForHealth(t, monitor, tt.wantHealthy)
+			for name, want := range tt.wantChecks {
+				if status.Checks[name] != want {
+					t.Errorf("check %q = %q, want %q", name, status.Checks[name], want)
+				}
+			}
+
+			// И восстановление тоже
+			down.Store(false)
+			waitForHealth(t, monitor, true)
+		})
+	}
+}
+
+func TestMonitorUnhealthyBeforeFirstCheck(t *testing.T) {
+	monitor := NewMonitor(time.Minute, time.Second, map[string]Check{
+		"minio": func(ctx context.Context) error { return nil },
+	})
+	if monitor.Status().Healthy {
+		t.Error("monitor is healthy before the first check")
+	}
+}
+
+func TestMonitorCurrentCache(t *testing.T) {
+	const window = 200 * time.Millisecond
+	errDown := errors.New("connection refused")
+
+	tests := []struct {
+		name        string
+		maxAge      time.Duration
+		probes      int
+		wait        time.Duration // пауза перед второй серией проб
+		wantDials   int64         // опросов каждой зависимости за обе серии
+		wantHealthy bool          // состояние во второй серии после отказа MongoDB
+	}{
+		{"burst within the window", window, 50, 0, 1, true},
+		{"state change after the window", window, 50, window + 50*time.Millisecond, 2, false},
+		{"cache disabled", 0, 50, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				minioDials, mongoDials atomic.Int64
+				down                   atomic.Bool
+			)
+			monitor := NewMonitor(time.Minute, time.Second, map[string]Check{
+				"minio": func(ctx context.Context) error {
+					minioDials.Add(1)
+					return nil
+				},
+				"mongodb": func(ctx context.Context) error {
+					mongoDials.Add(1)
+					if down.Load() {
+						return errDown
+					}
+					return nil
+				},
+			})
+
+			probe := func() []Status {
+				statuses := make([]Status, tt.probes)
+				var wg sync.WaitGroup
+				for i := range statuses {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						statuses[i] = monitor.Current(tt.maxAge)
+					}()
+				}
+				wg.Wait()
+				return statuses
+			}
+
+			for _, status := range probe() {
+				if status.Healthy != (tt.maxAge > 0) {
+					t.Fatalf("first burst status = %+v", status)
+				}
+			}
+
+			down.Store(true)
+			time.Sleep(tt.wait)
+			for _, status := range probe() {
+				if status.Healthy != tt.wantHealthy {
+					t.Errorf("second burst healthy = %t, want %t", status.Healthy, tt.wantHealthy)
+				}
+			}
+
+			if minioDials.Load() != tt.wantDials || mongoDials.Load() != tt.wantDials {
+				t.Errorf("dialed minio %d, mongodb %d times, want %d", minioDials.Load(), mongoDials.Load(), tt.wantDials)
+			}
+		})
+	}
+}
+
+// waitForHealth ждет, пока фоновый опрос не приведет состояние к healthy
+func waitForHealth(t *testing.T, monitor *Monitor, healthy bool) Status {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status := monitor.Status()
+		if status.Healthy == healthy {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status = %+v, want healthy=%t", status, healthy)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
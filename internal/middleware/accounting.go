@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TransferUsage - объем данных, переданных одним клиентом
+type TransferUsage struct {
+	Client          string `json:"client"`
+	BytesUploaded   int64  `json:"bytes_uploaded"`
+	BytesDownloaded int64  `json:"bytes_downloaded"`
+}
+
+type transferCounters struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+}
+
+// TransferAccounting накапливает фактически прочитанные из тела запроса и
+// записанные в ответ байты по метке клиента (ClientLabelKey)
+type TransferAccounting struct {
+	mu       sync.Mutex
+	counters map[string]*transferCounters
+}
+
+func NewTransferAccounting() *TransferAccounting {
+	return &TransferAccounting{counters: make(map[string]*transferCounters)}
+}
+
+func (a *TransferAccounting) client(label string) *transferCounters {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	counters, ok := a.counters[label]
+	if !ok {
+		counters = &transferCounters{}
+		a.counters[label] = counters
+	}
+	return counters
+}
+
+// Usage возвращает накопленные счетчики, упорядоченные по метке клиента
+func (a *TransferAccounting) Usage() []TransferUsage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	usage := make([]TransferUsage, 0, len(a.counters))
+	for label, counters := range a.counters {
+		usage = append(usage, TransferUsage{
+			Client:          label,
+			BytesUploaded:   counters.uploaded.Load(),
+			BytesDownloaded: counters.downloaded.Load(),
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Client < usage[j].Client })
+	return usage
+}
+
+// Account учитывает трафик запроса. Должен стоять после аутентификации,
+// которая выставляет метку клиента. Считаются реально переданные байты,
+// а не заявленный Content-Length
+func Account(accounting *TransferAccounting) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		counters := accounting.client(c.GetString(ClientLabelKey))
+
+		if c.Request.Body != nil {
+			c.Request.Body = &countingBody{ReadCloser: c.Request.Body, n: &counters.uploaded}
+		}
+
+		c.Next()
+
+		if size := c.Writer.Size(); size > 0 {
+			counters.downloaded.Add(int64(size))
+		}
+	}
+}
+
+// countingBody прибавляет прочитанные байты к счетчику клиента
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
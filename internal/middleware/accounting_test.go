@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	accounting := NewTransferAccounting()
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(ClientLabelKey, c.GetHeader("Authorization"))
+	}, Account(accounting))
+	router.POST("/upload", func(c *gin.Context) {
+		io.Copy(io.Discard, c.Request.Body)
+		c.Status(http.StatusOK)
+	})
+	router.POST("/upload/partial", func(c *gin.Context) {
+		// Обработчик отклоняет загрузку, прочитав только начало тела
+		io.CopyN(io.Discard, c.Request.Body, 10)
+		c.Status(http.StatusBadRequest)
+	})
+	router.GET("/download", func(c *gin.Context) {
+		size, _ := strconv.Atoi(c.Query("size"))
+		c.Data(http.StatusOK, "application/octet-stream", make([]byte, size))
+	})
+
+	requests := []struct {
+		method        string
+		target        string
+		client        string
+		body          []byte
+		contentLength int64 // заявленная длина, 0 - фактическая
+	}{
+		{http.MethodPost, "/upload", "mobile", make([]byte, 1000), 0},
+		{http.MethodGet, "/download?size=300", "mobile", nil, 0},
+		{http.MethodPost, "/upload", "mobile", make([]byte, 200), 5000}, // заявлена неверная длина
+		{http.MethodPost, "/upload/partial", "web", make([]byte, 1000), 0},
+		{http.MethodGet, "/download?size=50", "web", nil, 0},
+	}
+
+	for _, tt := range requests {
+		req := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(tt.body))
+		if tt.contentLength > 0 {
+			req.ContentLength = tt.contentLength
+		}
+		req.Header.Set("Authorization", tt.client)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Учитываются фактически прочитанные и записанные байты
+	want := []TransferUsage{
+		{Client: "mobile", BytesUploaded: 1200, BytesDownloaded: 300},
+		{Client: "web", BytesUploaded: 10, BytesDownloaded: 50},
+	}
+	got := accounting.Usage()
+	if len(got) != len(want) {
+		t.Fatalf("Usage() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Usage()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// Поддерживаемые кодировки ответов
+const (
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+// flushWriter - кодировщик, умеющий сбрасывать буфер (gzip и brotli)
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Compress сжимает JSON-ответы кодировкой из encodings, которую клиент
+// принимает в Accept-Encoding. Из принимаемых клиентом выбирается кодировка
+// с наибольшим q; при равных q - та, что раньше в encodings. Содержимое файлов
+// (в том числе JSON-файлы и диапазоны), миниатюры и multipart не сжимаются.
+// Пустой encodings отключает сжатие
+func Compress(encodings []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(encodings) == 0 || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"), encodings)
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = w
+		c.Next()
+		w.close()
+	}
+}
+
+// AcceptsEncoding сообщает, принимает ли клиент кодировку encoding
+// по заголовку Accept-Encoding
+func AcceptsEncoding(header, encoding string) bool {
+	return negotiateEncoding(header, []string{encoding}) == encoding
+}
+
+// negotiateEncoding выбирает кодировку из supported по заголовку Accept-Encoding
+func negotiateEncoding(header string, supported []string) string {
+	accepted := make(map[string]float64)
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			accepted[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supported {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter решает, сжимать ли ответ, при первой записи тела, когда
+// Content-Type уже выставлен обработчиком
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	encoder  flushWriter
+	decided  bool
+}
+
+func (w *compressWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	header := w.Header()
+	if !strings.HasPrefix(header.Get("Content-Type"), "application/json") || header.Get("Content-Encoding") != "" {
+		return
+	}
+	// Скачиваемый файл отдается байт в байт: к этим байтам относятся
+	// Content-Range, ETag и X-Checksum-SHA256
+	if header.Get("Content-Range") != "" || strings.HasPrefix(header.Get("Content-Disposition"), "attachment") {
+		return
+	}
+
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	switch w.encoding {
+	case EncodingBrotli:
+		w.encoder = brotli.NewWriter(w.ResponseWriter)
+	case EncodingGzip:
+		w.encoder = gzip.NewWriter(w.ResponseWriter)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.encoder == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.encoder.Write(data)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Flush() {
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) close() {
+	if w.encoder != nil {
+		w.encoder.Close()
+	}
+}
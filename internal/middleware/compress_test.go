@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCompress(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	payload := gin.H{"files": strings.Repeat("photo.png ", 200)}
+	content := bytes.Repeat([]byte("binary content "), 200)
+	// Хранимый JSON-файл: отдается как содержимое, а не как ответ API
+	jsonFile := []byte(`{"stored": "` + strings.Repeat("data ", 200) + `"}`)
+
+	tests := []struct {
+		name           string
+		encodings      []string
+		method         string
+		target         string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"brotli requested", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files", "br", EncodingBrotli},
+		{"gzip requested", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files", "gzip", EncodingGzip},
+		{"both accepted, server order", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files", "gzip, br", EncodingBrotli},
+		{"client prefers gzip", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files", "br;q=0.5, gzip", EncodingGzip},
+		{"brotli refused", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files", "br;q=0, gzip;q=0.1", EncodingGzip},
+		{"wildcard", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files", "*", EncodingBrotli},
+		{"brotli not configured", []string{EncodingGzip}, http.MethodGet, "/files", "br", ""},
+		{"compression disabled", nil, http.MethodGet, "/files", "br, gzip", ""},
+		{"no Accept-Encoding", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files", "", ""},
+		// Содержимое файлов отдается без сжатия
+		{"download", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files/1/content", "br", ""},
+		{"JSON file download", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files/2/content", "br", ""},
+		{"JSON file range", []string{EncodingBrotli, EncodingGzip}, http.MethodGet, "/files/2/range", "br", ""},
+		{"HEAD", []string{EncodingBrotli, EncodingGzip}, http.MethodHead, "/files", "br", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(Compress(tt.encodings))
+			router.Handle(tt.method, "/files", func(c *gin.Context) { c.JSON(http.StatusOK, payload) })
+			router.GET("/files/1/content", func(c *gin.Context) { c.Data(http.StatusOK, "image/png", content) })
+			router.GET("/files/2/content", func(c *gin.Context) {
+				c.Header("Content-Disposition", `attachment; filename="data.json"`)
+				c.Header("X-Checksum-SHA256", "checksum")
+				c.Data(http.StatusOK, "application/json", jsonFile)
+			})
+			router.GET("/files/2/range", func(c *gin.Context) {
+				c.Header("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(jsonFile)-1, len(jsonFile)+100))
+				c.Data(http.StatusPartialContent, "application/json", jsonFile)
+			})
+
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK && w.Code != http.StatusPartialContent {
+				t.Fatalf("status %d, want 200 or 206", w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding %q, want %q", got, tt.wantEncoding)
+			}
+			if tt.method == http.MethodHead {
+				return
+			}
+
+			var body io.Reader = w.Body
+			switch tt.wantEncoding {
+			case EncodingBrotli:
+				body = brotli.NewReader(w.Body)
+			case EncodingGzip:
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("decode %q body: %v", tt.wantEncoding, err)
+			}
+
+			// Тело после распаковки совпадает с несжатым ответом
+			want := content
+			switch {
+			case tt.target == "/files":
+				want, _ = json.Marshal(payload)
+			case strings.HasPrefix(tt.target, "/files/2/"):
+				want = jsonFile
+			}
+			if !bytes.Equal(data, want) {
+				t.Errorf("decoded body differs from the uncompressed response")
+			}
+		})
+	}
+}
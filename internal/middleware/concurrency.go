@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConcurrencyLimiter ограничивает число одновременно выполняемых запросов
+// на каждый ключ
+type ConcurrencyLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+	limit  int
+}
+
+// NewConcurrencyLimiter создает ограничитель на limit одновременных запросов
+// на ключ. При limit <= 0 возвращает nil - ограничение отключено
+func NewConcurrencyLimiter(limit int) *ConcurrencyLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &ConcurrencyLimiter{active: make(map[string]int), limit: limit}
+}
+
+// Acquire занимает слот ключа. Возвращает false, если все слоты заняты
+func (l *ConcurrencyLimiter) Acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[key] >= l.limit {
+		return false
+	}
+	l.active[key]++
+	return true
+}
+
+// Release освобождает слот ключа, занятый Acquire
+func (l *ConcurrencyLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[key] <= 1 {
+		delete(l.active, key)
+		return
+	}
+	l.active[key]--
+}
+
+// ConcurrencyLimit ограничивает число одновременных запросов каждого API
+// ключа (например, скачиваний больших файлов). Слот освобождается, когда
+// обработчик завершился: поток отдан целиком или клиент отключился.
+// nil-ограничитель пропускает все запросы
+func ConcurrencyLimit(limiter *ConcurrencyLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiter == nil {
+			c.Next()
+			return
+		}
+
+		key := c.GetHeader("Authorization")
+		if !limiter.Acquire(key) {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many concurrent downloads"})
+			return
+		}
+		defer limiter.Release(key)
+		c.Next()
+	}
+}
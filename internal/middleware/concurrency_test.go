@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const limit = 2
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	router := gin.New()
+	router.GET("/download", ConcurrencyLimit(NewConcurrencyLimiter(limit)), func(c *gin.Context) {
+		if c.Query("block") == "true" {
+			started <- struct{}{}
+			<-release
+		}
+		c.Status(http.StatusOK)
+	})
+
+	request := func(key string, block bool) *httptest.ResponseRecorder {
+		target := "/download"
+		if block {
+			target += "?block=true"
+		}
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Occupy every slot of key "a" with downloads that are still streaming
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := request("a", true); w.Code != http.StatusOK {
+				t.Errorf("download within the limit: status %d, want 200", w.Code)
+			}
+		}()
+		<-started
+	}
+
+	w := request("a", false)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("download over the limit: status %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("429 response has no Retry-After header")
+	}
+
+	if w := request("b", false); w.Code != http.StatusOK {
+		t.Errorf("other key: status %d, want 200", w.Code)
+	}
+
+	// Finished downloads free their slots
+	close(release)
+	wg.Wait()
+	if w := request("a", false); w.Code != http.StatusOK {
+		t.Errorf("after release: status %d, want 200", w.Code)
+	}
+}
+
+func TestConcurrencyLimitDisabled(t *testing.T) {
+	if NewConcurrencyLimiter(0) != nil {
+		t.Fatal("limit 0 should disable the limiter")
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/download", ConcurrencyLimit(nil), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/download", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", w.Code)
+	}
+}
+
+func TestConcurrencyLimitClientDisconnect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	finished := make(chan struct{}, 1)
+	router := gin.New()
+	router.GET("/download", ConcurrencyLimit(NewConcurrencyLimiter(1)), func(c *gin.Context) {
+		if c.Query("stream") != "true" {
+			c.Status(http.StatusOK)
+			return
+		}
+		// Поток не заканчивается, пока клиент не отключится
+		c.Writer.WriteString("first chunk")
+		c.Writer.Flush()
+		<-c.Request.Context().Done()
+		finished <- struct{}{}
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	get := func(ctx context.Context, target string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "a")
+		return http.DefaultClient.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := get(ctx, "/download?stream=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Body.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = get(context.Background(), "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("download while streaming: status %d, want 429", resp.StatusCode)
+	}
+
+	// Отключение клиента освобождает слот
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not notice the disconnect")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := get(context.Background(), "/download")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after disconnect: status %d, want 200", resp.StatusCode)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// RequestIDHeader - заголовок с идентификатором запроса
+	RequestIDHeader = "X-Request-ID"
+
+	// Ключи контекста gin
+	RequestIDKey    = "request_id"
+	ClientLabelKey  = "client_label"
+	ClientScopesKey = "client_scopes"
+)
+
+// RequestID берет идентификатор запроса из заголовка X-Request-ID или
+// генерирует новый и возвращает его клиенту
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = uuid.New().String()
+		}
+
+		c.Set(RequestIDKey, requestID)
+		c.Header(RequestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// accessLogEntry - одна строка журнала доступа
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Bytes     int     `json:"bytes"`
+	RequestID string  `json:"request_id"`
+	Client    string  `json:"client"`
+}
+
+// AccessLog пишет одну структурированную строку на каждый запрос.
+// format - "json" или "text"
+func AccessLog(out io.Writer, format string) gin.HandlerFunc {
+	logger := log.New(out, "", 0)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		bytes := c.Writer.Size()
+		if bytes < 0 {
+			bytes = 0
+		}
+
+		entry := accessLogEntry{
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Status:    c.Writer.Status(),
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			Bytes:     bytes,
+			RequestID: c.GetString(RequestIDKey),
+			Client:    c.GetString(ClientLabelKey),
+		}
+
+		if format == "json" {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				logger.Printf("access log encode error: %v", err)
+				return
+			}
+			logger.Println(string(line))
+			return
+		}
+
+		logger.Printf("time=%s method=%s path=%q status=%d latency_ms=%.3f bytes=%d request_id=%s client=%q",
+			entry.Time, entry.Method, entry.Path, entry.Status, entry.LatencyMs, entry.Bytes, entry.RequestID, entry.Client)
+	}
+}
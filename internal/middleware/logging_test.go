@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccessLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		format string
+		check  func(t *testing.T, line string)
+	}{
+		{
+			name:   "json",
+			format: "json",
+			check: func(t *testing.T, line string) {
+				var entry accessLogEntry
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("line %q is not JSON: %v", line, err)
+				}
+				if entry.Method != http.MethodPost || entry.Path != "/files/abc" || entry.Status != http.StatusCreated ||
+					entry.Bytes != len("created") || entry.RequestID != "req-1" || entry.Client != "mobile" {
+					t.Errorf("entry = %+v", entry)
+				}
+				if entry.LatencyMs < 0 || entry.Time == "" {
+					t.Errorf("latency %v, time %q", entry.LatencyMs, entry.Time)
+				}
+			},
+		},
+		{
+			name:   "text",
+			format: "text",
+			check: func(t *testing.T, line string) {
+				want := regexp.MustCompile(`^time=\S+ method=POST path="/files/abc" status=201 latency_ms=\d+\.\d{3} bytes=7 request_id=req-1 client="mobile"$`)
+				if !want.MatchString(line) {
+					t.Errorf("line %q does not match %s", line, want)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			router := gin.New()
+			router.Use(RequestID(), AccessLog(&out, tt.format), func(c *gin.Context) {
+				c.Set(ClientLabelKey, "mobile")
+			})
+			router.POST("/files/:id", func(c *gin.Context) { c.String(http.StatusCreated, "created") })
+
+			req := httptest.NewRequest(http.MethodPost, "/files/abc?token=secret", nil)
+			req.Header.Set(RequestIDHeader, "req-1")
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			// Одна строка на запрос, без строки запроса в пути
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("logged %d lines, want 1: %q", len(lines), out.String())
+			}
+			if strings.Contains(lines[0], "secret") {
+				t.Errorf("query string leaked into the log: %q", lines[0])
+			}
+			tt.check(t, lines[0])
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimiter - ограничитель частоты запросов по алгоритму token bucket
+// с отдельной корзиной на каждый ключ
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	rate    float64 // токенов в секунду
+	burst   float64
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter создает ограничитель на perMinute запросов в минуту
+// с допустимым всплеском burst запросов
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &RateLimiter{
+		buckets: make(map[string]*bucket),
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+	}
+}
+
+// Allow расходует токен ключа. Если токенов нет, возвращает false и время
+// до появления следующего токена
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		l.cleanup(now)
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Minute
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// cleanup удаляет корзины, которые успели полностью восстановиться,
+// чтобы карта не росла бесконечно
+func (l *RateLimiter) cleanup(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimit ограничивает частоту запросов для каждого API ключа
+func RateLimit(limiter *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, retryAfter := limiter.Allow(c.GetHeader("Authorization"))
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// When применяет middleware только к запросам, удовлетворяющим условию
+func When(condition func(*gin.Context) bool, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if condition(c) {
+			handler(c)
+			return
+		}
+		c.Next()
+	}
+}
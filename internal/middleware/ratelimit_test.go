@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPresignRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const burst = 3
+	router := gin.New()
+	presignLimit := RateLimit(NewRateLimiter(1, burst))
+	uploadLimit := RateLimit(NewRateLimiter(60, 100))
+	router.GET("/files/:id/presign", presignLimit, func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/files/:id", When(func(c *gin.Context) bool { return c.Query("expand") == "true" }, presignLimit),
+		func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/upload", uploadLimit, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(method, target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Ключ "a" расходует всю корзину подписанных ссылок
+	for i := 0; i < burst; i++ {
+		if w := request(http.MethodGet, "/files/1/presign", "a"); w.Code != http.StatusOK {
+			t.Fatalf("presign %d within the burst: status %d, want 200", i+1, w.Code)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		key        string
+		wantStatus int
+	}{
+		{"presign over the limit", http.MethodGet, "/files/1/presign", "a", http.StatusTooManyRequests},
+		{"expanded metadata shares the presign bucket", http.MethodGet, "/files/1?expand=true", "a", http.StatusTooManyRequests},
+		{"plain metadata is not limited", http.MethodGet, "/files/1", "a", http.StatusOK},
+		{"upload limiter is independent", http.MethodPost, "/upload", "a", http.StatusOK},
+		{"other keys keep their own bucket", http.MethodGet, "/files/1/presign", "b", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(tt.method, tt.target, tt.key)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusTooManyRequests {
+				return
+			}
+			retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			if err != nil || retryAfter < 1 || retryAfter > 60 {
+				t.Errorf("Retry-After = %q, want 1..60 seconds", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrSlowUpload возвращается при чтении тела запроса, если клиент передает
+// данные медленнее допустимого минимума
+var ErrSlowUpload = errors.New("request body is arriving too slowly")
+
+// SlowReadGuard защищает от slowloris-загрузок: каждое чтение тела ограничено
+// таймаутом простоя idleTimeout, а после grace средняя скорость передачи не
+// должна опускаться ниже minRate байт в секунду. Медленные, но равномерные
+// загрузки при этом не ограничиваются по общей длительности
+func SlowReadGuard(idleTimeout time.Duration, minRate int64, grace time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		rc := http.NewResponseController(c.Writer)
+		c.Request.Body = &slowReadBody{
+			body:    c.Request.Body,
+			rc:      rc,
+			idle:    idleTimeout,
+			minRate: float64(minRate),
+			grace:   grace,
+			start:   time.Now(),
+		}
+
+		c.Next()
+
+		// Снимаем дедлайн, чтобы он не повлиял на следующий запрос keep-alive
+		if idleTimeout > 0 {
+			_ = rc.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+type slowReadBody struct {
+	body    io.ReadCloser
+	rc      *http.ResponseController
+	idle    time.Duration
+	minRate float64
+	grace   time.Duration
+	start   time.Time
+	read    int64
+}
+
+func (b *slowReadBody) Read(p []byte) (int, error) {
+	if b.idle > 0 {
+		_ = b.rc.SetReadDeadline(time.Now().Add(b.idle))
+	}
+
+	n, err := b.body.Read(p)
+	b.read += int64(n)
+
+	if err == nil && b.minRate > 0 {
+		elapsed := time.Since(b.start)
+		if elapsed > b.grace && float64(b.read)/elapsed.Seconds() < b.minRate {
+			return n, ErrSlowUpload
+		}
+	}
+	return n, err
+}
+
+func (b *slowReadBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tricklingReader отдает тело запроса порциями chunk байт с паузой delay
+type tricklingReader struct {
+	remaining int
+	chunk     int
+	delay     time.Duration
+}
+
+func (r *tricklingReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := min(r.chunk, r.remaining, len(p))
+	for i := range p[:n] {
+		p[i] = 'a'
+	}
+	r.remaining -= n
+	return n, nil
+}
+
+func TestSlowReadGuard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name     string
+		body     *tricklingReader
+		minRate  int64
+		grace    time.Duration
+		wantSlow bool
+	}{
+		{"trickling client is aborted", &tricklingReader{remaining: 100, chunk: 1, delay: 5 * time.Millisecond}, 1000, 20 * time.Millisecond, true},
+		{"slow but steady upload passes", &tricklingReader{remaining: 2000, chunk: 100, delay: 5 * time.Millisecond}, 1000, 20 * time.Millisecond, false},
+		{"trickle within the grace period passes", &tricklingReader{remaining: 5, chunk: 1, delay: 2 * time.Millisecond}, 1000, time.Second, false},
+		{"rate floor disabled", &tricklingReader{remaining: 20, chunk: 1, delay: 5 * time.Millisecond}, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				readErr error
+				read    int
+			)
+			router := gin.New()
+			router.Use(SlowReadGuard(0, tt.minRate, tt.grace))
+			router.POST("/upload", func(c *gin.Context) {
+				data, err := io.ReadAll(c.Request.Body)
+				read, readErr = len(data), err
+				c.Status(http.StatusOK)
+			})
+
+			total := tt.body.remaining
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", tt.body))
+
+			if slow := errors.Is(readErr, ErrSlowUpload); slow != tt.wantSlow {
+				t.Fatalf("read error = %v, want slow upload %t", readErr, tt.wantSlow)
+			}
+			if tt.wantSlow {
+				if read >= total {
+					t.Errorf("read the whole %d-byte body before aborting", total)
+				}
+				return
+			}
+			if readErr != nil || read != total {
+				t.Errorf("read %d bytes with error %v, want %d", read, readErr, total)
+			}
+		})
+	}
+}
+
+func TestSlowReadGuardIdleTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	readErr := make(chan error, 1)
+	router := gin.New()
+	router.Use(SlowReadGuard(50*time.Millisecond, 0, 0))
+	router.POST("/upload", func(c *gin.Context) {
+		_, err := io.ReadAll(c.Request.Body)
+		readErr <- err
+		c.Status(http.StatusRequestTimeout)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// Клиент объявляет 100 байт, отправляет часть и замолкает
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 100\r\n\r\n0123456789")
+
+	select {
+	case err := <-readErr:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("read error = %v, want an idle timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled upload was not aborted")
+	}
+}
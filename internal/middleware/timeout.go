@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Timeout ограничивает время обработки запроса дедлайном контекста: по его
+// истечении обращения к Minio и MongoDB прерываются. Для маршрутов из routes
+// (ключ "METHOD /path" в виде шаблона gin) используется свой таймаут, для
+// остальных - defaultTimeout. Таймаут 0 снимает ограничение
+func Timeout(defaultTimeout time.Duration, routes map[string]time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout, ok := routes[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			timeout = defaultTimeout
+		}
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// ParseRouteTimeouts разбирает таймауты маршрутов из конфигурации
+// ("post /api/v1/upload" -> "10m") и проверяет ключи и значения
+func ParseRouteTimeouts(raw map[string]string) (map[string]time.Duration, error) {
+	routes := make(map[string]time.Duration, len(raw))
+	for key, value := range raw {
+		method, path, ok := strings.Cut(strings.TrimSpace(key), " ")
+		path = strings.TrimSpace(path)
+		if !ok || method == "" || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid route %q, expected \"METHOD /path\"", key)
+		}
+
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for route %q: %w", key, err)
+		}
+		if timeout < 0 {
+			return nil, fmt.Errorf("negative timeout for route %q", key)
+		}
+
+		routes[strings.ToUpper(method)+" "+path] = timeout
+	}
+	return routes, nil
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const defaultTimeout = 30 * time.Second
+	routes, err := ParseRouteTimeouts(map[string]string{
+		"post /api/v1/upload":           "10m",
+		"get /api/v1/files/:id/content": "0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining time.Duration
+	var hasDeadline bool
+	router := gin.New()
+	router.Use(Timeout(defaultTimeout, routes))
+	record := func(c *gin.Context) {
+		var deadline time.Time
+		deadline, hasDeadline = c.Request.Context().Deadline()
+		remaining = time.Until(deadline)
+		c.Status(http.StatusOK)
+	}
+	router.POST("/api/v1/upload", record)
+	router.GET("/api/v1/files/:id", record)
+	router.PUT("/api/v1/files/:id", record)
+	router.GET("/api/v1/files/:id/content", record)
+
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		wantDeadline bool
+		wantTimeout  time.Duration
+	}{
+		{"upload gets the route timeout", http.MethodPost, "/api/v1/upload", true, 10 * time.Minute},
+		{"metadata gets the default", http.MethodGet, "/api/v1/files/1", true, defaultTimeout},
+		{"other method of a configured path", http.MethodPut, "/api/v1/files/1", true, defaultTimeout},
+		{"zero disables the deadline", http.MethodGet, "/api/v1/files/1/content", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.target, nil))
+
+			if hasDeadline != tt.wantDeadline {
+				t.Fatalf("deadline set = %t, want %t", hasDeadline, tt.wantDeadline)
+			}
+			if tt.wantDeadline && (remaining > tt.wantTimeout || remaining < tt.wantTimeout-time.Second) {
+				t.Errorf("deadline in %s, want %s", remaining, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestParseRouteTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     map[string]string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{"method is upper-cased", map[string]string{"post /api/v1/upload": "10m"}, map[string]time.Duration{"POST /api/v1/upload": 10 * time.Minute}, false},
+		{"surrounding spaces", map[string]string{" get  /api/v1/files/:id ": "5s"}, map[string]time.Duration{"GET /api/v1/files/:id": 5 * time.Second}, false},
+		{"zero timeout", map[string]string{"GET /api/v1/files/:id/events": "0"}, map[string]time.Duration{"GET /api/v1/files/:id/events": 0}, false},
+		{"no method", map[string]string{"/api/v1/upload": "10m"}, nil, true},
+		{"relative path", map[string]string{"POST api/v1/upload": "10m"}, nil, true},
+		{"invalid duration", map[string]string{"POST /api/v1/upload": "ten minutes"}, nil, true},
+		{"negative duration", map[string]string{"POST /api/v1/upload": "-1s"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRouteTimeouts(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRouteTimeouts(%v) error = %v, want error %t", tt.raw, err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseRouteTimeouts(%v) = %v, want %v", tt.raw, got, tt.want)
+			}
+			for route, timeout := range tt.want {
+				if got[route] != timeout {
+					t.Errorf("timeout of %q = %s, want %s", route, got[route], timeout)
+				}
+			}
+		})
+	}
+}
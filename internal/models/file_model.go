@@ -3,11 +3,73 @@ package models
 import "time"
 
 type FileMetadata struct {
-    ID          string    `bson:"_id"`
-    OriginalName string   `bson:"original_name"`
-    FileSize    int64     `bson:"file_size"`
-    ContentType string    `bson:"content_type"`
-    BucketName  string    `bson:"bucket_name"`
-    UploadDate  time.Time `bson:"upload_date"`
-    URL         string    `bson:"url"`
-}
\ No newline at end of file
+    ID          string    `bson:"_id" xml:"id" json:"id"`
+    OriginalName string   `bson:"original_name" xml:"original_name" json:"original_name"`
+    FileSize    int64     `bson:"file_size" xml:"file_size" json:"file_size"`
+    ContentType string    `bson:"content_type" xml:"content_type" json:"content_type"`
+    BucketName  string    `bson:"bucket_name" xml:"bucket_name" json:"bucket_name"`
+    ObjectName  string    `bson:"object_name" xml:"object_name" json:"object_name"`
+    UploadDate  time.Time `bson:"upload_date" xml:"upload_date" json:"upload_date"`
+    URL         string    `bson:"url" xml:"url" json:"url"`
+    Description string    `bson:"description,omitempty" xml:"description,omitempty" json:"description,omitempty"`
+    Tags        []string  `bson:"tags,omitempty" xml:"tags>tag,omitempty" json:"tags,omitempty"`
+
+    // После этой даты файл хранится, но недоступен для чтения (410 Gone)
+    AccessibleUntil *time.Time `bson:"accessible_until,omitempty" xml:"accessible_until,omitempty" json:"accessible_until,omitempty"`
+
+    ContentEncoding string `bson:"content_encoding,omitempty" xml:"content_encoding,omitempty" json:"content_encoding,omitempty"`
+    DownloadCount   int64  `bson:"download_count" xml:"download_count" json:"download_count"`
+    // Время последнего скачивания; пусто - файл не скачивали
+    LastAccessed *time.Time `bson:"last_accessed,omitempty" xml:"last_accessed,omitempty" json:"last_accessed,omitempty"`
+    // Класс хранения, назначенный по частоте обращений; пусто - обычный
+    StorageTier string `bson:"storage_tier,omitempty" xml:"storage_tier,omitempty" json:"storage_tier,omitempty"`
+
+    // Контрольная сумма сохраненного объекта, подтвержденная хранилищем
+    Checksum          string `bson:"checksum,omitempty" xml:"checksum,omitempty" json:"checksum,omitempty"`
+    ChecksumAlgorithm string `bson:"checksum_algorithm,omitempty" xml:"checksum_algorithm,omitempty" json:"checksum_algorithm,omitempty"`
+    // SHA-256 исходного содержимого (hex), вычисляется сервисом при загрузке
+    ContentSHA256 string `bson:"sha256,omitempty" xml:"sha256,omitempty" json:"sha256,omitempty"`
+
+    ThumbnailURL    string `bson:"thumbnail_url,omitempty" xml:"thumbnail_url,omitempty" json:"thumbnail_url,omitempty"`
+    ThumbnailStatus string `bson:"thumbnail_status,omitempty" xml:"thumbnail_status,omitempty" json:"thumbnail_status,omitempty"`
+    // Причина последней неудачной генерации миниатюры
+    ThumbnailError string `bson:"thumbnail_error,omitempty" xml:"thumbnail_error,omitempty" json:"thumbnail_error,omitempty"`
+    // Бакет миниатюры; пусто - миниатюра лежит в бакете оригинала
+    ThumbnailBucket string `bson:"thumbnail_bucket,omitempty" xml:"thumbnail_bucket,omitempty" json:"thumbnail_bucket,omitempty"`
+}
+
+// Статусы генерации миниатюры
+const (
+    ThumbnailPending = "pending"
+    ThumbnailReady   = "ready"
+    ThumbnailFailed  = "failed"
+)
+
+// StorageTierCold - файл давно не скачивали, объект помечен тегом COLD_TIER_TAG
+const StorageTierCold = "cold"
+
+// MetadataPatch - частичное обновление метаданных; nil-поля не изменяются
+type MetadataPatch struct {
+    Description     *string
+    Tags            *[]string
+    AccessibleUntil *time.Time
+
+    // Поля содержимого, обновляемые при замене байтов объекта
+    FileSize          *int64
+    ContentType       *string
+    ContentEncoding   *string
+    Checksum          *string
+    ChecksumAlgorithm *string
+    ContentSHA256     *string
+    UploadDate        *time.Time
+    // Ключ и URL объекта меняются, если прежний объект общий с другими файлами
+    ObjectName *string
+    URL        *string
+}
+// UsageSnapshot - суточный срез занятого места; один документ на день (UTC)
+type UsageSnapshot struct {
+    ID         string    `bson:"_id" json:"date"`
+    TakenAt    time.Time `bson:"taken_at" json:"taken_at"`
+    TotalBytes int64     `bson:"total_bytes" json:"total_bytes"`
+    FileCount  int64     `bson:"file_count" json:"file_count"`
+}
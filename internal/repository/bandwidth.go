@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// minBandwidthBurst - минимальный объем корзины, чтобы чтение не дробилось
+// на слишком мелкие порции при низком лимите
+const minBandwidthBurst = 32 << 10
+
+// BandwidthLimiter - общий для всех передач ограничитель пропускной
+// способности по алгоритму token bucket: токен - один байт. Корзина вмещает
+// секунду трафика, поэтому кратковременные всплески сглаживаются до лимита
+type BandwidthLimiter struct {
+    mu     sync.Mutex
+    rate   float64 // байт в секунду
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+// NewBandwidthLimiter создает ограничитель на bytesPerSecond байт в секунду.
+// При bytesPerSecond <= 0 возвращает nil - ограничение отключено
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+    if bytesPerSecond <= 0 {
+        return nil
+    }
+    burst := math.Max(float64(bytesPerSecond), minBandwidthBurst)
+    return &BandwidthLimiter{
+        rate:   float64(bytesPerSecond),
+        burst:  burst,
+        tokens: burst,
+        last:   time.Now(),
+    }
+}
+
+// wait резервирует n байт и ждет, пока резерв не покроется накопленными
+// токенами. Резервирование сразу уменьшает корзину, так что параллельные
+// передачи делят лимит, а не превышают его каждая по отдельности
+func (l *BandwidthLimiter) wait(ctx context.Context, n int) error {
+    l.mu.Lock()
+    now := time.Now()
+    l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+    l.last = now
+    l.tokens -= float64(n)
+    deficit := -l.tokens
+    l.mu.Unlock()
+
+    if deficit <= 0 {
+        return nil
+    }
+
+    timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+    defer timer.Stop()
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-timer.C:
+        return nil
+    }
+}
+
+// Reader оборачивает r так, что чтение из него укладывается в лимит.
+// nil-ограничитель возвращает r без изменений
+func (l *BandwidthLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+    if l == nil {
+        return r
+    }
+    return &throttledReader{ctx: ctx, r: r, limiter: l}
+}
+
+// ReadCloser - то же, что Reader, с сохранением Close исходного потока
+func (l *BandwidthLimiter) ReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+    if l == nil {
+        return rc
+    }
+    return &throttledReadCloser{
+        throttledReader: throttledReader{ctx: ctx, r: rc, limiter: l},
+        closer:          rc,
+    }
+}
+
+type throttledReader struct {
+    ctx     context.Context
+    r       io.Reader
+    limiter *BandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+    // Одно чтение не больше корзины, иначе резерв растянулся бы на секунды
+    if limit := int(t.limiter.burst); len(p) > limit {
+        p = p[:limit]
+    }
+
+    n, err := t.r.Read(p)
+    if n > 0 {
+        if waitErr := t.limiter.wait(t.ctx, n); waitErr != nil {
+            return n, waitErr
+        }
+    }
+    return n, err
+}
+
+type throttledReadCloser struct {
+    throttledReader
+    closer io.Closer
+}
+
+func (t *throttledReadCloser) Close() error {
+    return t.closer.Close()
+}
@@ -0,0 +1,136 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"kuber-code-s3/internal/repository"
+	"kuber-code-s3/internal/repository/repotest"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	const rate = 2 << 20 // 2 МиБ/с, корзина - секунда трафика
+
+	tests := []struct {
+		name    string
+		rate    int64
+		readers int
+		size    int // байт на один поток
+		// Ожидаемое время: все, что сверх корзины, передается со скоростью rate
+		want time.Duration
+	}{
+		{"single stream", rate, 1, 3 << 20, 500 * time.Millisecond},
+		{"concurrent streams share the limit", rate, 3, 1 << 20, 500 * time.Millisecond},
+		{"within the burst", rate, 1, 1 << 20, 0},
+		{"limit disabled", 0, 1, 8 << 20, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := repository.NewBandwidthLimiter(tt.rate)
+			if (limiter == nil) != (tt.rate <= 0) {
+				t.Fatalf("NewBandwidthLimiter(%d) = %v", tt.rate, limiter)
+			}
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			for i := 0; i < tt.readers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r := limiter.Reader(context.Background(), bytes.NewReader(make([]byte, tt.size)))
+					n, err := io.Copy(io.Discard, r)
+					if err != nil || n != int64(tt.size) {
+						t.Errorf("read %d bytes, %v; want %d", n, err, tt.size)
+					}
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+
+			if elapsed < tt.want*9/10 || elapsed > tt.want+300*time.Millisecond {
+				t.Errorf("transfer took %s, want about %s", elapsed, tt.want)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimiterCancelled(t *testing.T) {
+	limiter := repository.NewBandwidthLimiter(64 << 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Ожидание токенов прерывается отменой запроса
+	start := time.Now()
+	_, err := io.Copy(io.Discard, limiter.Reader(ctx, bytes.NewReader(make([]byte, 1<<20))))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled read returned after %s", elapsed)
+	}
+}
+
+func TestMinioRepositoryBandwidth(t *testing.T) {
+	const (
+		rate = 2 << 20
+		size = 3 << 20
+	)
+
+	tests := []struct {
+		name          string
+		limitUpload   bool
+		limitDownload bool
+		upload        bool          // замеряется загрузка, иначе скачивание
+		want          time.Duration // время передачи сверх корзины
+	}{
+		{"upload limited", true, false, true, 500 * time.Millisecond},
+		{"download limited", false, true, false, 500 * time.Millisecond},
+		{"upload not limited by the download limit", false, true, true, 0},
+		{"download not limited by the upload limit", true, false, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := repotest.NewS3(t, "files")
+			repo := s3.Repository(t, "files")
+			var upload, download *repository.BandwidthLimiter
+			if tt.limitUpload {
+				upload = repository.NewBandwidthLimiter(rate)
+			}
+			if tt.limitDownload {
+				download = repository.NewBandwidthLimiter(rate)
+			}
+			repo.SetBandwidthLimiters(upload, download)
+
+			ctx := context.Background()
+			start := time.Now()
+			if tt.upload {
+				if _, err := repo.PutObjectStream(ctx, "file.bin", bytes.NewReader(make([]byte, size)), size, "application/octet-stream", ""); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				s3.Put("files", "file.bin", repotest.Object{Data: make([]byte, size)})
+				body, err := repo.GetObject(ctx, "file.bin")
+				if err != nil {
+					t.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, body)
+				body.Close()
+				if err != nil || n != size {
+					t.Fatalf("downloaded %d bytes, %v; want %d", n, err, size)
+				}
+			}
+			elapsed := time.Since(start)
+
+			if elapsed < tt.want*9/10 || elapsed > tt.want+300*time.Millisecond {
+				t.Errorf("transfer took %s, want about %s", elapsed, tt.want)
+			}
+		})
+	}
+}
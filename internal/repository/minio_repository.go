@@ -3,17 +3,48 @@ package repository
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
 )
 
 type MinioRepository struct {
     client *minio.Client
     Bucket string
+
+    // Заголовки кеширования, передаваемые в подписанных ссылках
+    presignCacheControl string
+    presignSetExpires   bool
+
+    // Алгоритм контрольной суммы, передаваемой с загружаемыми объектами
+    checksumAlgorithm string
+    // Число частей multipart-загрузки, передаваемых в Minio параллельно
+    partConcurrency uint
+    // Общие ограничители трафика в Minio и из него; nil - без ограничения
+    uploadLimiter   *BandwidthLimiter
+    downloadLimiter *BandwidthLimiter
+}
+
+// Алгоритмы контрольных сумм объектов
+const (
+    ChecksumMD5    = "md5"
+    ChecksumSHA256 = "sha256"
+    ChecksumCRC32C = "crc32c"
+)
+
+// UploadResult описывает загруженный объект
+type UploadResult struct {
+    URL string
+    // Контрольная сумма, подтвержденная хранилищем (base64 для sha256 и
+    // crc32c, hex для md5); пусто, если алгоритм не задан
+    Checksum string
 }
 
 const (
@@ -26,10 +57,15 @@ const (
 var (
     ErrFileNotFound     = fmt.Errorf("file not found in storage")
     ErrBucketNotCreated = fmt.Errorf("failed to create bucket")
+    ErrBucketNotFound   = fmt.Errorf("bucket does not exist")
+    ErrUnknownChecksum  = fmt.Errorf("unknown checksum algorithm")
+    ErrBadDigest        = fmt.Errorf("stored content does not match its checksum")
 )
 
-// NewMinioRepository создает новое подключение к Minio и проверяет существование бакета
-func NewMinioRepository(endpoint, accessKey, secretKey string, useSSL bool, bucketName string) (*MinioRepository, error) {
+// NewMinioRepository создает новое подключение к Minio и проверяет существование
+// бакета. Отсутствующий бакет создается только при createBucket, иначе
+// возвращается ErrBucketNotFound
+func NewMinioRepository(endpoint, accessKey, secretKey string, useSSL bool, bucketName string, createBucket bool) (*MinioRepository, error) {
     ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
     defer cancel()
 
@@ -38,6 +74,8 @@ func NewMinioRepository(endpoint, accessKey, secretKey string, useSSL bool, buck
         Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
         Secure: useSSL,
         Region: defaultRegion,
+        // Нужны для передачи контрольных сумм CRC32C и SHA256 в трейлере запроса
+        TrailingHeaders: true,
     })
     if err != nil {
         return nil, fmt.Errorf("minio connection error: %w", err)
@@ -49,6 +87,10 @@ func NewMinioRepository(endpoint, accessKey, secretKey string, useSSL bool, buck
         return nil, fmt.Errorf("bucket check error: %w", err)
     }
 
+    if !exists && !createBucket {
+        return nil, fmt.Errorf("%w: %s", ErrBucketNotFound, bucketName)
+    }
+
     // Создание бакета если не существует
     if !exists {
         err = client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{
@@ -77,22 +119,206 @@ func NewMinioRepository(endpoint, accessKey, secretKey string, useSSL bool, buck
     }
 }
 
-// UploadFile загружает файл в Minio и возвращает URL
-func (m *MinioRepository) UploadFile(ctx context.Context, objectName, filePath, contentType string) (string, error) {
-    // Загрузка файла
-    _, err := m.client.FPutObject(ctx, m.Bucket, objectName, filePath, minio.PutObjectOptions{
-        ContentType:  contentType,
-        UserMetadata: map[string]string{"x-amz-acl": "public-read"},
-    })
+// PutObjectStream загружает содержимое из потока в Minio и возвращает URL.
+// При size = -1 Minio загружает объект частями неизвестной длины
+func (m *MinioRepository) PutObjectStream(ctx context.Context, objectName string, reader io.Reader, size int64, contentType, contentEncoding string) (*UploadResult, error) {
+    reader = m.uploadLimiter.Reader(ctx, reader)
+    info, err := m.client.PutObject(ctx, m.Bucket, objectName, reader, size, m.putOptions(contentType, contentEncoding, size))
     if err != nil {
-        return "", fmt.Errorf("upload error: %w", err)
+        m.cleanupCancelledUpload(ctx, objectName)
+        if isBadDigest(err) {
+            return nil, fmt.Errorf("%w: %v", ErrBadDigest, err)
+        }
+        return nil, fmt.Errorf("upload error: %w", err)
     }
 
-    // Генерация публичного URL
-    url := fmt.Sprintf("http://%s/%s/%s", m.client.EndpointURL().Host, m.Bucket, objectName)
-    return url, err
+    return &UploadResult{URL: m.ObjectURL(objectName), Checksum: m.checksumOf(info)}, nil
+}
+
+// SetChecksumAlgorithm задает контрольную сумму, которую хранилище проверяет
+// при загрузке объекта: md5, sha256 или crc32c. Пустая строка отключает
+func (m *MinioRepository) SetChecksumAlgorithm(algorithm string) error {
+    switch algorithm {
+    case "", ChecksumMD5, ChecksumSHA256, ChecksumCRC32C:
+        m.checksumAlgorithm = algorithm
+        return nil
+    }
+    return fmt.Errorf("%w: %q", ErrUnknownChecksum, algorithm)
+}
+
+// SetBandwidthLimiters задает ограничители трафика загрузки в Minio и чтения
+// из него. Одни и те же ограничители передаются всем репозиториям, чтобы
+// лимит был общим для всего сервиса. nil отключает ограничение
+func (m *MinioRepository) SetBandwidthLimiters(upload, download *BandwidthLimiter) {
+    m.uploadLimiter = upload
+    m.downloadLimiter = download
+}
+
+// SetPartConcurrency задает число частей, которые загружаются в Minio
+// одновременно, когда объект достаточно велик для multipart-загрузки.
+// Порядок частей и их ETag при сборке объекта отслеживает minio-go.
+// 0 и 1 - части загружаются по одной
+func (m *MinioRepository) SetPartConcurrency(parts int) {
+    m.partConcurrency = uint(max(parts, 0))
+}
 
-    return url, nil
+// ChecksumAlgorithm возвращает заданный алгоритм контрольной суммы
+func (m *MinioRepository) ChecksumAlgorithm() string {
+    return m.checksumAlgorithm
+}
+
+func (m *MinioRepository) putOptions(contentType, contentEncoding string, size int64) minio.PutObjectOptions {
+    opts := minio.PutObjectOptions{
+        ContentType:     contentType,
+        ContentEncoding: contentEncoding,
+        NumThreads:      m.partConcurrency,
+    }
+    // Поток без io.ReaderAt (файл формы, тело запроса) minio-go загружает по
+    // одной части, пока не включена ConcurrentStreamParts. Она держит в памяти
+    // NumThreads частей, поэтому включается только при известном размере и
+    // не больше, чем частей в объекте
+    if m.partConcurrency > 1 && size >= 0 {
+        parts, partSize, _, err := minio.OptimalPartInfo(size, 0)
+        if err == nil && parts > 1 {
+            opts.ConcurrentStreamParts = true
+            opts.PartSize = uint64(partSize)
+            opts.NumThreads = min(m.partConcurrency, uint(parts))
+        }
+    }
+    switch m.checksumAlgorithm {
+    case ChecksumMD5:
+        opts.SendContentMd5 = true
+    case ChecksumSHA256:
+        opts.Checksum = minio.ChecksumSHA256
+    case ChecksumCRC32C:
+        opts.Checksum = minio.ChecksumCRC32C
+    }
+    return opts
+}
+
+// checksumOf возвращает контрольную сумму загруженного объекта из ответа
+// хранилища. Для объектов, загруженных частями, это составная сумма ("...-N")
+func (m *MinioRepository) checksumOf(info minio.UploadInfo) string {
+    switch m.checksumAlgorithm {
+    case ChecksumMD5:
+        return info.ETag
+    case ChecksumSHA256:
+        return info.ChecksumSHA256
+    case ChecksumCRC32C:
+        return info.ChecksumCRC32C
+    }
+    return ""
+}
+
+// isBadDigest сообщает, что хранилище отклонило загрузку из-за несовпадения
+// переданной контрольной суммы с полученным содержимым
+func isBadDigest(err error) bool {
+    switch minio.ToErrorResponse(err).Code {
+    case "BadDigest", "XAmzContentSHA256Mismatch", "XAmzContentChecksumMismatch":
+        return true
+    }
+    return false
+}
+
+// ObjectURL возвращает публичный URL объекта бакета
+func (m *MinioRepository) ObjectURL(objectName string) string {
+    return fmt.Sprintf("http://%s/%s/%s", m.client.EndpointURL().Host, m.Bucket, objectName)
+}
+
+// cleanupCancelledUpload удаляет незавершенную multipart-загрузку, если
+// загрузка прервана отменой контекста (например, клиент отключился)
+func (m *MinioRepository) cleanupCancelledUpload(ctx context.Context, objectName string) {
+    if ctx.Err() == nil {
+        return
+    }
+
+    // Контекст запроса уже отменен, очистка выполняется в собственном
+    cleanupCtx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+    defer cancel()
+
+    if err := m.client.RemoveIncompleteUpload(cleanupCtx, m.Bucket, objectName); err != nil {
+        log.Printf("Incomplete upload cleanup error for %s: %v", objectName, err)
+        return
+    }
+    log.Printf("Cleaned up cancelled upload of %s", objectName)
+}
+
+// CleanupIncompleteUploads прерывает незавершенные multipart-загрузки старше
+// olderThan с ключами, начинающимися с prefix, и возвращает число удаленных загрузок
+func (m *MinioRepository) CleanupIncompleteUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+    cutoff := time.Now().Add(-olderThan)
+
+    // RemoveIncompleteUpload удаляет все загрузки ключа сразу, поэтому ключи,
+    // у которых есть свежая загрузка, пропускаются
+    stale := make(map[string]bool)
+    fresh := make(map[string]bool)
+    for upload := range m.client.ListIncompleteUploads(ctx, m.Bucket, prefix, true) {
+        if upload.Err != nil {
+            return 0, fmt.Errorf("list incomplete uploads error: %w", upload.Err)
+        }
+        if upload.Initiated.Before(cutoff) {
+            stale[upload.Key] = true
+        } else {
+            fresh[upload.Key] = true
+        }
+    }
+
+    removed := 0
+    for objectName := range stale {
+        if fresh[objectName] {
+            continue
+        }
+        if err := m.client.RemoveIncompleteUpload(ctx, m.Bucket, objectName); err != nil {
+            log.Printf("Incomplete upload removal error for %s: %v", objectName, err)
+            continue
+        }
+        removed++
+    }
+
+    return removed, nil
+}
+
+// GetObject открывает объект из Minio на чтение
+func (m *MinioRepository) GetObject(ctx context.Context, objectName string) (io.ReadCloser, error) {
+    return m.openObject(ctx, objectName, minio.GetObjectOptions{})
+}
+
+// GetObjectRange открывает на чтение байты объекта с start по end включительно.
+// Диапазон запрашивается одним GET: Stat у minio.Object сбрасывает заголовок
+// Range, и последующее чтение вернуло бы объект с начала
+func (m *MinioRepository) GetObjectRange(ctx context.Context, objectName string, start, end int64) (io.ReadCloser, error) {
+    opts := minio.GetObjectOptions{}
+    if err := opts.SetRange(start, end); err != nil {
+        return nil, fmt.Errorf("get object error: %w", err)
+    }
+
+    body, _, _, err := minio.Core{Client: m.client}.GetObject(ctx, m.Bucket, objectName, opts)
+    if err != nil {
+        if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+            return nil, ErrFileNotFound
+        }
+        return nil, fmt.Errorf("get object error: %w", err)
+    }
+
+    return m.downloadLimiter.ReadCloser(ctx, body), nil
+}
+
+func (m *MinioRepository) openObject(ctx context.Context, objectName string, opts minio.GetObjectOptions) (io.ReadCloser, error) {
+    object, err := m.client.GetObject(ctx, m.Bucket, objectName, opts)
+    if err != nil {
+        return nil, fmt.Errorf("get object error: %w", err)
+    }
+
+    // GetObject ленивый: ошибка NoSuchKey появляется только при первом обращении
+    if _, err := object.Stat(); err != nil {
+        object.Close()
+        if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+            return nil, ErrFileNotFound
+        }
+        return nil, fmt.Errorf("get object error: %w", err)
+    }
+
+    return m.downloadLimiter.ReadCloser(ctx, object), nil
 }
 
 // DeleteFile удаляет файл из Minio
@@ -114,6 +340,76 @@ func (m *MinioRepository) DeleteFile(ctx context.Context, objectName string) err
     return nil
 }
 
+// DeleteFiles удаляет объекты пакетными запросами RemoveObjects вместо
+// отдельного запроса на каждый объект. Возвращает ошибки по ключам, которые
+// удалить не удалось; отсутствующий объект ошибкой не считается
+func (m *MinioRepository) DeleteFiles(ctx context.Context, objectNames []string) map[string]error {
+    objects := make(chan minio.ObjectInfo, len(objectNames))
+    for _, objectName := range objectNames {
+        objects <- minio.ObjectInfo{Key: objectName}
+    }
+    close(objects)
+
+    failed := make(map[string]error)
+    opts := minio.RemoveObjectsOptions{GovernanceBypass: true}
+    for result := range m.client.RemoveObjects(ctx, m.Bucket, objects, opts) {
+        if result.Err != nil && minio.ToErrorResponse(result.Err).Code != "NoSuchKey" {
+            failed[result.ObjectName] = fmt.Errorf("delete error: %w", result.Err)
+        }
+    }
+
+    log.Printf("Successfully deleted %d of %d objects\n", len(objectNames)-len(failed), len(objectNames))
+    return failed
+}
+
+// SetObjectTag добавляет объекту тег key=value, сохраняя остальные теги.
+// По тегам правила жизненного цикла бакета меняют класс хранения объекта
+func (m *MinioRepository) SetObjectTag(ctx context.Context, objectName, key, value string) error {
+    return m.updateObjectTags(ctx, objectName, func(objectTags *tags.Tags) error {
+        return objectTags.Set(key, value)
+    })
+}
+
+// RemoveObjectTag удаляет тег key объекта, сохраняя остальные теги
+func (m *MinioRepository) RemoveObjectTag(ctx context.Context, objectName, key string) error {
+    return m.updateObjectTags(ctx, objectName, func(objectTags *tags.Tags) error {
+        objectTags.Remove(key)
+        return nil
+    })
+}
+
+func (m *MinioRepository) updateObjectTags(ctx context.Context, objectName string, update func(*tags.Tags) error) error {
+    objectTags, err := m.client.GetObjectTagging(ctx, m.Bucket, objectName, minio.GetObjectTaggingOptions{})
+    if err != nil {
+        if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+            return ErrFileNotFound
+        }
+        return fmt.Errorf("get tags error: %w", err)
+    }
+
+    if err := update(objectTags); err != nil {
+        return err
+    }
+
+    if err := m.client.PutObjectTagging(ctx, m.Bucket, objectName, objectTags, minio.PutObjectTaggingOptions{}); err != nil {
+        return fmt.Errorf("put tags error: %w", err)
+    }
+    return nil
+}
+
+// SetPublicReadPolicy разрешает анонимное чтение объектов бакета
+func (m *MinioRepository) SetPublicReadPolicy(ctx context.Context) error {
+    policy := fmt.Sprintf(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":["*"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::%s/*"]}]}`, m.Bucket)
+    return m.client.SetBucketPolicy(ctx, m.Bucket, policy)
+}
+
+// SetPresignCacheHeaders задает Cache-Control и признак установки Expires
+// (равного сроку действия ссылки) для объектов, отдаваемых по подписанным ссылкам
+func (m *MinioRepository) SetPresignCacheHeaders(cacheControl string, setExpires bool) {
+    m.presignCacheControl = cacheControl
+    m.presignSetExpires = setExpires
+}
+
 // GetFileURL возвращает публичный URL файла
 func (m *MinioRepository) GetFileURL(ctx context.Context, objectName string, expires time.Duration) (string, error) {
     if expires <= 0 {
@@ -128,6 +424,14 @@ func (m *MinioRepository) GetFileURL(ctx context.Context, objectName string, exp
         reqParams.Set("secure", "true")
     }
 
+    // Директивы кеширования, с которыми Minio отдаст объект по ссылке
+    if m.presignCacheControl != "" {
+        reqParams.Set("response-cache-control", m.presignCacheControl)
+    }
+    if m.presignSetExpires {
+        reqParams.Set("response-expires", time.Now().Add(expires).UTC().Format(http.TimeFormat))
+    }
+
     url, err := m.client.PresignedGetObject(ctx, m.Bucket, objectName, expires, reqParams)
     if err != nil {
         return "", fmt.Errorf("url generation error: %w", err)
@@ -136,8 +440,143 @@ func (m *MinioRepository) GetFileURL(ctx context.Context, objectName string, exp
     return url.String(), nil
 }
 
+// ObjectStat - свойства объекта, которые хранит Minio
+type ObjectStat struct {
+    Size            int64
+    ContentType     string
+    ContentEncoding string
+    ETag            string
+    LastModified    time.Time
+    // Контрольные суммы (base64), если объект загружен с ними
+    ChecksumSHA256 string
+    ChecksumCRC32C string
+}
+
+// Checksum возвращает контрольную сумму объекта в формате UploadResult.Checksum
+// для алгоритма algorithm; пусто, если хранилище ее не вернуло
+func (o *ObjectStat) Checksum(algorithm string) string {
+    switch algorithm {
+    case ChecksumMD5:
+        return o.ETag
+    case ChecksumSHA256:
+        return o.ChecksumSHA256
+    case ChecksumCRC32C:
+        return o.ChecksumCRC32C
+    }
+    return ""
+}
+
+// StatObject возвращает свойства объекта без чтения содержимого
+func (m *MinioRepository) StatObject(ctx context.Context, objectName string) (*ObjectStat, error) {
+    info, err := m.client.StatObject(ctx, m.Bucket, objectName, minio.StatObjectOptions{Checksum: true})
+    if err != nil {
+        if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+            return nil, ErrFileNotFound
+        }
+        return nil, fmt.Errorf("stat error: %w", err)
+    }
+
+    return &ObjectStat{
+        Size:            info.Size,
+        ContentType:     info.ContentType,
+        ContentEncoding: info.Metadata.Get("Content-Encoding"),
+        ETag:            info.ETag,
+        LastModified:    info.LastModified,
+        ChecksumSHA256:  info.ChecksumSHA256,
+        ChecksumCRC32C:  info.ChecksumCRC32C,
+    }, nil
+}
+
+// ObjectExists проверяет наличие объекта в бакете
+func (m *MinioRepository) ObjectExists(ctx context.Context, objectName string) (bool, error) {
+    _, err := m.client.StatObject(ctx, m.Bucket, objectName, minio.StatObjectOptions{})
+    if err != nil {
+        if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+            return false, nil
+        }
+        return false, fmt.Errorf("stat error: %w", err)
+    }
+    return true, nil
+}
+
+// ObjectNameFromURL извлекает ключ объекта из URL файла. Возвращает false,
+// если URL указывает не на этот сервер Minio или не на этот бакет
+func (m *MinioRepository) ObjectNameFromURL(rawURL string) (string, bool) {
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Host != m.client.EndpointURL().Host {
+        return "", false
+    }
+
+    prefix := "/" + m.Bucket + "/"
+    if !strings.HasPrefix(u.Path, prefix) {
+        return "", false
+    }
+
+    objectName := strings.TrimPrefix(u.Path, prefix)
+    if objectName == "" {
+        return "", false
+    }
+    return objectName, true
+}
+
+// PresignedPostPolicy формирует подписанную POST-политику для загрузки из
+// браузера напрямую в Minio. Политика ограничивает префикс ключа, тип
+// содержимого и размер файла. Возвращает URL формы и ее поля
+func (m *MinioRepository) PresignedPostPolicy(ctx context.Context, keyPrefix, contentType string, maxSize int64, expires time.Duration) (string, map[string]string, error) {
+    policy := minio.NewPostPolicy()
+    if err := policy.SetBucket(m.Bucket); err != nil {
+        return "", nil, err
+    }
+    if err := policy.SetKeyStartsWith(keyPrefix); err != nil {
+        return "", nil, err
+    }
+    if err := policy.SetContentType(contentType); err != nil {
+        return "", nil, err
+    }
+    if err := policy.SetContentLengthRange(1, maxSize); err != nil {
+        return "", nil, err
+    }
+    if err := policy.SetExpires(time.Now().UTC().Add(expires)); err != nil {
+        return "", nil, err
+    }
+
+    u, fields, err := m.client.PresignedPostPolicy(ctx, policy)
+    if err != nil {
+        return "", nil, fmt.Errorf("post policy error: %w", err)
+    }
+
+    return u.String(), fields, nil
+}
+
 // HealthCheck проверяет соединение с Minio
 func (m *MinioRepository) HealthCheck(ctx context.Context) error {
     _, err := m.client.ListBuckets(ctx)
     return err
+}
+
+// ClockSkew возвращает расхождение часов Minio с локальными по заголовку Date
+// ответа на HEAD-запрос (положительное - часы Minio спешат). Точность
+// ограничена секундой: Date не содержит долей секунды
+func (m *MinioRepository) ClockSkew(ctx context.Context) (time.Duration, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodHead, m.client.EndpointURL().String(), nil)
+    if err != nil {
+        return 0, err
+    }
+
+    sent := time.Now()
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return 0, fmt.Errorf("clock skew check error: %w", err)
+    }
+    resp.Body.Close()
+    received := time.Now()
+
+    serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+    if err != nil {
+        return 0, fmt.Errorf("invalid Date header from minio: %w", err)
+    }
+
+    // Сравнение с серединой запроса компенсирует сетевую задержку
+    local := sent.Add(received.Sub(sent) / 2)
+    return serverTime.Sub(local).Truncate(time.Second), nil
 }
\ No newline at end of file
@@ -0,0 +1,308 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"kuber-code-s3/internal/repository"
+	"kuber-code-s3/internal/repository/repotest"
+)
+
+// slowReader отдает начало содержимого, а затем ждет отмены контекста,
+// как тело загрузки от клиента, который перестал отправлять данные
+type slowReader struct {
+	ctx     context.Context
+	head    io.Reader
+	started chan struct{}
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if n, err := r.head.Read(p); n > 0 || err != io.EOF {
+		return n, err
+	}
+	select {
+	case <-r.started:
+	default:
+		close(r.started)
+	}
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func TestPutObjectStreamCancellationCleanup(t *testing.T) {
+	tests := []struct {
+		name   string
+		cancel bool
+	}{
+		{"cancelled mid-upload", true},
+		{"completed upload", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := repotest.NewS3(t, "files")
+			repo := s3.Repository(t, "files")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			content := bytes.Repeat([]byte("a"), 1<<10)
+			var reader io.Reader = bytes.NewReader(content)
+			started := make(chan struct{})
+			if tt.cancel {
+				reader = &slowReader{ctx: ctx, head: bytes.NewReader(content), started: started}
+				go func() {
+					<-started
+					// Загрузка неизвестной длины уже начата в хранилище
+					if uploads := s3.Uploads(); len(uploads) != 1 {
+						t.Errorf("incomplete uploads before cancellation = %v, want one", uploads)
+					}
+					cancel()
+				}()
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := repo.PutObjectStream(ctx, "video.mp4", reader, -1, "video/mp4", "")
+				done <- err
+			}()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("upload was not cancelled")
+			}
+
+			if tt.cancel {
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("PutObjectStream() error = %v, want context.Canceled", err)
+				}
+				if uploads := s3.Uploads(); len(uploads) != 0 {
+					t.Errorf("incomplete uploads left after cancellation: %v", uploads)
+				}
+				if keys := s3.Keys("files"); len(keys) != 0 {
+					t.Errorf("partial object stored: %v", keys)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("PutObjectStream() error = %v", err)
+			}
+			if object, ok := s3.Get("files", "video.mp4"); !ok || !bytes.Equal(object.Data, content) {
+				t.Error("completed upload was not stored")
+			}
+		})
+	}
+}
+
+func TestCleanupIncompleteUploadsReportsCount(t *testing.T) {
+	s3 := repotest.NewS3(t, "files")
+	repo := s3.Repository(t, "files")
+	s3.AddUpload("files", "a.mp4", time.Now().Add(-2*time.Hour))
+	s3.AddUpload("files", "b.mp4", time.Now().Add(-2*time.Hour))
+	s3.AddUpload("files", "c.mp4", time.Now())
+
+	removed, err := repo.CleanupIncompleteUploads(context.Background(), "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("removed %d uploads, want 2", removed)
+	}
+}
+
+func TestGetFileURLCacheHeaders(t *testing.T) {
+	tests := []struct {
+		name             string
+		cacheControl     string
+		setExpires       bool
+		wantCacheControl string
+	}{
+		{"disabled", "", false, ""},
+		{"cache control only", "public, max-age=3600", false, "public, max-age=3600"},
+		{"expires only", "", true, ""},
+		{"both", "private, max-age=60", true, "private, max-age=60"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := repotest.NewS3(t, "files")
+			repo := s3.Repository(t, "files")
+			repo.SetPresignCacheHeaders(tt.cacheControl, tt.setExpires)
+
+			const expires = time.Hour
+			before := time.Now().Add(expires).Truncate(time.Second)
+			raw, err := repo.GetFileURL(context.Background(), "photo.png", expires)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := time.Now().Add(expires)
+
+			u, err := url.Parse(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			if got := query.Get("response-cache-control"); got != tt.wantCacheControl {
+				t.Errorf("response-cache-control = %q, want %q", got, tt.wantCacheControl)
+			}
+
+			// Expires совпадает со сроком действия ссылки
+			value := query.Get("response-expires")
+			if !tt.setExpires {
+				if query.Has("response-expires") {
+					t.Errorf("response-expires = %q, want none", value)
+				}
+				return
+			}
+			expiresAt, err := http.ParseTime(value)
+			if err != nil {
+				t.Fatalf("response-expires %q: %v", value, err)
+			}
+			if expiresAt.Before(before) || expiresAt.After(after) {
+				t.Errorf("response-expires = %v, want between %v and %v", expiresAt, before, after)
+			}
+		})
+	}
+}
+
+func TestGetObjectRange(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+
+	tests := []struct {
+		name       string
+		key        string
+		start, end int64
+		want       string
+		wantErr    error
+	}{
+		{"from the start", "file.bin", 0, 4, "01234", nil},
+		{"from an offset", "file.bin", 10, 14, "abcde", nil},
+		{"last byte", "file.bin", 19, 19, "j", nil},
+		{"missing object", "missing.bin", 0, 4, "", repository.ErrFileNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := repotest.NewS3(t, "files")
+			repo := s3.Repository(t, "files")
+			s3.Put("files", "file.bin", repotest.Object{Data: content})
+
+			body, err := repo.GetObjectRange(context.Background(), tt.key, tt.start, tt.end)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetObjectRange() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer body.Close()
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("GetObjectRange(%d, %d) = %q, want %q", tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMinioRepositoryMissingBucket(t *testing.T) {
+	tests := []struct {
+		name        string
+		bucket      string
+		create      bool
+		wantErr     error
+		wantCreated bool
+	}{
+		{"existing bucket", "files", false, nil, false},
+		{"missing bucket created", "missing", true, nil, true},
+		{"missing bucket with creation disabled", "missing", false, repository.ErrBucketNotFound, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := repotest.NewS3(t, "files")
+
+			repo, err := repository.NewMinioRepository(s3.Endpoint(), "access", "secret-key", false, tt.bucket, tt.create)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewMinioRepository() error = %v, want %v", err, tt.wantErr)
+			}
+			if (repo == nil) != (tt.wantErr != nil) {
+				t.Errorf("NewMinioRepository() repository = %v with error %v", repo, err)
+			}
+
+			// Запуск не создает бакет, если это не разрешено
+			created := false
+			for _, req := range s3.Requests(http.MethodPut) {
+				if req.Bucket == tt.bucket && req.Key == "" && !req.Query.Has("policy") {
+					created = true
+				}
+			}
+			if created != tt.wantCreated {
+				t.Errorf("bucket created = %t, want %t", created, tt.wantCreated)
+			}
+		})
+	}
+}
+
+// skewedMinio запускает заглушку Minio, часы которой отличаются на skew.
+// Бакеты считаются существующими; при noDate заголовок Date не отправляется
+func skewedMinio(t *testing.T, skew time.Duration, noDate bool) *repository.MinioRepository {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if noDate {
+			w.Header()["Date"] = nil
+		} else {
+			w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	repo, err := repository.NewMinioRepository(strings.TrimPrefix(server.URL, "http://"), "access", "secret-key", false, "files", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestClockSkew(t *testing.T) {
+	tests := []struct {
+		name    string
+		skew    time.Duration
+		noDate  bool
+		wantErr bool
+	}{
+		{"clocks in sync", 0, false, false},
+		{"minio ahead", 2 * time.Minute, false, false},
+		{"minio behind", -90 * time.Second, false, false},
+		{"no Date header", 0, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := skewedMinio(t, tt.skew, tt.noDate)
+
+			skew, err := repo.ClockSkew(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ClockSkew() error = %v, want error %t", err, tt.wantErr)
+			}
+			// Date передается с точностью до секунды
+			if diff := (skew - tt.skew).Abs(); !tt.wantErr && diff > time.Second {
+				t.Errorf("ClockSkew() = %s, want %s", skew, tt.skew)
+			}
+		})
+	}
+}
@@ -3,14 +3,20 @@ package repository
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"regexp"
+	"strconv"
 	"time"
 
 	"kuber-code-s3/internal/models"
 
+	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 type MongoRepository struct {
@@ -20,14 +26,30 @@ type MongoRepository struct {
 
 var (
     ErrDocumentNotFound = errors.New("document not found")
+    ErrDocumentLocked   = errors.New("document is locked")
+    ErrWriteUnavailable = errors.New("write was not acknowledged in time")
 )
 
-// NewMongoRepository создает новый репозиторий для работы с MongoDB
-func NewMongoRepository(uri, dbName string) (*MongoRepository, error) {
+// writeConcernFailed - код ошибки MongoDB при истечении wtimeout
+const writeConcernFailed = 64
+
+// NewMongoRepository создает новый репозиторий для работы с MongoDB.
+// writeConcern - значение w ("majority" или число реплик; пусто - по умолчанию
+// сервера), writeTimeout - время ожидания подтверждения записи репликами
+func NewMongoRepository(uri, dbName, writeConcern string, writeTimeout time.Duration) (*MongoRepository, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+    clientOpts := options.Client().ApplyURI(uri)
+    if writeConcern != "" {
+        var w interface{} = writeConcern
+        if n, err := strconv.Atoi(writeConcern); err == nil {
+            w = n
+        }
+        clientOpts.SetWriteConcern(&writeconcern.WriteConcern{W: w, WTimeout: writeTimeout})
+    }
+
+    client, err := mongo.Connect(ctx, clientOpts)
     if err != nil {
         return nil, err
     }
@@ -39,10 +61,15 @@ func NewMongoRepository(uri, dbName string) (*MongoRepository, error) {
         return nil, err
     }
 
+    return NewMongoRepositoryWithClient(client, dbName), nil
+}
+
+// NewMongoRepositoryWithClient создает репозиторий поверх уже подключенного клиента
+func NewMongoRepositoryWithClient(client *mongo.Client, dbName string) *MongoRepository {
     return &MongoRepository{
         client: client,
         dbName: dbName,
-    }, nil
+    }
 }
 
 // SaveMetadata сохраняет метаданные файла в MongoDB
@@ -54,7 +81,7 @@ func (m *MongoRepository) SaveMetadata(ctx context.Context, metadata *models.Fil
     result, err := collection.InsertOne(ctx, metadata)
     if err != nil {
         log.Printf("MongoDB insert error: %v", err) // Логируем ошибку
-        return err
+        return writeError(err)
     }
 
     log.Printf("Inserted document ID: %v", result.InsertedID) // Логируем ID документа
@@ -79,6 +106,277 @@ func (m *MongoRepository) GetMetadata(ctx context.Context, fileID string) (*mode
     return &result, nil
 }
 
+// FindByObjectName возвращает метаданные файла по ключу объекта в Minio.
+// Для записей без поля object_name сравнивается сохраненный URL
+func (m *MongoRepository) FindByObjectName(ctx context.Context, objectName, objectURL string) (*models.FileMetadata, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    var result models.FileMetadata
+    filter := bson.D{{Key: "$or", Value: bson.A{
+        bson.D{{Key: "object_name", Value: objectName}},
+        bson.D{{Key: "url", Value: objectURL}},
+    }}}
+
+    err := collection.FindOne(ctx, filter).Decode(&result)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            return nil, ErrDocumentNotFound
+        }
+        return nil, err
+    }
+
+    return &result, nil
+}
+
+// FindByChecksum возвращает метаданные файла с содержимым, SHA-256
+// которого равен checksum
+func (m *MongoRepository) FindByChecksum(ctx context.Context, checksum string) (*models.FileMetadata, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    var result models.FileMetadata
+    filter := bson.D{{Key: "sha256", Value: checksum}}
+    opts := options.FindOne().SetSort(bson.D{{Key: "upload_date", Value: 1}})
+
+    err := collection.FindOne(ctx, filter, opts).Decode(&result)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            return nil, ErrDocumentNotFound
+        }
+        return nil, err
+    }
+
+    return &result, nil
+}
+
+// FindOriginalNames возвращает исходные имена файлов с расширением ext,
+// равные name или подходящие под регулярное выражение pattern (варианты
+// имени с суффиксом). Файл excludeID не учитывается
+func (m *MongoRepository) FindOriginalNames(ctx context.Context, name, pattern, ext, excludeID string) ([]string, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    // Расширение берется из ключа объекта, для старых записей - из URL
+    keyPattern := regexp.QuoteMeta(ext) + "$"
+    if ext == "" {
+        keyPattern = `(^|/)[^./]*$`
+    }
+    filter := bson.D{
+        {Key: "_id", Value: bson.D{{Key: "$ne", Value: excludeID}}},
+        {Key: "original_name", Value: bson.D{{Key: "$in", Value: bson.A{
+            name,
+            primitive.Regex{Pattern: pattern},
+        }}}},
+        {Key: "$or", Value: bson.A{
+            bson.D{{Key: "object_name", Value: primitive.Regex{Pattern: keyPattern}}},
+            bson.D{{Key: "object_name", Value: bson.D{{Key: "$exists", Value: false}}}, {Key: "url", Value: primitive.Regex{Pattern: keyPattern}}},
+        }},
+    }
+    opts := options.Find().SetProjection(bson.D{{Key: "original_name", Value: 1}})
+
+    cursor, err := collection.Find(ctx, filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    var docs []struct {
+        OriginalName string `bson:"original_name"`
+    }
+    if err := cursor.All(ctx, &docs); err != nil {
+        return nil, err
+    }
+
+    names := make([]string, 0, len(docs))
+    for _, doc := range docs {
+        names = append(names, doc.OriginalName)
+    }
+    return names, nil
+}
+
+// CountObjectReferences возвращает число файлов, кроме excludeID, которые
+// ссылаются на объект objectName (для записей без object_name - по URL)
+func (m *MongoRepository) CountObjectReferences(ctx context.Context, objectName, objectURL, excludeID string) (int64, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{
+        {Key: "_id", Value: bson.D{{Key: "$ne", Value: excludeID}}},
+        objectReference(objectName, objectURL),
+    }
+    return collection.CountDocuments(ctx, filter)
+}
+
+// CountWarmObjectReferences возвращает число файлов, кроме excludeID, которые
+// ссылаются на объект objectName и еще не отнесены к холодному хранению
+func (m *MongoRepository) CountWarmObjectReferences(ctx context.Context, objectName, objectURL, excludeID string) (int64, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{
+        {Key: "_id", Value: bson.D{{Key: "$ne", Value: excludeID}}},
+        {Key: "storage_tier", Value: bson.D{{Key: "$ne", Value: models.StorageTierCold}}},
+        objectReference(objectName, objectURL),
+    }
+    return collection.CountDocuments(ctx, filter)
+}
+
+// objectReference - условие "файл ссылается на объект objectName"
+// (для записей без object_name - по URL)
+func objectReference(objectName, objectURL string) bson.E {
+    return bson.E{Key: "$or", Value: bson.A{
+        bson.D{{Key: "object_name", Value: objectName}},
+        bson.D{{Key: "url", Value: objectURL}},
+    }}
+}
+
+// keyPrefixFilter добавляет к filter условие "ключ объекта начинается с
+// prefix", чтобы выборка не включала файлы других окружений с общим бакетом
+// (KEY_PREFIX). Пустой префикс выборку не ограничивает
+func keyPrefixFilter(filter bson.D, prefix string) bson.D {
+    if prefix == "" {
+        return filter
+    }
+    return append(filter, bson.E{Key: "object_name", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}})
+}
+
+// ListColdCandidates возвращает до limit файлов с ключами под prefix, еще не
+// отнесенных к холодному хранению, которые не скачивали с момента before. Для
+// ни разу не скачанных файлов учитывается дата загрузки. Давно не
+// использованные идут первыми
+func (m *MongoRepository) ListColdCandidates(ctx context.Context, prefix string, before time.Time, limit int) ([]models.FileMetadata, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{
+        {Key: "storage_tier", Value: bson.D{{Key: "$ne", Value: models.StorageTierCold}}},
+        {Key: "$or", Value: bson.A{
+            bson.D{{Key: "last_accessed", Value: bson.D{{Key: "$lt", Value: before}}}},
+            bson.D{
+                {Key: "last_accessed", Value: bson.D{{Key: "$exists", Value: false}}},
+                {Key: "upload_date", Value: bson.D{{Key: "$lt", Value: before}}},
+            },
+        }},
+    }
+    filter = keyPrefixFilter(filter, prefix)
+    opts := options.Find().
+        SetLimit(int64(limit)).
+        SetSort(bson.D{{Key: "last_accessed", Value: 1}, {Key: "upload_date", Value: 1}})
+
+    cursor, err := collection.Find(ctx, filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    files := []models.FileMetadata{}
+    if err := cursor.All(ctx, &files); err != nil {
+        return nil, err
+    }
+    return files, nil
+}
+
+// SetStorageTier сохраняет класс хранения файла
+func (m *MongoRepository) SetStorageTier(ctx context.Context, fileID, tier string) error {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{{Key: "_id", Value: fileID}}
+    update := bson.D{{Key: "$set", Value: bson.D{{Key: "storage_tier", Value: tier}}}}
+
+    result, err := collection.UpdateOne(ctx, filter, update)
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return ErrDocumentNotFound
+    }
+    return nil
+}
+
+// ClearObjectStorageTier сбрасывает класс хранения всех файлов, ссылающихся
+// на объект objectName
+func (m *MongoRepository) ClearObjectStorageTier(ctx context.Context, objectName, objectURL string) error {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{objectReference(objectName, objectURL)}
+    update := bson.D{{Key: "$unset", Value: bson.D{{Key: "storage_tier", Value: ""}}}}
+
+    _, err := collection.UpdateMany(ctx, filter, update)
+    return err
+}
+
+// ListMetadata возвращает страницу метаданных файлов с ключами под prefix,
+// отсортированных по полю sortField (upload_date, file_size или
+// original_name). Файлы с равным значением поля упорядочиваются по ID, чтобы
+// страницы не пересекались
+func (m *MongoRepository) ListMetadata(ctx context.Context, prefix string, limit, offset int, sortField string, descending bool) ([]models.FileMetadata, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    direction := 1
+    if descending {
+        direction = -1
+    }
+    opts := options.Find().
+        SetLimit(int64(limit)).
+        SetSkip(int64(offset)).
+        SetSort(bson.D{{Key: sortField, Value: direction}, {Key: "_id", Value: 1}})
+
+    cursor, err := collection.Find(ctx, keyPrefixFilter(bson.D{}, prefix), opts)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    files := []models.FileMetadata{}
+    if err := cursor.All(ctx, &files); err != nil {
+        return nil, err
+    }
+    return files, nil
+}
+
+// GetMetadataByIDs возвращает метаданные файлов с указанными ID одним
+// запросом. Порядок не гарантируется, отсутствующие ID пропускаются
+func (m *MongoRepository) GetMetadataByIDs(ctx context.Context, ids []string) ([]models.FileMetadata, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}
+    cursor, err := collection.Find(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    files := []models.FileMetadata{}
+    if err := cursor.All(ctx, &files); err != nil {
+        return nil, err
+    }
+    return files, nil
+}
+
+// ListMetadataSince возвращает до limit файлов с ключами под prefix,
+// загруженных не раньше since, новые первыми
+func (m *MongoRepository) ListMetadataSince(ctx context.Context, prefix string, since time.Time, limit int) ([]models.FileMetadata, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := keyPrefixFilter(bson.D{{Key: "upload_date", Value: bson.D{{Key: "$gte", Value: since}}}}, prefix)
+    opts := options.Find().
+        SetLimit(int64(limit)).
+        SetSort(bson.D{{Key: "upload_date", Value: -1}, {Key: "_id", Value: 1}})
+
+    cursor, err := collection.Find(ctx, filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    files := []models.FileMetadata{}
+    if err := cursor.All(ctx, &files); err != nil {
+        return nil, err
+    }
+    return files, nil
+}
+
+// CountMetadata возвращает общее число файлов с ключами под prefix
+func (m *MongoRepository) CountMetadata(ctx context.Context, prefix string) (int64, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+    return collection.CountDocuments(ctx, keyPrefixFilter(bson.D{}, prefix))
+}
+
 // DeleteMetadata удаляет метаданные файла по ID
 func (m *MongoRepository) DeleteMetadata(ctx context.Context, fileID string) error {
     collection := m.client.Database(m.dbName).Collection("files")
@@ -96,8 +394,9 @@ func (m *MongoRepository) DeleteMetadata(ctx context.Context, fileID string) err
     return nil
 }
 
-// UpdateMetadata обновляет метаданные файла
-func (m *MongoRepository) UpdateMetadata(ctx context.Context, fileID string, metadata *models.FileMetadata) error {
+// UpdateMetadata обновляет метаданные файла и возвращает документ в состоянии
+// после обновления
+func (m *MongoRepository) UpdateMetadata(ctx context.Context, fileID string, metadata *models.FileMetadata) (*models.FileMetadata, error) {
     collection := m.client.Database(m.dbName).Collection("files")
 
     filter := bson.D{{Key: "_id", Value: fileID}}
@@ -106,25 +405,333 @@ func (m *MongoRepository) UpdateMetadata(ctx context.Context, fileID string, met
             {Key: "original_name", Value: metadata.OriginalName},
             {Key: "file_size", Value: metadata.FileSize},
             {Key: "content_type", Value: metadata.ContentType},
+            {Key: "content_encoding", Value: metadata.ContentEncoding},
+            {Key: "checksum", Value: metadata.Checksum},
+            {Key: "checksum_algorithm", Value: metadata.ChecksumAlgorithm},
+            {Key: "sha256", Value: metadata.ContentSHA256},
             {Key: "bucket_name", Value: metadata.BucketName},
+            {Key: "object_name", Value: metadata.ObjectName},
             {Key: "upload_date", Value: metadata.UploadDate},
             {Key: "url", Value: metadata.URL},
         }},
     }
 
     opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
-    result := collection.FindOneAndUpdate(ctx, filter, update, opts)
 
-    if result.Err() != nil {
-        if errors.Is(result.Err(), mongo.ErrNoDocuments) {
-            return ErrDocumentNotFound
+    var result models.FileMetadata
+    err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            return nil, ErrDocumentNotFound
         }
-        return result.Err()
+        return nil, writeError(err)
+    }
+
+    return &result, nil
+}
+
+// UpdateThumbnail сохраняет статус, бакет и URL миниатюры файла, а также
+// причину неудачной генерации (failure; пустая строка ее сбрасывает)
+func (m *MongoRepository) UpdateThumbnail(ctx context.Context, fileID, bucket, thumbnailURL, status, failure string) error {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{{Key: "_id", Value: fileID}}
+    update := bson.D{
+        {Key: "$set", Value: bson.D{
+            {Key: "thumbnail_bucket", Value: bucket},
+            {Key: "thumbnail_url", Value: thumbnailURL},
+            {Key: "thumbnail_status", Value: status},
+            {Key: "thumbnail_error", Value: failure},
+        }},
+    }
+
+    result, err := collection.UpdateOne(ctx, filter, update)
+    if err != nil {
+        return err
+    }
+
+    if result.MatchedCount == 0 {
+        return ErrDocumentNotFound
+    }
+
+    return nil
+}
+
+// PatchMetadata обновляет заданные в patch поля и возвращает обновленный документ
+func (m *MongoRepository) PatchMetadata(ctx context.Context, fileID string, patch models.MetadataPatch) (*models.FileMetadata, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    set := bson.D{}
+    if patch.Description != nil {
+        set = append(set, bson.E{Key: "description", Value: *patch.Description})
+    }
+    if patch.Tags != nil {
+        set = append(set, bson.E{Key: "tags", Value: *patch.Tags})
+    }
+    if patch.AccessibleUntil != nil {
+        set = append(set, bson.E{Key: "accessible_until", Value: *patch.AccessibleUntil})
+    }
+    if patch.FileSize != nil {
+        set = append(set, bson.E{Key: "file_size", Value: *patch.FileSize})
+    }
+    if patch.ContentType != nil {
+        set = append(set, bson.E{Key: "content_type", Value: *patch.ContentType})
+    }
+    if patch.ContentEncoding != nil {
+        set = append(set, bson.E{Key: "content_encoding", Value: *patch.ContentEncoding})
+    }
+    if patch.Checksum != nil {
+        set = append(set, bson.E{Key: "checksum", Value: *patch.Checksum})
+    }
+    if patch.ChecksumAlgorithm != nil {
+        set = append(set, bson.E{Key: "checksum_algorithm", Value: *patch.ChecksumAlgorithm})
+    }
+    if patch.ContentSHA256 != nil {
+        set = append(set, bson.E{Key: "sha256", Value: *patch.ContentSHA256})
+    }
+    if patch.UploadDate != nil {
+        set = append(set, bson.E{Key: "upload_date", Value: *patch.UploadDate})
+    }
+    if patch.ObjectName != nil {
+        set = append(set, bson.E{Key: "object_name", Value: *patch.ObjectName})
+    }
+    if patch.URL != nil {
+        set = append(set, bson.E{Key: "url", Value: *patch.URL})
+    }
+    if len(set) == 0 {
+        return m.GetMetadata(ctx, fileID)
+    }
+
+    filter := bson.D{{Key: "_id", Value: fileID}}
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+    var result models.FileMetadata
+    err := collection.FindOneAndUpdate(ctx, filter, bson.D{{Key: "$set", Value: set}}, opts).Decode(&result)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            return nil, ErrDocumentNotFound
+        }
+        return nil, writeError(err)
+    }
+
+    return &result, nil
+}
+
+// RecordAccess сохраняет время последнего обращения к файлу и, если counted,
+// атомарно увеличивает счетчик скачиваний
+func (m *MongoRepository) RecordAccess(ctx context.Context, fileID string, counted bool) error {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{{Key: "_id", Value: fileID}}
+    update := bson.D{{Key: "$set", Value: bson.D{{Key: "last_accessed", Value: time.Now()}}}}
+    if counted {
+        update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: "download_count", Value: 1}}})
+    }
+
+    result, err := collection.UpdateOne(ctx, filter, update)
+    if err != nil {
+        return err
+    }
+
+    if result.MatchedCount == 0 {
+        return ErrDocumentNotFound
     }
 
     return nil
 }
 
+// SetContentTypeIfEmpty заполняет content_type записи, у которой он пуст
+// или отсутствует. Уже заполненный тип не меняется
+func (m *MongoRepository) SetContentTypeIfEmpty(ctx context.Context, fileID, contentType string) error {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{
+        {Key: "_id", Value: fileID},
+        {Key: "content_type", Value: bson.D{{Key: "$in", Value: bson.A{"", nil}}}},
+    }
+    update := bson.D{{Key: "$set", Value: bson.D{{Key: "content_type", Value: contentType}}}}
+
+    _, err := collection.UpdateOne(ctx, filter, update)
+    return err
+}
+
+// ListMissingSHA256 возвращает до limit файлов без SHA-256 содержимого
+// (созданных до его вычисления при загрузке) с ID больше afterID, по ID
+func (m *MongoRepository) ListMissingSHA256(ctx context.Context, afterID string, limit int) ([]models.FileMetadata, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{
+        {Key: "sha256", Value: bson.D{{Key: "$in", Value: bson.A{"", nil}}}},
+        {Key: "_id", Value: bson.D{{Key: "$gt", Value: afterID}}},
+    }
+    opts := options.Find().
+        SetLimit(int64(limit)).
+        SetSort(bson.D{{Key: "_id", Value: 1}})
+
+    cursor, err := collection.Find(ctx, filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    files := []models.FileMetadata{}
+    if err := cursor.All(ctx, &files); err != nil {
+        return nil, err
+    }
+    return files, nil
+}
+
+// SetContentSHA256IfEmpty сохраняет SHA-256 содержимого записи, у которой
+// он пуст или отсутствует. Записанный при замене содержимого хеш не меняется
+func (m *MongoRepository) SetContentSHA256IfEmpty(ctx context.Context, fileID, sha256hex string) error {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{
+        {Key: "_id", Value: fileID},
+        {Key: "sha256", Value: bson.D{{Key: "$in", Value: bson.A{"", nil}}}},
+    }
+    update := bson.D{{Key: "$set", Value: bson.D{{Key: "sha256", Value: sha256hex}}}}
+
+    _, err := collection.UpdateOne(ctx, filter, update)
+    return err
+}
+
+// AcquireLock устанавливает рекомендательную блокировку документа до now+ttl.
+// Просроченные блокировки считаются свободными. Возвращает токен для снятия
+func (m *MongoRepository) AcquireLock(ctx context.Context, fileID string, ttl time.Duration) (string, error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    now := time.Now()
+    token := uuid.New().String()
+    filter := bson.D{
+        {Key: "_id", Value: fileID},
+        {Key: "$or", Value: bson.A{
+            bson.D{{Key: "locked_until", Value: bson.D{{Key: "$exists", Value: false}}}},
+            bson.D{{Key: "locked_until", Value: bson.D{{Key: "$lt", Value: now}}}},
+        }},
+    }
+    update := bson.D{
+        {Key: "$set", Value: bson.D{
+            {Key: "locked_until", Value: now.Add(ttl)},
+            {Key: "lock_token", Value: token},
+        }},
+    }
+
+    result, err := collection.UpdateOne(ctx, filter, update)
+    if err != nil {
+        return "", err
+    }
+
+    if result.MatchedCount == 0 {
+        // Документ либо отсутствует, либо заблокирован другой операцией
+        if _, err := m.GetMetadata(ctx, fileID); err != nil {
+            return "", err
+        }
+        return "", ErrDocumentLocked
+    }
+
+    return token, nil
+}
+
+// ReleaseLock снимает блокировку, если она все еще принадлежит владельцу токена
+func (m *MongoRepository) ReleaseLock(ctx context.Context, fileID, token string) error {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    filter := bson.D{
+        {Key: "_id", Value: fileID},
+        {Key: "lock_token", Value: token},
+    }
+    update := bson.D{
+        {Key: "$unset", Value: bson.D{
+            {Key: "locked_until", Value: ""},
+            {Key: "lock_token", Value: ""},
+        }},
+    }
+
+    _, err := collection.UpdateOne(ctx, filter, update)
+    return err
+}
+
+// ComputeUsage подсчитывает суммарный размер и число файлов
+func (m *MongoRepository) ComputeUsage(ctx context.Context) (totalBytes, fileCount int64, err error) {
+    collection := m.client.Database(m.dbName).Collection("files")
+
+    pipeline := mongo.Pipeline{
+        {{Key: "$group", Value: bson.D{
+            {Key: "_id", Value: nil},
+            {Key: "total_bytes", Value: bson.D{{Key: "$sum", Value: "$file_size"}}},
+            {Key: "file_count", Value: bson.D{{Key: "$sum", Value: 1}}},
+        }}},
+    }
+
+    cursor, err := collection.Aggregate(ctx, pipeline)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer cursor.Close(ctx)
+
+    var result struct {
+        TotalBytes int64 `bson:"total_bytes"`
+        FileCount  int64 `bson:"file_count"`
+    }
+    if cursor.Next(ctx) {
+        if err := cursor.Decode(&result); err != nil {
+            return 0, 0, err
+        }
+    }
+    return result.TotalBytes, result.FileCount, cursor.Err()
+}
+
+// WriteUsageSnapshot сохраняет срез использования; повторная запись за тот же
+// день заменяет предыдущую
+func (m *MongoRepository) WriteUsageSnapshot(ctx context.Context, snapshot *models.UsageSnapshot) error {
+    collection := m.client.Database(m.dbName).Collection("usage_snapshots")
+
+    filter := bson.D{{Key: "_id", Value: snapshot.ID}}
+    _, err := collection.ReplaceOne(ctx, filter, snapshot, options.Replace().SetUpsert(true))
+    return err
+}
+
+// GetUsageSnapshots возвращает срезы за дни с from по to включительно
+// (ключи вида 2006-01-02), упорядоченные по дате
+func (m *MongoRepository) GetUsageSnapshots(ctx context.Context, from, to string) ([]models.UsageSnapshot, error) {
+    collection := m.client.Database(m.dbName).Collection("usage_snapshots")
+
+    filter := bson.D{{Key: "_id", Value: bson.D{
+        {Key: "$gte", Value: from},
+        {Key: "$lte", Value: to},
+    }}}
+    opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+
+    cursor, err := collection.Find(ctx, filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    snapshots := []models.UsageSnapshot{}
+    if err := cursor.All(ctx, &snapshots); err != nil {
+        return nil, err
+    }
+    return snapshots, nil
+}
+
+// writeError оборачивает в ErrWriteUnavailable ошибки, при которых запись
+// не подтверждена вовремя: истекший wtimeout или таймаут операции.
+// Такая запись могла примениться на primary, поэтому ее результат неизвестен
+func writeError(err error) error {
+    var serverErr mongo.ServerError
+    if mongo.IsTimeout(err) || (errors.As(err, &serverErr) && serverErr.HasErrorCode(writeConcernFailed)) {
+        return fmt.Errorf("%w: %v", ErrWriteUnavailable, err)
+    }
+    return err
+}
+
+// Ping проверяет соединение с MongoDB
+func (m *MongoRepository) Ping(ctx context.Context) error {
+    return m.client.Ping(ctx, nil)
+}
+
 // Close закрывает подключение к MongoDB
 func (m *MongoRepository) Close() error {
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"kuber-code-s3/internal/models"
+)
+
+func TestAcquireLock(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	document := mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch, bson.D{{Key: "_id", Value: "file-1"}})
+	noDocument := mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch)
+
+	tests := []struct {
+		name      string
+		replies   []bson.D
+		wantErr   error
+		wantToken bool
+	}{
+		{"free or expired lock", []bson.D{updated(1)}, nil, true},
+		{"held by another operation", []bson.D{updated(0), document}, ErrDocumentLocked, false},
+		{"missing document", []bson.D{updated(0), noDocument}, ErrDocumentNotFound, false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			repo := NewMongoRepositoryWithClient(mt.Client, "file_storage")
+			mt.AddMockResponses(tt.replies...)
+
+			token, err := repo.AcquireLock(context.Background(), "file-1", time.Minute)
+			if !errors.Is(err, tt.wantErr) {
+				mt.Fatalf("AcquireLock() error = %v, want %v", err, tt.wantErr)
+			}
+			if (token != "") != tt.wantToken {
+				mt.Errorf("AcquireLock() token = %q, want token %t", token, tt.wantToken)
+			}
+
+			// Блокировка берется условным обновлением: свободна, если ее нет или
+			// срок истек, поэтому зависшие блокировки снимаются сами
+			update := mt.GetStartedEvent()
+			if update == nil || update.CommandName != "update" {
+				mt.Fatalf("first command = %v, want update", update)
+			}
+			filter := update.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("q").Document()
+			expiry, err := filter.LookupErr("$or", "1", "locked_until", "$lt")
+			if err != nil {
+				mt.Fatalf("lock filter %v has no expiry condition", filter)
+			}
+			if since := time.Since(expiry.Time()); since < 0 || since > time.Minute {
+				mt.Errorf("expiry compared against %v, want now", expiry.Time())
+			}
+		})
+	}
+}
+
+func updated(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	uploaded := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Документ после обновления содержит и поля, которые обновление не задавало
+	stored := bson.D{
+		{Key: "_id", Value: "file-1"},
+		{Key: "original_name", Value: "new"},
+		{Key: "file_size", Value: int64(4096)},
+		{Key: "content_type", Value: "image/png"},
+		{Key: "object_name", Value: "file-1.png"},
+		{Key: "upload_date", Value: uploaded},
+		{Key: "description", Value: "kept by the update"},
+		{Key: "download_count", Value: int64(7)},
+	}
+
+	tests := []struct {
+		name    string
+		reply   bson.D
+		wantErr error
+	}{
+		{"updated document", mtest.CreateSuccessResponse(bson.E{Key: "value", Value: stored}), nil},
+		{"missing document", mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}), ErrDocumentNotFound},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			repo := NewMongoRepositoryWithClient(mt.Client, "file_storage")
+			mt.AddMockResponses(tt.reply)
+
+			result, err := repo.UpdateMetadata(context.Background(), "file-1", &models.FileMetadata{
+				OriginalName: "new",
+				FileSize:     4096,
+				ContentType:  "image/png",
+				ObjectName:   "file-1.png",
+				UploadDate:   uploaded,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				mt.Fatalf("UpdateMetadata() error = %v, want %v", err, tt.wantErr)
+			}
+
+			command := mt.GetStartedEvent()
+			if command == nil || command.CommandName != "findAndModify" {
+				mt.Fatalf("command = %v, want findAndModify", command)
+			}
+			if !command.Command.Lookup("new").Boolean() {
+				mt.Error("findAndModify does not return the document after the update")
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if result.ID != "file-1" || result.FileSize != 4096 || !result.UploadDate.Equal(uploaded) {
+				mt.Errorf("UpdateMetadata() = %+v, want the updated fields", result)
+			}
+			if result.Description != "kept by the update" || result.DownloadCount != 7 {
+				mt.Errorf("UpdateMetadata() = %+v, want the stored document", result)
+			}
+		})
+	}
+}
+
+func TestWriteUsageSnapshot(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name     string
+		snapshot models.UsageSnapshot
+	}{
+		{"first snapshot of the day", models.UsageSnapshot{ID: "2026-01-02", TotalBytes: 1000, FileCount: 10}},
+		{"empty storage", models.UsageSnapshot{ID: "2026-01-03"}},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			repo := NewMongoRepositoryWithClient(mt.Client, "file_storage")
+			mt.AddMockResponses(updated(1))
+
+			if err := repo.WriteUsageSnapshot(context.Background(), &tt.snapshot); err != nil {
+				mt.Fatal(err)
+			}
+
+			// Повторная запись за тот же день заменяет срез, а не добавляет второй
+			command := mt.GetStartedEvent()
+			if command == nil || command.CommandName != "update" {
+				mt.Fatalf("command = %v, want update", command)
+			}
+			update := command.Command.Lookup("updates").Array().Index(0).Value().Document()
+			if id := update.Lookup("q", "_id").StringValue(); id != tt.snapshot.ID {
+				mt.Errorf("replaced snapshot %q, want %q", id, tt.snapshot.ID)
+			}
+			if !update.Lookup("upsert").Boolean() {
+				mt.Error("snapshot is not upserted")
+			}
+			var written models.UsageSnapshot
+			if err := bson.Unmarshal(update.Lookup("u").Document(), &written); err != nil {
+				mt.Fatal(err)
+			}
+			if written != tt.snapshot {
+				mt.Errorf("written %+v, want %+v", written, tt.snapshot)
+			}
+		})
+	}
+}
+
+func TestListingsScopedToKeyPrefix(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	// Ключи двух окружений в общем бакете; "staging-old/" не входит в "staging/"
+	keys := []string{"staging/a.png", "staging/3f/b.png", "prod/c.png", "staging-old/d.png", "e.png"}
+	noDocuments := mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch)
+
+	listings := []struct {
+		name string
+		call func(repo *MongoRepository, prefix string) error
+	}{
+		{"ListMetadata", func(repo *MongoRepository, prefix string) error {
+			_, err := repo.ListMetadata(context.Background(), prefix, 10, 0, "upload_date", true)
+			return err
+		}},
+		{"ListMetadataSince", func(repo *MongoRepository, prefix string) error {
+			_, err := repo.ListMetadataSince(context.Background(), prefix, time.Now().Add(-time.Hour), 10)
+			return err
+		}},
+		{"ListColdCandidates", func(repo *MongoRepository, prefix string) error {
+			_, err := repo.ListColdCandidates(context.Background(), prefix, time.Now(), 10)
+			return err
+		}},
+		{"CountMetadata", func(repo *MongoRepository, prefix string) error {
+			_, err := repo.CountMetadata(context.Background(), prefix)
+			return err
+		}},
+	}
+	tests := []struct {
+		prefix   string
+		wantKeys []string
+	}{
+		{"staging/", []string{"staging/a.png", "staging/3f/b.png"}},
+		{"", keys},
+	}
+
+	for _, listing := range listings {
+		for _, tt := range tests {
+			mt.Run(listing.name+" prefix "+strconv.Quote(tt.prefix), func(mt *mtest.T) {
+				repo := NewMongoRepositoryWithClient(mt.Client, "file_storage")
+				mt.AddMockResponses(noDocuments)
+
+				if err := listing.call(repo, tt.prefix); err != nil {
+					mt.Fatalf("%s() error = %v", listing.name, err)
+				}
+
+				event := mt.GetStartedEvent()
+				filter, ok := event.Command.Lookup("filter").DocumentOK()
+				if event.CommandName == "aggregate" {
+					filter, ok = event.Command.Lookup("pipeline", "0", "$match").DocumentOK()
+				}
+				if !ok {
+					mt.Fatalf("%s command has no filter: %v", event.CommandName, event.Command)
+				}
+
+				condition, err := filter.LookupErr("object_name")
+				if tt.prefix == "" {
+					if err == nil {
+						mt.Errorf("filter %v limits object_name without a prefix", filter)
+					}
+					return
+				}
+				pattern, _, ok := condition.RegexOK()
+				if !ok {
+					mt.Fatalf("object_name condition %v, want a regex", condition)
+				}
+				re := regexp.MustCompile(pattern)
+				var matched []string
+				for _, key := range keys {
+					if re.MatchString(key) {
+						matched = append(matched, key)
+					}
+				}
+				if !slices.Equal(matched, tt.wantKeys) {
+					mt.Errorf("filter %v selects %v, want %v", filter, matched, tt.wantKeys)
+				}
+			})
+		}
+	}
+}
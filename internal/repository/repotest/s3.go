@@ -0,0 +1,654 @@
+// Package repotest содержит поддельное S3-хранилище для тестов кода,
+// работающего с MinioRepository, без запущенного Minio
+package repotest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kuber-code-s3/internal/repository"
+)
+
+// Object - объект поддельного хранилища
+type Object struct {
+    Data            []byte
+    ContentType     string
+    ContentEncoding string
+    Metadata        map[string]string
+    Tags            map[string]string
+    ModTime         time.Time
+}
+
+// Request - запрос, полученный хранилищем
+type Request struct {
+    Method string
+    Bucket string
+    Key    string
+    Query  url.Values
+    Header http.Header
+}
+
+// Upload - незавершенная multipart-загрузка
+type Upload struct {
+    Bucket    string
+    Key       string
+    ID        string
+    Initiated time.Time
+    parts     map[int][]byte
+    // Свойства объекта, переданные при создании загрузки
+    object Object
+}
+
+// S3 - хранилище в памяти, отвечающее на запросы minio-go. Поддерживает
+// операции, которые использует MinioRepository
+type S3 struct {
+    server *httptest.Server
+
+    mu       sync.Mutex
+    buckets  map[string]map[string]*Object
+    uploads  map[string]*Upload
+    requests []Request
+    nextID   int
+
+    // Коды ошибок S3, которыми по очереди отвечают загрузки объектов
+    putErrors []string
+    // Число следующих загрузок, содержимое которых портится при сохранении
+    corruptPuts int
+}
+
+// NewS3 запускает поддельное хранилище с заданными бакетами. Сервер
+// останавливается по окончании теста
+func NewS3(t testing.TB, buckets ...string) *S3 {
+    t.Helper()
+
+    s := &S3{
+        buckets: make(map[string]map[string]*Object),
+        uploads: make(map[string]*Upload),
+    }
+    for _, bucket := range buckets {
+        s.buckets[bucket] = make(map[string]*Object)
+    }
+    s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+    t.Cleanup(s.server.Close)
+    return s
+}
+
+// Endpoint возвращает адрес хранилища в виде host:port
+func (s *S3) Endpoint() string {
+    return strings.TrimPrefix(s.server.URL, "http://")
+}
+
+// Repository подключает MinioRepository к бакету хранилища
+func (s *S3) Repository(t testing.TB, bucket string) *repository.MinioRepository {
+    t.Helper()
+
+    repo, err := repository.NewMinioRepository(s.Endpoint(), "access", "secret-key", false, bucket, false)
+    if err != nil {
+        t.Fatalf("connect to fake S3: %v", err)
+    }
+    return repo
+}
+
+// Put кладет объект в бакет в обход API
+func (s *S3) Put(bucket, key string, object Object) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if object.ModTime.IsZero() {
+        object.ModTime = time.Now()
+    }
+    s.bucket(bucket)[key] = &object
+}
+
+// Get возвращает копию объекта бакета
+func (s *S3) Get(bucket, key string) (Object, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    object, ok := s.buckets[bucket][key]
+    if !ok {
+        return Object{}, false
+    }
+    return *object, true
+}
+
+// Keys возвращает отсортированные ключи объектов бакета
+func (s *S3) Keys(bucket string) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var keys []string
+    for key := range s.buckets[bucket] {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// AddUpload регистрирует незавершенную multipart-загрузку
+func (s *S3) AddUpload(bucket, key string, initiated time.Time) string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.newUpload(bucket, key, initiated).ID
+}
+
+// Uploads возвращает ID незавершенных загрузок
+func (s *S3) Uploads() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var ids []string
+    for id := range s.uploads {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+// FailPuts задает коды ошибок, которыми ответят следующие загрузки объектов
+func (s *S3) FailPuts(codes ...string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.putErrors = append(s.putErrors, codes...)
+}
+
+// CorruptPuts портит содержимое следующих n загрузок: хранилище сохраняет и
+// подтверждает суммой не те байты, что получило
+func (s *S3) CorruptPuts(n int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.corruptPuts = n
+}
+
+// Requests возвращает запросы с заданным методом; пустой метод - все
+func (s *S3) Requests(method string) []Request {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var requests []Request
+    for _, req := range s.requests {
+        if method == "" || req.Method == method {
+            requests = append(requests, req)
+        }
+    }
+    return requests
+}
+
+// Mutations возвращает запросы, изменяющие объекты (PUT, POST, DELETE)
+func (s *S3) Mutations() []Request {
+    var mutations []Request
+    for _, req := range s.Requests("") {
+        if req.Method != http.MethodGet && req.Method != http.MethodHead {
+            mutations = append(mutations, req)
+        }
+    }
+    return mutations
+}
+
+func (s *S3) bucket(name string) map[string]*Object {
+    if s.buckets[name] == nil {
+        s.buckets[name] = make(map[string]*Object)
+    }
+    return s.buckets[name]
+}
+
+func (s *S3) newUpload(bucket, key string, initiated time.Time) *Upload {
+    s.nextID++
+    upload := &Upload{
+        Bucket:    bucket,
+        Key:       key,
+        ID:        fmt.Sprintf("upload-%d", s.nextID),
+        Initiated: initiated,
+        parts:     make(map[int][]byte),
+    }
+    s.uploads[upload.ID] = upload
+    return upload
+}
+
+func (s *S3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+    bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+    query := r.URL.Query()
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.requests = append(s.requests, Request{
+        Method: r.Method,
+        Bucket: bucket,
+        Key:    key,
+        Query:  query,
+        Header: r.Header.Clone(),
+    })
+
+    switch {
+    case bucket == "":
+        s.serveRoot(w, r)
+    case key == "":
+        s.serveBucket(w, r, bucket, query)
+    default:
+        if _, ok := s.buckets[bucket]; !ok {
+            writeError(w, http.StatusNotFound, "NoSuchBucket", bucket, key)
+            return
+        }
+        s.serveObject(w, r, bucket, key, query)
+    }
+}
+
+func (s *S3) serveRoot(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodHead {
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    type bucketInfo struct {
+        Name         string
+        CreationDate string
+    }
+    var result struct {
+        XMLName xml.Name     `xml:"ListAllMyBucketsResult"`
+        Buckets []bucketInfo `xml:"Buckets>Bucket"`
+    }
+    for name := range s.buckets {
+        result.Buckets = append(result.Buckets, bucketInfo{Name: name, CreationDate: time.Now().UTC().Format(time.RFC3339)})
+    }
+    writeXML(w, result)
+}
+
+func (s *S3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) {
+    _, exists := s.buckets[bucket]
+
+    switch {
+    case r.Method == http.MethodPut && query.Has("policy"):
+        w.WriteHeader(http.StatusNoContent)
+    case r.Method == http.MethodPut:
+        s.bucket(bucket)
+        w.WriteHeader(http.StatusOK)
+    case !exists:
+        writeError(w, http.StatusNotFound, "NoSuchBucket", bucket, "")
+    case r.Method == http.MethodHead:
+        w.WriteHeader(http.StatusOK)
+    case r.Method == http.MethodGet && query.Has("location"):
+        writeXML(w, struct {
+            XMLName xml.Name `xml:"LocationConstraint"`
+        }{})
+    case r.Method == http.MethodGet && query.Has("uploads"):
+        s.listUploads(w, bucket, query.Get("prefix"))
+    case r.Method == http.MethodPost && query.Has("delete"):
+        s.deleteObjects(w, r, bucket)
+    default:
+        writeError(w, http.StatusNotImplemented, "NotImplemented", bucket, "")
+    }
+}
+
+func (s *S3) listUploads(w http.ResponseWriter, bucket, prefix string) {
+    type uploadInfo struct {
+        Key       string
+        UploadId  string
+        Initiated string
+    }
+    var result struct {
+        XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+        Bucket      string
+        IsTruncated bool
+        Uploads     []uploadInfo `xml:"Upload"`
+    }
+    result.Bucket = bucket
+
+    var uploads []*Upload
+    for _, upload := range s.uploads {
+        if upload.Bucket == bucket && strings.HasPrefix(upload.Key, prefix) {
+            uploads = append(uploads, upload)
+        }
+    }
+    sort.Slice(uploads, func(i, j int) bool { return uploads[i].ID < uploads[j].ID })
+    for _, upload := range uploads {
+        result.Uploads = append(result.Uploads, uploadInfo{
+            Key:       upload.Key,
+            UploadId:  upload.ID,
+            Initiated: upload.Initiated.UTC().Format(time.RFC3339),
+        })
+    }
+    writeXML(w, result)
+}
+
+func (s *S3) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+    var request struct {
+        Objects []struct {
+            Key string
+        } `xml:"Object"`
+    }
+    if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+        writeError(w, http.StatusBadRequest, "MalformedXML", bucket, "")
+        return
+    }
+
+    type deleted struct {
+        Key string
+    }
+    var result struct {
+        XMLName xml.Name  `xml:"DeleteResult"`
+        Deleted []deleted `xml:"Deleted"`
+    }
+    for _, object := range request.Objects {
+        delete(s.buckets[bucket], object.Key)
+        result.Deleted = append(result.Deleted, deleted{Key: object.Key})
+    }
+    writeXML(w, result)
+}
+
+func (s *S3) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values) {
+    switch {
+    case query.Has("tagging"):
+        s.serveTagging(w, r, bucket, key)
+    case r.Method == http.MethodPost && query.Has("uploads"):
+        upload := s.newUpload(bucket, key, time.Now())
+        upload.object = objectFromHeader(r.Header)
+        writeXML(w, struct {
+            XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+            Bucket   string
+            Key      string
+            UploadId string
+        }{Bucket: bucket, Key: key, UploadId: upload.ID})
+    case query.Has("uploadId"):
+        s.serveUpload(w, r, bucket, key, query)
+    case r.Method == http.MethodPut:
+        s.putObject(w, r, bucket, key)
+    case r.Method == http.MethodGet || r.Method == http.MethodHead:
+        s.getObject(w, r, bucket, key)
+    case r.Method == http.MethodDelete:
+        delete(s.buckets[bucket], key)
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        writeError(w, http.StatusNotImplemented, "NotImplemented", bucket, key)
+    }
+}
+
+func (s *S3) serveTagging(w http.ResponseWriter, r *http.Request, bucket, key string) {
+    object, ok := s.buckets[bucket][key]
+    if !ok {
+        writeError(w, http.StatusNotFound, "NoSuchKey", bucket, key)
+        return
+    }
+
+    type tag struct {
+        Key   string
+        Value string
+    }
+    type tagging struct {
+        XMLName xml.Name `xml:"Tagging"`
+        Tags    []tag    `xml:"TagSet>Tag"`
+    }
+
+    switch r.Method {
+    case http.MethodPut:
+        var request tagging
+        if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+            writeError(w, http.StatusBadRequest, "MalformedXML", bucket, key)
+            return
+        }
+        object.Tags = make(map[string]string)
+        for _, t := range request.Tags {
+            object.Tags[t.Key] = t.Value
+        }
+        w.WriteHeader(http.StatusOK)
+    case http.MethodGet:
+        var result tagging
+        for k, v := range object.Tags {
+            result.Tags = append(result.Tags, tag{Key: k, Value: v})
+        }
+        sort.Slice(result.Tags, func(i, j int) bool { return result.Tags[i].Key < result.Tags[j].Key })
+        writeXML(w, result)
+    default:
+        writeError(w, http.StatusNotImplemented, "NotImplemented", bucket, key)
+    }
+}
+
+func (s *S3) serveUpload(w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values) {
+    upload, ok := s.uploads[query.Get("uploadId")]
+    if !ok || upload.Bucket != bucket || upload.Key != key {
+        writeError(w, http.StatusNotFound, "NoSuchUpload", bucket, key)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodPut:
+        number, err := strconv.Atoi(query.Get("partNumber"))
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "InvalidArgument", bucket, key)
+            return
+        }
+        data, _, err := readPayload(r)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "IncompleteBody", bucket, key)
+            return
+        }
+        upload.parts[number] = data
+        w.Header().Set("ETag", etag(data))
+        w.WriteHeader(http.StatusOK)
+    case http.MethodPost:
+        numbers := make([]int, 0, len(upload.parts))
+        for number := range upload.parts {
+            numbers = append(numbers, number)
+        }
+        sort.Ints(numbers)
+        var data []byte
+        for _, number := range numbers {
+            data = append(data, upload.parts[number]...)
+        }
+        delete(s.uploads, upload.ID)
+        object := upload.object
+        object.Data = data
+        object.ModTime = time.Now()
+        s.bucket(bucket)[key] = &object
+        writeXML(w, struct {
+            XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+            Bucket  string
+            Key     string
+            ETag    string
+        }{Bucket: bucket, Key: key, ETag: fmt.Sprintf(`"%s-%d"`, strings.Trim(etag(data), `"`), len(numbers))})
+    case http.MethodDelete:
+        delete(s.uploads, upload.ID)
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        writeError(w, http.StatusNotImplemented, "NotImplemented", bucket, key)
+    }
+}
+
+func (s *S3) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+    data, trailer, err := readPayload(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "IncompleteBody", bucket, key)
+        return
+    }
+    if len(s.putErrors) > 0 {
+        code := s.putErrors[0]
+        s.putErrors = s.putErrors[1:]
+        writeError(w, http.StatusBadRequest, code, bucket, key)
+        return
+    }
+    if s.corruptPuts > 0 {
+        s.corruptPuts--
+        data = append([]byte(nil), data...)
+        if len(data) == 0 {
+            data = []byte{0}
+        }
+        data[0] ^= 0xff
+    }
+
+    object := objectFromHeader(r.Header)
+    object.Data = data
+    object.ModTime = time.Now()
+    s.bucket(bucket)[key] = &object
+
+    // Хранилище подтверждает суммой то, что сохранило
+    w.Header().Set("ETag", etag(data))
+    if checksumSent(r, trailer, "X-Amz-Checksum-Sha256") {
+        sum := sha256.Sum256(data)
+        w.Header().Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+    }
+    if checksumSent(r, trailer, "X-Amz-Checksum-Crc32c") {
+        sum := binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+        w.Header().Set("X-Amz-Checksum-Crc32c", base64.StdEncoding.EncodeToString(sum))
+    }
+    w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+    object, ok := s.buckets[bucket][key]
+    if !ok {
+        writeError(w, http.StatusNotFound, "NoSuchKey", bucket, key)
+        return
+    }
+
+    header := w.Header()
+    header.Set("ETag", etag(object.Data))
+    if object.ContentType != "" {
+        header.Set("Content-Type", object.ContentType)
+    } else {
+        header.Set("Content-Type", "binary/octet-stream")
+    }
+    if object.ContentEncoding != "" {
+        header.Set("Content-Encoding", object.ContentEncoding)
+    }
+    for k, v := range object.Metadata {
+        header.Set("X-Amz-Meta-"+k, v)
+    }
+    // По x-amz-checksum-mode хранилище возвращает суммы содержимого
+    if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" {
+        sha := sha256.Sum256(object.Data)
+        header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sha[:]))
+        crc := binary.BigEndian.AppendUint32(nil, crc32.Checksum(object.Data, crc32.MakeTable(crc32.Castagnoli)))
+        header.Set("X-Amz-Checksum-Crc32c", base64.StdEncoding.EncodeToString(crc))
+    }
+    http.ServeContent(w, r, "", object.ModTime, bytes.NewReader(object.Data))
+}
+
+// objectFromHeader возвращает свойства объекта из заголовков загрузки
+func objectFromHeader(header http.Header) Object {
+    object := Object{
+        ContentType: header.Get("Content-Type"),
+        Metadata:    make(map[string]string),
+    }
+    // aws-chunked - служебная кодировка тела запроса, а не содержимого объекта
+    var encodings []string
+    for _, encoding := range strings.Split(header.Get("Content-Encoding"), ",") {
+        if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+            encodings = append(encodings, encoding)
+        }
+    }
+    object.ContentEncoding = strings.Join(encodings, ",")
+
+    for name, values := range header {
+        if meta, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+            object.Metadata[meta] = values[0]
+        }
+    }
+    if tagging := header.Get("X-Amz-Tagging"); tagging != "" {
+        tags, _ := url.ParseQuery(tagging)
+        object.Tags = make(map[string]string)
+        for k := range tags {
+            object.Tags[k] = tags.Get(k)
+        }
+    }
+    return object
+}
+
+// readPayload читает тело загрузки, раскрывая aws-chunked кодировку
+// потоковой подписи. Возвращает содержимое и заголовки трейлера
+func readPayload(r *http.Request) ([]byte, http.Header, error) {
+    trailer := make(http.Header)
+    if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+        data, err := io.ReadAll(r.Body)
+        return data, trailer, err
+    }
+
+    var data []byte
+    reader := bufio.NewReader(r.Body)
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return nil, nil, err
+        }
+        sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+        size, err := strconv.ParseInt(sizeHex, 16, 64)
+        if err != nil {
+            return nil, nil, err
+        }
+        if size == 0 {
+            break
+        }
+        chunk := make([]byte, size)
+        if _, err := io.ReadFull(reader, chunk); err != nil {
+            return nil, nil, err
+        }
+        data = append(data, chunk...)
+        if _, err := reader.Discard(2); err != nil {
+            return nil, nil, err
+        }
+    }
+
+    // Трейлер: строки "имя:значение" до пустой строки или конца тела
+    for {
+        line, err := reader.ReadString('\n')
+        line = strings.TrimSpace(line)
+        if name, value, ok := strings.Cut(line, ":"); ok {
+            trailer.Set(name, value)
+        }
+        if err != nil || line == "" {
+            break
+        }
+    }
+    return data, trailer, nil
+}
+
+// checksumSent сообщает, передал ли клиент контрольную сумму в заголовке
+// или в трейлере запроса
+func checksumSent(r *http.Request, trailer http.Header, name string) bool {
+    return r.Header.Get(name) != "" || trailer.Get(name) != "" ||
+        strings.EqualFold(r.Header.Get("X-Amz-Trailer"), name)
+}
+
+func etag(data []byte) string {
+    sum := md5.Sum(data)
+    return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(http.StatusOK)
+    _ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, bucket, key string) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(status)
+    _ = xml.NewEncoder(w).Encode(struct {
+        XMLName    xml.Name `xml:"Error"`
+        Code       string
+        Message    string
+        BucketName string
+        Key        string
+        RequestId  string
+    }{Code: code, Message: code, BucketName: bucket, Key: key, RequestId: "fake"})
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"kuber-code-s3/internal/repository"
+)
+
+// ObjectDeleteResult описывает удаление объекта по ключу из админского API
+type ObjectDeleteResult struct {
+    ObjectName      string `json:"object_name"`
+    ObjectDeleted   bool   `json:"object_deleted"`
+    FileID          string `json:"file_id,omitempty"`
+    MetadataDeleted bool   `json:"metadata_deleted"`
+}
+
+// DeleteObjectByName удаляет объект Minio по ключу вместе с метаданными,
+// которые на него ссылаются (если они есть). Используется для очистки
+// объектов, оставшихся без метаданных, и наоборот. ErrFileNotFound
+// возвращается, только если нет ни объекта, ни метаданных. Ключи вне
+// KEY_PREFIX принадлежат другим окружениям и считаются отсутствующими
+func (s *FileService) DeleteObjectByName(ctx context.Context, objectName string) (*ObjectDeleteResult, error) {
+    if !strings.HasPrefix(objectName, s.keyPrefix) {
+        return nil, ErrFileNotFound
+    }
+    result := &ObjectDeleteResult{ObjectName: objectName}
+
+    metadata, err := s.mongoRepo.FindByObjectName(ctx, objectName, s.minioRepo.ObjectURL(objectName))
+    if err != nil && !errors.Is(err, repository.ErrDocumentNotFound) {
+        return nil, err
+    }
+    if metadata != nil {
+        unlock, err := s.lockFile(ctx, metadata.ID)
+        if err != nil {
+            return nil, err
+        }
+        defer unlock()
+        result.FileID = metadata.ID
+    }
+
+    exists, err := s.minioRepo.ObjectExists(ctx, objectName)
+    if err != nil {
+        return nil, err
+    }
+    if !exists && metadata == nil {
+        return nil, ErrFileNotFound
+    }
+
+    if exists {
+        if err := s.minioRepo.DeleteFile(ctx, objectName); err != nil && !errors.Is(err, repository.ErrFileNotFound) {
+            return nil, err
+        }
+        result.ObjectDeleted = true
+        s.invalidatePresigned(objectName)
+    }
+
+    if metadata != nil {
+        if metadata.ThumbnailURL != "" {
+            if err := s.thumbnailRepoFor(metadata).DeleteFile(ctx, s.thumbnailObjectName(metadata.ID)); err != nil {
+                log.Printf("Thumbnail deletion error for %s: %v", metadata.ID, err)
+            }
+        }
+        if err := s.mongoRepo.DeleteMetadata(ctx, metadata.ID); err != nil && !errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, err
+        }
+        result.MetadataDeleted = true
+    }
+
+    return result, nil
+}
+
+// FieldDiff - расхождение одного поля между метаданными и объектом Minio
+type FieldDiff struct {
+    Field    string `json:"field"`
+    Metadata string `json:"metadata"`
+    Object   string `json:"object"`
+}
+
+// FileDiff - результат сверки метаданных файла с объектом в Minio
+type FileDiff struct {
+    FileID        string      `json:"file_id"`
+    ObjectName    string      `json:"object_name"`
+    ObjectExists  bool        `json:"object_exists"`
+    Discrepancies []FieldDiff `json:"discrepancies"`
+}
+
+// DiffFile сравнивает сохраненные метаданные файла со свойствами объекта
+// в Minio (StatObject). Размер сравнивается только для объектов, хранящихся
+// без сжатия: для сжатых в метаданных записан исходный размер. Контрольная
+// сумма сравнивается, если она есть и в метаданных, и у объекта
+func (s *FileService) DiffFile(ctx context.Context, fileID string) (*FileDiff, error) {
+    metadata, err := s.mongoRepo.GetMetadata(ctx, fileID)
+    if err != nil {
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, ErrFileNotFound
+        }
+        return nil, err
+    }
+
+    diff := &FileDiff{
+        FileID:        fileID,
+        ObjectName:    objectNameFor(metadata),
+        Discrepancies: []FieldDiff{},
+    }
+
+    stat, err := s.minioRepo.StatObject(ctx, diff.ObjectName)
+    if err != nil {
+        if errors.Is(err, repository.ErrFileNotFound) {
+            return diff, nil
+        }
+        return nil, err
+    }
+    diff.ObjectExists = true
+
+    if metadata.ContentEncoding == "" && stat.Size != metadata.FileSize {
+        diff.add("file_size", strconv.FormatInt(metadata.FileSize, 10), strconv.FormatInt(stat.Size, 10))
+    }
+    if stat.ContentType != metadata.ContentType {
+        diff.add("content_type", metadata.ContentType, stat.ContentType)
+    }
+    if stat.ContentEncoding != metadata.ContentEncoding {
+        diff.add("content_encoding", metadata.ContentEncoding, stat.ContentEncoding)
+    }
+    if metadata.Checksum != "" {
+        if checksum := stat.Checksum(metadata.ChecksumAlgorithm); checksum != "" && checksum != metadata.Checksum {
+            diff.add("checksum", metadata.Checksum, checksum)
+        }
+    }
+
+    return diff, nil
+}
+
+func (d *FileDiff) add(field, metadata, object string) {
+    d.Discrepancies = append(d.Discrepancies, FieldDiff{Field: field, Metadata: metadata, Object: object})
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+)
+
+// checksumBackfillBatch - число файлов, обрабатываемых одним запросом к MongoDB
+const checksumBackfillBatch = 100
+
+// ChecksumBackfillResult - итог прохода по файлам без SHA-256 содержимого
+type ChecksumBackfillResult struct {
+    Processed      int `json:"processed"`
+    Updated        int `json:"updated"`
+    MissingObjects int `json:"missing_objects"`
+    // ID последнего обработанного файла; передается как after, чтобы
+    // продолжить с места остановки
+    LastID string `json:"last_id,omitempty"`
+    // Файлов без SHA-256 после LastID не осталось
+    Done bool `json:"done"`
+}
+
+// BackfillChecksums вычисляет SHA-256 содержимого для файлов, созданных до
+// его сохранения при загрузке, читая объекты из Minio. Обрабатывается не
+// более limit файлов с ID больше after (limit <= 0 - все). Файлы без объекта
+// пропускаются и учитываются в MissingObjects
+func (s *FileService) BackfillChecksums(ctx context.Context, after string, limit int) (*ChecksumBackfillResult, error) {
+    result := &ChecksumBackfillResult{LastID: after}
+    for {
+        batch := checksumBackfillBatch
+        if limit > 0 {
+            batch = min(batch, limit-result.Processed)
+        }
+        if batch == 0 {
+            return result, nil
+        }
+
+        files, err := s.mongoRepo.ListMissingSHA256(ctx, result.LastID, batch)
+        if err != nil {
+            return result, err
+        }
+
+        for i := range files {
+            metadata := &files[i]
+            sum, err := s.contentSHA256(ctx, metadata)
+            switch {
+            case errors.Is(err, repository.ErrFileNotFound):
+                log.Printf("Checksum backfill: object %s of %s not found", objectNameFor(metadata), metadata.ID)
+                result.MissingObjects++
+            case err != nil:
+                return result, err
+            default:
+                if err := s.mongoRepo.SetContentSHA256IfEmpty(ctx, metadata.ID, sum); err != nil {
+                    return result, err
+                }
+                result.Updated++
+            }
+            result.Processed++
+            result.LastID = metadata.ID
+        }
+
+        log.Printf("Checksum backfill: %d processed, %d updated, %d missing objects",
+            result.Processed, result.Updated, result.MissingObjects)
+
+        if len(files) < batch {
+            result.Done = true
+            return result, nil
+        }
+    }
+}
+
+// contentSHA256 читает объект файла и возвращает SHA-256 (hex) исходного
+// содержимого; сжатые при хранении объекты распаковываются
+func (s *FileService) contentSHA256(ctx context.Context, metadata *models.FileMetadata) (string, error) {
+    src, err := s.minioRepo.GetObject(ctx, objectNameFor(metadata))
+    if err != nil {
+        return "", err
+    }
+    defer src.Close()
+
+    body := io.Reader(src)
+    if metadata.ContentEncoding == encodingGzip {
+        gz, err := gzip.NewReader(src)
+        if err != nil {
+            return "", err
+        }
+        defer gz.Close()
+        body = gz
+    }
+
+    hash := sha256.New()
+    if _, err := io.Copy(hash, body); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+)
+
+// BulkDeleteFailure - файл, который не удалось удалить, и причина
+type BulkDeleteFailure struct {
+    ID    string `json:"id"`
+    Error string `json:"error"`
+}
+
+// BulkDeleteResult - итог пакетного удаления по каждому ID
+type BulkDeleteResult struct {
+    Deleted  []string            `json:"deleted"`
+    NotFound []string            `json:"notFound"`
+    Failed   []BulkDeleteFailure `json:"failed"`
+}
+
+func (r *BulkDeleteResult) fail(fileID string, err error) {
+    r.Failed = append(r.Failed, BulkDeleteFailure{ID: fileID, Error: err.Error()})
+}
+
+// DeleteFiles удаляет несколько файлов. Каждый файл блокируется и проверяется
+// так же, как в DeleteFile, а объекты удаляются из Minio одним пакетным
+// запросом. Ошибка по одному файлу не прерывает удаление остальных
+func (s *FileService) DeleteFiles(ctx context.Context, ids []string) *BulkDeleteResult {
+    result := &BulkDeleteResult{
+        Deleted:  []string{},
+        NotFound: []string{},
+        Failed:   []BulkDeleteFailure{},
+    }
+
+    var pending []*models.FileMetadata
+    seen := make(map[string]bool, len(ids))
+    for _, fileID := range ids {
+        if seen[fileID] {
+            continue
+        }
+        seen[fileID] = true
+
+        unlock, err := s.lockFile(ctx, fileID)
+        if err != nil {
+            if err == ErrFileNotFound {
+                result.NotFound = append(result.NotFound, fileID)
+            } else {
+                result.fail(fileID, err)
+            }
+            continue
+        }
+        defer unlock()
+
+        metadata, err := s.mongoRepo.GetMetadata(ctx, fileID)
+        if err != nil {
+            if errors.Is(err, repository.ErrDocumentNotFound) {
+                result.NotFound = append(result.NotFound, fileID)
+            } else {
+                result.fail(fileID, err)
+            }
+            continue
+        }
+        pending = append(pending, metadata)
+    }
+
+    pending, objectNames := s.bulkDeleteObjects(ctx, pending, result)
+    var failed map[string]error
+    if len(objectNames) > 0 {
+        failed = s.minioRepo.DeleteFiles(ctx, objectNames)
+    }
+
+    for _, metadata := range pending {
+        objectName := objectNameFor(metadata)
+        if err := failed[objectName]; err != nil {
+            log.Printf("Bulk delete error for %s: %v", metadata.ID, err)
+            result.fail(metadata.ID, err)
+            continue
+        }
+        s.invalidatePresigned(objectName)
+
+        if err := s.deleteRecords(ctx, metadata); err != nil {
+            result.fail(metadata.ID, err)
+            continue
+        }
+        result.Deleted = append(result.Deleted, metadata.ID)
+    }
+    return result
+}
+
+// bulkDeleteObjects возвращает файлы, которые можно удалять, и ключи их объектов
+// для удаления из Minio. Объект, общий с файлами вне пакета, не удаляется;
+// файлы пакета с одним объектом учитываются вместе. Файлы, для которых
+// не удалось посчитать ссылки, не удаляются и считаются ссылками вне пакета
+func (s *FileService) bulkDeleteObjects(ctx context.Context, pending []*models.FileMetadata, result *BulkDeleteResult) ([]*models.FileMetadata, []string) {
+    var ready []*models.FileMetadata
+    references := make(map[string]int64, len(pending))
+    inBatch := make(map[string]int64)
+    for _, metadata := range pending {
+        objectName := objectNameFor(metadata)
+        count, err := s.mongoRepo.CountObjectReferences(ctx, objectName, s.minioRepo.ObjectURL(objectName), metadata.ID)
+        if err != nil {
+            result.fail(metadata.ID, err)
+            continue
+        }
+        ready = append(ready, metadata)
+        references[metadata.ID] = count
+        inBatch[objectName]++
+    }
+
+    var objectNames []string
+    queued := make(map[string]bool)
+    for _, metadata := range ready {
+        objectName := objectNameFor(metadata)
+        if queued[objectName] || !objectFreed(references[metadata.ID], inBatch[objectName]) {
+            continue
+        }
+        queued[objectName] = true
+        objectNames = append(objectNames, objectName)
+    }
+    return ready, objectNames
+}
+
+// objectFreed сообщает, освобождается ли объект после удаления пакета:
+// references - ссылки на объект кроме самого файла, deleting - число
+// удаляемых файлов пакета, включая этот, которые ссылаются на объект
+func objectFreed(references, deleting int64) bool {
+    return references-(deleting-1) <= 0
+}
@@ -0,0 +1,25 @@
+package service
+
+import "testing"
+
+func TestObjectFreed(t *testing.T) {
+	tests := []struct {
+		name       string
+		references int64
+		deleting   int64
+		want       bool
+	}{
+		{"sole reference", 0, 1, true},
+		{"shared outside the batch", 1, 1, false},
+		{"all references in the batch", 2, 3, true},
+		{"one reference left outside the batch", 2, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := objectFreed(tt.references, tt.deleting); got != tt.want {
+				t.Errorf("objectFreed(%d, %d) = %t, want %t", tt.references, tt.deleting, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"kuber-code-s3/internal/repository"
+)
+
+var (
+    ErrDestinationNotAllowed = errors.New("destination host is not allowed")
+    ErrDestinationFailed     = errors.New("destination rejected the upload")
+)
+
+// CopyResult описывает результат выгрузки файла во внешнее хранилище
+type CopyResult struct {
+    FileID string `json:"file_id"`
+    Bytes  int64  `json:"bytes"`
+}
+
+// copyClient не следует редиректам: иначе разрешенный хост мог бы
+// перенаправить запрос на внутренний адрес в обход списка разрешенных
+var copyClient = &http.Client{
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        return http.ErrUseLastResponse
+    },
+}
+
+// CopyTo передает содержимое файла потоком по внешней подписанной PUT-ссылке,
+// не сохраняя его локально. Хост ссылки должен быть в списке разрешенных
+func (s *FileService) CopyTo(ctx context.Context, fileID, destination string) (*CopyResult, error) {
+    target, err := s.copyDestination(destination)
+    if err != nil {
+        return nil, err
+    }
+
+    metadata, err := s.GetAccessibleMetadata(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+
+    src, err := s.minioRepo.GetObject(ctx, objectNameFor(metadata))
+    if err != nil {
+        if errors.Is(err, repository.ErrFileNotFound) {
+            return nil, ErrFileNotFound
+        }
+        return nil, err
+    }
+    defer src.Close()
+
+    // Сжатые при хранении объекты выгружаются в исходном виде
+    body := io.Reader(src)
+    if metadata.ContentEncoding == encodingGzip {
+        gz, err := gzip.NewReader(src)
+        if err != nil {
+            return nil, err
+        }
+        defer gz.Close()
+        body = gz
+    }
+
+    counter := &countingReader{r: body, declared: -1}
+    req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), counter)
+    if err != nil {
+        return nil, err
+    }
+    req.ContentLength = metadata.FileSize
+    if metadata.ContentType != "" {
+        req.Header.Set("Content-Type", metadata.ContentType)
+    }
+
+    resp, err := copyClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        log.Printf("Copy of %s to %s failed with status %d", fileID, target.Host, resp.StatusCode)
+        return nil, fmt.Errorf("%w: status %d", ErrDestinationFailed, resp.StatusCode)
+    }
+
+    return &CopyResult{FileID: fileID, Bytes: counter.n}, nil
+}
+
+// copyDestination разбирает ссылку назначения и проверяет схему и хост
+func (s *FileService) copyDestination(destination string) (*url.URL, error) {
+    target, err := url.Parse(destination)
+    if err != nil || target.Host == "" {
+        return nil, ErrDestinationNotAllowed
+    }
+    if target.Scheme != "https" && target.Scheme != "http" {
+        return nil, ErrDestinationNotAllowed
+    }
+    if !s.copyAllowedHosts[strings.ToLower(target.Hostname())] {
+        return nil, ErrDestinationNotAllowed
+    }
+    return target, nil
+}
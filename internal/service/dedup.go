@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+)
+
+// findDuplicate возвращает файл с тем же содержимым, объект которого можно
+// переиспользовать: он лежит в текущем бакете под KEY_PREFIX и существует.
+// Если такого файла нет, возвращает nil без ошибки
+func (s *FileService) findDuplicate(ctx context.Context, contentSHA256 string) (*models.FileMetadata, error) {
+    existing, err := s.mongoRepo.FindByChecksum(ctx, contentSHA256)
+    if err != nil {
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, nil
+        }
+        return nil, err
+    }
+
+    objectName := objectNameFor(existing)
+    if existing.BucketName != s.minioRepo.Bucket || !strings.HasPrefix(objectName, s.keyPrefix) {
+        return nil, nil
+    }
+
+    exists, err := s.minioRepo.ObjectExists(ctx, objectName)
+    if err != nil || !exists {
+        return nil, err
+    }
+    return existing, nil
+}
+
+// objectShared сообщает, ссылаются ли на объект файла другие файлы
+// (после дедупликации загрузок). Такой объект нельзя удалять или перезаписывать
+func (s *FileService) objectShared(ctx context.Context, metadata *models.FileMetadata) (bool, error) {
+    objectName := objectNameFor(metadata)
+    count, err := s.mongoRepo.CountObjectReferences(ctx, objectName, s.minioRepo.ObjectURL(objectName), metadata.ID)
+    if err != nil {
+        return false, err
+    }
+    return count > 0, nil
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"kuber-code-s3/internal/models"
+)
+
+// statusHub рассылает подписчикам изменения статуса фоновых заданий по файлу
+// (сейчас - построения миниатюры). События живут только в памяти процесса
+type statusHub struct {
+    mu   sync.Mutex
+    subs map[string]map[chan string]struct{}
+}
+
+func newStatusHub() *statusHub {
+    return &statusHub{subs: make(map[string]map[chan string]struct{})}
+}
+
+func (h *statusHub) subscribe(fileID string) (chan string, func()) {
+    ch := make(chan string, 1)
+
+    h.mu.Lock()
+    if h.subs[fileID] == nil {
+        h.subs[fileID] = make(map[chan string]struct{})
+    }
+    h.subs[fileID][ch] = struct{}{}
+    h.mu.Unlock()
+
+    return ch, func() {
+        h.mu.Lock()
+        delete(h.subs[fileID], ch)
+        if len(h.subs[fileID]) == 0 {
+            delete(h.subs, fileID)
+        }
+        h.mu.Unlock()
+    }
+}
+
+// publish не блокируется: медленный подписчик получает только последний статус
+func (h *statusHub) publish(fileID, status string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    for ch := range h.subs[fileID] {
+        select {
+        case ch <- status:
+        default:
+            select {
+            case <-ch:
+            default:
+            }
+            ch <- status
+        }
+    }
+}
+
+// WatchThumbnail подписывает на изменения статуса миниатюры и возвращает
+// текущие метаданные. Подписка оформляется до чтения метаданных, поэтому
+// переход статуса между чтением и подпиской не теряется. Вызывающий обязан
+// вызвать возвращенную функцию отписки
+func (s *FileService) WatchThumbnail(ctx context.Context, fileID string) (*models.FileMetadata, <-chan string, func(), error) {
+    ch, unsubscribe := s.events.subscribe(fileID)
+
+    metadata, err := s.GetAccessibleMetadata(ctx, fileID)
+    if err != nil {
+        unsubscribe()
+        return nil, nil, nil, err
+    }
+    return metadata, ch, unsubscribe, nil
+}
@@ -1,126 +1,422 @@
 package service
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"io"
+	"log"
 	"mime/multipart"
-	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/mongo"
-
+	"kuber-code-s3/internal/config"
 	"kuber-code-s3/internal/models"
 	"kuber-code-s3/internal/repository"
+	"kuber-code-s3/pkg/utils"
 )
 
+const encodingGzip = "gzip"
+
 var (
-    ErrFileNotFound = errors.New("file not found")
-    ErrInvalidFile  = errors.New("invalid file")
+    ErrFileNotFound  = errors.New("file not found")
+    ErrInvalidFile   = errors.New("invalid file")
+    ErrFileLocked    = errors.New("file is locked by another operation")
+    ErrForeignURL    = errors.New("url does not belong to this storage")
+    ErrSizeMismatch  = errors.New("received size differs from declared size")
+    ErrAccessExpired = errors.New("file access has expired")
+    ErrUnavailable   = errors.New("metadata storage is temporarily unavailable")
+    ErrKeyTooLong    = errors.New("object key is too long")
+    ErrTooManyTags   = errors.New("too many tags")
+    ErrTagTooLong    = errors.New("tag is too long")
+
+    ErrChecksumMismatch = errors.New("content checksum does not match the declared one")
+    ErrFileTooNew       = errors.New("file was uploaded after the given date")
+    ErrCorruption       = errors.New("stored content does not match the uploaded one")
 )
 
+// FileDetails - расширенное представление файла для детальных страниц
+type FileDetails struct {
+    Metadata     *models.FileMetadata
+    PresignedURL string
+    ObjectExists bool
+}
+
+// DeleteResult описывает удаленный (или, в режиме dry-run, удаляемый) объект
+type DeleteResult struct {
+    FileID     string `json:"file_id"`
+    ObjectName string `json:"object_name"`
+    BucketName string `json:"bucket_name"`
+    FileSize   int64  `json:"file_size"`
+    DryRun     bool   `json:"dry_run"`
+    // Объект используется другими файлами и не удаляется
+    ObjectShared bool `json:"object_shared,omitempty"`
+}
+
+// DeleteOptions - условия удаления файла
+type DeleteOptions struct {
+    // Только сообщить, что будет удалено, ничего не удаляя
+    DryRun bool
+    // Удалять, только если файл загружен раньше этой даты (ErrFileTooNew)
+    OlderThan *time.Time
+}
+
+// UploadResult - результат загрузки файла
+type UploadResult struct {
+    ID  string
+    URL string
+    // Содержимое уже хранилось под другим файлом, новый объект не создавался
+    Deduplicated bool
+}
+
+// UploadOptions - дополнительные поля, передаваемые вместе с файлом
+type UploadOptions struct {
+    Description string
+    Tags        []string
+    // Проверенный тип содержимого; если пуст, берется заголовок части формы
+    ContentType string
+    // Срок, после которого файл недоступен для чтения
+    AccessibleUntil *time.Time
+    // Ожидаемый SHA-256 содержимого (hex); если задан, загрузка с другим
+    // содержимым отклоняется до записи в Minio
+    ExpectedSHA256 string
+}
+
+// UploadPolicy - подписанная POST-политика для прямой загрузки в Minio
+type UploadPolicy struct {
+    FileID    string            `json:"file_id"`
+    URL       string            `json:"url"`
+    Fields    map[string]string `json:"fields"`
+    ExpiresAt time.Time         `json:"expires_at"`
+}
+
 type FileService struct {
     minioRepo *repository.MinioRepository
     mongoRepo *repository.MongoRepository
+
+    thumbnails       *ThumbnailPool
+    thumbnailMaxSize int
+    thumbRepo        *repository.MinioRepository
+    thumbOnReplace   bool
+    events           *statusHub
+
+    compressTypes map[string]bool
+    lockTTL       time.Duration
+    idScheme      string
+    hashPrefix    int
+    keyPrefix     string
+
+    maxUploadSize int64
+    postPolicyTTL time.Duration
+    sizeTolerance int64
+    replaceNewKey bool
+    maxKeyLength  int
+    dedup         bool
+    uniqueNames   string
+
+    // Повторные загрузки при несовпадении контрольной суммы в хранилище
+    checksumRetries int
+
+    // Хосты, на которые разрешена выгрузка файлов по подписанным ссылкам
+    copyAllowedHosts map[string]bool
+
+    // Кеш подписанных ссылок; nil - кеш отключен
+    presigned *presignCache
+
+    // Тег холодного хранения (COLD_TIER_TAG); пустой ключ - пометка отключена
+    coldTagKey   string
+    coldTagValue string
 }
 
-func NewFileService(minio *repository.MinioRepository, mongo *repository.MongoRepository) *FileService {
-    return &FileService{
-        minioRepo: minio,
-        mongoRepo: mongo,
+func NewFileService(minio *repository.MinioRepository, mongo *repository.MongoRepository, cfg *config.Config) *FileService {
+    s := &FileService{
+        minioRepo:        minio,
+        mongoRepo:        mongo,
+        thumbnailMaxSize: cfg.ThumbnailMaxSize,
+        thumbRepo:        minio,
+        thumbOnReplace:   cfg.ThumbnailOnReplace,
+        events:           newStatusHub(),
+        compressTypes:    make(map[string]bool),
+        lockTTL:          cfg.FileLockTTL,
+        idScheme:         cfg.IDScheme,
+        hashPrefix:       cfg.HashPrefix,
+        keyPrefix:        NormalizeKeyPrefix(cfg.KeyPrefix),
+        maxUploadSize:    cfg.MaxUploadSize,
+        postPolicyTTL:    cfg.PostPolicyTTL,
+        sizeTolerance:    cfg.SizeMismatchTolerance,
+        replaceNewKey:    cfg.ReplaceNewKey,
+        maxKeyLength:     cfg.MaxObjectKeyLength,
+        dedup:            cfg.DedupEnabled,
+        checksumRetries:  cfg.UploadChecksumRetries,
+
+        copyAllowedHosts: make(map[string]bool),
+    }
+    for _, contentType := range cfg.CompressContentTypes {
+        s.compressTypes[contentType] = true
+    }
+    for _, host := range cfg.CopyToAllowedHosts {
+        s.copyAllowedHosts[strings.ToLower(host)] = true
+    }
+    if cfg.PresignCacheSize > 0 {
+        s.presigned = newPresignCache(cfg.PresignCacheSize)
+    }
+    if cfg.Features.Thumbnails {
+        s.thumbnails = NewThumbnailPool(cfg.ThumbnailWorkers, cfg.ThumbnailQueueSize, s.processThumbnail)
+    }
+    return s
+}
+
+// Close останавливает фоновые воркеры сервиса
+func (s *FileService) Close() {
+    if s.thumbnails != nil {
+        s.thumbnails.Stop()
     }
 }
 
-func (s *FileService) UploadFile(ctx context.Context, file *multipart.FileHeader) (string, error) {
+func (s *FileService) UploadFile(ctx context.Context, file *multipart.FileHeader, opts UploadOptions) (*UploadResult, error) {
     // Генерация уникального имени файла
-    fileID := uuid.New().String()
+    fileID := utils.GenerateFileID(s.idScheme)
     ext := filepath.Ext(file.Filename)
-    objectName := fileID + ext
-    
-    // Сохранение временного файла
-    localPath := filepath.Join(os.TempDir(), objectName)
-    if err := saveUploadedFile(file, localPath); err != nil {
-        return "", err
+    objectName := s.objectKey(fileID, file.Filename)
+    if err := s.checkObjectKey(objectName); err != nil {
+        return nil, err
+    }
+    originalName, err := s.uniqueName(ctx, strings.TrimSuffix(file.Filename, ext), file.Filename, "")
+    if err != nil {
+        return nil, err
     }
-    defer os.Remove(localPath) // Очистка временного файла
 
-    // Загрузка в Minio
-    url, err := s.minioRepo.UploadFile(ctx, objectName, localPath, file.Header.Get("Content-Type"))
+    // Файл передается в Minio потоком из части формы, без временной копии
+    src, err := file.Open()
     if err != nil {
-        return "", err
+        return nil, err
+    }
+    defer src.Close()
+
+    // SHA-256 до загрузки нужен только для проверки X-Content-SHA256 и поиска
+    // дубликата; иначе он считается по ходу передачи в Minio
+    var contentSHA256 string
+    if opts.ExpectedSHA256 != "" || s.dedup {
+        contentSHA256, err = hashPart(src)
+        if err != nil {
+            return nil, err
+        }
+        if opts.ExpectedSHA256 != "" && !strings.EqualFold(opts.ExpectedSHA256, contentSHA256) {
+            return nil, ErrChecksumMismatch
+        }
+    }
+
+    contentType := opts.ContentType
+    if contentType == "" {
+        contentType = file.Header.Get("Content-Type")
     }
 
-    // Сохранение метаданных
     metadata := &models.FileMetadata{
         ID:           fileID,
-        OriginalName: strings.TrimSuffix(file.Filename, ext),
+        OriginalName: originalName,
         FileSize:     file.Size,
-        ContentType:  file.Header.Get("Content-Type"),
-        BucketName:   s.minioRepo.Bucket,
+        ContentType:  contentType,
         UploadDate:   time.Now(),
-        URL:          url,
+        Description:  opts.Description,
+        Tags:         opts.Tags,
+
+        AccessibleUntil: opts.AccessibleUntil,
+
+        ThumbnailStatus: s.initialThumbnailStatus(contentType),
+    }
+
+    var duplicate *models.FileMetadata
+    if s.dedup {
+        duplicate, err = s.findDuplicate(ctx, contentSHA256)
+        if err != nil {
+            return nil, err
+        }
     }
 
+    if duplicate != nil {
+        // Содержимое уже хранится: новый файл ссылается на существующий объект
+        objectName = objectNameFor(duplicate)
+        metadata.BucketName = duplicate.BucketName
+        metadata.ObjectName = objectName
+        metadata.URL = duplicate.URL
+        metadata.ContentEncoding = duplicate.ContentEncoding
+        metadata.Checksum = duplicate.Checksum
+        metadata.ChecksumAlgorithm = duplicate.ChecksumAlgorithm
+        s.warmObject(ctx, duplicate)
+    } else {
+        // Загрузка в Minio
+        uploaded, encoding, streamed, err := s.uploadPart(ctx, objectName, src, file.Size, contentType)
+        if err != nil {
+            return nil, err
+        }
+        contentSHA256 = streamed
+        metadata.BucketName = s.minioRepo.Bucket
+        metadata.ObjectName = objectName
+        metadata.URL = uploaded.URL
+        metadata.ContentEncoding = encoding
+        metadata.Checksum = uploaded.Checksum
+        metadata.ChecksumAlgorithm = s.checksumAlgorithm(uploaded)
+    }
+
+    metadata.ContentSHA256 = contentSHA256
+
+    // Сохранение метаданных
     if err := s.mongoRepo.SaveMetadata(ctx, metadata); err != nil {
-        // Откат: удаляем файл из Minio при ошибке сохранения метаданных
-        _ = s.minioRepo.DeleteFile(ctx, objectName)
-        return "", err
+        // Откат: удаляем файл из Minio при ошибке сохранения метаданных.
+        // Общий с другим файлом объект не трогаем
+        if duplicate == nil {
+            _ = s.minioRepo.DeleteFile(ctx, objectName)
+        }
+        if errors.Is(err, repository.ErrWriteUnavailable) {
+            // Неподтвержденная запись могла примениться: убираем и ее
+            if delErr := s.mongoRepo.DeleteMetadata(ctx, fileID); delErr != nil && !errors.Is(delErr, repository.ErrDocumentNotFound) {
+                log.Printf("Metadata rollback error for %s: %v", fileID, delErr)
+            }
+            return nil, ErrUnavailable
+        }
+        return nil, err
     }
 
-    return url, nil
+    // Миниатюра строится асинхронно, загрузка не ждет ее готовности
+    s.enqueueThumbnail(ctx, metadata)
+
+    return &UploadResult{ID: metadata.ID, URL: metadata.URL, Deduplicated: duplicate != nil}, nil
 }
 
-func (s *FileService) DeleteFile(ctx context.Context, fileID string) error {
+// DeleteFile удаляет файл и его метаданные. При dryRun ничего не удаляется,
+// а возвращается описание того, что было бы удалено
+func (s *FileService) DeleteFile(ctx context.Context, fileID string, opts DeleteOptions) (*DeleteResult, error) {
+    dryRun := opts.DryRun
+    if !dryRun {
+        unlock, err := s.lockFile(ctx, fileID)
+        if err != nil {
+            return nil, err
+        }
+        defer unlock()
+    }
+
     // Получение метаданных
     metadata, err := s.mongoRepo.GetMetadata(ctx, fileID)
     if err != nil {
-        if errors.Is(err, mongo.ErrNoDocuments) {
-            return ErrFileNotFound
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, ErrFileNotFound
         }
-        return err
+        return nil, err
+    }
+    // Файл, загруженный заново после даты отсечения, не удаляется
+    if opts.OlderThan != nil && !metadata.UploadDate.Before(*opts.OlderThan) {
+        return nil, ErrFileTooNew
     }
 
-    // Удаление из Minio
-    objectName := fileID + filepath.Ext(metadata.OriginalName)
-    if err := s.minioRepo.DeleteFile(ctx, objectName); err != nil {
-        return err
+    result := &DeleteResult{
+        FileID:     fileID,
+        ObjectName: objectNameFor(metadata),
+        BucketName: metadata.BucketName,
+        FileSize:   metadata.FileSize,
+        DryRun:     dryRun,
+    }
+    result.ObjectShared, err = s.objectShared(ctx, metadata)
+    if err != nil {
+        return nil, err
+    }
+    if dryRun {
+        return result, nil
+    }
+
+    // Удаление из Minio; общий объект остается другим файлам
+    if !result.ObjectShared {
+        if err := s.minioRepo.DeleteFile(ctx, result.ObjectName); err != nil {
+            return nil, err
+        }
+        s.invalidatePresigned(result.ObjectName)
+    }
+    if err := s.deleteRecords(ctx, metadata); err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+// deleteRecords удаляет миниатюру и метаданные файла, объект которого уже удален
+// или остается другим файлам. Ошибка удаления миниатюры только логируется
+func (s *FileService) deleteRecords(ctx context.Context, metadata *models.FileMetadata) error {
+    if metadata.ThumbnailURL != "" {
+        if err := s.thumbnailRepoFor(metadata).DeleteFile(ctx, s.thumbnailObjectName(metadata.ID)); err != nil {
+            log.Printf("Thumbnail deletion error for %s: %v", metadata.ID, err)
+        }
     }
 
     // Удаление метаданных
-    return s.mongoRepo.DeleteMetadata(ctx, fileID)
+    return s.mongoRepo.DeleteMetadata(ctx, metadata.ID)
 }
 
-func (s *FileService) ReplaceFile(ctx context.Context, fileID string, newFile *multipart.FileHeader) (string, error) {
+// ReplaceFile заменяет содержимое файла. contentType - тип содержимого,
+// определенный и проверенный обработчиком; заявленный клиентом тип
+// из заголовка части формы не используется
+func (s *FileService) ReplaceFile(ctx context.Context, fileID string, newFile *multipart.FileHeader, contentType string) (string, error) {
+    unlock, err := s.lockFile(ctx, fileID)
+    if err != nil {
+        return "", err
+    }
+    defer unlock()
+
     // Получение текущих метаданных
     oldMetadata, err := s.mongoRepo.GetMetadata(ctx, fileID)
     if err != nil {
-        if errors.Is(err, mongo.ErrNoDocuments) {
+        if errors.Is(err, repository.ErrDocumentNotFound) {
             return "", ErrFileNotFound
         }
         return "", err
     }
 
-    // Удаление старого файла
-    oldObjectName := fileID + filepath.Ext(oldMetadata.OriginalName)
-    if err := s.minioRepo.DeleteFile(ctx, oldObjectName); err != nil {
+    src, err := newFile.Open()
+    if err != nil {
+        return "", err
+    }
+    defer src.Close()
+
+    // Общий с другими файлами объект не удаляется и не перезаписывается
+    oldShared, err := s.objectShared(ctx, oldMetadata)
+    if err != nil {
         return "", err
     }
 
-    // Загрузка нового файла
+    // Ключ нового объекта проверяется до удаления старого
+    newObjectName := s.objectKey(fileID, newFile.Filename)
+    if s.replaceNewKey || oldShared {
+        newObjectName = s.versionedObjectKey(fileID, newFile.Filename)
+    }
+    if err := s.checkObjectKey(newObjectName); err != nil {
+        return "", err
+    }
     newExt := filepath.Ext(newFile.Filename)
-    newObjectName := fileID + newExt
-    localPath := filepath.Join(os.TempDir(), newObjectName)
-    
-    if err := saveUploadedFile(newFile, localPath); err != nil {
+    originalName, err := s.uniqueName(ctx, strings.TrimSuffix(newFile.Filename, newExt), newFile.Filename, fileID)
+    if err != nil {
         return "", err
     }
-    defer os.Remove(localPath)
 
-    // Загрузка в Minio
-    url, err := s.minioRepo.UploadFile(ctx, newObjectName, localPath, newFile.Header.Get("Content-Type"))
+    // Удаление старого файла. Отсутствие объекта при наличии метаданных -
+    // восстановимое состояние: продолжаем и загружаем новый объект.
+    // При REPLACE_NEW_KEY старый объект удаляется только после того, как
+    // метаданные начнут указывать на новый ключ
+    oldObjectName := objectNameFor(oldMetadata)
+    if !s.replaceNewKey && !oldShared {
+        if err := s.minioRepo.DeleteFile(ctx, oldObjectName); err != nil {
+            if !errors.Is(err, repository.ErrFileNotFound) {
+                return "", err
+            }
+            log.Printf("Old object %s for file %s is already missing, continuing replace", oldObjectName, fileID)
+        }
+    }
+
+    // Загрузка нового файла в Minio потоком
+    uploaded, encoding, contentSHA256, err := s.uploadPart(ctx, newObjectName, src, newFile.Size, contentType)
     if err != nil {
         return "", err
     }
@@ -128,44 +424,587 @@ func (s *FileService) ReplaceFile(ctx context.Context, fileID string, newFile *m
     // Обновление метаданных
     newMetadata := &models.FileMetadata{
         ID:           fileID,
-        OriginalName: strings.TrimSuffix(newFile.Filename, newExt),
+        OriginalName: originalName,
         FileSize:     newFile.Size,
-        ContentType:  newFile.Header.Get("Content-Type"),
+        ContentType:  contentType,
         BucketName:   s.minioRepo.Bucket,
+        ObjectName:   newObjectName,
         UploadDate:   time.Now(),
-        URL:          url,
+        URL:          uploaded.URL,
+
+        ContentEncoding:   encoding,
+        Checksum:          uploaded.Checksum,
+        ChecksumAlgorithm: s.checksumAlgorithm(uploaded),
+        ContentSHA256:     contentSHA256,
     }
 
-    if err := s.mongoRepo.UpdateMetadata(ctx, fileID, newMetadata); err != nil {
+    updated, err := s.mongoRepo.UpdateMetadata(ctx, fileID, newMetadata)
+    if err != nil {
         _ = s.minioRepo.DeleteFile(ctx, newObjectName)
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return "", ErrFileNotFound
+        }
+        if errors.Is(err, repository.ErrWriteUnavailable) {
+            return "", ErrUnavailable
+        }
         return "", err
     }
+    s.invalidatePresigned(oldObjectName)
+    s.refreshThumbnail(ctx, oldMetadata, updated)
+
+    if s.replaceNewKey && !oldShared && oldObjectName != newObjectName {
+        if err := s.minioRepo.DeleteFile(ctx, oldObjectName); err != nil && !errors.Is(err, repository.ErrFileNotFound) {
+            log.Printf("Failed to delete replaced object %s for file %s: %v", oldObjectName, fileID, err)
+        }
+    }
+
+    return updated.URL, nil
+}
+
+// CreateUploadPolicy выдает POST-политику, по которой браузер загружает файл
+// напрямую в Minio под ключом нового файла. Метаданные при такой загрузке
+// сервисом не создаются
+func (s *FileService) CreateUploadPolicy(ctx context.Context, filename, contentType string) (*UploadPolicy, error) {
+    fileID := utils.GenerateFileID(s.idScheme)
+    key := s.objectKey(fileID, filename)
+    if err := s.checkObjectKey(key); err != nil {
+        return nil, err
+    }
+    keyPrefix := strings.TrimSuffix(key, utils.NormalizeExtension(filename))
+
+    url, fields, err := s.minioRepo.PresignedPostPolicy(ctx, keyPrefix, contentType, s.maxUploadSize, s.postPolicyTTL)
+    if err != nil {
+        return nil, err
+    }
+    fields["key"] = key
+
+    return &UploadPolicy{
+        FileID:    fileID,
+        URL:       url,
+        Fields:    fields,
+        ExpiresAt: time.Now().Add(s.postPolicyTTL),
+    }, nil
+}
+
+// ReplaceContent заменяет только байты объекта, сохраняя идентификатор, имя,
+// описание и прочие метаданные. size может быть -1, если длина потока неизвестна
+func (s *FileService) ReplaceContent(ctx context.Context, fileID string, reader io.Reader, size int64, contentType string) (*models.FileMetadata, error) {
+    unlock, err := s.lockFile(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+    defer unlock()
+
+    metadata, err := s.mongoRepo.GetMetadata(ctx, fileID)
+    if err != nil {
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, ErrFileNotFound
+        }
+        return nil, err
+    }
+
+    // Новое содержимое сохраняется под новым ключом и проверяется до того,
+    // как на него переключатся метаданные: при повреждении при передаче
+    // прежний объект остается целым. Общий с другими файлами объект после
+    // замены не удаляется
+    oldObjectName := objectNameFor(metadata)
+    shared, err := s.objectShared(ctx, metadata)
+    if err != nil {
+        return nil, err
+    }
+    objectName := s.versionedObjectKey(fileID, oldObjectName)
+    if err := s.checkObjectKey(objectName); err != nil {
+        return nil, err
+    }
+    // Заявленный размер передается Minio, только если расхождение не
+    // допускается: тело короче заявленного в пределах SIZE_MISMATCH_TOLERANCE
+    // не уложилось бы в загрузку с известным размером
+    uploadSize := size
+    if s.sizeTolerance > 0 {
+        uploadSize = -1
+    }
+    uploadCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    hash := sha256.New()
+    counter := &countingReader{r: io.TeeReader(reader, hash), declared: size, tolerance: s.sizeTolerance, cancel: cancel}
+    uploaded, encoding, err := s.uploadStream(uploadCtx, objectName, counter, uploadSize, contentType)
+    if err != nil {
+        if counter.mismatch {
+            log.Printf("Size mismatch for %s: declared %d, received %d", fileID, size, counter.n)
+            return nil, ErrSizeMismatch
+        }
+        // Тело запроса прочитано, повторить загрузку нельзя
+        if errors.Is(err, repository.ErrBadDigest) {
+            return nil, ErrCorruption
+        }
+        return nil, err
+    }
+
+    contentSHA256 := hex.EncodeToString(hash.Sum(nil))
+    if !s.storedChecksumMatches(uploaded, encoding, contentSHA256) {
+        if delErr := s.minioRepo.DeleteFile(ctx, objectName); delErr != nil && !errors.Is(delErr, repository.ErrFileNotFound) {
+            log.Printf("Failed to delete corrupted object %s: %v", objectName, delErr)
+        }
+        return nil, ErrCorruption
+    }
+
+    now := time.Now()
+    algorithm := s.checksumAlgorithm(uploaded)
+    patch := models.MetadataPatch{
+        FileSize:          &counter.n,
+        ContentType:       &contentType,
+        ContentEncoding:   &encoding,
+        Checksum:          &uploaded.Checksum,
+        ChecksumAlgorithm: &algorithm,
+        ContentSHA256:     &contentSHA256,
+        UploadDate:        &now,
+        ObjectName:        &objectName,
+        URL:               &uploaded.URL,
+    }
+    updated, err := s.UpdateFile(ctx, fileID, patch)
+    if err != nil {
+        // Откат: метаданные по-прежнему указывают на прежний объект
+        _ = s.minioRepo.DeleteFile(ctx, objectName)
+        return nil, err
+    }
+    s.invalidatePresigned(oldObjectName)
 
-    return url, nil
+    if !shared {
+        if err := s.minioRepo.DeleteFile(ctx, oldObjectName); err != nil && !errors.Is(err, repository.ErrFileNotFound) {
+            log.Printf("Failed to delete replaced object %s for file %s: %v", oldObjectName, fileID, err)
+        }
+    }
+    s.refreshThumbnail(ctx, metadata, updated)
+    return updated, nil
 }
 
 func (s *FileService) GetFileMetadata(ctx context.Context, fileID string) (*models.FileMetadata, error) {
-    return s.mongoRepo.GetMetadata(ctx, fileID)
+    metadata, err := s.mongoRepo.GetMetadata(ctx, fileID)
+    if err != nil {
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, ErrFileNotFound
+        }
+        return nil, err
+    }
+    return metadata, nil
 }
 
-// saveUploadedFile сохраняет загруженный файл во временную директорию
-func saveUploadedFile(file *multipart.FileHeader, dst string) error {
-    src, err := file.Open()
+// Поля, по которым можно сортировать список файлов
+var ListSortFields = []string{"upload_date", "file_size", "original_name"}
+
+// ListFiles возвращает страницу файлов, отсортированных по полю sortField из
+// ListSortFields, и их общее число
+func (s *FileService) ListFiles(ctx context.Context, limit, offset int, sortField string, descending bool) ([]models.FileMetadata, int64, error) {
+    files, err := s.mongoRepo.ListMetadata(ctx, s.keyPrefix, limit, offset, sortField, descending)
     if err != nil {
-        return err
+        return nil, 0, err
     }
-    defer src.Close()
+    total, err := s.mongoRepo.CountMetadata(ctx, s.keyPrefix)
+    if err != nil {
+        return nil, 0, err
+    }
+    return files, total, nil
+}
+
+// RecentFiles возвращает до limit файлов, загруженных за последние window,
+// и начало окна
+func (s *FileService) RecentFiles(ctx context.Context, window time.Duration, limit int) ([]models.FileMetadata, time.Time, error) {
+    since := time.Now().Add(-window)
+    files, err := s.mongoRepo.ListMetadataSince(ctx, s.keyPrefix, since, limit)
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+    return files, since, nil
+}
 
-    if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
-        return err
+// GetAccessibleMetadata возвращает метаданные файла для чтения; после
+// AccessibleUntil возвращает ErrAccessExpired, хотя файл по-прежнему хранится
+func (s *FileService) GetAccessibleMetadata(ctx context.Context, fileID string) (*models.FileMetadata, error) {
+    metadata, err := s.GetFileMetadata(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkAccessible(metadata); err != nil {
+        return nil, err
     }
+    return metadata, nil
+}
 
-    out, err := os.Create(dst)
+// checkAccessible проверяет, не истек ли срок доступа к файлу
+func checkAccessible(metadata *models.FileMetadata) error {
+    if metadata.AccessibleUntil != nil && !time.Now().Before(*metadata.AccessibleUntil) {
+        return ErrAccessExpired
+    }
+    return nil
+}
+
+// UpdateFile частично обновляет редактируемые поля метаданных
+func (s *FileService) UpdateFile(ctx context.Context, fileID string, patch models.MetadataPatch) (*models.FileMetadata, error) {
+    metadata, err := s.mongoRepo.PatchMetadata(ctx, fileID, patch)
     if err != nil {
-        return err
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, ErrFileNotFound
+        }
+        if errors.Is(err, repository.ErrWriteUnavailable) {
+            return nil, ErrUnavailable
+        }
+        return nil, err
     }
-    defer out.Close()
+    return metadata, nil
+}
 
-    _, err = io.Copy(out, src)
-    return err
+// ResolveURL находит метаданные файла по ранее выданному URL
+func (s *FileService) ResolveURL(ctx context.Context, rawURL string) (*models.FileMetadata, error) {
+    objectName, ok := s.minioRepo.ObjectNameFromURL(rawURL)
+    if !ok {
+        return nil, ErrForeignURL
+    }
+
+    // Для записей без object_name сравнивается URL без параметров подписи
+    objectURL := rawURL
+    if i := strings.IndexByte(objectURL, '?'); i >= 0 {
+        objectURL = objectURL[:i]
+    }
+
+    metadata, err := s.mongoRepo.FindByObjectName(ctx, objectName, objectURL)
+    if err != nil {
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, ErrFileNotFound
+        }
+        return nil, err
+    }
+    if err := checkAccessible(metadata); err != nil {
+        return nil, err
+    }
+    return metadata, nil
+}
+
+// GetFileDetails возвращает метаданные вместе с вычисляемыми полями:
+// подписанной ссылкой (возможно, выданной ранее и взятой из кеша) и
+// признаком наличия объекта в Minio
+func (s *FileService) GetFileDetails(ctx context.Context, fileID string) (*FileDetails, error) {
+    metadata, err := s.GetAccessibleMetadata(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+
+    objectName := objectNameFor(metadata)
+    exists, err := s.minioRepo.ObjectExists(ctx, objectName)
+    if err != nil {
+        return nil, err
+    }
+
+    details := &FileDetails{
+        Metadata:     metadata,
+        ObjectExists: exists,
+    }
+    if exists {
+        details.PresignedURL, err = s.presignedURL(ctx, metadata)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return details, nil
+}
+
+// OpenContent открывает объект файла для отдачи клиенту через сервис.
+// Объект возвращается в том виде, в каком хранится: для сжатых при хранении
+// файлов поток сжат (metadata.ContentEncoding)
+func (s *FileService) OpenContent(ctx context.Context, metadata *models.FileMetadata) (io.ReadCloser, error) {
+    object, err := s.minioRepo.GetObject(ctx, objectNameFor(metadata))
+    if errors.Is(err, repository.ErrFileNotFound) {
+        return nil, ErrFileNotFound
+    }
+    return object, err
+}
+
+// OpenContentRange открывает байты объекта файла с start по end включительно.
+// Для сжатых при хранении файлов диапазон относится к сжатым байтам
+func (s *FileService) OpenContentRange(ctx context.Context, metadata *models.FileMetadata, start, end int64) (io.ReadCloser, error) {
+    object, err := s.minioRepo.GetObjectRange(ctx, objectNameFor(metadata), start, end)
+    if errors.Is(err, repository.ErrFileNotFound) {
+        return nil, ErrFileNotFound
+    }
+    return object, err
+}
+
+// RecordDownload в фоне, чтобы не замедлять отдачу файла, сохраняет время
+// обращения и, если counted, увеличивает счетчик скачиваний. С холодного
+// файла снимается тег холодного хранения. Ошибки только логируются:
+// счетчик носит статистический характер
+func (s *FileService) RecordDownload(metadata *models.FileMetadata, counted bool) {
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+
+        if err := s.mongoRepo.RecordAccess(ctx, metadata.ID, counted); err != nil {
+            log.Printf("Download count update error for %s: %v", metadata.ID, err)
+        }
+        s.warmObject(ctx, metadata)
+    }()
+}
+
+// BackfillContentType в фоне сохраняет тип содержимого, определенный при
+// отдаче файла, для старых записей без content_type. Ошибки только логируются
+func (s *FileService) BackfillContentType(fileID, contentType string) {
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+
+        if err := s.mongoRepo.SetContentTypeIfEmpty(ctx, fileID, contentType); err != nil {
+            log.Printf("Content type backfill error for %s: %v", fileID, err)
+        }
+    }()
+}
+
+// NormalizeTags обрезает пробелы, приводит теги к нижнему регистру, удаляет
+// пустые и повторяющиеся значения и проверяет ограничения на их число и длину
+func NormalizeTags(tags []string, maxTags, maxLength int) ([]string, error) {
+    seen := make(map[string]bool, len(tags))
+    normalized := make([]string, 0, len(tags))
+    for _, tag := range tags {
+        tag = strings.ToLower(strings.TrimSpace(tag))
+        if tag == "" || seen[tag] {
+            continue
+        }
+        if utf8.RuneCountInString(tag) > maxLength {
+            return nil, ErrTagTooLong
+        }
+        seen[tag] = true
+        normalized = append(normalized, tag)
+    }
+
+    if len(normalized) > maxTags {
+        return nil, ErrTooManyTags
+    }
+    return normalized, nil
+}
+
+// lockFile захватывает блокировку файла на время изменяющей операции и
+// возвращает функцию для ее снятия
+func (s *FileService) lockFile(ctx context.Context, fileID string) (func(), error) {
+    token, err := s.mongoRepo.AcquireLock(ctx, fileID, s.lockTTL)
+    if err != nil {
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, ErrFileNotFound
+        }
+        if errors.Is(err, repository.ErrDocumentLocked) {
+            return nil, ErrFileLocked
+        }
+        return nil, err
+    }
+
+    return func() {
+        // Контекст запроса к этому моменту может быть уже отменен
+        if err := s.mongoRepo.ReleaseLock(context.Background(), fileID, token); err != nil {
+            log.Printf("Lock release error for %s: %v", fileID, err)
+        }
+    }, nil
+}
+
+// objectKey строит ключ объекта из ID и нормализованного расширения. При
+// HASH_PREFIX > 0 ключ начинается с первых символов SHA-256 от ID
+// ("3f/<id>.jpg"), что равномерно распределяет объекты по префиксам.
+// Ключ начинается с KEY_PREFIX окружения
+func (s *FileService) objectKey(fileID, filename string) string {
+    key := fileID + utils.NormalizeExtension(filename)
+    if s.hashPrefix <= 0 {
+        return s.keyPrefix + key
+    }
+
+    sum := sha256.Sum256([]byte(fileID))
+    hash := hex.EncodeToString(sum[:])
+    if s.hashPrefix < len(hash) {
+        hash = hash[:s.hashPrefix]
+    }
+    return s.keyPrefix + hash + "/" + key
+}
+
+// NormalizeKeyPrefix приводит KEY_PREFIX к виду "env/": без ведущего
+// и с одним завершающим слешем. Пустой префикс остается пустым
+func NormalizeKeyPrefix(prefix string) string {
+    prefix = strings.Trim(prefix, "/")
+    if prefix == "" {
+        return ""
+    }
+    return prefix + "/"
+}
+
+// checkObjectKey проверяет длину ключа до загрузки: Minio отклоняет ключи
+// длиннее 1024 байт, и без проверки ошибка приходит уже после приема файла
+func (s *FileService) checkObjectKey(key string) error {
+    if len(key) > s.maxKeyLength {
+        return ErrKeyTooLong
+    }
+    return nil
+}
+
+// versionedObjectKey строит новый ключ для того же ID: к ключу objectKey
+// добавляется метка времени ("<id>-<version>.jpg"), поэтому замененный файл
+// получает новый URL и не отдается из устаревшего кеша CDN
+func (s *FileService) versionedObjectKey(fileID, filename string) string {
+    ext := utils.NormalizeExtension(filename)
+    key := strings.TrimSuffix(s.objectKey(fileID, filename), ext)
+    return key + "-" + strconv.FormatInt(time.Now().UnixNano(), 36) + ext
+}
+
+// objectNameFor возвращает ключ объекта в Minio. Для записей, сохраненных
+// до появления поля object_name, ключ восстанавливается из URL
+func objectNameFor(metadata *models.FileMetadata) string {
+    if metadata.ObjectName != "" {
+        return metadata.ObjectName
+    }
+    return path.Base(metadata.URL)
+}
+
+// uploadStream загружает поток в Minio, сжимая gzip типы из
+// COMPRESS_CONTENT_TYPES. Возвращает результат загрузки и кодировку,
+// с которой сохранен объект
+func (s *FileService) uploadStream(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) (*repository.UploadResult, string, error) {
+    if !s.compressTypes[contentType] {
+        uploaded, err := s.minioRepo.PutObjectStream(ctx, objectName, reader, size, contentType, "")
+        return uploaded, "", err
+    }
+
+    // Размер сжатого потока заранее неизвестен
+    pr, pw := io.Pipe()
+    go func() {
+        zw := gzip.NewWriter(pw)
+        _, err := io.Copy(zw, reader)
+        if err == nil {
+            err = zw.Close()
+        }
+        pw.CloseWithError(err)
+    }()
+
+    uploaded, err := s.minioRepo.PutObjectStream(ctx, objectName, pr, -1, contentType, encodingGzip)
+    pr.CloseWithError(err)
+    return uploaded, encodingGzip, err
+}
+
+// uploadPart передает часть формы в Minio и возвращает, кроме результата
+// загрузки и кодировки, SHA-256 переданного содержимого. Размер части известен,
+// поэтому без сжатия Minio не буферизует объект целиком.
+// Если содержимое в хранилище не совпало с переданным, загрузка повторяется
+// до UPLOAD_CHECKSUM_RETRIES раз; затем объект удаляется и возвращается ErrCorruption
+func (s *FileService) uploadPart(ctx context.Context, objectName string, src io.Reader, size int64, contentType string) (*repository.UploadResult, string, string, error) {
+    var (
+        uploaded  *repository.UploadResult
+        encoding  string
+        sha256hex string
+    )
+    err := retryOnCorruption(src, s.checksumRetries, func() error {
+        hash := sha256.New()
+        var err error
+        uploaded, encoding, err = s.uploadStream(ctx, objectName, io.TeeReader(src, hash), size, contentType)
+        if errors.Is(err, repository.ErrBadDigest) {
+            return ErrCorruption
+        }
+        if err != nil {
+            return err
+        }
+        sha256hex = hex.EncodeToString(hash.Sum(nil))
+        if !s.storedChecksumMatches(uploaded, encoding, sha256hex) {
+            return ErrCorruption
+        }
+        return nil
+    })
+    if err == ErrCorruption {
+        if delErr := s.minioRepo.DeleteFile(ctx, objectName); delErr != nil && !errors.Is(delErr, repository.ErrFileNotFound) {
+            log.Printf("Failed to delete corrupted object %s: %v", objectName, delErr)
+        }
+    }
+    if err != nil {
+        return nil, "", "", err
+    }
+    return uploaded, encoding, sha256hex, nil
+}
+
+// retryOnCorruption выполняет upload и, пока он завершается ErrCorruption,
+// повторяет его не более retries раз, перематывая src в начало. Поток без
+// перемотки повторить нельзя: для него ошибка возвращается сразу
+func retryOnCorruption(src io.Reader, retries int, upload func() error) error {
+    seeker, _ := src.(io.Seeker)
+    for attempt := 1; ; attempt++ {
+        err := upload()
+        if err != ErrCorruption || seeker == nil || attempt > retries {
+            return err
+        }
+        log.Printf("Upload checksum mismatch, retrying (%d/%d)", attempt, retries)
+        if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+            return err
+        }
+    }
+}
+
+// storedChecksumMatches сверяет SHA-256, который вернуло хранилище, с
+// посчитанным при передаче. Сверить можно только несжатый объект,
+// загруженный целиком: для остальных сумма хранилища считается по другим байтам
+func (s *FileService) storedChecksumMatches(uploaded *repository.UploadResult, encoding, sha256hex string) bool {
+    if s.minioRepo.ChecksumAlgorithm() != repository.ChecksumSHA256 || encoding != "" ||
+        uploaded.Checksum == "" || strings.Contains(uploaded.Checksum, "-") {
+        return true
+    }
+    sum, err := hex.DecodeString(sha256hex)
+    if err != nil {
+        return false
+    }
+    return base64.StdEncoding.EncodeToString(sum) == uploaded.Checksum
+}
+
+// hashPart возвращает SHA-256 части формы и перематывает ее в начало
+func hashPart(src multipart.File) (string, error) {
+    hash := sha256.New()
+    if _, err := io.Copy(hash, src); err != nil {
+        return "", err
+    }
+    if _, err := src.Seek(0, io.SeekStart); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checksumAlgorithm возвращает алгоритм для сохранения рядом с контрольной
+// суммой; пусто, если хранилище сумму не вернуло
+func (s *FileService) checksumAlgorithm(uploaded *repository.UploadResult) string {
+    if uploaded.Checksum == "" {
+        return ""
+    }
+    return s.minioRepo.ChecksumAlgorithm()
+}
+
+// countingReader подсчитывает фактически прочитанные байты. Если задан
+// заявленный размер (declared >= 0), по окончании потока сверяет его с
+// фактическим и вместо io.EOF возвращает ErrSizeMismatch при расхождении
+// больше tolerance: ошибка чтения прерывает загрузку до ее завершения в Minio.
+// cancel отменяет контекст загрузки, чтобы Minio не повторял запрос
+type countingReader struct {
+    r         io.Reader
+    n         int64
+    declared  int64
+    tolerance int64
+    mismatch  bool
+    cancel    context.CancelFunc
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    c.n += int64(n)
+
+    if (err == io.EOF || err == io.ErrUnexpectedEOF) && c.declared >= 0 {
+        diff := c.n - c.declared
+        if diff < 0 {
+            diff = -diff
+        }
+        if diff > c.tolerance {
+            c.mismatch = true
+            if c.cancel != nil {
+                c.cancel()
+            }
+            return n, ErrSizeMismatch
+        }
+    }
+    return n, err
 }
\ No newline at end of file
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"kuber-code-s3/internal/repository"
+	"kuber-code-s3/internal/repository/repotest"
+)
+
+func TestRetryOnCorruption(t *testing.T) {
+	errUpload := errors.New("upload failed")
+
+	tests := []struct {
+		name         string
+		src          io.Reader
+		retries      int
+		failures     []error // results of consecutive attempts before success
+		wantErr      error
+		wantAttempts int
+	}{
+		{"success on first attempt", bytes.NewReader([]byte("content")), 1, nil, nil, 1},
+		{"corrupted once, retried", bytes.NewReader([]byte("content")), 1, []error{ErrCorruption}, nil, 2},
+		{"corrupted after all retries", bytes.NewReader([]byte("content")), 1, []error{ErrCorruption, ErrCorruption}, ErrCorruption, 2},
+		{"retries disabled", bytes.NewReader([]byte("content")), 0, []error{ErrCorruption}, ErrCorruption, 1},
+		{"other errors are not retried", bytes.NewReader([]byte("content")), 1, []error{errUpload}, errUpload, 1},
+		{"plain reader is not retried", io.MultiReader(strings.NewReader("content")), 1, []error{ErrCorruption}, ErrCorruption, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := retryOnCorruption(tt.src, tt.retries, func() error {
+				attempts++
+				// Каждая попытка должна читать содержимое с начала
+				data, err := io.ReadAll(tt.src)
+				if err != nil {
+					return err
+				}
+				if string(data) != "content" {
+					t.Fatalf("attempt %d read %q, want %q", attempts, data, "content")
+				}
+				if attempts <= len(tt.failures) {
+					return tt.failures[attempts-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("retryOnCorruption() error = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestStoredChecksumMatches(t *testing.T) {
+	// SHA-256 строки "content"
+	const (
+		contentHex    = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+		contentBase64 = "7XACtDnprIRfIjV9giusFERzD722AW0+yUMil7nsn3M="
+	)
+
+	tests := []struct {
+		name      string
+		algorithm string
+		checksum  string
+		encoding  string
+		want      bool
+	}{
+		{"matching checksum", repository.ChecksumSHA256, contentBase64, "", true},
+		{"corrupted content", repository.ChecksumSHA256, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "", false},
+		{"composite multipart checksum", repository.ChecksumSHA256, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=-3", "", true},
+		{"compressed object", repository.ChecksumSHA256, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", encodingGzip, true},
+		{"no checksum returned", repository.ChecksumSHA256, "", "", true},
+		{"other algorithm", repository.ChecksumMD5, "9a0364b9e99bb480dd25e1f0284c8555", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &repository.MinioRepository{}
+			if err := repo.SetChecksumAlgorithm(tt.algorithm); err != nil {
+				t.Fatal(err)
+			}
+			s := &FileService{minioRepo: repo}
+			uploaded := &repository.UploadResult{Checksum: tt.checksum}
+			if got := s.storedChecksumMatches(uploaded, tt.encoding, contentHex); got != tt.want {
+				t.Errorf("storedChecksumMatches() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	const (
+		maxTags   = 3
+		maxLength = 5
+	)
+
+	tests := []struct {
+		name    string
+		tags    []string
+		want    []string
+		wantErr error
+	}{
+		{"at the count limit", []string{"a", "b", "c"}, []string{"a", "b", "c"}, nil},
+		{"over the count limit", []string{"a", "b", "c", "d"}, nil, ErrTooManyTags},
+		{"at the length limit", []string{"abcde"}, []string{"abcde"}, nil},
+		{"over the length limit", []string{"abcdef"}, nil, ErrTagTooLong},
+		{"length counts characters", []string{"пляжи"}, []string{"пляжи"}, nil},
+		{"whitespace is trimmed", []string{"  beach ", "\tsun\n"}, []string{"beach", "sun"}, nil},
+		{"lower-cased", []string{"Beach", "SUN"}, []string{"beach", "sun"}, nil},
+		{"duplicates removed in order", []string{"sun", "Beach", "sun ", "beach"}, []string{"sun", "beach"}, nil},
+		{"duplicates do not count towards the limit", []string{"a", "A", " a", "b", "c"}, []string{"a", "b", "c"}, nil},
+		{"empty tags dropped", []string{"", "  ", "a"}, []string{"a"}, nil},
+		{"trimmed before the length check", []string{"  abcde  "}, []string{"abcde"}, nil},
+		{"no tags", nil, []string{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeTags(tt.tags, maxTags, maxLength)
+			if err != tt.wantErr {
+				t.Fatalf("NormalizeTags(%q) error = %v, want %v", tt.tags, err, tt.wantErr)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") || (got == nil) != (tt.want == nil) {
+				t.Errorf("NormalizeTags(%q) = %q, want %q", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestObjectKeyHashPrefix(t *testing.T) {
+	const fileID = "3f2b8c1e-9a4d-4e7b-8f6a-2c1d0e9b8a7f"
+	sum := sha256.Sum256([]byte(fileID))
+	hash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name       string
+		hashPrefix int
+		keyPrefix  string
+		want       string
+	}{
+		{"disabled", 0, "", fileID + ".jpg"},
+		{"two characters", 2, "", hash[:2] + "/" + fileID + ".jpg"},
+		{"four characters", 4, "", hash[:4] + "/" + fileID + ".jpg"},
+		{"longer than the hash", 100, "", hash + "/" + fileID + ".jpg"},
+		{"after the key prefix", 2, "prod/", "prod/" + hash[:2] + "/" + fileID + ".jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &FileService{hashPrefix: tt.hashPrefix, keyPrefix: tt.keyPrefix}
+			if got := s.objectKey(fileID, "photo.JPG"); got != tt.want {
+				t.Errorf("objectKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeKeyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"staging", "staging/"},
+		{"staging/", "staging/"},
+		{"/staging/", "staging/"},
+		{"env/staging", "env/staging/"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeKeyPrefix(tt.prefix); got != tt.want {
+			t.Errorf("NormalizeKeyPrefix(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestObjectKeyHashPrefixDistribution(t *testing.T) {
+	const files = 4096
+	s := &FileService{hashPrefix: 1}
+
+	// С одним символом хеша ключи расходятся по 16 префиксам примерно поровну
+	counts := make(map[string]int)
+	for i := 0; i < files; i++ {
+		prefix, _, _ := strings.Cut(s.objectKey(fmt.Sprintf("file-%d", i), "photo.jpg"), "/")
+		counts[prefix]++
+	}
+	if len(counts) != 16 {
+		t.Fatalf("keys use %d prefixes, want 16: %v", len(counts), counts)
+	}
+	for prefix, count := range counts {
+		if count < files/16/2 || count > files/16*2 {
+			t.Errorf("prefix %q has %d of %d keys, want about %d", prefix, count, files, files/16)
+		}
+	}
+}
+
+func TestCountingReaderSizeMismatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		declared  int64
+		tolerance int64
+		wantErr   error
+	}{
+		{"matching size", "content", 7, 0, nil},
+		{"size not declared", "content", -1, 0, nil},
+		{"shorter than declared", "content", 10, 0, ErrSizeMismatch},
+		{"longer than declared", "content", 5, 0, ErrSizeMismatch},
+		{"within the tolerance", "content", 10, 3, nil},
+		{"beyond the tolerance", "content", 11, 3, ErrSizeMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancelled := false
+			counter := &countingReader{
+				r:         strings.NewReader(tt.content),
+				declared:  tt.declared,
+				tolerance: tt.tolerance,
+				cancel:    func() { cancelled = true },
+			}
+			_, err := io.ReadAll(counter)
+			if err != tt.wantErr {
+				t.Fatalf("read error = %v, want %v", err, tt.wantErr)
+			}
+			if counter.n != int64(len(tt.content)) {
+				t.Errorf("counted %d bytes, want %d", counter.n, len(tt.content))
+			}
+			// Расхождение отменяет загрузку, чтобы Minio не повторял запрос
+			if mismatch := tt.wantErr != nil; counter.mismatch != mismatch || cancelled != mismatch {
+				t.Errorf("mismatch = %t, cancelled = %t, want %t", counter.mismatch, cancelled, mismatch)
+			}
+		})
+	}
+}
+
+func TestUploadFilePartConcurrency(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	// Минимальный размер части minio-go - 16 МиБ: объект загружается четырьмя частями
+	const partSize = 16 << 20
+	content := make([]byte, 3*partSize+1)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	tests := []struct {
+		name         string
+		concurrency  int
+		wantInFlight int32
+	}{
+		{"one part at a time", 1, 1},
+		{"two parts at a time", 2, 2},
+		{"limit above the part count", 8, 4},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			s3 := repotest.NewS3(mt, "files")
+
+			// Прокси перед хранилищем считает одновременно загружаемые части.
+			// Задержка дает параллельным частям время пересечься
+			target, err := url.Parse("http://" + s3.Endpoint())
+			if err != nil {
+				mt.Fatal(err)
+			}
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			var inFlight, maxInFlight atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut && r.URL.Query().Has("partNumber") {
+					n := inFlight.Add(1)
+					defer inFlight.Add(-1)
+					for {
+						current := maxInFlight.Load()
+						if n <= current || maxInFlight.CompareAndSwap(current, n) {
+							break
+						}
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+				proxy.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			repo, err := repository.NewMinioRepository(strings.TrimPrefix(server.URL, "http://"), "access", "secret-key", false, "files", false)
+			if err != nil {
+				mt.Fatal(err)
+			}
+			repo.SetPartConcurrency(tt.concurrency)
+			s := &FileService{
+				minioRepo:    repo,
+				mongoRepo:    repository.NewMongoRepositoryWithClient(mt.Client, "file_storage"),
+				maxKeyLength: 1024,
+			}
+
+			// Файл формы, как его получает обработчик: поток части, а не io.ReaderAt
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			part, err := form.CreateFormFile("file", "video.mp4")
+			if err != nil {
+				mt.Fatal(err)
+			}
+			if _, err := part.Write(content); err != nil {
+				mt.Fatal(err)
+			}
+			if err := form.Close(); err != nil {
+				mt.Fatal(err)
+			}
+			parsed, err := multipart.NewReader(&body, form.Boundary()).ReadForm(1 << 20)
+			if err != nil {
+				mt.Fatal(err)
+			}
+			defer parsed.RemoveAll()
+
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+			result, err := s.UploadFile(context.Background(), parsed.File["file"][0], UploadOptions{ContentType: "video/mp4"})
+			if err != nil {
+				mt.Fatalf("UploadFile() error = %v", err)
+			}
+
+			if got := maxInFlight.Load(); got != tt.wantInFlight {
+				mt.Errorf("%d parts uploaded at once, want %d", got, tt.wantInFlight)
+			}
+			// Части собраны по порядку независимо от порядка завершения
+			stored, ok := s3.Get("files", result.ID+".mp4")
+			if !ok {
+				mt.Fatalf("object is not stored, keys: %v", s3.Keys("files"))
+			}
+			if !bytes.Equal(stored.Data, content) {
+				mt.Errorf("stored object of %d bytes differs from the %d uploaded", len(stored.Data), len(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+
+	"kuber-code-s3/internal/models"
+)
+
+// GalleryItem - файл в манифесте галереи: метаданные, миниатюра
+// и подписанная ссылка на оригинал
+type GalleryItem struct {
+    Metadata     *models.FileMetadata `json:"metadata"`
+    ThumbnailURL string               `json:"thumbnail_url,omitempty"`
+    URL          string               `json:"url"`
+}
+
+// GalleryManifest - все, что нужно фронтенду галереи, одним ответом
+type GalleryManifest struct {
+    // Файлы в порядке запроса
+    Items []GalleryItem `json:"items"`
+    // Запрошенные ID, для которых нет доступного файла: не найден или
+    // истек срок доступа
+    Missing []string `json:"missing"`
+}
+
+// Gallery собирает манифест для набора файлов: метаданные читаются одним
+// запросом, ссылки на оригиналы берутся из кеша подписанных ссылок.
+// Порядок элементов совпадает с порядком ids; недоступные ID пропускаются
+// и перечисляются в Missing
+func (s *FileService) Gallery(ctx context.Context, ids []string) (*GalleryManifest, error) {
+    found, err := s.mongoRepo.GetMetadataByIDs(ctx, ids)
+    if err != nil {
+        return nil, err
+    }
+
+    byID := make(map[string]*models.FileMetadata, len(found))
+    for i := range found {
+        byID[found[i].ID] = &found[i]
+    }
+
+    manifest := &GalleryManifest{
+        Items:   make([]GalleryItem, 0, len(ids)),
+        Missing: []string{},
+    }
+    for _, id := range ids {
+        metadata, ok := byID[id]
+        if !ok || checkAccessible(metadata) != nil {
+            manifest.Missing = append(manifest.Missing, id)
+            continue
+        }
+
+        url, err := s.presignedURL(ctx, metadata)
+        if err == ErrAccessExpired {
+            // Срок доступа истек между проверкой и подписью ссылки
+            manifest.Missing = append(manifest.Missing, id)
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+
+        item := GalleryItem{Metadata: metadata, URL: url}
+        if metadata.ThumbnailStatus == models.ThumbnailReady {
+            item.ThumbnailURL = metadata.ThumbnailURL
+        }
+        manifest.Items = append(manifest.Items, item)
+    }
+    return manifest, nil
+}
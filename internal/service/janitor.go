@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"kuber-code-s3/internal/repository"
+)
+
+// StartIncompleteUploadJanitor периодически прерывает незавершенные
+// multipart-загрузки старше maxAge, освобождая место в Minio. Затрагиваются
+// только ключи с префиксом keyPrefix. При interval <= 0 очистка отключена
+func StartIncompleteUploadJanitor(ctx context.Context, minioRepo *repository.MinioRepository, keyPrefix string, interval, maxAge time.Duration) {
+    if interval <= 0 {
+        return
+    }
+
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                removed, err := minioRepo.CleanupIncompleteUploads(ctx, NormalizeKeyPrefix(keyPrefix), maxAge)
+                if err != nil {
+                    log.Printf("Incomplete upload cleanup error: %v", err)
+                    continue
+                }
+                log.Printf("Incomplete upload cleanup: removed %d stale uploads older than %s", removed, maxAge)
+            }
+        }
+    }()
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"kuber-code-s3/internal/repository/repotest"
+)
+
+func TestIncompleteUploadJanitor(t *testing.T) {
+	const maxAge = time.Hour
+	stale := time.Now().Add(-2 * maxAge)
+	fresh := time.Now().Add(-time.Minute)
+
+	type upload struct {
+		key       string
+		initiated time.Time
+		wantKept  bool
+	}
+	tests := []struct {
+		name      string
+		keyPrefix string
+		uploads   []upload
+	}{
+		{
+			name: "stale uploads are aborted",
+			uploads: []upload{
+				{"a.mp4", stale, false},
+				{"b.mp4", stale, false},
+			},
+		},
+		{
+			name: "fresh uploads are kept",
+			uploads: []upload{
+				{"a.mp4", fresh, true},
+				{"b.mp4", stale, false},
+			},
+		},
+		{
+			name: "key with a fresh upload is kept whole",
+			uploads: []upload{
+				{"a.mp4", stale, true},
+				{"a.mp4", fresh, true},
+			},
+		},
+		{
+			name:      "other environments are untouched",
+			keyPrefix: "prod",
+			uploads: []upload{
+				{"prod/a.mp4", stale, false},
+				{"staging/a.mp4", stale, true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := repotest.NewS3(t, "files")
+			repo := s3.Repository(t, "files")
+
+			var wantKept []string
+			for _, u := range tt.uploads {
+				id := s3.AddUpload("files", u.key, u.initiated)
+				if u.wantKept {
+					wantKept = append(wantKept, id)
+				}
+			}
+			slices.Sort(wantKept)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			StartIncompleteUploadJanitor(ctx, repo, tt.keyPrefix, 10*time.Millisecond, maxAge)
+
+			// Второй просмотр загрузок начинается после завершения первой очистки
+			deadline := time.Now().Add(2 * time.Second)
+			for listings(s3) < 2 || !slices.Equal(s3.Uploads(), wantKept) {
+				if time.Now().After(deadline) {
+					t.Fatalf("incomplete uploads = %v, want %v", s3.Uploads(), wantKept)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// listings возвращает число запросов списка незавершенных загрузок
+func listings(s3 *repotest.S3) int {
+	n := 0
+	for _, r := range s3.Requests(http.MethodGet) {
+		if r.Key == "" && r.Query.Has("uploads") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"kuber-code-s3/pkg/utils"
+)
+
+// Политики UNIQUE_NAMES для файлов с совпадающим исходным именем
+const (
+    UniqueNamesReject = "reject"
+    UniqueNamesSuffix = "suffix"
+)
+
+var (
+    ErrNameTaken          = errors.New("a file with this name already exists")
+    ErrUnknownNamesPolicy = errors.New("unknown unique names policy")
+)
+
+// SetUniqueNames задает политику для загрузок с уже занятым именем:
+// reject - отклонять, suffix - добавлять к имени " (1)", " (2)" и т.д.
+// Пустая строка отключает проверку. Вызывается до начала обработки запросов
+func (s *FileService) SetUniqueNames(policy string) error {
+    switch policy {
+    case "", UniqueNamesReject, UniqueNamesSuffix:
+        s.uniqueNames = policy
+        return nil
+    }
+    return fmt.Errorf("%w: %q", ErrUnknownNamesPolicy, policy)
+}
+
+// uniqueName применяет политику UNIQUE_NAMES к исходному имени name (без
+// расширения) файла filename. Имя считается занятым, если в хранилище есть
+// файл с тем же именем и расширением; excludeID - файл, имя которого
+// заменяется. Проверка выполняется перед записью и не защищает от гонки
+// двух одновременных загрузок
+func (s *FileService) uniqueName(ctx context.Context, name, filename, excludeID string) (string, error) {
+    if s.uniqueNames == "" {
+        return name, nil
+    }
+
+    pattern := "^" + regexp.QuoteMeta(name) + ` \([0-9]+\)$`
+    taken, err := s.mongoRepo.FindOriginalNames(ctx, name, pattern, utils.NormalizeExtension(filename), excludeID)
+    if err != nil {
+        return "", err
+    }
+
+    used := make(map[string]bool, len(taken))
+    for _, existing := range taken {
+        used[existing] = true
+    }
+    if !used[name] {
+        return name, nil
+    }
+    if s.uniqueNames == UniqueNamesReject {
+        return "", ErrNameTaken
+    }
+
+    for i := 1; ; i++ {
+        candidate := fmt.Sprintf("%s (%d)", name, i)
+        if !used[candidate] {
+            return candidate, nil
+        }
+    }
+}
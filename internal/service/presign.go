@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"kuber-code-s3/internal/models"
+)
+
+// Срок действия подписанной ссылки на скачивание
+const presignedURLTTL = 7 * 24 * time.Hour
+
+// Кешированная ссылка переиспользуется, пока не прошла эта доля ее срока,
+// чтобы клиент всегда получал ссылку с заметным запасом времени
+const presignReuseFraction = 0.9
+
+// presignCache хранит выданные подписанные ссылки по ключу объекта, чтобы не
+// подписывать запрос заново на каждое чтение. Размер ограничен; при
+// переполнении сначала вытесняются устаревшие записи, затем произвольные
+type presignCache struct {
+    mu      sync.Mutex
+    entries map[string]presignEntry
+    maxSize int
+}
+
+type presignEntry struct {
+    url        string
+    reuseUntil time.Time
+}
+
+func newPresignCache(maxSize int) *presignCache {
+    return &presignCache{entries: make(map[string]presignEntry), maxSize: maxSize}
+}
+
+func (c *presignCache) get(objectName string) (string, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry, ok := c.entries[objectName]
+    if !ok || time.Now().After(entry.reuseUntil) {
+        return "", false
+    }
+    return entry.url, true
+}
+
+func (c *presignCache) put(objectName, url string, reuseUntil time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if _, ok := c.entries[objectName]; !ok && len(c.entries) >= c.maxSize {
+        c.evict()
+    }
+    c.entries[objectName] = presignEntry{url: url, reuseUntil: reuseUntil}
+}
+
+// evict освобождает место хотя бы под одну запись. Вызывается под mu
+func (c *presignCache) evict() {
+    now := time.Now()
+    for name, entry := range c.entries {
+        if now.After(entry.reuseUntil) {
+            delete(c.entries, name)
+        }
+    }
+    for name := range c.entries {
+        if len(c.entries) < c.maxSize {
+            break
+        }
+        delete(c.entries, name)
+    }
+}
+
+func (c *presignCache) invalidate(objectName string) {
+    c.mu.Lock()
+    delete(c.entries, objectName)
+    c.mu.Unlock()
+}
+
+// presignedURL возвращает подписанную ссылку на объект файла, по возможности
+// из кеша. При PRESIGN_CACHE_SIZE=0 ссылка подписывается на каждый запрос.
+// Ссылка на файл с AccessibleUntil действует не дольше этого момента и не
+// кешируется: кеш общий для всех файлов, ссылающихся на объект
+func (s *FileService) presignedURL(ctx context.Context, metadata *models.FileMetadata) (string, error) {
+    objectName := objectNameFor(metadata)
+    if metadata.AccessibleUntil != nil {
+        expires := accessibleExpiry(metadata, presignedURLTTL)
+        if expires < time.Second {
+            return "", ErrAccessExpired
+        }
+        return s.minioRepo.GetFileURL(ctx, objectName, expires)
+    }
+
+    if s.presigned == nil {
+        return s.minioRepo.GetFileURL(ctx, objectName, presignedURLTTL)
+    }
+
+    if url, ok := s.presigned.get(objectName); ok {
+        return url, nil
+    }
+
+    signedAt := time.Now()
+    url, err := s.minioRepo.GetFileURL(ctx, objectName, presignedURLTTL)
+    if err != nil {
+        return "", err
+    }
+    s.presigned.put(objectName, url, signedAt.Add(time.Duration(float64(presignedURLTTL)*presignReuseFraction)))
+    return url, nil
+}
+
+// PresignFile выдает подписанную ссылку на файл со сроком expires. Срок
+// ограничен максимумом Minio (7 дней) и моментом, после которого доступ
+// к файлу закрыт (AccessibleUntil). Такие ссылки не кешируются: их срок
+// задает клиент
+func (s *FileService) PresignFile(ctx context.Context, fileID string, expires time.Duration) (string, time.Time, error) {
+    metadata, err := s.GetAccessibleMetadata(ctx, fileID)
+    if err != nil {
+        return "", time.Time{}, err
+    }
+
+    expires = accessibleExpiry(metadata, expires)
+    if expires < time.Second {
+        return "", time.Time{}, ErrAccessExpired
+    }
+
+    expiresAt := time.Now().Add(expires)
+    url, err := s.minioRepo.GetFileURL(ctx, objectNameFor(metadata), expires)
+    if err != nil {
+        return "", time.Time{}, err
+    }
+    return url, expiresAt, nil
+}
+
+// accessibleExpiry ограничивает срок ссылки максимумом Minio (7 дней) и
+// моментом, после которого доступ к файлу закрыт
+func accessibleExpiry(metadata *models.FileMetadata, expires time.Duration) time.Duration {
+    expires = min(expires, presignedURLTTL)
+    if metadata.AccessibleUntil != nil {
+        expires = min(expires, time.Until(*metadata.AccessibleUntil).Truncate(time.Second))
+    }
+    return expires
+}
+
+// invalidatePresigned сбрасывает кешированную ссылку после замены или удаления объекта
+func (s *FileService) invalidatePresigned(objectName string) {
+    if s.presigned != nil {
+        s.presigned.invalidate(objectName)
+    }
+}
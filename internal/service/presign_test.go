@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository/repotest"
+)
+
+func TestPresignedURLCache(t *testing.T) {
+	const objectName = "photo.png"
+	file := &models.FileMetadata{ObjectName: objectName}
+
+	tests := []struct {
+		name       string
+		cacheSize  int
+		change     func(s *FileService) // действие между двумя запросами
+		wantReused bool
+	}{
+		{"second request reuses the URL", 10, nil, true},
+		{"cache disabled", 0, nil, false},
+		{"invalidated on replace or delete", 10, func(s *FileService) { s.invalidatePresigned(objectName) }, false},
+		{"reuse window passed", 10, func(s *FileService) {
+			s.presigned.entries[objectName] = presignEntry{
+				url:        s.presigned.entries[objectName].url,
+				reuseUntil: time.Now().Add(-time.Second),
+			}
+		}, false},
+		{"other objects do not evict within the limit", 10, func(s *FileService) {
+			if _, err := s.presignedURL(context.Background(), &models.FileMetadata{ObjectName: "other.png"}); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+
+	// Подпись содержит время с точностью до секунды: первые ссылки выдаются
+	// заранее, чтобы новая подпись во втором запросе отличалась от кешированной
+	services := make([]*FileService, len(tests))
+	first := make([]string, len(tests))
+	for i, tt := range tests {
+		s3 := repotest.NewS3(t, "files")
+		services[i] = &FileService{minioRepo: s3.Repository(t, "files")}
+		if tt.cacheSize > 0 {
+			services[i].presigned = newPresignCache(tt.cacheSize)
+		}
+		url, err := services[i].presignedURL(context.Background(), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first[i] = url
+	}
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := services[i]
+			if tt.change != nil {
+				tt.change(s)
+			}
+			second, err := s.presignedURL(context.Background(), file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reused := second == first[i]; reused != tt.wantReused {
+				t.Errorf("second URL reused = %t, want %t:\n%s\n%s", reused, tt.wantReused, first[i], second)
+			}
+		})
+	}
+}
+
+func TestPresignCacheBounded(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int
+		stale   int // устаревших записей в заполненном кеше
+	}{
+		{"stale entries evicted first", 3, 2},
+		{"arbitrary entry evicted when none are stale", 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newPresignCache(tt.maxSize)
+			for i := 0; i < tt.maxSize; i++ {
+				reuseUntil := time.Now().Add(time.Hour)
+				if i < tt.stale {
+					reuseUntil = time.Now().Add(-time.Second)
+				}
+				cache.put(string(rune('a'+i)), "url", reuseUntil)
+			}
+
+			cache.put("new", "url", time.Now().Add(time.Hour))
+
+			if len(cache.entries) > tt.maxSize {
+				t.Errorf("cache holds %d entries, limit %d", len(cache.entries), tt.maxSize)
+			}
+			if _, ok := cache.get("new"); !ok {
+				t.Error("new entry was not cached")
+			}
+			for i := tt.stale; i < tt.maxSize && tt.stale > 0; i++ {
+				if _, ok := cache.get(string(rune('a' + i))); !ok {
+					t.Errorf("fresh entry %q evicted while stale ones were present", string(rune('a'+i)))
+				}
+			}
+		})
+	}
+}
+
+func TestPresignedURLAccessibleUntil(t *testing.T) {
+	tests := []struct {
+		name        string
+		until       time.Duration // AccessibleUntil относительно текущего момента
+		wantExpires int           // наибольший допустимый X-Amz-Expires, секунд
+		wantErr     error
+	}{
+		{"access closes in a minute", time.Minute, 60, nil},
+		{"access closes after the maximum TTL", 30 * 24 * time.Hour, int(presignedURLTTL / time.Second), nil},
+		{"access already closed", -time.Minute, 0, ErrAccessExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := repotest.NewS3(t, "files")
+			s := &FileService{minioRepo: s3.Repository(t, "files"), presigned: newPresignCache(10)}
+
+			// Тот же объект уже подписан для файла без срока доступа (дедупликация):
+			// кешированная недельная ссылка не должна достаться файлу со сроком
+			if _, err := s.presignedURL(context.Background(), &models.FileMetadata{ObjectName: "photo.png"}); err != nil {
+				t.Fatal(err)
+			}
+
+			until := time.Now().Add(tt.until)
+			signed, err := s.presignedURL(context.Background(), &models.FileMetadata{ObjectName: "photo.png", AccessibleUntil: &until})
+			if err != tt.wantErr {
+				t.Fatalf("presignedURL() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			parsed, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expires, err := strconv.Atoi(parsed.Query().Get("X-Amz-Expires"))
+			if err != nil {
+				t.Fatalf("X-Amz-Expires of %s: %v", signed, err)
+			}
+			if expires <= 0 || expires > tt.wantExpires {
+				t.Errorf("X-Amz-Expires = %d, want 1..%d", expires, tt.wantExpires)
+			}
+		})
+	}
+}
+
+func TestPresignedURLNeverStale(t *testing.T) {
+	const objectName = "photo.png"
+	file := &models.FileMetadata{ObjectName: objectName}
+	// Выданная ссылка действует еще хотя бы эту долю срока, даже если взята из кеша
+	minRemaining := time.Duration(float64(presignedURLTTL) * (1 - presignReuseFraction))
+
+	tests := []struct {
+		name     string
+		signedAt time.Duration // когда подписана кешированная ссылка, относительно текущего момента
+	}{
+		{"no cached link", 0},
+		{"cached link signed just now", -time.Minute},
+		{"cached link within the reuse window", -time.Duration(float64(presignedURLTTL) * presignReuseFraction * 0.99)},
+		{"cached link past the reuse window", -time.Duration(float64(presignedURLTTL) * presignReuseFraction * 1.01)},
+		{"cached link about to expire", -presignedURLTTL + time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := repotest.NewS3(t, "files")
+			s := &FileService{minioRepo: s3.Repository(t, "files"), presigned: newPresignCache(10)}
+			if tt.signedAt != 0 {
+				// Ссылка, выданная раньше: кеш хранит ее вместе со сроком переиспользования
+				signed, err := s.minioRepo.GetFileURL(context.Background(), objectName, presignedURLTTL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := url.Parse(signed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				signedAt := time.Now().Add(tt.signedAt)
+				query := parsed.Query()
+				query.Set("X-Amz-Date", signedAt.UTC().Format("20060102T150405Z"))
+				parsed.RawQuery = query.Encode()
+				s.presigned.put(objectName, parsed.String(), signedAt.Add(time.Duration(float64(presignedURLTTL)*presignReuseFraction)))
+			}
+
+			fetched, err := s.presignedURL(context.Background(), file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := url.Parse(fetched)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signedAt, err := time.Parse("20060102T150405Z", parsed.Query().Get("X-Amz-Date"))
+			if err != nil {
+				t.Fatalf("X-Amz-Date of %s: %v", fetched, err)
+			}
+			expires, err := strconv.Atoi(parsed.Query().Get("X-Amz-Expires"))
+			if err != nil {
+				t.Fatalf("X-Amz-Expires of %s: %v", fetched, err)
+			}
+			if remaining := time.Until(signedAt.Add(time.Duration(expires) * time.Second)); remaining < minRemaining {
+				t.Errorf("fetched URL expires in %v, want at least %v", remaining, minRemaining)
+			}
+		})
+	}
+}
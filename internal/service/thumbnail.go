@@ -0,0 +1,302 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"sync"
+
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+)
+
+var (
+    ErrThumbnailQueueFull   = errors.New("thumbnail queue is full")
+    ErrThumbnailUnsupported = errors.New("thumbnails are not generated for this file")
+)
+
+const thumbnailContentType = "image/jpeg"
+
+// thumbnailSources - типы содержимого, для которых строятся миниатюры
+var thumbnailSources = map[string]bool{
+    "image/jpeg": true,
+    "image/png":  true,
+}
+
+// ThumbnailJob - задание на построение миниатюры для загруженного объекта
+type ThumbnailJob struct {
+    FileID     string
+    ObjectName string
+}
+
+// ThumbnailPool - ограниченный пул воркеров, обрабатывающих очередь заданий
+// на построение миниатюр. Число одновременно выполняемых заданий не превышает
+// размер пула, поэтому всплеск загрузок не перегружает CPU
+type ThumbnailPool struct {
+    jobs    chan ThumbnailJob
+    process func(ctx context.Context, job ThumbnailJob)
+    wg      sync.WaitGroup
+    once    sync.Once
+}
+
+// NewThumbnailPool создает пул из workers воркеров с очередью размера queueSize
+// и сразу запускает воркеры
+func NewThumbnailPool(workers, queueSize int, process func(ctx context.Context, job ThumbnailJob)) *ThumbnailPool {
+    if workers <= 0 {
+        workers = 1
+    }
+    if queueSize < 0 {
+        queueSize = 0
+    }
+
+    p := &ThumbnailPool{
+        jobs:    make(chan ThumbnailJob, queueSize),
+        process: process,
+    }
+
+    p.wg.Add(workers)
+    for i := 0; i < workers; i++ {
+        go p.worker()
+    }
+
+    return p
+}
+
+// Enqueue ставит задание в очередь, не блокируя вызывающего
+func (p *ThumbnailPool) Enqueue(job ThumbnailJob) error {
+    select {
+    case p.jobs <- job:
+        return nil
+    default:
+        return ErrThumbnailQueueFull
+    }
+}
+
+// Stop закрывает очередь и дожидается завершения уже принятых заданий
+func (p *ThumbnailPool) Stop() {
+    p.once.Do(func() {
+        close(p.jobs)
+    })
+    p.wg.Wait()
+}
+
+func (p *ThumbnailPool) worker() {
+    defer p.wg.Done()
+    for job := range p.jobs {
+        p.process(context.Background(), job)
+    }
+}
+
+// processThumbnail строит миниатюру объекта и сохраняет ее рядом с оригиналом
+func (s *FileService) processThumbnail(ctx context.Context, job ThumbnailJob) {
+    thumbnailURL, err := s.buildThumbnail(ctx, job)
+    if err != nil {
+        log.Printf("Thumbnail generation error for %s: %v", job.FileID, err)
+        if err := s.mongoRepo.UpdateThumbnail(ctx, job.FileID, "", "", models.ThumbnailFailed, err.Error()); err != nil {
+            log.Printf("Thumbnail status update error for %s: %v", job.FileID, err)
+        }
+        s.events.publish(job.FileID, models.ThumbnailFailed)
+        return
+    }
+
+    if err := s.mongoRepo.UpdateThumbnail(ctx, job.FileID, s.thumbRepo.Bucket, thumbnailURL, models.ThumbnailReady, ""); err != nil {
+        log.Printf("Thumbnail status update error for %s: %v", job.FileID, err)
+    }
+    s.events.publish(job.FileID, models.ThumbnailReady)
+}
+
+func (s *FileService) buildThumbnail(ctx context.Context, job ThumbnailJob) (string, error) {
+    src, err := s.minioRepo.GetObject(ctx, job.ObjectName)
+    if err != nil {
+        return "", err
+    }
+    defer src.Close()
+
+    data, err := generateThumbnail(src, s.thumbnailMaxSize)
+    if err != nil {
+        return "", err
+    }
+
+    uploaded, err := s.thumbRepo.PutObjectStream(ctx, s.thumbnailObjectName(job.FileID), bytes.NewReader(data), int64(len(data)), thumbnailContentType, "")
+    if err != nil {
+        return "", err
+    }
+    return uploaded.URL, nil
+}
+
+// enqueueThumbnail ставит построение миниатюры в очередь для уже сохраненных
+// метаданных со статусом pending. Если очередь переполнена, статус меняется на failed
+func (s *FileService) enqueueThumbnail(ctx context.Context, metadata *models.FileMetadata) {
+    if metadata.ThumbnailStatus != models.ThumbnailPending {
+        return
+    }
+
+    job := ThumbnailJob{FileID: metadata.ID, ObjectName: objectNameFor(metadata)}
+    if err := s.thumbnails.Enqueue(job); err != nil {
+        log.Printf("Thumbnail enqueue error for %s: %v", metadata.ID, err)
+        metadata.ThumbnailStatus = models.ThumbnailFailed
+        metadata.ThumbnailError = err.Error()
+        if err := s.mongoRepo.UpdateThumbnail(ctx, metadata.ID, "", "", models.ThumbnailFailed, metadata.ThumbnailError); err != nil {
+            log.Printf("Thumbnail status update error for %s: %v", metadata.ID, err)
+        }
+        s.events.publish(metadata.ID, models.ThumbnailFailed)
+    }
+}
+
+// refreshThumbnail вызывается после замены содержимого файла: удаляет
+// миниатюру старого содержимого и, если новое содержимое - изображение,
+// ставит построение новой (THUMBNAIL_ON_REPLACE). Для остальных типов
+// миниатюра просто удаляется
+func (s *FileService) refreshThumbnail(ctx context.Context, previous, updated *models.FileMetadata) {
+    if previous.ThumbnailURL != "" {
+        if err := s.thumbnailRepoFor(previous).DeleteFile(ctx, s.thumbnailObjectName(previous.ID)); err != nil && !errors.Is(err, repository.ErrFileNotFound) {
+            log.Printf("Stale thumbnail deletion error for %s: %v", previous.ID, err)
+        }
+    }
+
+    status := ""
+    if s.thumbOnReplace {
+        status = s.initialThumbnailStatus(updated.ContentType)
+    }
+    if status == "" && updated.ThumbnailStatus == "" && updated.ThumbnailURL == "" {
+        return
+    }
+
+    if err := s.mongoRepo.UpdateThumbnail(ctx, updated.ID, "", "", status, ""); err != nil {
+        log.Printf("Thumbnail status update error for %s: %v", updated.ID, err)
+        return
+    }
+    updated.ThumbnailStatus = status
+    updated.ThumbnailURL = ""
+    updated.ThumbnailBucket = ""
+    updated.ThumbnailError = ""
+
+    s.enqueueThumbnail(ctx, updated)
+}
+
+// RegenerateThumbnail повторно ставит построение миниатюры файла в очередь,
+// например после неудачной генерации. Если построение уже ожидает в очереди,
+// возвращает текущие метаданные без повторной постановки
+func (s *FileService) RegenerateThumbnail(ctx context.Context, fileID string) (*models.FileMetadata, error) {
+    metadata, err := s.GetAccessibleMetadata(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+
+    status := s.initialThumbnailStatus(metadata.ContentType)
+    if status == "" {
+        return nil, ErrThumbnailUnsupported
+    }
+    if metadata.ThumbnailStatus == models.ThumbnailPending {
+        return metadata, nil
+    }
+
+    if err := s.mongoRepo.UpdateThumbnail(ctx, fileID, "", "", status, ""); err != nil {
+        if errors.Is(err, repository.ErrDocumentNotFound) {
+            return nil, ErrFileNotFound
+        }
+        return nil, err
+    }
+    metadata.ThumbnailStatus = status
+    metadata.ThumbnailURL = ""
+    metadata.ThumbnailBucket = ""
+    metadata.ThumbnailError = ""
+
+    s.enqueueThumbnail(ctx, metadata)
+    if metadata.ThumbnailStatus == models.ThumbnailFailed {
+        return nil, ErrThumbnailQueueFull
+    }
+    return metadata, nil
+}
+
+// OpenThumbnail открывает готовую миниатюру файла. Если миниатюры нет
+// (не строилась, еще не готова или объект удален), возвращает nil без ошибки
+func (s *FileService) OpenThumbnail(ctx context.Context, metadata *models.FileMetadata) (io.ReadCloser, error) {
+    if metadata.ThumbnailStatus != models.ThumbnailReady {
+        return nil, nil
+    }
+
+    thumbnail, err := s.thumbnailRepoFor(metadata).GetObject(ctx, s.thumbnailObjectName(metadata.ID))
+    if err != nil {
+        if errors.Is(err, repository.ErrFileNotFound) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    return thumbnail, nil
+}
+
+// initialThumbnailStatus возвращает начальный статус миниатюры для типа
+// содержимого. При отключенном FEATURE_THUMBNAILS миниатюры не строятся
+func (s *FileService) initialThumbnailStatus(contentType string) string {
+    if s.thumbnails != nil && thumbnailSources[contentType] {
+        return models.ThumbnailPending
+    }
+    return ""
+}
+
+// SetThumbnailRepository направляет новые миниатюры в отдельный бакет
+// (MINIO_THUMB_BUCKET). Вызывается до начала обработки запросов
+func (s *FileService) SetThumbnailRepository(repo *repository.MinioRepository) {
+    s.thumbRepo = repo
+}
+
+// thumbnailRepoFor возвращает репозиторий бакета, в котором лежит миниатюра
+// файла. Миниатюры, построенные до настройки отдельного бакета, остаются
+// в бакете оригинала
+func (s *FileService) thumbnailRepoFor(metadata *models.FileMetadata) *repository.MinioRepository {
+    if metadata.ThumbnailBucket != "" && metadata.ThumbnailBucket == s.thumbRepo.Bucket {
+        return s.thumbRepo
+    }
+    return s.minioRepo
+}
+
+// thumbnailObjectName возвращает ключ объекта миниатюры
+func (s *FileService) thumbnailObjectName(fileID string) string {
+    return s.keyPrefix + "thumbnails/" + fileID + ".jpg"
+}
+
+// generateThumbnail уменьшает изображение так, чтобы большая сторона
+// не превышала maxSize, и кодирует результат в JPEG
+func generateThumbnail(r io.Reader, maxSize int) ([]byte, error) {
+    img, _, err := image.Decode(r)
+    if err != nil {
+        return nil, err
+    }
+
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    newWidth, newHeight := width, height
+    if width > maxSize || height > maxSize {
+        if width >= height {
+            newWidth, newHeight = maxSize, height*maxSize/width
+        } else {
+            newWidth, newHeight = width*maxSize/height, maxSize
+        }
+    }
+    if newWidth < 1 {
+        newWidth = 1
+    }
+    if newHeight < 1 {
+        newHeight = 1
+    }
+
+    // Масштабирование методом ближайшего соседа
+    dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+    for y := 0; y < newHeight; y++ {
+        for x := 0; x < newWidth; x++ {
+            dst.Set(x, y, img.At(bounds.Min.X+x*width/newWidth, bounds.Min.Y+y*height/newHeight))
+        }
+    }
+
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
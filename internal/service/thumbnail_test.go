@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThumbnailPoolCapsConcurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		jobs    int
+		want    int32
+	}{
+		{"single worker", 1, 5, 1},
+		{"pool smaller than burst", 3, 10, 3},
+		{"pool larger than burst", 8, 4, 4},
+		{"non-positive size runs one worker", 0, 3, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running, peak int32
+			var done sync.WaitGroup
+			done.Add(tt.jobs)
+			release := make(chan struct{})
+
+			pool := NewThumbnailPool(tt.workers, tt.jobs, func(ctx context.Context, job ThumbnailJob) {
+				defer done.Done()
+				n := atomic.AddInt32(&running, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&running, -1)
+			})
+			defer pool.Stop()
+
+			for i := 0; i < tt.jobs; i++ {
+				if err := pool.Enqueue(ThumbnailJob{FileID: fmt.Sprint(i)}); err != nil {
+					t.Fatalf("Enqueue() error = %v", err)
+				}
+			}
+
+			// Даем воркерам разобрать все, что они могут взять одновременно
+			deadline := time.Now().Add(time.Second)
+			for atomic.LoadInt32(&running) < tt.want && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+			done.Wait()
+
+			if peak != tt.want {
+				t.Errorf("peak concurrency = %d, want %d", peak, tt.want)
+			}
+		})
+	}
+}
+
+func TestThumbnailPoolQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	pool := NewThumbnailPool(1, 1, func(ctx context.Context, job ThumbnailJob) {
+		started <- struct{}{}
+		<-release
+	})
+	defer pool.Stop()
+	defer close(release)
+
+	// Первое задание занимает воркер, второе - единственное место в очереди
+	if err := pool.Enqueue(ThumbnailJob{FileID: "busy"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := pool.Enqueue(ThumbnailJob{FileID: "queued"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Enqueue(ThumbnailJob{FileID: "overflow"}); err != ErrThumbnailQueueFull {
+		t.Errorf("Enqueue() on a full queue error = %v, want %v", err, ErrThumbnailQueueFull)
+	}
+	go func() { <-started }()
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+)
+
+var ErrInvalidTierTag = errors.New("cold tier tag must be in key=value form")
+
+// coldTieringBatch - число файлов, обрабатываемых одним запросом к MongoDB
+const coldTieringBatch = 500
+
+// StartColdTieringJob каждые interval помечает тегом tag ("key=value") объекты
+// файлов, которые не скачивали дольше threshold (для ни разу не скачанных -
+// с момента загрузки). По тегу правила жизненного цикла бакета переводят
+// объекты в более дешевый класс хранения. При скачивании холодного файла тег
+// снимается. При interval <= 0 или threshold <= 0 отключено
+func (s *FileService) StartColdTieringJob(ctx context.Context, interval, threshold time.Duration, tag string) error {
+    if interval <= 0 || threshold <= 0 {
+        return nil
+    }
+
+    key, value, ok := strings.Cut(tag, "=")
+    key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+    if !ok || key == "" || value == "" {
+        return ErrInvalidTierTag
+    }
+    s.coldTagKey, s.coldTagValue = key, value
+
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                tagged, err := s.tierColdObjects(ctx, threshold)
+                if err != nil {
+                    log.Printf("Cold tiering error: %v", err)
+                }
+                if tagged > 0 {
+                    log.Printf("Cold tiering: tagged %d objects not accessed for %s", tagged, threshold)
+                }
+            }
+        }
+    }()
+    return nil
+}
+
+// tierColdObjects относит к холодному хранению все файлы, которые не скачивали
+// дольше threshold, и возвращает число помеченных объектов. Общий объект
+// (после дедупликации) помечается, только когда холодными стали все
+// ссылающиеся на него файлы
+func (s *FileService) tierColdObjects(ctx context.Context, threshold time.Duration) (int, error) {
+    tagged := 0
+    for {
+        candidates, err := s.mongoRepo.ListColdCandidates(ctx, s.keyPrefix, time.Now().Add(-threshold), coldTieringBatch)
+        if err != nil {
+            return tagged, err
+        }
+
+        for i := range candidates {
+            metadata := &candidates[i]
+            objectName := objectNameFor(metadata)
+
+            warm, err := s.mongoRepo.CountWarmObjectReferences(ctx, objectName, s.minioRepo.ObjectURL(objectName), metadata.ID)
+            if err != nil {
+                return tagged, err
+            }
+            if warm == 0 {
+                err := s.minioRepo.SetObjectTag(ctx, objectName, s.coldTagKey, s.coldTagValue)
+                switch {
+                case errors.Is(err, repository.ErrFileNotFound):
+                    log.Printf("Cold tiering: object %s of %s not found", objectName, metadata.ID)
+                case err != nil:
+                    return tagged, err
+                default:
+                    tagged++
+                }
+            }
+
+            if err := s.mongoRepo.SetStorageTier(ctx, metadata.ID, models.StorageTierCold); err != nil && !errors.Is(err, repository.ErrDocumentNotFound) {
+                return tagged, err
+            }
+        }
+
+        if len(candidates) < coldTieringBatch {
+            return tagged, nil
+        }
+    }
+}
+
+// warmObject снимает тег холодного хранения с объекта файла, к которому снова
+// обратились, и сбрасывает класс хранения всех файлов, ссылающихся на объект.
+// Ошибки только логируются: объект будет помечен повторно при следующем проходе
+func (s *FileService) warmObject(ctx context.Context, metadata *models.FileMetadata) {
+    if metadata.StorageTier != models.StorageTierCold || s.coldTagKey == "" {
+        return
+    }
+
+    objectName := objectNameFor(metadata)
+    if err := s.minioRepo.RemoveObjectTag(ctx, objectName, s.coldTagKey); err != nil && !errors.Is(err, repository.ErrFileNotFound) {
+        log.Printf("Cold tier tag removal error for %s: %v", metadata.ID, err)
+        return
+    }
+    if err := s.mongoRepo.ClearObjectStorageTier(ctx, objectName, s.minioRepo.ObjectURL(objectName)); err != nil {
+        log.Printf("Storage tier reset error for %s: %v", metadata.ID, err)
+    }
+}
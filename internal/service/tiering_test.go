@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+	"kuber-code-s3/internal/repository/repotest"
+)
+
+func TestTierColdObjects(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	const threshold = 30 * 24 * time.Hour
+
+	tests := []struct {
+		name       string
+		stored     bool  // объект есть в хранилище
+		warmShares int64 // другие файлы, к которым обращались недавно
+		tag        string
+		wantTags   map[string]string
+		wantTagged int
+	}{
+		{"cold object tagged", true, 0, "tier=cold", map[string]string{"tier": "cold"}, 1},
+		{"configured tag", true, 0, "class=archive", map[string]string{"class": "archive"}, 1},
+		{"shared with a warm file", true, 1, "tier=cold", nil, 0},
+		{"object missing", false, 0, "tier=cold", nil, 0},
+	}
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			s3 := repotest.NewS3(mt, "files")
+			s := &FileService{
+				minioRepo: s3.Repository(mt, "files"),
+				mongoRepo: repository.NewMongoRepositoryWithClient(mt.Client, "file_storage"),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// Интервал больше времени теста: проход запускается вручную
+			if err := s.StartColdTieringJob(ctx, time.Hour, threshold, tt.tag); err != nil {
+				mt.Fatal(err)
+			}
+
+			file := models.FileMetadata{
+				ID:         "file-a",
+				BucketName: "files",
+				ObjectName: "file-a.png",
+				UploadDate: time.Now().Add(-2 * threshold).UTC().Truncate(time.Millisecond),
+			}
+			if tt.stored {
+				s3.Put("files", file.ObjectName, repotest.Object{Data: []byte("content")})
+			}
+			raw, err := bson.Marshal(file)
+			if err != nil {
+				mt.Fatal(err)
+			}
+			var doc bson.D
+			if err := bson.Unmarshal(raw, &doc); err != nil {
+				mt.Fatal(err)
+			}
+			count := mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch)
+			if tt.warmShares > 0 {
+				count = mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch, bson.D{{Key: "n", Value: tt.warmShares}})
+			}
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, "file_storage.files", mtest.FirstBatch, doc),
+				count,
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			)
+
+			tagged, err := s.tierColdObjects(ctx, threshold)
+			if err != nil {
+				mt.Fatalf("tierColdObjects() error = %v", err)
+			}
+			if tagged != tt.wantTagged {
+				mt.Errorf("tagged %d objects, want %d", tagged, tt.wantTagged)
+			}
+
+			// Кандидаты - файлы, к которым не обращались дольше порога
+			find := mt.GetAllStartedEvents()[0]
+			before := find.Command.Lookup("filter", "$or").Array().Index(0).Value().Document().
+				Lookup("last_accessed", "$lt").Time()
+			if diff := time.Now().Add(-threshold).Sub(before).Abs(); diff > time.Second {
+				mt.Errorf("candidates accessed before %v, want %s ago", before, threshold)
+			}
+
+			if tt.stored {
+				object, _ := s3.Get("files", file.ObjectName)
+				if len(object.Tags) != len(tt.wantTags) {
+					mt.Errorf("object tags %v, want %v", object.Tags, tt.wantTags)
+				}
+				for key, value := range tt.wantTags {
+					if object.Tags[key] != value {
+						mt.Errorf("object tags %v, want %v", object.Tags, tt.wantTags)
+					}
+				}
+			}
+
+			// Файл относится к холодному хранению, даже если объект пока не помечен
+			var tier string
+			for _, event := range mt.GetAllStartedEvents() {
+				if event.CommandName == "update" {
+					tier = event.Command.Lookup("updates").Array().Index(0).Value().Document().
+						Lookup("u", "$set", "storage_tier").StringValue()
+				}
+			}
+			if tier != models.StorageTierCold {
+				mt.Errorf("storage tier %q recorded, want %q", tier, models.StorageTierCold)
+			}
+		})
+	}
+}
+
+func TestStartColdTieringJobTag(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		tag       string
+		wantErr   error
+		wantKey   string
+		wantValue string
+	}{
+		{"default tag", time.Hour, "tier=cold", nil, "tier", "cold"},
+		{"spaces trimmed", time.Hour, " tier = cold ", nil, "tier", "cold"},
+		{"no value", time.Hour, "tier=", ErrInvalidTierTag, "", ""},
+		{"no key", time.Hour, "=cold", ErrInvalidTierTag, "", ""},
+		{"no separator", time.Hour, "cold", ErrInvalidTierTag, "", ""},
+		{"disabled job ignores the tag", 0, "cold", nil, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s := &FileService{}
+			err := s.StartColdTieringJob(ctx, time.Hour, tt.threshold, tt.tag)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("StartColdTieringJob(%q) error = %v, want %v", tt.tag, err, tt.wantErr)
+			}
+			if s.coldTagKey != tt.wantKey || s.coldTagValue != tt.wantValue {
+				t.Errorf("tag %q=%q, want %q=%q", s.coldTagKey, s.coldTagValue, tt.wantKey, tt.wantValue)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"kuber-code-s3/internal/models"
+	"kuber-code-s3/internal/repository"
+)
+
+// usageDateLayout - формат ключа суточного среза
+const usageDateLayout = "2006-01-02"
+
+// StartUsageSnapshotJob сразу и затем каждые interval записывает срез
+// использования хранилища за текущие сутки (UTC). При interval <= 0 отключено
+func StartUsageSnapshotJob(ctx context.Context, mongoRepo *repository.MongoRepository, interval time.Duration) {
+    if interval <= 0 {
+        return
+    }
+
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for {
+            if err := takeUsageSnapshot(ctx, mongoRepo); err != nil {
+                log.Printf("Usage snapshot error: %v", err)
+            }
+
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+            }
+        }
+    }()
+}
+
+func takeUsageSnapshot(ctx context.Context, mongoRepo *repository.MongoRepository) error {
+    totalBytes, fileCount, err := mongoRepo.ComputeUsage(ctx)
+    if err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    return mongoRepo.WriteUsageSnapshot(ctx, &models.UsageSnapshot{
+        ID:         now.Format(usageDateLayout),
+        TakenAt:    now,
+        TotalBytes: totalBytes,
+        FileCount:  fileCount,
+    })
+}
+
+// GetUsage возвращает суточные срезы использования за период [from, to]
+func (s *FileService) GetUsage(ctx context.Context, from, to time.Time) ([]models.UsageSnapshot, error) {
+    return s.mongoRepo.GetUsageSnapshots(ctx, from.UTC().Format(usageDateLayout), to.UTC().Format(usageDateLayout))
+}
@@ -11,15 +11,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"kuber-code-s3/internal/config"
 	"kuber-code-s3/internal/handler"
+	"kuber-code-s3/internal/health"
+	"kuber-code-s3/internal/middleware"
 	"kuber-code-s3/internal/repository"
 	"kuber-code-s3/internal/service"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	_  "kuber-code-s3/docs"
@@ -42,12 +53,21 @@ import (
 // @securityDefinitions.apikey  ApiKeyAuth
 // @in                          header
 // @name                        Authorization
+
+// @securityDefinitions.apikey  AdminKeyAuth
+// @in                          header
+// @name                        Authorization
 func main() {
 	// Установка режима Release
     gin.SetMode(gin.ReleaseMode)
 
 	// Load configuration
 	cfg := config.LoadConfig()
+	logConfig(cfg)
+
+	// Контекст отменяется по SIGINT/SIGTERM и останавливает фоновые задачи
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// Initialize Minio repository
 	minioRepo, err := repository.NewMinioRepository(
@@ -55,52 +75,165 @@ func main() {
 		cfg.MinioAccessKey,
 		cfg.MinioSecretKey,
 		cfg.MinioSSL,
-		"user-uploads",
+		cfg.MinioBucket,
+		cfg.CreateBucketIfMissing,
 	)
 	if err != nil {
 		log.Fatalf("Failed to initialize Minio client: %v", err)
 	}
+	minioRepo.SetPresignCacheHeaders(cfg.PresignCacheControl, cfg.PresignSetExpires)
+	if err := minioRepo.SetChecksumAlgorithm(cfg.ChecksumAlgorithm); err != nil {
+		log.Fatalf("Invalid CHECKSUM_ALGORITHM: %v", err)
+	}
+	minioRepo.SetPartConcurrency(cfg.UploadPartConcurrency)
+
+	// Общий лимит трафика с Minio для всех бакетов
+	uploadLimiter := repository.NewBandwidthLimiter(int64(cfg.UploadBandwidthMBps) << 20)
+	downloadLimiter := repository.NewBandwidthLimiter(int64(cfg.DownloadBandwidthMBps) << 20)
+	minioRepo.SetBandwidthLimiters(uploadLimiter, downloadLimiter)
 
 	// Initialize MongoDB repository
-	mongoRepo, err := repository.NewMongoRepository(cfg.MongoURI, cfg.MongoDatabase)
+	mongoRepo, err := repository.NewMongoRepository(cfg.MongoURI, cfg.MongoDatabase, cfg.MongoWriteConcern, cfg.MongoWriteTimeout)
 	if err != nil {
 		log.Fatalf("Failed to initialize MongoDB client: %v", err)
 	}
 
+	// Фоновая проверка доступности зависимостей для /readyz
+	healthMonitor := health.NewMonitor(cfg.HealthCheckInterval, cfg.HealthCheckTimeout, map[string]health.Check{
+		"minio":   minioRepo.HealthCheck,
+		"mongodb": mongoRepo.Ping,
+	})
+	healthMonitor.Start(ctx)
+	checkClockSkew(minioRepo, healthMonitor, cfg.ClockSkewThreshold)
+
+	// Фоновая очистка незавершенных multipart-загрузок
+	service.StartIncompleteUploadJanitor(ctx, minioRepo, cfg.KeyPrefix,
+		cfg.IncompleteUploadCleanupInterval, cfg.IncompleteUploadMaxAge)
+
+	// Суточные срезы использования хранилища
+	service.StartUsageSnapshotJob(ctx, mongoRepo, cfg.UsageSnapshotInterval)
+
 	// Create services
-	fileService := service.NewFileService(minioRepo, mongoRepo)
+	fileService := service.NewFileService(minioRepo, mongoRepo, cfg)
+	if err := fileService.SetUniqueNames(cfg.UniqueNames); err != nil {
+		log.Fatalf("Invalid UNIQUE_NAMES: %v", err)
+	}
+
+	// Пометка давно не скачанных объектов для правил жизненного цикла бакета
+	if err := fileService.StartColdTieringJob(ctx, cfg.ColdTierInterval, cfg.ColdTierAfter, cfg.ColdTierTag); err != nil {
+		log.Fatalf("Invalid COLD_TIER_TAG: %v", err)
+	}
+
+	// Отдельный бакет для миниатюр
+	if cfg.MinioThumbBucket != "" {
+		thumbRepo, err := repository.NewMinioRepository(
+			cfg.MinioEndpoint,
+			cfg.MinioAccessKey,
+			cfg.MinioSecretKey,
+			cfg.MinioSSL,
+			cfg.MinioThumbBucket,
+			cfg.CreateBucketIfMissing,
+		)
+		if err != nil {
+			log.Fatalf("Failed to initialize thumbnail bucket: %v", err)
+		}
+		if cfg.MinioThumbBucketPublic {
+			if err := thumbRepo.SetPublicReadPolicy(context.Background()); err != nil {
+				log.Fatalf("Failed to set thumbnail bucket policy: %v", err)
+			}
+		}
+		thumbRepo.SetBandwidthLimiters(uploadLimiter, downloadLimiter)
+		fileService.SetThumbnailRepository(thumbRepo)
+	}
 
 	// Create handlers
-	fileHandler := handler.NewFileHandler(fileService)
+	fileHandler := handler.NewFileHandler(fileService, cfg)
 
 	// Setup Gin router
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(middleware.RequestID())
+	router.Use(middleware.AccessLog(os.Stdout, cfg.AccessLogFormat))
+	router.Use(middleware.SlowReadGuard(cfg.UploadIdleTimeout, cfg.UploadMinRate, cfg.UploadRateGrace))
+	router.Use(middleware.Compress(cfg.ResponseEncodings))
+
+	// Таймауты обработки: общий и для отдельных маршрутов
+	routeTimeouts, err := middleware.ParseRouteTimeouts(cfg.RouteTimeouts)
+	if err != nil {
+		log.Fatalf("Invalid ROUTE_TIMEOUTS: %v", err)
+	}
+	router.Use(middleware.Timeout(cfg.RequestTimeout, routeTimeouts))
+
+	router.MaxMultipartMemory = cfg.MultipartMemThreshold
+
+	// Опечатки в JSON-телах запросов дают 400, а не молча игнорируются
+	binding.EnableDecoderDisallowUnknownFields = cfg.StrictJSON
 
-	router.MaxMultipartMemory = 1024 << 20 // 1 GB
+	handleMethodNotAllowed(router)
 
 	// Доверяем только локальному прокси
 	router.SetTrustedProxies([]string{"127.0.0.1"})
 
 	// CORS configuration
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-	}))
+	router.Use(cors.New(corsConfig(cfg)))
+
+	// Отдельный лимит на генерацию подписанных ссылок
+	presignLimit := middleware.RateLimit(middleware.NewRateLimiter(cfg.PresignRateLimit, cfg.PresignRateBurst))
+	downloadLimit := middleware.ConcurrencyLimit(middleware.NewConcurrencyLimiter(cfg.MaxConcurrentDownloads))
+	isExpanded := func(c *gin.Context) bool { return c.Query("expand") == "true" }
+
+	// Учет трафика по клиентам
+	transfers := middleware.NewTransferAccounting()
 
 	// API routes
 	api := router.Group("/api/v1")
 	{
 		// Authentication middleware
-		api.Use(apiKeyAuth())
+		api.Use(apiKeyAuth(cfg.APIKeys))
+		api.Use(middleware.Account(transfers))
+
+		api.GET("/auth/check", fileHandler.AuthCheck)
 
 		// File operations
 		api.POST("/upload", fileHandler.UploadFile)
-		api.GET("/files/:id", fileHandler.GetFileMetadata)
+		api.POST("/upload/batch", fileHandler.UploadBatch)
+		api.POST("/upload/post-policy", presignLimit, fileHandler.CreateUploadPolicy)
+		api.GET("/files", fileHandler.ListFiles)
+		api.GET("/files/recent", fileHandler.RecentFiles)
+		api.POST("/gallery", presignLimit, fileHandler.GetGallery)
+		api.GET("/files/:id", middleware.When(isExpanded, presignLimit), fileHandler.GetFileMetadata)
 		api.PUT("/files/:id", fileHandler.ReplaceFile)
+		api.PATCH("/files/:id", fileHandler.UpdateFile)
+		api.GET("/files/:id/content", downloadLimit, fileHandler.GetFileContent)
+		api.PUT("/files/:id/content", fileHandler.ReplaceContent)
+		if cfg.Features.CopyTo {
+			api.POST("/files/:id/copy-to", fileHandler.CopyTo)
+		}
+		api.GET("/files/:id/presign", presignLimit, fileHandler.PresignFile)
+		api.GET("/files/:id/bundle", fileHandler.GetFileBundle)
+		api.GET("/files/:id/thumbnail", fileHandler.GetThumbnail)
+		api.POST("/files/:id/thumbnail/regenerate", fileHandler.RegenerateThumbnail)
+		api.GET("/files/:id/events", fileHandler.GetFileEvents)
+		api.GET("/resolve", fileHandler.ResolveURL)
 		api.DELETE("/files/:id", fileHandler.DeleteFile)
+		api.DELETE("/files", fileHandler.DeleteFiles)
+	}
+
+	// Административные эндпоинты с отдельным ключом
+	admin := router.Group("/api/v1/admin")
+	{
+		admin.Use(adminKeyAuth(cfg.AdminAPIKey))
+
+		admin.GET("/usage", fileHandler.GetUsage)
+		admin.DELETE("/objects", fileHandler.DeleteObject)
+		admin.GET("/files/:id/diff", fileHandler.GetFileDiff)
+		admin.POST("/backfill-checksums", fileHandler.BackfillChecksums)
+		admin.GET("/usage/by-key", func(c *gin.Context) {
+			c.JSON(http.StatusOK, transfers.Usage())
+		})
+		admin.GET("/features", func(c *gin.Context) {
+			c.JSON(http.StatusOK, cfg.Features.Active())
+		})
 	}
 
 	// Swagger documentation
@@ -109,26 +242,186 @@ func main() {
 	}
 
 	// router.GET("/swagger/*", ginSwagger.WrapHandler(swaggerFiles.Handler))
-	// Health check endpoint
-	router.GET("/health", func(c *gin.Context) {
+	// Liveness: процесс жив и обслуживает запросы; зависимости не проверяются,
+	// чтобы недоступность Minio или MongoDB не приводила к перезапуску пода
+	router.GET("/health/live", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// Readiness отдает состояние зависимостей не старше READINESS_CACHE_TTL:
+	// 503 с результатом по каждой зависимости, если хотя бы одна недоступна
+	readiness := func(c *gin.Context) {
+		status := healthMonitor.Current(cfg.ReadinessCacheTTL)
+		if !status.Healthy {
+			c.JSON(503, status)
+			return
+		}
+		c.JSON(200, status)
+	}
+	router.GET("/health", readiness)
+	router.GET("/health/ready", readiness)
+	router.GET("/readyz", readiness)
+
+	warnUnknownRoutes(router.Routes(), routeTimeouts)
+
 	// Start server
-	log.Printf("Server starting on port %s", cfg.ServerPort)
-	if err := router.Run(cfg.ServerPort); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	server := &http.Server{
+		Addr:              cfg.ServerPort,
+		Handler:           router,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+	}
+
+	go func() {
+		log.Printf("Server starting on port %s", cfg.ServerPort)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(server, fileService, mongoRepo, cfg.ShutdownTimeout)
+}
+
+// handleMethodNotAllowed включает ответ 405 вместо 404 для известных путей
+// с неверным методом. Заголовок Allow со списком методов пути добавляет gin
+func handleMethodNotAllowed(router *gin.Engine) {
+	router.HandleMethodNotAllowed = true
+	router.NoMethod(func(c *gin.Context) {
+		c.JSON(http.StatusMethodNotAllowed, handler.ErrorResponse{Error: "Method not allowed"})
+	})
+}
+
+// corsConfig - настройки CORS. Результат preflight-запроса браузер кеширует
+// на CORS_MAX_AGE, клиентскому коду доступны заголовки CORS_EXPOSE_HEADERS
+func corsConfig(cfg *config.Config) cors.Config {
+	return cors.Config{
+		AllowOrigins:     []string{"*"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		ExposeHeaders:    cfg.CORSExposeHeaders,
+		AllowCredentials: true,
+		MaxAge:           cfg.CORSMaxAge,
+	}
+}
+
+// shutdown останавливает сервис по сигналу: перестает принимать соединения,
+// дожидается начатых запросов (в том числе загрузок) не дольше timeout,
+// затем останавливает воркеры миниатюр и закрывает соединение с MongoDB
+func shutdown(server *http.Server, fileService *service.FileService, mongoRepo *repository.MongoRepository, timeout time.Duration) {
+	log.Printf("Shutdown signal received, waiting up to %s for in-flight requests", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown error: %v", err)
+	} else {
+		log.Println("HTTP server stopped")
+	}
+
+	fileService.Close()
+	log.Println("Thumbnail workers stopped")
+
+	if err := mongoRepo.Close(); err != nil {
+		log.Printf("MongoDB disconnect error: %v", err)
+	} else {
+		log.Println("MongoDB connection closed")
+	}
+	log.Println("Shutdown complete")
+}
+
+// checkClockSkew сравнивает локальные часы с часами Minio. При расхождении
+// подписи запросов и подписанных ссылок перестают проходить проверку без
+// понятной ошибки, поэтому заметное расхождение выводится предупреждением,
+// а его значение - в подробностях /readyz
+func checkClockSkew(minioRepo *repository.MinioRepository, monitor *health.Monitor, threshold time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	skew, err := minioRepo.ClockSkew(ctx)
+	if err != nil {
+		log.Printf("Clock skew check failed: %v", err)
+		monitor.SetDetail("minio_clock_skew", "unknown")
+		return
+	}
+
+	monitor.SetDetail("minio_clock_skew", skew.String())
+	if skew.Abs() > threshold {
+		log.Printf("WARNING: clock skew with Minio is %s (threshold %s), presigned URLs and request signatures may be rejected", skew, threshold)
+	}
+}
+
+// warnUnknownRoutes предупреждает о таймаутах для незарегистрированных
+// маршрутов: скорее всего, в ROUTE_TIMEOUTS опечатка или маршрут отключен флагом
+func warnUnknownRoutes(routes gin.RoutesInfo, timeouts map[string]time.Duration) {
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for route := range timeouts {
+		if !registered[route] {
+			log.Printf("WARNING: ROUTE_TIMEOUTS has a timeout for unknown route %q", route)
+		}
 	}
 }
 
-// apiKeyAuth middleware для проверки API ключа
-func apiKeyAuth() gin.HandlerFunc {
+// logConfig выводит действующую конфигурацию без секретов
+func logConfig(cfg *config.Config) {
+	redacted := cfg.Redacted()
+	keys := make([]string, 0, len(redacted))
+	for key := range redacted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	log.Println("Effective configuration:")
+	for _, key := range keys {
+		log.Printf("  %s=%s", key, redacted[key])
+	}
+}
+
+// apiKeyAuth middleware для проверки API ключа. keys сопоставляет ключ
+// с именем клиента, которое сохраняется в контексте для журналов и учета.
+// Без настроенных ключей, как и раньше, проходят запросы без Authorization
+func apiKeyAuth(keys map[string]string) gin.HandlerFunc {
+	if len(keys) == 0 {
+		keys = map[string]string{"": "default"}
+	}
+
 	return func(c *gin.Context) {
 		apiKey := c.GetHeader("Authorization")
-		if apiKey != os.Getenv("API_KEY") {
+		client, ok := keys[apiKey]
+		if !ok {
+			log.Printf("Unknown API key %q from %s", apiKeyPrefix(apiKey), c.ClientIP())
+			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Set(middleware.ClientLabelKey, client)
+		c.Set(middleware.ClientScopesKey, []string{"files"})
+		c.Next()
+	}
+}
+
+// apiKeyPrefix возвращает начало ключа для журнала, не раскрывая ключ целиком
+func apiKeyPrefix(apiKey string) string {
+	const visible = 4
+	if len(apiKey) <= visible {
+		return strings.Repeat("*", len(apiKey))
+	}
+	return apiKey[:visible] + "..."
+}
+
+// adminKeyAuth middleware для проверки административного ключа.
+// Пока ключ не задан, административные эндпоинты недоступны
+func adminKeyAuth(adminKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminKey == "" || c.GetHeader("Authorization") != adminKey {
 			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
 			return
 		}
+		c.Set(middleware.ClientLabelKey, "admin")
+		c.Set(middleware.ClientScopesKey, []string{"admin"})
 		c.Next()
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+
+	"kuber-code-s3/internal/config"
+	"kuber-code-s3/internal/handler"
+	"kuber-code-s3/internal/health"
+	"kuber-code-s3/internal/repository"
+)
+
+func TestCORSPreflightMaxAge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		maxAge     time.Duration
+		method     string
+		path       string
+		wantMaxAge string
+	}{
+		{"default for upload", config.LoadConfig().CORSMaxAge, http.MethodPost, "/api/v1/upload", "600"},
+		{"default for delete", config.LoadConfig().CORSMaxAge, http.MethodDelete, "/api/v1/files/1", "600"},
+		{"configured", 90 * time.Second, http.MethodPost, "/api/v1/upload", "90"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(cors.New(corsConfig(&config.Config{CORSMaxAge: tt.maxAge})))
+			router.POST("/api/v1/upload", func(c *gin.Context) { c.Status(http.StatusOK) })
+			router.DELETE("/api/v1/files/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodOptions, tt.path, nil)
+			req.Header.Set("Origin", "https://app.example.com")
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("preflight status %d, want 204", w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Max-Age"); got != tt.wantMaxAge {
+				t.Errorf("Access-Control-Max-Age = %q, want %q", got, tt.wantMaxAge)
+			}
+
+			// Обычный запрос не несет заголовков preflight
+			req = httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Origin", "https://app.example.com")
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if got := w.Header().Get("Access-Control-Max-Age"); got != "" {
+				t.Errorf("%s response has Access-Control-Max-Age %q", tt.method, got)
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	handleMethodNotAllowed(router)
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/api/v1/files/:id/presign", ok)
+	router.GET("/api/v1/files/:id", ok)
+	router.PUT("/api/v1/files/:id", ok)
+	router.DELETE("/api/v1/files/:id", ok)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantAllow  []string
+	}{
+		{"post to a GET-only route", http.MethodPost, "/api/v1/files/1/presign", http.StatusMethodNotAllowed, []string{"GET"}},
+		{"post to a multi-method route", http.MethodPost, "/api/v1/files/1", http.StatusMethodNotAllowed, []string{"GET", "PUT", "DELETE"}},
+		{"supported method", http.MethodGet, "/api/v1/files/1/presign", http.StatusOK, nil},
+		{"unknown path", http.MethodPost, "/api/v1/unknown", http.StatusNotFound, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			allow := w.Header().Values("Allow")
+			if tt.wantAllow == nil {
+				if len(allow) != 0 {
+					t.Errorf("Allow = %q, want none", allow)
+				}
+				return
+			}
+			got := strings.Split(strings.Join(allow, ", "), ", ")
+			slices.Sort(got)
+			want := slices.Clone(tt.wantAllow)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("Allow = %q, want %q", got, want)
+			}
+
+			var body handler.ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+				t.Errorf("body %q is not an error response", w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	fileHandler := handler.NewFileHandler(nil, config.LoadConfig())
+	router := gin.New()
+	router.GET("/api/v1/auth/check", apiKeyAuth(map[string]string{"key-mobile": "mobile"}), fileHandler.AuthCheck)
+	router.GET("/api/v1/admin/auth/check", adminKeyAuth("key-admin"), fileHandler.AuthCheck)
+
+	tests := []struct {
+		name       string
+		path       string
+		key        string
+		wantStatus int
+		want       handler.AuthCheckResponse
+	}{
+		{"valid key", "/api/v1/auth/check", "key-mobile", http.StatusOK, handler.AuthCheckResponse{Client: "mobile", Scopes: []string{"files"}}},
+		{"admin key", "/api/v1/admin/auth/check", "key-admin", http.StatusOK, handler.AuthCheckResponse{Client: "admin", Scopes: []string{"admin"}}},
+		{"unknown key", "/api/v1/auth/check", "key-unknown", http.StatusUnauthorized, handler.AuthCheckResponse{}},
+		{"missing key", "/api/v1/auth/check", "", http.StatusUnauthorized, handler.AuthCheckResponse{}},
+		{"admin key on the API", "/api/v1/auth/check", "key-admin", http.StatusUnauthorized, handler.AuthCheckResponse{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set("Authorization", tt.key)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got handler.AuthCheckResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Client != tt.want.Client || !slices.Equal(got.Scopes, tt.want.Scopes) {
+				t.Errorf("response %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSExposeHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name string
+		env  string // CORS_EXPOSE_HEADERS; пусто - переменная не задана
+		want []string
+	}{
+		{"defaults", "", []string{"Content-Length", "Content-Range", "ETag", "X-Request-ID", "X-Checksum-SHA256", "Retry-After", "Link"}},
+		{"configured", "X-Request-ID, ETag", []string{"X-Request-ID", "ETag"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_EXPOSE_HEADERS", tt.env)
+			if tt.env == "" {
+				os.Unsetenv("CORS_EXPOSE_HEADERS")
+			}
+
+			router := gin.New()
+			router.Use(cors.New(corsConfig(config.LoadConfig())))
+			router.GET("/api/v1/files/:id/content", func(c *gin.Context) {
+				c.Header("ETag", `"abc"`)
+				c.Header("X-Request-ID", "req-1")
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/files/1/content", nil)
+			req.Header.Set("Origin", "https://app.example.com")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.Code)
+			}
+			var got []string
+			for _, name := range strings.Split(w.Header().Get("Access-Control-Expose-Headers"), ",") {
+				got = append(got, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+			}
+			want := make([]string, len(tt.want))
+			for i, name := range tt.want {
+				want[i] = http.CanonicalHeaderKey(name)
+			}
+			slices.Sort(got)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("Access-Control-Expose-Headers = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	const threshold = time.Minute
+
+	tests := []struct {
+		name        string
+		skew        time.Duration
+		unreachable bool
+		wantWarning bool
+	}{
+		{"clocks in sync", 0, false, false},
+		{"within the threshold", 30 * time.Second, false, false},
+		{"minio ahead", 5 * time.Minute, false, true},
+		{"minio behind", -5 * time.Minute, false, true},
+		{"minio unreachable", 0, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Заглушка Minio с отстающими или спешащими часами
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", time.Now().Add(tt.skew).UTC().Format(http.TimeFormat))
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+			minioRepo, err := repository.NewMinioRepository(strings.TrimPrefix(server.URL, "http://"), "access", "secret-key", false, "files", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.unreachable {
+				server.Close()
+			}
+			monitor := health.NewMonitor(time.Minute, time.Second, nil)
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			checkClockSkew(minioRepo, monitor, threshold)
+			log.SetOutput(os.Stderr)
+
+			if warned := strings.Contains(logs.String(), "WARNING: clock skew"); warned != tt.wantWarning {
+				t.Errorf("warning logged = %t, want %t: %q", warned, tt.wantWarning, logs.String())
+			}
+
+			// Расхождение видно в подробностях /readyz
+			detail := monitor.Status().Details["minio_clock_skew"]
+			if tt.unreachable {
+				if detail != "unknown" {
+					t.Errorf("minio_clock_skew = %q, want unknown", detail)
+				}
+				return
+			}
+			skew, err := time.ParseDuration(detail)
+			if err != nil || (skew-tt.skew).Abs() > time.Second {
+				t.Errorf("minio_clock_skew = %q, want %s", detail, tt.skew)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+    ErrArchiveTooLarge  = errors.New("archive uncompressed size exceeds limit")
+    ErrArchiveTooMany   = errors.New("archive has too many entries")
+    ErrArchiveEntryPath = errors.New("archive entry path escapes destination")
+)
+
+// ArchiveLimits ограничивает распаковку архива
+type ArchiveLimits struct {
+    // Суммарный размер распакованных данных, байт
+    MaxTotalSize int64
+    // Число записей в архиве; 0 - без ограничения
+    MaxEntries int
+}
+
+// ExtractZip распаковывает zip-архив в dst с защитой от zip-бомб: считаются
+// фактически распакованные байты, а не размеры из заголовков, которые можно
+// подделать. При превышении лимита распаковка прерывается с ошибкой, уже
+// распакованные файлы остаются в dst и удаляются вызывающим
+func ExtractZip(r io.ReaderAt, size int64, dst string, limits ArchiveLimits) error {
+    archive, err := zip.NewReader(r, size)
+    if err != nil {
+        return err
+    }
+
+    if limits.MaxEntries > 0 && len(archive.File) > limits.MaxEntries {
+        return ErrArchiveTooMany
+    }
+
+    remaining := limits.MaxTotalSize
+    for _, entry := range archive.File {
+        target, err := archiveEntryPath(dst, entry.Name)
+        if err != nil {
+            return err
+        }
+
+        if entry.FileInfo().IsDir() {
+            if err := os.MkdirAll(target, 0750); err != nil {
+                return err
+            }
+            continue
+        }
+
+        written, err := extractZipEntry(entry, target, remaining)
+        if err != nil {
+            return err
+        }
+        remaining -= written
+    }
+    return nil
+}
+
+// extractZipEntry распаковывает одну запись, читая не больше remaining+1 байт
+func extractZipEntry(entry *zip.File, target string, remaining int64) (int64, error) {
+    if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+        return 0, err
+    }
+
+    src, err := entry.Open()
+    if err != nil {
+        return 0, err
+    }
+    defer src.Close()
+
+    out, err := os.Create(target)
+    if err != nil {
+        return 0, err
+    }
+    defer out.Close()
+
+    written, err := io.Copy(out, io.LimitReader(src, remaining+1))
+    if err != nil {
+        return written, err
+    }
+    if written > remaining {
+        return written, fmt.Errorf("%w: entry %q", ErrArchiveTooLarge, entry.Name)
+    }
+    return written, nil
+}
+
+// archiveEntryPath возвращает путь записи внутри dst, отклоняя абсолютные
+// пути и выход за пределы dst через ".." (zip slip)
+func archiveEntryPath(dst, name string) (string, error) {
+    if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+        return "", ErrArchiveEntryPath
+    }
+
+    target := filepath.Join(dst, name)
+    rel, err := filepath.Rel(dst, target)
+    if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return "", ErrArchiveEntryPath
+    }
+    return target, nil
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strings"
+)
+
+// DetectContentType определяет тип содержимого по началу файла. Дополняет
+// http.DetectContentType, который смотрит только первые 512 байт: ftyp-бокс
+// ISO-BMFF (mp4, mov) с длинным списком совместимых брендов в них не
+// помещается, и такой файл распознается как application/octet-stream
+func DetectContentType(head []byte) string {
+    contentType := http.DetectContentType(head)
+    if contentType != "application/octet-stream" {
+        return contentType
+    }
+    if isoType := isoBMFFContentType(head); isoType != "" {
+        return isoType
+    }
+    return contentType
+}
+
+// isoBMFFContentType разбирает ftyp-бокс в начале файла и возвращает тип по
+// основному или совместимым брендам. Бренды за пределами head не учитываются
+func isoBMFFContentType(head []byte) string {
+    if len(head) < 16 || string(head[4:8]) != "ftyp" {
+        return ""
+    }
+
+    boxSize := int(binary.BigEndian.Uint32(head[:4]))
+    if boxSize < 16 {
+        return ""
+    }
+    end := min(boxSize, len(head))
+
+    // Основной бренд (8:12), версия (12:16), затем совместимые бренды
+    brands := []string{string(head[8:12])}
+    for i := 16; i+4 <= end; i += 4 {
+        brands = append(brands, string(head[i:i+4]))
+    }
+
+    quicktime := false
+    for _, brand := range brands {
+        if strings.HasPrefix(brand, "mp4") || brand == "isom" {
+            return "video/mp4"
+        }
+        if brand == "qt  " {
+            quicktime = true
+        }
+    }
+    if quicktime {
+        return "video/quicktime"
+    }
+    return ""
+}
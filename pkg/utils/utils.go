@@ -1,7 +1,138 @@
 package utils
 
-import "github.com/google/uuid"
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
-func GenerateFileID() string {
+	"github.com/google/uuid"
+)
+
+// Схемы идентификаторов файлов
+const (
+    IDSchemeUUID = "uuid"
+    IDSchemeULID = "ulid"
+)
+
+// crockfordAlphabet - алфавит Crockford base32, используемый в ULID
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// GenerateFileID создает идентификатор файла в заданной схеме (по умолчанию UUID)
+func GenerateFileID(scheme string) string {
+    if scheme == IDSchemeULID {
+        return newULID(time.Now())
+    }
     return uuid.New().String()
-}
\ No newline at end of file
+}
+
+// IsValidFileID проверяет, что id соответствует заданной схеме
+func IsValidFileID(scheme, id string) bool {
+    if scheme == IDSchemeULID {
+        return isValidULID(id)
+    }
+    _, err := uuid.Parse(id)
+    return err == nil
+}
+
+// NormalizeFileID приводит id к виду, в котором он хранится: ULID
+// генерируются в верхнем регистре, а Crockford base32 регистронезависим
+func NormalizeFileID(scheme, id string) string {
+    if scheme == IDSchemeULID {
+        return strings.ToUpper(id)
+    }
+    return id
+}
+
+// newULID формирует ULID: 48 бит времени в миллисекундах и 80 случайных бит,
+// закодированные в 26 символов Crockford base32
+func newULID(t time.Time) string {
+    var data [16]byte
+    ms := uint64(t.UnixMilli())
+    for i := 5; i >= 0; i-- {
+        data[i] = byte(ms)
+        ms >>= 8
+    }
+    if _, err := rand.Read(data[6:]); err != nil {
+        panic(fmt.Sprintf("ulid: random source failed: %v", err))
+    }
+
+    // 128 бит кодируются в 130 бит (26 символов по 5 бит) с двумя нулевыми старшими битами
+    var out [26]byte
+    value := new(big.Int).SetBytes(data[:])
+    mask := big.NewInt(31)
+    for i := 25; i >= 0; i-- {
+        out[i] = crockfordAlphabet[new(big.Int).And(value, mask).Int64()]
+        value.Rsh(value, 5)
+    }
+    return string(out[:])
+}
+
+// isValidULID проверяет длину, алфавит и переполнение старшего символа ULID.
+// Допускается только верхний регистр, в котором ULID хранятся; ввод клиента
+// приводится к нему через NormalizeFileID
+func isValidULID(id string) bool {
+    if len(id) != 26 {
+        return false
+    }
+    for _, r := range id {
+        if !strings.ContainsRune(crockfordAlphabet, r) {
+            return false
+        }
+    }
+    // Первый символ несет только 3 бита, иначе значение не помещается в 128 бит
+    return id[0] <= '7'
+}
+
+// FormatSize возвращает размер в человекочитаемом виде (например, "1.5 MB")
+func FormatSize(size int64) string {
+    const unit = 1024
+    if size < unit {
+        return fmt.Sprintf("%d B", size)
+    }
+    div, exp := int64(unit), 0
+    for n := size / unit; n >= unit; n /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+
+// NormalizeExtension возвращает расширение имени файла в нижнем регистре,
+// оставляя только латинские буквы и цифры (".JPG" -> ".jpg", ".j%pg" -> ".jpg").
+// Если после нормализации ничего не осталось, возвращается пустая строка
+func NormalizeExtension(filename string) string {
+    ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+
+    var b strings.Builder
+    for _, r := range ext {
+        if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+            b.WriteRune(r)
+        }
+    }
+
+    if b.Len() == 0 {
+        return ""
+    }
+    return "." + b.String()
+}
+
+// ETag возвращает валидатор для содержимого файла. При наличии контрольной
+// суммы используется сильный ETag, иначе (для записей, созданных до хранения
+// контрольных сумм) - слабый, построенный из даты загрузки и размера
+func ETag(checksum string, uploadDate time.Time, size int64) string {
+    if checksum != "" {
+        return `"` + checksum + `"`
+    }
+    return fmt.Sprintf(`W/"%x-%x"`, uploadDate.UnixNano(), size)
+}
+
+// IsDiskFull сообщает, вызвана ли ошибка нехваткой места на диске (ENOSPC)
+func IsDiskFull(err error) bool {
+    return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsValidFileID(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		id     string
+		want   bool
+	}{
+		{"uuid", IDSchemeUUID, "3f2b8c1e-9a4d-4e7b-8f6a-2c1d0e9b8a7f", true},
+		{"uuid malformed", IDSchemeUUID, "3f2b8c1e-9a4d", false},
+		{"uuid empty", IDSchemeUUID, "", false},
+		{"uuid given ulid", IDSchemeUUID, "01HZX3Y4K5M6N7P8Q9R0S1T2V3", false},
+		{"uuid garbage", IDSchemeUUID, "not-a-file-id", false},
+		{"uuid path traversal", IDSchemeUUID, "../../etc/passwd", false},
+		{"ulid", IDSchemeULID, "01HZX3Y4K5M6N7P8Q9R0S1T2V3", true},
+		{"ulid lowercase", IDSchemeULID, "01hzx3y4k5m6n7p8q9r0s1t2v3", false},
+		{"ulid too short", IDSchemeULID, "01HZX3Y4K5M6N7P8Q9R0S1T2V", false},
+		{"ulid excluded letter", IDSchemeULID, "01HZX3Y4K5M6N7P8Q9R0S1T2VU", false},
+		{"ulid overflow", IDSchemeULID, "81HZX3Y4K5M6N7P8Q9R0S1T2V3", false},
+		{"ulid given uuid", IDSchemeULID, "3f2b8c1e-9a4d-4e7b-8f6a-2c1d0e9b8a7f", false},
+		{"ulid garbage", IDSchemeULID, "not-a-file-id", false},
+		{"ulid empty", IDSchemeULID, "", false},
+		{"ulid path traversal", IDSchemeULID, "../../etc/passwd/xxxxxxxxx", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsValidFileID(tt.scheme, tt.id); got != tt.want {
+				t.Errorf("IsValidFileID(%q, %q) = %t, want %t", tt.scheme, tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeFileID(t *testing.T) {
+	if got := NormalizeFileID(IDSchemeULID, "01hzx3y4k5m6n7p8q9r0s1t2v3"); got != "01HZX3Y4K5M6N7P8Q9R0S1T2V3" {
+		t.Errorf("ULID not upper-cased: %q", got)
+	}
+	uuid := "3F2B8C1E-9A4D-4E7B-8F6A-2C1D0E9B8A7F"
+	if got := NormalizeFileID(IDSchemeUUID, uuid); got != uuid {
+		t.Errorf("UUID changed: %q", got)
+	}
+}
+
+func TestGenerateFileIDIsValid(t *testing.T) {
+	for _, scheme := range []string{IDSchemeUUID, IDSchemeULID} {
+		id := GenerateFileID(scheme)
+		if !IsValidFileID(scheme, id) {
+			t.Errorf("generated %s ID %q is not valid", scheme, id)
+		}
+		if scheme == IDSchemeULID && id != strings.ToUpper(id) {
+			t.Errorf("generated ULID %q is not upper case", id)
+		}
+	}
+}
+
+func TestNormalizeExtension(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"plain", "photo.jpg", ".jpg"},
+		{"upper case", "photo.JPG", ".jpg"},
+		{"multiple dots", "archive.tar.gz", ".gz"},
+		{"double extension", "evil.php.jpg", ".jpg"},
+		{"encoded NUL before extension", "evil.php%00.jpg", ".jpg"},
+		{"encoded NUL after extension", "evil.jpg%00.php", ".php"},
+		{"raw NUL in extension", "evil.j\x00pg", ".jpg"},
+		{"percent inside extension", "photo.p%ng", ".png"},
+		{"trailing space", "photo.JPG ", ".jpg"},
+		{"trailing dot", "photo.", ""},
+		{"only symbols", "photo.%$#", ""},
+		{"non-latin letters", "photo.жпг", ""},
+		{"no extension", "photo", ""},
+		{"dot in directory", "dir.png/photo", ""},
+		{"hidden file", ".htaccess", ".htaccess"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeExtension(tt.filename); got != tt.want {
+				t.Errorf("NormalizeExtension(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	uploaded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		checksum   string
+		uploadDate time.Time
+		size       int64
+		want       string
+	}{
+		{"strong from checksum", "ed7002b439e9ac845f22357d822bac14", uploaded, 7, `"ed7002b439e9ac845f22357d822bac14"`},
+		{"strong ignores date and size", "ed7002b439e9ac845f22357d822bac14", uploaded.Add(time.Hour), 8, `"ed7002b439e9ac845f22357d822bac14"`},
+		{"weak without checksum", "", uploaded, 7, `W/"17cb5b99f8638000-7"`},
+		{"weak changes with size", "", uploaded, 8, `W/"17cb5b99f8638000-8"`},
+		{"weak changes with upload date", "", uploaded.Add(time.Second), 7, `W/"17cb5b9a33fe4a00-7"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ETag(tt.checksum, tt.uploadDate, tt.size); got != tt.want {
+				t.Errorf("ETag(%q, %v, %d) = %s, want %s", tt.checksum, tt.uploadDate, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsDiskFull(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"ENOSPC", syscall.ENOSPC, true},
+		{"failed temp file write", &fs.PathError{Op: "write", Path: "/tmp/multipart-1", Err: syscall.ENOSPC}, true},
+		{"wrapped", fmt.Errorf("spool part: %w", &fs.PathError{Op: "write", Path: "/tmp/multipart-1", Err: syscall.ENOSPC}), true},
+		{"other write error", &fs.PathError{Op: "write", Path: "/tmp/multipart-1", Err: syscall.EIO}, false},
+		{"quota exceeded", syscall.EDQUOT, false},
+		{"no error", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsDiskFull(tt.err); got != tt.want {
+				t.Errorf("IsDiskFull(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	type entry struct {
+		name string
+		size int
+	}
+
+	tests := []struct {
+		name    string
+		entries []entry
+		limits  ArchiveLimits
+		wantErr error
+	}{
+		{"within limits", []entry{{"a.txt", 100}, {"dir/b.txt", 200}}, ArchiveLimits{MaxTotalSize: 300, MaxEntries: 2}, nil},
+		// 10 МБ нулей сжимаются примерно до 10 КБ
+		{"zip bomb", []entry{{"bomb.bin", 10 << 20}}, ArchiveLimits{MaxTotalSize: 1 << 20}, ErrArchiveTooLarge},
+		{"total over the limit", []entry{{"a.txt", 200}, {"b.txt", 200}}, ArchiveLimits{MaxTotalSize: 300}, ErrArchiveTooLarge},
+		{"too many entries", []entry{{"a.txt", 1}, {"b.txt", 1}, {"c.txt", 1}}, ArchiveLimits{MaxTotalSize: 300, MaxEntries: 2}, ErrArchiveTooMany},
+		{"entries not limited", []entry{{"a.txt", 1}, {"b.txt", 1}, {"c.txt", 1}}, ArchiveLimits{MaxTotalSize: 300}, nil},
+		{"zip slip", []entry{{"../evil.txt", 1}}, ArchiveLimits{MaxTotalSize: 300}, ErrArchiveEntryPath},
+		{"absolute path", []entry{{"/etc/evil.txt", 1}}, ArchiveLimits{MaxTotalSize: 300}, ErrArchiveEntryPath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			archive := zip.NewWriter(&buf)
+			for _, e := range tt.entries {
+				w, err := archive.Create(e.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(make([]byte, e.size)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := archive.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			dst := t.TempDir()
+			err := ExtractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dst, tt.limits)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ExtractZip() error = %v, want %v", err, tt.wantErr)
+			}
+
+			// Распаковка не выходит за лимит и за пределы dst
+			var extracted int64
+			filepath.WalkDir(filepath.Dir(dst), func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				if !strings.HasPrefix(path, dst+string(filepath.Separator)) {
+					t.Errorf("extracted %s outside the destination", path)
+				}
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				extracted += info.Size()
+				return nil
+			})
+			if extracted > tt.limits.MaxTotalSize+1 {
+				t.Errorf("extracted %d bytes, limit %d", extracted, tt.limits.MaxTotalSize)
+			}
+			if tt.wantErr == nil {
+				for _, e := range tt.entries {
+					info, err := os.Stat(filepath.Join(dst, e.name))
+					if err != nil || info.Size() != int64(e.size) {
+						t.Errorf("entry %s not extracted: %v", e.name, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	// ftyp-бокс, в котором нужный бренд стоит после padding совместимых брендов
+	ftyp := func(brand string, padding int) []byte {
+		box := []byte("\x00\x00\x00\x00ftypXXXX\x00\x00\x02\x00")
+		box = append(box, bytes.Repeat([]byte("avc1"), padding)...)
+		box = append(box, brand...)
+		binary.BigEndian.PutUint32(box, uint32(len(box)))
+		return append(box, make([]byte, 64)...)
+	}
+	longMP4 := ftyp("isom", 200) // бренд на смещении 816
+
+	tests := []struct {
+		name   string
+		data   []byte
+		sample int
+		want   string
+	}{
+		{"short mp4 box", ftyp("mp42", 2), 512, "video/mp4"},
+		{"long mp4 box within the sample", longMP4, 1024, "video/mp4"},
+		{"long mp4 box beyond the sample", longMP4, 512, "application/octet-stream"},
+		{"quicktime", ftyp("qt  ", 200), 1024, "video/quicktime"},
+		{"unknown brands", ftyp("abcd", 200), 1024, "application/octet-stream"},
+		{"box size below the header", []byte("\x00\x00\x00\x08ftypisom\x00\x00\x00\x00"), 512, "application/octet-stream"},
+		{"png", []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 600)), 1024, "image/png"},
+		{"text", []byte(strings.Repeat("plain text ", 100)), 1024, "text/plain; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head := tt.data[:min(tt.sample, len(tt.data))]
+			if got := DetectContentType(head); got != tt.want {
+				t.Errorf("DetectContentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}